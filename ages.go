@@ -0,0 +1,97 @@
+package ccache
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// The upper bounds of the served age histogram's buckets. Ages above the last
+// bound are counted in an extra, unbounded, bucket.
+var servedAgeBounds = []time.Duration{
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+	15 * time.Minute,
+	time.Hour,
+	6 * time.Hour,
+	24 * time.Hour,
+}
+
+// How old the items returned by Get were, see Configuration.TrackServedAge.
+// An item's age is measured from its Modified time when it was set with one,
+// otherwise from when it was set.
+type ServedAges struct {
+	// Count[i] is the number of items served with an age up to Bounds[i]. The
+	// last count, which has no bound, is for older items.
+	Bounds []time.Duration
+	Counts []int64
+	Max    time.Duration
+}
+
+// The smallest bound which at least fraction (0 to 1) of the served items were
+// younger than. Returns Max when that falls in the unbounded bucket, and 0 when
+// nothing was served.
+func (s ServedAges) Percentile(fraction float64) time.Duration {
+	total := int64(0)
+	for _, count := range s.Counts {
+		total += count
+	}
+	if total == 0 {
+		return 0
+	}
+	target := int64(math.Ceil(fraction * float64(total)))
+	seen := int64(0)
+	for i, bound := range s.Bounds {
+		seen += s.Counts[i]
+		if seen >= target {
+			return bound
+		}
+	}
+	return s.Max
+}
+
+type servedAges struct {
+	// first, so that it's 64-bit aligned for atomic access on 32-bit platforms
+	max    int64
+	counts []int64
+}
+
+func newServedAges() *servedAges {
+	return &servedAges{counts: make([]int64, len(servedAgeBounds)+1)}
+}
+
+func (s *servedAges) record(item *Item) {
+	from := item.modified
+	if from == 0 {
+		from = item.created
+	}
+	age := time.Now().UnixNano() - from
+	i := 0
+	for ; i < len(servedAgeBounds); i++ {
+		if age <= int64(servedAgeBounds[i]) {
+			break
+		}
+	}
+	atomic.AddInt64(&s.counts[i], 1)
+	for {
+		max := atomic.LoadInt64(&s.max)
+		if age <= max || atomic.CompareAndSwapInt64(&s.max, max, age) {
+			return
+		}
+	}
+}
+
+func (s *servedAges) get() ServedAges {
+	ages := ServedAges{
+		Bounds: append([]time.Duration(nil), servedAgeBounds...),
+		Counts: make([]int64, len(s.counts)),
+		Max:    time.Duration(atomic.LoadInt64(&s.max)),
+	}
+	for i := range s.counts {
+		ages.Counts[i] = atomic.LoadInt64(&s.counts[i])
+	}
+	return ages
+}
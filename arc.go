@@ -0,0 +1,120 @@
+package ccache
+
+import "container/list"
+
+// Orders the worker's list for EvictARC. ARC (Adaptive Replacement Cache)
+// splits the cache between the items which were used once (T1) and those which
+// were used again (T2), and remembers the keys recently evicted from each (B1
+// and B2). A Set of a key found in B1 means T1 is too small, so its target
+// size p grows, and one found in B2 that T2 is too small, so p shrinks.
+//
+// ccache evicts from the back of a single list, so this is ARC on top of the
+// segments of EvictSLRU: T1 is probation, T2 is protected and is limited to
+// what p leaves of the max size, its least recently used items going back to
+// probation when it outgrows that. Owned by the worker.
+type arc struct {
+	*slru
+	cache *Cache
+	// the target size of T1
+	p int64
+	// the keys recently evicted from T1 (B1) and from T2 (B2)
+	recent   *keyQueue
+	frequent *keyQueue
+}
+
+func newARC(c *Cache) *arc {
+	a := &arc{cache: c, recent: newKeyQueue(), frequent: newKeyQueue()}
+	a.slru = &slru{limit: func() int64 {
+		return c.maxSize - a.p
+	}}
+	return a
+}
+
+func (a *arc) insert(l *list.List, item *Item) *list.Element {
+	recent, frequent := int64(a.recent.len()), int64(a.frequent.len())
+	switch {
+	case a.recent.remove(item.key):
+		delta := int64(1)
+		if frequent > recent {
+			delta = frequent / recent
+		}
+		if a.p += delta * item.size; a.p > a.cache.maxSize {
+			a.p = a.cache.maxSize
+		}
+	case a.frequent.remove(item.key):
+		delta := int64(1)
+		if recent > frequent {
+			delta = recent / frequent
+		}
+		if a.p -= delta * item.size; a.p < 0 {
+			a.p = 0
+		}
+	default:
+		return a.slru.insert(l, item)
+	}
+	// the key was used before, so it goes straight to T2
+	item.protected = true
+	item.reused = true
+	a.protectedSize += item.size
+	element := l.PushFront(item)
+	a.demote(l)
+	return element
+}
+
+func (a *arc) evicted(l *list.List, item *Item) {
+	// the ghost lists each remember up to as many keys as there were items in
+	// the cache, the evicted one included. Not the max size, which can count
+	// bytes (see Sizer) rather than items.
+	max := l.Len() + 1
+	if item.reused {
+		a.frequent.push(item.key, max)
+	} else {
+		a.recent.push(item.key, max)
+	}
+}
+
+func (a *arc) reset() {
+	a.slru.reset()
+	a.p = 0
+	a.recent = newKeyQueue()
+	a.frequent = newKeyQueue()
+}
+
+// A bounded FIFO set of keys
+type keyQueue struct {
+	order *list.List
+	keys  map[string]*list.Element
+}
+
+func newKeyQueue() *keyQueue {
+	return &keyQueue{order: list.New(), keys: make(map[string]*list.Element)}
+}
+
+func (q *keyQueue) len() int {
+	return q.order.Len()
+}
+
+// Adds the key, dropping the oldest keys beyond max
+func (q *keyQueue) push(key string, max int) {
+	if element, exists := q.keys[key]; exists {
+		q.order.MoveToFront(element)
+		return
+	}
+	q.keys[key] = q.order.PushFront(key)
+	for q.order.Len() > max {
+		oldest := q.order.Back()
+		delete(q.keys, oldest.Value.(string))
+		q.order.Remove(oldest)
+	}
+}
+
+// Removes the key, returning false if it wasn't there
+func (q *keyQueue) remove(key string) bool {
+	element, exists := q.keys[key]
+	if exists == false {
+		return false
+	}
+	delete(q.keys, key)
+	q.order.Remove(element)
+	return true
+}
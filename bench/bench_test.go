@@ -0,0 +1,50 @@
+package bench
+
+import (
+	"testing"
+
+	"github.com/karlseguin/ccache/v2"
+	. "github.com/karlseguin/expect"
+)
+
+type BenchTests struct{}
+
+func Test_Bench(t *testing.T) {
+	Expectify(new(BenchTests), t)
+}
+
+func (_ BenchTests) ScanWrapsAround() {
+	w := Scan(3)(1)
+	Expect(w.Next(), w.Next(), w.Next(), w.Next()).To.Equal("1", "2", "0", "1")
+}
+
+func (_ BenchTests) ZipfianStaysInRange() {
+	factory, err := Zipfian(10, 1.1)
+	Expect(err).To.Equal(nil)
+	w := factory(1)
+	for i := 0; i < 1000; i++ {
+		Expect(len(w.Next())).To.Equal(1)
+	}
+}
+
+func (_ BenchTests) ZipfianRejectsInvalidSkews() {
+	_, err := Zipfian(10, 1)
+	Expect(err).To.Equal(ErrInvalidSkew)
+}
+
+func (_ BenchTests) RunReportsHitRatio() {
+	result := Run("tiny", ccache.Configure().MaxSize(1000), Uniform(10), Options{Ops: 1000, Concurrency: 2})
+	Expect(result.Ops).To.Equal(1000)
+	Expect(result.HitRatio > 0.9).To.Equal(true)
+	Expect(result.OpsPerSecond > 0).To.Equal(true)
+}
+
+func (_ BenchTests) CompareRunsInOrder() {
+	configs := map[string]*ccache.Configuration{
+		"small": ccache.Configure().MaxSize(5).ItemsToPrune(1),
+		"large": ccache.Configure().MaxSize(100),
+	}
+	results := Compare(configs, []string{"small", "large"}, Scan(20), Options{Ops: 200})
+	Expect(results[0].Name, results[1].Name).To.Equal("small", "large")
+	Expect(results[1].HitRatio).To.Equal(0.9)
+}
@@ -0,0 +1,100 @@
+package bench
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/karlseguin/ccache/v2"
+)
+
+type Options struct {
+	// The total number of operations, split among the goroutines
+	Ops int
+	// The number of goroutines concurrently using the cache
+	Concurrency int
+	// The TTL of the items set on a miss
+	TTL time.Duration
+}
+
+type Result struct {
+	Name         string
+	Ops          int
+	Duration     time.Duration
+	OpsPerSecond float64
+	AllocsPerOp  float64
+	BytesPerOp   float64
+	HitRatio     float64
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("%-20s %12.0f ops/s %8.2f allocs/op %10.2f B/op %6.2f%% hits",
+		r.Name, r.OpsPerSecond, r.AllocsPerOp, r.BytesPerOp, r.HitRatio*100)
+}
+
+// Runs the workload against a new cache created from config. Every operation
+// is a Get which, on a miss, is followed by a Set (i.e. a read-through cache).
+func Run(name string, config *ccache.Configuration, workload WorkloadFactory, opts Options) Result {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	if opts.TTL == 0 {
+		opts.TTL = time.Minute
+	}
+	cache := ccache.New(config)
+	defer cache.Stop()
+
+	perWorker := opts.Ops / opts.Concurrency
+	workloads := make([]Workload, opts.Concurrency)
+	for i := range workloads {
+		workloads[i] = workload(int64(i + 1))
+	}
+
+	var hits int64
+	var wg sync.WaitGroup
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	for _, w := range workloads {
+		wg.Add(1)
+		go func(w Workload) {
+			defer wg.Done()
+			h := int64(0)
+			for i := 0; i < perWorker; i++ {
+				key := w.Next()
+				if item := cache.Get(key); item != nil && item.Expired() == false {
+					h += 1
+				} else {
+					cache.Set(key, key, opts.TTL)
+				}
+			}
+			atomic.AddInt64(&hits, h)
+		}(w)
+	}
+	wg.Wait()
+
+	duration := time.Since(start)
+	runtime.ReadMemStats(&after)
+	ops := perWorker * opts.Concurrency
+	result := Result{Name: name, Ops: ops, Duration: duration}
+	if ops > 0 {
+		result.OpsPerSecond = float64(ops) / duration.Seconds()
+		result.AllocsPerOp = float64(after.Mallocs-before.Mallocs) / float64(ops)
+		result.BytesPerOp = float64(after.TotalAlloc-before.TotalAlloc) / float64(ops)
+		result.HitRatio = float64(hits) / float64(ops)
+	}
+	return result
+}
+
+// Runs the same workload against each configuration, in order
+func Compare(configs map[string]*ccache.Configuration, order []string, workload WorkloadFactory, opts Options) []Result {
+	results := make([]Result, 0, len(order))
+	for _, name := range order {
+		results = append(results, Run(name, configs[name], workload, opts))
+	}
+	return results
+}
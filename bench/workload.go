@@ -0,0 +1,81 @@
+// Reusable workloads and a runner for measuring the cache's throughput,
+// allocations and hit ratio, so that tuning and regression testing of the
+// cache internals is reproducible.
+package bench
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+)
+
+// Returned by Zipfian when s isn't greater than 1, which the distribution
+// requires
+var ErrInvalidSkew = errors.New("bench: the zipfian skew must be greater than 1")
+
+// A Workload generates the keys requested from the cache. Workloads aren't
+// thread-safe, the runner creates one per goroutine.
+type Workload interface {
+	Next() string
+}
+
+// Creates a workload. Each goroutine gets a different seed.
+type WorkloadFactory func(seed int64) Workload
+
+type uniform struct {
+	keys int
+	r    *rand.Rand
+}
+
+// Every one of the keys is equally likely to be requested
+func Uniform(keys int) WorkloadFactory {
+	return func(seed int64) Workload {
+		return &uniform{keys: keys, r: rand.New(rand.NewSource(seed))}
+	}
+}
+
+func (u *uniform) Next() string {
+	return strconv.Itoa(u.r.Intn(u.keys))
+}
+
+type zipfian struct {
+	z *rand.Zipf
+}
+
+// A few keys are requested most of the time, like real-world traffic. s (> 1)
+// controls the skew: the higher it is, the hotter the hottest keys.
+func Zipfian(keys int, s float64) (WorkloadFactory, error) {
+	if s <= 1 {
+		return nil, ErrInvalidSkew
+	}
+	return func(seed int64) Workload {
+		r := rand.New(rand.NewSource(seed))
+		return &zipfian{z: rand.NewZipf(r, s, 1, uint64(keys-1))}
+	}, nil
+}
+
+func (z *zipfian) Next() string {
+	return strconv.FormatUint(z.z.Uint64(), 10)
+}
+
+type scan struct {
+	keys int
+	next int
+}
+
+// Requests every key in order, over and over again, which is the worst case
+// for an LRU smaller than the number of keys.
+func Scan(keys int) WorkloadFactory {
+	return func(seed int64) Workload {
+		return &scan{keys: keys, next: int(seed) % keys}
+	}
+}
+
+func (s *scan) Next() string {
+	key := strconv.Itoa(s.next)
+	s.next += 1
+	if s.next == s.keys {
+		s.next = 0
+	}
+	return key
+}
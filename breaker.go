@@ -0,0 +1,94 @@
+package ccache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stops Sets from waiting on a saturated worker, see
+// Configuration.CircuitBreaker.
+type breaker struct {
+	saturatedFor int64
+	openFor      int64
+	// when the promote buffer was first seen full, 0 when it isn't
+	saturatedSince int64
+	// Sets bypass the cache until then
+	openUntil int64
+	bypassed  int64
+}
+
+func newBreaker(config *Configuration) *breaker {
+	return &breaker{
+		saturatedFor: int64(config.saturatedFor),
+		openFor:      int64(config.openFor),
+	}
+}
+
+// Whether Sets should currently bypass the cache
+func (b *breaker) open() bool {
+	if atomic.LoadInt64(&b.openUntil) < time.Now().UnixNano() {
+		return false
+	}
+	atomic.AddInt64(&b.bypassed, 1)
+	return true
+}
+
+// Records whether the promote buffer is full, opening the breaker once it has
+// been full for saturatedFor
+func (b *breaker) observe(full bool) {
+	if full == false {
+		if atomic.LoadInt64(&b.saturatedSince) != 0 {
+			atomic.StoreInt64(&b.saturatedSince, 0)
+		}
+		return
+	}
+	now := time.Now().UnixNano()
+	since := atomic.LoadInt64(&b.saturatedSince)
+	if since == 0 {
+		atomic.CompareAndSwapInt64(&b.saturatedSince, 0, now)
+		return
+	}
+	if now-since >= b.saturatedFor {
+		atomic.StoreInt64(&b.openUntil, now+b.openFor)
+		atomic.StoreInt64(&b.saturatedSince, 0)
+	}
+}
+
+// Whether Sets are currently bypassing the cache because its worker couldn't
+// keep up. Always false unless Configuration.CircuitBreaker was set.
+func (c *Cache) Degraded() bool {
+	return c.breaker != nil && atomic.LoadInt64(&c.breaker.openUntil) >= time.Now().UnixNano()
+}
+
+// The number of Sets which bypassed the cache because of the circuit breaker
+func (c *Cache) BypassedSets() int64 {
+	if c.breaker == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&c.breaker.bypassed)
+}
+
+// Whether the Set of key should bypass the cache. The existing value is
+// deleted, so that it isn't served in place of the newer, uncached, one. Unlike
+// Delete, this doesn't wait on the worker, which is behind already.
+func (c *Cache) bypass(key string) bool {
+	if c.breaker == nil || c.breaker.open() == false {
+		return false
+	}
+	if c.shadow != nil {
+		c.shadow.delete(key)
+	}
+	if c.ghosts != nil {
+		c.ghosts.delete(key)
+	}
+	item := c.bucket(key).remove(key)
+	if item == nil {
+		return true
+	}
+	atomic.AddInt64(&c.stats.deletes, 1)
+	if c.front != nil {
+		c.front.remove(item)
+	}
+	c.tryQueueDelete(item)
+	return true
+}
@@ -1,14 +1,105 @@
 package ccache
 
 import (
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type bucket struct {
 	sync.RWMutex
 	lookup map[string]*Item
+	// when > 0, explicitly deleted keys leave a tombstone (the time of deletion)
+	// for this long, see setIfNotDeletedSince
+	tombstoneTTL int64
+	tombstones   map[string]int64
+	lastSweep    int64
+	// when true, readonly holds a copy of lookup which is replaced (rather
+	// than modified) on every write, so that get never has to lock
+	cow      bool
+	readonly atomic.Value
+	// nil unless contention tracking is enabled
+	stats *lockStats
+	// whether scalar values are stored inline, see Item.inlineValue
+	inline bool
+	// see Configuration.Strict
+	strict bool
+	// see Configuration.NonPositiveSize
+	sizeBehavior SizeBehavior
+	logSize      func(key string, size int64)
+	// see Configuration.Sizer
+	sizer func(value interface{}) int64
+	// see Configuration.ValueEqual
+	equal func(a, b interface{}) bool
+	// see Configuration.SlidingTTL
+	sliding bool
+	// the most keys lookup held since it was allocated, see compact
+	peak int
+	// see Configuration.Named
+	info *CacheInfo
+	// see Configuration.IterationBatch
+	batch int
+	// shared by all of the cache's buckets, nil unless
+	// Configuration.OrderedIndex is set
+	index *keyIndex
+	// values are checksummed with it when set, see Configuration.DetectMutations
+	checksumCodec Codec
+	// shared by all of the cache's buckets, nil unless
+	// Configuration.ChangeFeed is set
+	feed *changeFeed
+	// nil unless Configuration.WriteAheadLog is set
+	wal *wal
+}
+
+// Lock acquisition counters, see Configuration.TrackContention
+type LockStats struct {
+	ReadLocks  int64
+	ReadWait   time.Duration
+	WriteLocks int64
+	WriteWait  time.Duration
+}
+
+type lockStats struct {
+	readLocks  int64
+	readWait   int64
+	writeLocks int64
+	writeWait  int64
+}
+
+func (b *bucket) RLock() {
+	if b.stats == nil {
+		b.RWMutex.RLock()
+		return
+	}
+	start := time.Now()
+	b.RWMutex.RLock()
+	atomic.AddInt64(&b.stats.readLocks, 1)
+	atomic.AddInt64(&b.stats.readWait, int64(time.Since(start)))
+}
+
+func (b *bucket) Lock() {
+	if b.stats == nil {
+		b.RWMutex.Lock()
+		return
+	}
+	start := time.Now()
+	b.RWMutex.Lock()
+	atomic.AddInt64(&b.stats.writeLocks, 1)
+	atomic.AddInt64(&b.stats.writeWait, int64(time.Since(start)))
+}
+
+func (b *bucket) lockStats() LockStats {
+	if b.stats == nil {
+		return LockStats{}
+	}
+	return LockStats{
+		ReadLocks:  atomic.LoadInt64(&b.stats.readLocks),
+		ReadWait:   time.Duration(atomic.LoadInt64(&b.stats.readWait)),
+		WriteLocks: atomic.LoadInt64(&b.stats.writeLocks),
+		WriteWait:  time.Duration(atomic.LoadInt64(&b.stats.writeWait)),
+	}
 }
 
 func (b *bucket) itemCount() int {
@@ -18,10 +109,12 @@ func (b *bucket) itemCount() int {
 }
 
 func (b *bucket) forEachFunc(matches func(key string, item *Item) bool) bool {
-	lookup := b.lookup
+	if b.batch > 0 {
+		return b.forEachBatch(matches)
+	}
 	b.RLock()
 	defer b.RUnlock()
-	for key, item := range lookup {
+	for key, item := range b.lookup {
 		if !matches(key, item) {
 			return false
 		}
@@ -29,26 +122,333 @@ func (b *bucket) forEachFunc(matches func(key string, item *Item) bool) bool {
 	return true
 }
 
+// forEachFunc with Configuration.IterationBatch: matches is called without
+// the lock, on batches of items copied out under it
+func (b *bucket) forEachBatch(matches func(key string, item *Item) bool) bool {
+	keys := b.keys()
+	found := make([]string, 0, b.batch)
+	items := make([]*Item, 0, b.batch)
+	for len(keys) > 0 {
+		n := b.batch
+		if n > len(keys) {
+			n = len(keys)
+		}
+		found, items = found[:0], items[:0]
+		b.RLock()
+		for _, key := range keys[:n] {
+			if item := b.lookup[key]; item != nil {
+				found = append(found, key)
+				items = append(items, item)
+			}
+		}
+		b.RUnlock()
+		keys = keys[n:]
+		for i, item := range items {
+			if !matches(found[i], item) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (b *bucket) keys() []string {
+	b.RLock()
+	defer b.RUnlock()
+	keys := make([]string, 0, len(b.lookup))
+	for key := range b.lookup {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Appends the bucket's items to items
+func (b *bucket) collect(items []*Item) []*Item {
+	b.RLock()
+	defer b.RUnlock()
+	for _, item := range b.lookup {
+		items = append(items, item)
+	}
+	return items
+}
+
+// Calls matches on each item in key order, until it returns false
+func forEachSorted(items []*Item, matches func(key string, item *Item) bool) {
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].key < items[j].key
+	})
+	for _, item := range items {
+		if !matches(item.key, item) {
+			return
+		}
+	}
+}
+
+// Must be called under the write lock, after lookup was modified
+func (b *bucket) publish() {
+	if b.cow == false {
+		return
+	}
+	readonly := make(map[string]*Item, len(b.lookup))
+	for key, item := range b.lookup {
+		readonly[key] = item
+	}
+	b.readonly.Store(readonly)
+}
+
 func (b *bucket) get(key string) *Item {
+	if b.cow {
+		return b.readonly.Load().(map[string]*Item)[key]
+	}
 	b.RLock()
 	defer b.RUnlock()
 	return b.lookup[key]
 }
 
+// Returns the item of the first of keys which is present and usable, with a
+// single lock acquisition
+func (b *bucket) getFirst(keys []string, usable func(item *Item) bool) *Item {
+	var lookup map[string]*Item
+	if b.cow {
+		lookup = b.readonly.Load().(map[string]*Item)
+	} else {
+		b.RLock()
+		defer b.RUnlock()
+		lookup = b.lookup
+	}
+	for _, key := range keys {
+		if item := lookup[key]; item != nil && usable(item) {
+			return item
+		}
+	}
+	return nil
+}
+
+func (b *bucket) newItem(key string, value interface{}, duration time.Duration, track bool) *Item {
+	now := time.Now().UnixNano()
+	item := newItem(key, value, now+int64(duration), track)
+	if b.sizer != nil {
+		item.size = sizeOf(value, b.sizer)
+	}
+	return b.initItem(item, now)
+}
+
+// Like newItem, but with the given size rather than the value's, see
+// Cache.SetWithSize
+func (b *bucket) newSizedItem(key string, value interface{}, size int64, duration time.Duration) *Item {
+	now := time.Now().UnixNano()
+	item := &Item{key: key, value: value, size: size, expires: now + int64(duration), fixedSize: true}
+	return b.initItem(item, now)
+}
+
+func (b *bucket) initItem(item *Item, now int64) *Item {
+	value := item.value
+	item.created = now
+	item.info = b.info
+	if b.sliding {
+		item.sliding = item.expires - now
+	}
+	if b.inline {
+		item.inlineValue()
+	}
+	if b.strict {
+		item.strict = true
+		item.checkSize()
+	}
+	item.fixSize(b.sizeBehavior, b.logSize)
+	if b.checksumCodec != nil {
+		item.checksum, item.checksummed = checksumValue(b.checksumCodec, value)
+	}
+	return item
+}
+
 func (b *bucket) set(key string, value interface{}, duration time.Duration, track bool) (*Item, *Item) {
-	expires := time.Now().Add(duration).UnixNano()
-	item := newItem(key, value, expires, track)
+	item := b.newItem(key, value, duration, track)
 	b.Lock()
 	existing := b.lookup[key]
+	if b.refreshes(existing, value) {
+		// the existing item stays, with the new item's expiry
+		atomic.StoreInt64(&existing.expires, item.expires)
+		if track {
+			existing.track()
+		}
+		b.changed(ChangeSet, key, existing)
+		b.Unlock()
+		return existing, existing
+	}
+	inheritFence(item, existing)
 	b.lookup[key] = item
+	b.indexAdded(key, existing)
+	b.grown()
+	b.changed(ChangeSet, key, item)
+	b.publish()
 	b.Unlock()
 	return item, existing
 }
 
+// Whether setting value only refreshes the existing item's TTL, see
+// Configuration.ValueEqual. Must be called under the write lock.
+func (b *bucket) refreshes(existing *Item, value interface{}) bool {
+	if b.equal == nil || existing == nil || existing.soft != 0 || existing.Expired() {
+		return false
+	}
+	return b.equal(existing.Value(), value)
+}
+
+// Adds the key which was just set to the index, unless it replaced an existing
+// item. Must be called under the write lock.
+func (b *bucket) indexAdded(key string, existing *Item) {
+	if b.index != nil && existing == nil {
+		b.index.add(key)
+	}
+}
+
+// Must be called under the write lock, after a key was added
+func (b *bucket) grown() {
+	if len(b.lookup) > b.peak {
+		b.peak = len(b.lookup)
+	}
+}
+
+// Must be called under the write lock
+func (b *bucket) indexRemoved(key string) {
+	if b.index != nil {
+		b.index.remove(key)
+	}
+}
+
+// Records the change in the change feed and write-ahead log, if there are
+// any. Must be called under the write lock.
+func (b *bucket) changed(op ChangeOp, key string, item *Item) {
+	if b.feed != nil {
+		b.feed.record(op, key, item)
+	}
+	if b.wal != nil {
+		b.wal.record(op, key, item)
+	}
+}
+
+// Sets the item only if accept, called under lock with the existing item (which
+// may be nil), returns true. Returns a nil item when the set was rejected.
+// Caches the new item if accept accepts the item it replaces
+func (b *bucket) setIf(item *Item, accept func(existing *Item) bool) (*Item, *Item) {
+	key := item.key
+	b.Lock()
+	defer b.Unlock()
+	existing := b.lookup[key]
+	if accept(existing) == false {
+		return nil, nil
+	}
+	inheritFence(item, existing)
+	b.lookup[key] = item
+	b.indexAdded(key, existing)
+	b.grown()
+	b.changed(ChangeSet, key, item)
+	b.publish()
+	return item, existing
+}
+
+// Like set, but refuses to set the value (returning nil) if the key was
+// explicitly deleted at or after since. This stops a load which started
+// before a delete from resurrecting the data that the delete invalidated.
+func (b *bucket) setIfNotDeletedSince(key string, value interface{}, duration time.Duration, since int64) (*Item, *Item) {
+	item := b.newItem(key, value, duration, false)
+	b.Lock()
+	defer b.Unlock()
+	if deleted, exists := b.tombstones[key]; exists && deleted >= since {
+		return nil, nil
+	}
+	existing := b.lookup[key]
+	inheritFence(item, existing)
+	b.lookup[key] = item
+	b.indexAdded(key, existing)
+	b.grown()
+	b.changed(ChangeSet, key, item)
+	b.publish()
+	return item, existing
+}
+
+// Carries the fence of the item being replaced (see SetIfVersionAtLeast) over
+// to the new item, so that a set without one doesn't reset it
+func inheritFence(item *Item, existing *Item) {
+	if existing != nil && existing.fence > item.fence {
+		item.fence = existing.fence
+	}
+}
+
+// Deletes the key, leaving a tombstone behind if tombstones are enabled.
+func (b *bucket) remove(key string) *Item {
+	b.Lock()
+	item := b.lookup[key]
+	delete(b.lookup, key)
+	b.bury(key)
+	if item != nil {
+		b.indexRemoved(key)
+		b.changed(ChangeDelete, key, nil)
+	}
+	b.publish()
+	b.Unlock()
+	return item
+}
+
+// Like remove, but only if the key still maps to the item. Returns true if it
+// did.
+func (b *bucket) removeItem(item *Item) bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.lookup[item.key] != item {
+		return false
+	}
+	delete(b.lookup, item.key)
+	b.bury(item.key)
+	b.indexRemoved(item.key)
+	b.changed(ChangeDelete, item.key, nil)
+	b.publish()
+	return true
+}
+
+// Must be called under the write lock
+func (b *bucket) bury(key string) {
+	if b.tombstoneTTL == 0 {
+		return
+	}
+	now := time.Now().UnixNano()
+	if b.tombstones == nil {
+		b.tombstones = make(map[string]int64)
+	}
+	b.tombstones[key] = now
+	if now-b.lastSweep > b.tombstoneTTL {
+		for key, deleted := range b.tombstones {
+			if now-deleted > b.tombstoneTTL {
+				delete(b.tombstones, key)
+			}
+		}
+		b.lastSweep = now
+	}
+}
+
+// Deletes the item's key, but only if it still maps to that item (and not to a
+// newer item which replaced it). Returns true if it did.
+func (b *bucket) evict(item *Item) bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.lookup[item.key] != item {
+		return false
+	}
+	delete(b.lookup, item.key)
+	b.indexRemoved(item.key)
+	b.publish()
+	return true
+}
+
 func (b *bucket) delete(key string) *Item {
 	b.Lock()
 	item := b.lookup[key]
 	delete(b.lookup, key)
+	if item != nil {
+		b.indexRemoved(key)
+	}
+	b.publish()
 	b.Unlock()
 	return item
 }
@@ -61,19 +461,18 @@ func (b *bucket) delete(key string) *Item {
 //     the actual deletion
 
 // Also, this is the only place where the Bucket is aware of cache detail: the
-// deletables channel. Passing it here lets us avoid iterating over matched items
+// queue of deletes. Passing it here lets us avoid iterating over matched items
 // again in the cache. Further, we pass item to deletables BEFORE actually removing
 // the item from the map. I'm pretty sure this is 100% fine, but it is unique.
 // (We do this so that the write to the channel is under the read lock and not the
 // write lock)
-func (b *bucket) deleteFunc(matches func(key string, item *Item) bool, deletables chan *Item) int {
-	lookup := b.lookup
+func (b *bucket) deleteFunc(matches func(key string, item *Item) bool, deletables func(item *Item)) int {
 	items := make([]*Item, 0)
 
 	b.RLock()
-	for key, item := range lookup {
+	for key, item := range b.lookup {
 		if matches(key, item) {
-			deletables <- item
+			deletables(item)
 			items = append(items, item)
 		}
 	}
@@ -84,22 +483,56 @@ func (b *bucket) deleteFunc(matches func(key string, item *Item) bool, deletable
 		return 0
 	}
 
+	// lookup may have been replaced (see compact) since it was read
 	b.Lock()
 	for _, item := range items {
-		delete(lookup, item.key)
+		if _, exists := b.lookup[item.key]; exists {
+			b.indexRemoved(item.key)
+			b.changed(ChangeDelete, item.key, nil)
+		}
+		delete(b.lookup, item.key)
+		b.bury(item.key)
 	}
+	b.publish()
 	b.Unlock()
 	return len(items)
 }
 
-func (b *bucket) deletePrefix(prefix string, deletables chan *Item) int {
+func (b *bucket) deletePrefix(prefix string, deletables func(item *Item)) int {
 	return b.deleteFunc(func(key string, item *Item) bool {
 		return strings.HasPrefix(key, prefix)
 	}, deletables)
 }
 
+// Replaces the bucket's items with lookup's, returning the old ones. Must be
+// called under the write lock.
+func (b *bucket) swap(lookup map[string]*Item) map[string]*Item {
+	old := b.lookup
+	for key := range old {
+		b.indexRemoved(key)
+	}
+	for key := range lookup {
+		b.indexAdded(key, nil)
+	}
+	b.lookup = lookup
+	b.peak = len(lookup)
+	b.publish()
+	return old
+}
+
 func (b *bucket) clear() {
 	b.Lock()
-	b.lookup = make(map[string]*Item)
+	b.reset()
 	b.Unlock()
 }
+
+// Drops the bucket's items. Must be called under the write lock.
+func (b *bucket) reset() {
+	for key := range b.lookup {
+		b.indexRemoved(key)
+	}
+	b.lookup = make(map[string]*Item)
+	b.peak = 0
+	b.tombstones = nil
+	b.publish()
+}
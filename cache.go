@@ -3,7 +3,12 @@ package ccache
 
 import (
 	"container/list"
-	"hash/fnv"
+	"context"
+	"errors"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -35,20 +40,87 @@ type gc struct {
 	done chan struct{}
 }
 
+type purgeExpired struct {
+	res chan int
+}
+
+// Blocks the worker until resume is closed, used by tests to back up the
+// worker's queues
+type pauseWorker struct {
+	resume chan struct{}
+}
+
+type resize struct {
+	item *Item
+	done chan struct{}
+}
+
+// Returned by Fetch when MaxConcurrentFetches is configured and no fetch slot
+// became available within the configured wait.
+var ErrFetchTimeout = errors.New("ccache: timed out waiting for a fetch slot")
+
 type Cache struct {
+	// the counters which are accessed atomically come first, so that they're
+	// 64-bit aligned on 32-bit platforms
+	stats       stats
+	droppedSets int64
 	*Configuration
-	list        *list.List
-	size        int64
-	buckets     []*bucket
-	bucketMask  uint32
-	deletables  chan *Item
+	list       *list.List
+	size       int64
+	buckets    []*bucket
+	bucketMask uint32
+	deletables chan *Item
+	// nil unless Configuration.SpillDeletes is set
+	spill       *deleteSpill
 	promotables chan *Item
 	control     chan interface{}
+	fetchSlots  chan struct{}
+	shadow      *shadow
+	revalidator *revalidator
+	stopped     int32
+	frozen      int32
+	front       *front
+	// holds a *Chaos, see SetChaos
+	chaos   atomic.Value
+	ages    *servedAges
+	breaker *breaker
+	// owned by the worker, nil once the warmup is over
+	warmup  *warmup
+	flights flights
+	ghosts  *ghosts
+	index   *keyIndex
+	feed    *changeFeed
+	// owned by the worker, nil for EvictLRU
+	order evictionOrder
+	// owned by the worker, nil unless Configuration.TinyLFU is set
+	sketch *sketch
+	// owned by the worker, nil unless Configuration.ExpireEvery is set
+	expiry *expiryHeap
+	wal    *wal
+	// the last change applied by ApplyChanges
+	applied   uint64
+	applyLock sync.Mutex
+	// nil unless Configuration.AutoSnapshot is set
+	snapshots *snapshotter
+	// owned by the worker, where the next GC resumes, see Configuration.ResumeGC
+	gcCursor *list.Element
+	// background refreshes started by FetchStale
+	refreshes backgroundLoads
+	// items removed since the maps were last checked, see
+	// Configuration.CompactBelow. Owned by the worker.
+	unlinked int
+	// held by the worker while it handles a message, and by the Sets which
+	// promote their item themselves, nil unless the backpressure strategy is
+	// InlineOnFullBuffer
+	inline *sync.Mutex
+	// the items GC'd by those Sets, guarded by inline
+	inlineDropped int
 }
 
 // Create a new cache with the specified configuration
 // See ccache.Configure() for creating a configuration
 func New(config *Configuration) *Cache {
+	config.validate()
 	c := &Cache{
 		list:          list.New(),
 		Configuration: config,
@@ -56,12 +128,101 @@ func New(config *Configuration) *Cache {
 		buckets:       make([]*bucket, config.buckets),
 		control:       make(chan interface{}),
 	}
+	if config.ordered {
+		c.index = newKeyIndex()
+	}
+	switch config.eviction {
+	case EvictLFU:
+		c.order = new(lfu)
+	case EvictSLRU:
+		c.order = &slru{limit: func() int64 {
+			return int64(float64(c.maxSize) * c.protectedRatio)
+		}}
+	case EvictARC:
+		c.order = newARC(c)
+	case EvictLRU:
+		if config.priorities {
+			c.order = new(prioritized)
+		}
+	}
+	if config.tinyLFU {
+		c.sketch = newSketch(int(config.maxSize))
+	}
+	if config.expireEvery > 0 {
+		c.expiry = new(expiryHeap)
+	}
+	if config.feedSize > 0 {
+		c.feed = newChangeFeed(config.feedSize)
+	}
 	for i := 0; i < config.buckets; i++ {
 		c.buckets[i] = &bucket{
-			lookup: make(map[string]*Item),
+			lookup:       make(map[string]*Item),
+			tombstoneTTL: int64(config.tombstoneTTL),
+			cow:          config.copyOnWrite,
+			inline:       config.inlineValues,
+			strict:       config.strict,
+			sizeBehavior: config.sizeBehavior,
+			logSize:      config.logSize,
+			sizer:        config.sizer,
+			equal:        config.valueEqual,
+			sliding:      config.slidingTTL,
+			batch:        config.iterationBatch,
+			info:         config.info,
+			index:        c.index,
+			feed:         c.feed,
+		}
+		if config.onMutation != nil {
+			c.buckets[i].checksumCodec = config.codec
 		}
+		if config.contention {
+			c.buckets[i].stats = new(lockStats)
+		}
+		c.buckets[i].publish()
+	}
+	if config.maxFetches > 0 {
+		c.fetchSlots = make(chan struct{}, config.maxFetches)
+	}
+	if config.shadowSize > 0 {
+		c.shadow = newShadow(config.shadowSize)
+	}
+	if config.spillDeletes {
+		c.spill = newDeleteSpill()
+	}
+	if config.backpressure == InlineOnFullBuffer {
+		c.inline = new(sync.Mutex)
+	}
+	if config.revalidator != nil {
+		c.revalidator = newRevalidator(config)
+	}
+	if config.frontSize > 0 {
+		c.front = newFront(config.frontSize)
+	}
+	if config.servedAge {
+		c.ages = newServedAges()
+	}
+	if config.openFor > 0 {
+		c.breaker = newBreaker(config)
+	}
+	if config.ghostGrace > 0 {
+		c.ghosts = newGhosts(config.ghostGrace)
+	}
+	if config.warming {
+		// the warmup swaps settings, which mustn't leak into the caller's
+		// configuration
+		copy := *config
+		c.Configuration = &copy
+		c.startWarmup()
 	}
 	c.restart()
+	if config.walPath != "" {
+		c.openWAL(config.walPath)
+	}
+	if config.snapshotPath != "" {
+		c.startSnapshots()
+	}
+	if config.expvarName != "" {
+		publishExpvar(config.expvarName, c)
+	}
 	return c
 }
 
@@ -74,23 +235,160 @@ func (c *Cache) ItemCount() int {
 }
 
 func (c *Cache) DeletePrefix(prefix string) int {
+	if c.ghosts != nil {
+		c.ghosts.deletePrefix(prefix)
+	}
+	if c.shadow != nil {
+		return c.DeleteFunc(func(key string, item *Item) bool {
+			return strings.HasPrefix(key, prefix)
+		})
+	}
 	count := 0
 	for _, b := range c.buckets {
-		count += b.deletePrefix(prefix, c.deletables)
+		count += b.deletePrefix(prefix, c.queueDelete)
+	}
+	atomic.AddInt64(&c.stats.deletes, int64(count))
+	if count > 0 && c.front != nil {
+		c.front.invalidate()
 	}
 	return count
 }
 
+// Returns, sorted, up to limit of the keys which start with prefix, e.g. to
+// preview what DeletePrefix would remove. When more keys match, which of them
+// are returned is undefined. The limit is capped by
+// Configuration.MaxBulkResults.
+// [limit 0 - unlimited]
+func (c *Cache) KeysWithPrefix(prefix string, limit int) []string {
+	limit = c.bulkLimit(limit)
+	keys := make([]string, 0)
+	for _, b := range c.buckets {
+		more := b.forEachFunc(func(key string, item *Item) bool {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+			return limit <= 0 || len(keys) < limit
+		})
+		if more == false {
+			break
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Returns, in order, the keys from from (inclusive) to to (exclusive). An empty
+// to has no upper bound, e.g. RangeKeys(since, "") for "everything since".
+// Without Configuration.OrderedIndex, this scans and sorts all of the keys.
+// With Configuration.MaxBulkResults, only the first keys are returned, see
+// RangeKeysPage for the rest.
+func (c *Cache) RangeKeys(from, to string) []string {
+	return c.rangeKeys(from, to, c.bulkLimit(0))
+}
+
+// Like RangeKeys, but returns up to limit keys (capped by
+// Configuration.MaxBulkResults), along with the key the next page starts from,
+// to pass as from. next is empty once there are no more keys.
+// [limit 0 - unlimited]
+func (c *Cache) RangeKeysPage(from, to string, limit int) (keys []string, next string) {
+	limit = c.bulkLimit(limit)
+	if limit == 0 {
+		return c.rangeKeys(from, to, 0), ""
+	}
+	keys = c.rangeKeys(from, to, limit+1)
+	if len(keys) > limit {
+		return keys[:limit], keys[limit]
+	}
+	return keys, ""
+}
+
+// The first limit keys of the range, 0 being unlimited. Without the index, at
+// most twice limit keys are held while the buckets are scanned.
+func (c *Cache) rangeKeys(from, to string, limit int) []string {
+	if c.index != nil {
+		return c.index.rangeKeys(from, to, limit)
+	}
+	keys := make([]string, 0)
+	for _, b := range c.buckets {
+		b.forEachFunc(func(key string, item *Item) bool {
+			if key >= from && (to == "" || key < to) {
+				keys = append(keys, key)
+				if limit > 0 && len(keys) == 2*limit {
+					sort.Strings(keys)
+					keys = keys[:limit]
+				}
+			}
+			return true
+		})
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+// Caps the limit of a bulk API by Configuration.MaxBulkResults, 0 being
+// unlimited
+func (c *Cache) bulkLimit(limit int) int {
+	if c.maxBulkResults > 0 && (limit <= 0 || limit > c.maxBulkResults) {
+		return c.maxBulkResults
+	}
+	return limit
+}
+
 // Deletes all items that the matches func evaluates to true.
 func (c *Cache) DeleteFunc(matches func(key string, item *Item) bool) int {
+	if c.ghosts != nil {
+		c.ghosts.deleteFunc(matches)
+	}
+	if s := c.shadow; s != nil {
+		original := matches
+		matches = func(key string, item *Item) bool {
+			if original(key, item) {
+				s.delete(key)
+				return true
+			}
+			return false
+		}
+	}
+	count := 0
+	for _, b := range c.buckets {
+		count += b.deleteFunc(matches, c.queueDelete)
+	}
+	atomic.AddInt64(&c.stats.deletes, int64(count))
+	if count > 0 && c.front != nil {
+		c.front.invalidate()
+	}
+	return count
+}
+
+// Sets the TTL of all items that the matches func evaluates to true to newTTL,
+// measured from now. Returns the number of items updated. Meant for bulk
+// changes, like extending every TTL while a backend is down.
+func (c *Cache) SetTTLWhere(matches func(key string, item *Item) bool, newTTL time.Duration) int {
 	count := 0
 	for _, b := range c.buckets {
-		count += b.deleteFunc(matches, c.deletables)
+		b.forEachFunc(func(key string, item *Item) bool {
+			if matches(key, item) {
+				item.Extend(newTTL)
+				count++
+			}
+			return true
+		})
 	}
 	return count
 }
 
 func (c *Cache) ForEachFunc(matches func(key string, item *Item) bool) {
+	if c.sorted {
+		var items []*Item
+		for _, b := range c.buckets {
+			items = b.collect(items)
+		}
+		forEachSorted(items, matches)
+		return
+	}
 	for _, b := range c.buckets {
 		if !b.forEachFunc(matches) {
 			break
@@ -98,31 +396,188 @@ func (c *Cache) ForEachFunc(matches func(key string, item *Item) bool) {
 	}
 }
 
+// Returns the hit count of every item which was hit since the last call, and
+// resets those counts to 0. Meant for periodically exporting popularity data.
+// Requires Configuration.CountHits.
+func (c *Cache) DrainHitCounts() map[string]int64 {
+	counts := make(map[string]int64)
+	for _, b := range c.buckets {
+		b.forEachFunc(func(key string, item *Item) bool {
+			if hits := atomic.SwapInt64(&item.hits, 0); hits > 0 {
+				counts[key] = hits
+			}
+			return true
+		})
+	}
+	return counts
+}
+
+// Scales the hit count of every item by factor (between 0 and 1), so that the
+// counts favor recent popularity: with the counts halved every hour, a hit from
+// an hour ago weighs half as much as one now. Requires Configuration.CountHits.
+func (c *Cache) DecayHitCounts(factor float64) {
+	for _, b := range c.buckets {
+		b.forEachFunc(func(key string, item *Item) bool {
+			for {
+				hits := atomic.LoadInt64(&item.hits)
+				if hits == 0 || atomic.CompareAndSwapInt64(&item.hits, hits, int64(float64(hits)*factor)) {
+					break
+				}
+			}
+			return true
+		})
+	}
+}
+
 // Get an item from the cache. Returns nil if the item wasn't found.
 // This can return an expired item. Use item.Expired() to see if the item
 // is expired and item.TTL() to see how long until the item expires (which
-// will be negative for an already expired item).
+// will be negative for an already expired item). With ServeStaleFor, items
+// which expired longer ago than the grace period are not returned.
 func (c *Cache) Get(key string) *Item {
-	item := c.bucket(key).get(key)
+	done := c.observe(context.Background(), OperationGet, key)
+	item := c.lookup(key)
+	done(item != nil && !item.Expired(), nil)
+	return item
+}
+
+// Get, without the instrumentation
+func (c *Cache) lookup(key string) *Item {
+	return c.lookupWith(key, true)
+}
+
+// lookup, promote being false for the reads of WithoutPromotion
+func (c *Cache) lookupWith(key string, promote bool) *Item {
+	item := c.get(key, promote)
+	c.stats.get(item)
+	return item
+}
+
+// Removes an item which failed the ValidateOnGet check
+func (c *Cache) invalidate(item *Item) {
+	if c.bucket(item.key).evict(item) == false {
+		// already replaced or deleted
+		return
+	}
+	if c.front != nil {
+		c.front.remove(item)
+	}
+	item.setReason(DeleteReasonInvalid)
+	c.queueDelete(item)
+}
+
+// Whether Fetch can serve the item rather than fetching it
+func (c *Cache) fresh(item *Item) bool {
+	return item != nil && (c.Frozen() || (!item.Stale() && !c.refreshEarly(item)))
+}
+
+func (c *Cache) get(key string, promote bool) *Item {
+	// the revalidation loader gets the key it knows, not its digest
+	original := key
+	key, ok := c.checkKey(key)
+	if ok == false {
+		return nil
+	}
+	var item *Item
+	if c.front != nil {
+		item = c.front.get(key, c.bucket(key))
+	} else {
+		item = c.bucket(key).get(key)
+	}
+	if item == nil && c.ghosts != nil {
+		item = c.revive(key)
+	}
+	if item == nil && c.underlay != nil {
+		item = c.getUnderlay(key)
+	}
+	if item != nil && c.staleFor > 0 && item.expiredFor(c.staleFor) && !c.Frozen() {
+		item = nil
+	}
+	// past their hard TTL, items with a soft TTL are never served
+	if item != nil && item.soft != 0 && item.Expired() && !c.Frozen() {
+		item = nil
+	}
+	if item != nil && c.validator != nil && c.validator(item) == false {
+		c.invalidate(item)
+		item = nil
+	}
+	if c.shadow != nil {
+		c.shadow.get(key, item != nil && !item.Expired())
+	}
 	if item == nil {
 		return nil
 	}
-	if !item.Expired() {
-		select {
-		case c.promotables <- item:
-		default:
+	if c.ages != nil {
+		c.ages.record(item)
+	}
+	if c.countHits {
+		atomic.AddInt64(&item.hits, 1)
+	}
+	if item.sliding > 0 && promote {
+		item.slide()
+	}
+	if c.eviction == EvictClock {
+		// the GC gives the item a second chance, rather than it being promoted
+		if promote && atomic.LoadInt32(&item.referenced) == 0 {
+			atomic.StoreInt32(&item.referenced, 1)
 		}
+		return item
+	}
+	// past its soft TTL (see SetWithSoftTTL), an item is stale before it expires
+	if c.revalidator != nil && item.Stale() && !c.Frozen() {
+		c.revalidator.schedule(original, c.Set, func(v interface{}) {
+			c.logRefreshPanic(original, v)
+		})
+	}
+	if item.Expired() || promote == false {
+		return item
+	}
+	if chaos := c.loadChaos(); chaos != nil && chaos.roll(chaos.FullBufferRate) {
+		return item
+	}
+	select {
+	case c.promotables <- item:
+	default:
 	}
 	return item
 }
 
+// Loads key from the Underlay snapshot into the cache, nil if the snapshot
+// doesn't have it (or it can't be decoded)
+func (c *Cache) getUnderlay(key string) *Item {
+	data, ok := c.underlay.get(key)
+	if ok == false {
+		return nil
+	}
+	value, err := unmarshalValue(c.codec, data)
+	if err != nil {
+		return nil
+	}
+	return c.set(key, value, c.underlayTTL, false)
+}
+
 // Same as Get but does not promote the value. This essentially circumvents the
 // "least recently used" aspect of this cache. To some degree, it's akin to a
 // "peak"
 func (c *Cache) GetWithoutPromote(key string) *Item {
+	key, ok := c.checkKey(key)
+	if ok == false {
+		return nil
+	}
 	return c.bucket(key).get(key)
 }
 
+// Returns how long until the key's item expires (negative if it already has),
+// and false if the key isn't cached. Like GetWithoutPromote, the item isn't
+// promoted, and the Get isn't counted in the stats.
+func (c *Cache) TTL(key string) (time.Duration, bool) {
+	item := c.GetWithoutPromote(key)
+	if item == nil {
+		return 0, false
+	}
+	return item.TTL(), true
+}
+
 // Used when the cache was created with the Track() configuration option.
 // Avoid otherwise
 func (c *Cache) TrackingGet(key string) TrackedItem {
@@ -130,56 +585,392 @@ func (c *Cache) TrackingGet(key string) TrackedItem {
 	if item == nil {
 		return NilTracked
 	}
-	item.track()
+	c.checkRefCount(item, item.track())
+	if c.leakReport != nil {
+		item.watchLeaks(c.leakReport, 1)
+	}
+	return item
+}
+
+// Same as TrackingGet, but the item is automatically released once ctx is done,
+// which ties the tracked reference to, for example, an HTTP request. The
+// returned item must not be released by the caller. With a ctx which is never
+// done, such as context.Background(), the item is never released.
+func (c *Cache) TrackingGetContext(ctx context.Context, key string) TrackedItem {
+	item := c.TrackingGet(key)
+	if item != NilTracked {
+		releaseWhenDone(ctx, item)
+	}
 	return item
 }
 
+func releaseWhenDone(ctx context.Context, item TrackedItem) {
+	done := ctx.Done()
+	if done == nil {
+		// never done, the item stays tracked like with TrackingGet
+		return
+	}
+	go func() {
+		<-done
+		item.Release()
+	}()
+}
+
 // Used when the cache was created with the Track() configuration option.
 // Sets the item, and returns a tracked reference to it.
 func (c *Cache) TrackingSet(key string, value interface{}, duration time.Duration) TrackedItem {
-	return c.set(key, value, duration, true)
+	done := c.observe(context.Background(), OperationSet, key)
+	item := c.countedSet(key, value, duration, true)
+	done(false, nil)
+	if c.leakReport != nil {
+		item.watchLeaks(c.leakReport, 1)
+	}
+	return item
 }
 
-// Set the value in the cache for the specified duration
+// Set the value in the cache for the specified duration. The duration is used
+// as given, even when it's 0 and a DefaultTTL is configured: a non-positive
+// duration follows Configuration.NonPositiveTTL.
 func (c *Cache) Set(key string, value interface{}, duration time.Duration) {
-	c.set(key, value, duration, false)
+	done := c.observe(context.Background(), OperationSet, key)
+	c.countedSet(key, value, duration, false)
+	done(false, nil)
+}
+
+// Set the value in the cache for the configured DefaultTTL. Panics if no
+// DefaultTTL is configured.
+func (c *Cache) Put(key string, value interface{}) {
+	c.Set(key, value, c.putTTL())
+}
+
+// Sets the value with a soft TTL, after which the item is still served but is
+// Stale (and Fetch refreshes it, or FetchStale and, with Revalidate configured,
+// Get in the background), and a hard TTL, after which it's never served.
+func (c *Cache) SetWithSoftTTL(key string, value interface{}, soft time.Duration, hard time.Duration) {
+	c.setIf(key, value, hard, func(existing *Item) bool {
+		return true
+	}, func(item *Item) {
+		item.soft = time.Now().Add(soft).UnixNano()
+	})
+}
+
+// Sets the value with the given priority: the GC evicts the items of a lower
+// priority first, even if they were used more recently. Requires
+// Configuration.Priorities, the priority is ignored otherwise.
+func (c *Cache) SetWithPriority(key string, value interface{}, duration time.Duration, priority Priority) {
+	c.setIf(key, value, duration, func(existing *Item) bool {
+		return true
+	}, func(item *Item) {
+		item.priority = priority
+	})
+}
+
+// Sets the value and pins the item (see Item.Pin), so that it's never evicted
+// by the GC, not even between the Set and a call to Pin.
+func (c *Cache) SetPinned(key string, value interface{}, duration time.Duration) {
+	c.setIf(key, value, duration, func(existing *Item) bool {
+		return true
+	}, func(item *Item) {
+		item.pinned = 1
+	})
+}
+
+// Sets the value with the given size, rather than the size of the value (see
+// Sized and Configuration.Sizer), for when the caller already knows what the
+// value costs, such as the length of an HTTP body. The size is subject to
+// NonPositiveSize and MaxItemSize like any other, and Resize keeps it.
+func (c *Cache) SetWithSize(key string, value interface{}, size int64, duration time.Duration) {
+	original := key
+	key, ok := c.checkKey(key)
+	if ok == false {
+		return
+	}
+	if duration, ok = c.checkTTL(key, duration); ok == false {
+		return
+	}
+	if c.bypass(key) || c.rejectsSizeOf(original, size, true) {
+		return
+	}
+	c.put(c.bucket(key).newSizedItem(key, value, size, duration), func(existing *Item) bool {
+		return true
+	}, nil)
+}
+
+// Sets the value only if fence is at least the fencing token of the currently
+// cached item. This rejects stale, out-of-order, writes from delayed or retried
+// workers. Returns true if the value was set.
+// The highest fence is tracked on the cached item, and kept by the sets which
+// replace it without a fence. Once a key is deleted, evicted or expires and is
+// removed, any fence is accepted.
+func (c *Cache) SetIfVersionAtLeast(key string, value interface{}, duration time.Duration, fence uint64) bool {
+	return c.setIf(key, value, duration, func(existing *Item) bool {
+		return existing == nil || fence >= existing.fence
+	}, func(item *Item) {
+		item.fence = fence
+	})
+}
+
+// Set the value in the cache for the specified duration, recording when the
+// value was last modified at its source (exposed via Item.Modified).
+func (c *Cache) SetWithTimestamp(key string, value interface{}, duration time.Duration, modified time.Time) {
+	c.setIf(key, value, duration, func(existing *Item) bool {
+		return true
+	}, func(item *Item) {
+		item.modified = modified.UnixNano()
+	})
+}
+
+// Like SetWithTimestamp, but only sets the value if modified is newer than the
+// modification time of the currently cached item. Caches mirrored from a change
+// feed can use this to only ever apply monotonic updates. Returns true if the
+// value was set.
+func (c *Cache) SetIfNewer(key string, value interface{}, duration time.Duration, modified time.Time) bool {
+	ts := modified.UnixNano()
+	return c.setIf(key, value, duration, func(existing *Item) bool {
+		return existing == nil || ts > existing.modified
+	}, func(item *Item) {
+		item.modified = ts
+	})
 }
 
 // Replace the value if it exists, does not set if it doesn't.
 // Returns true if the item existed an was replaced, false otherwise.
 // Replace does not reset item's TTL
 func (c *Cache) Replace(key string, value interface{}) bool {
+	key, ok := c.checkKey(key)
+	if ok == false {
+		return false
+	}
 	item := c.bucket(key).get(key)
 	if item == nil {
 		return false
 	}
-	c.Set(key, value, item.TTL())
+	atomic.AddInt64(&c.stats.replaces, 1)
+	c.set(key, value, item.TTL(), false)
 	return true
 }
 
 // Attempts to get the value from the cache and calles fetch on a miss (missing
 // or stale item). If fetch returns an error, no value is cached and the error
 // is returned back to the caller.
-// Note that Fetch merely calls the public Get and Set functions. If you want
-// a different Fetch behavior, such as thundering herd protection or returning
-// expired items, implement it in your application.
+// Concurrent misses for the same key are coalesced: only one of the callers
+// runs its fetch, and they all get its item or error.
 func (c *Cache) Fetch(key string, duration time.Duration, fetch func() (interface{}, error)) (*Item, error) {
-	item := c.Get(key)
-	if item != nil && !item.Expired() {
+	return c.fetchWith(key, duration, fetch, true)
+}
+
+// Fetch, promote being false for the reads of WithoutPromotion
+func (c *Cache) fetchWith(key string, duration time.Duration, fetch func() (interface{}, error), promote bool) (*Item, error) {
+	done := c.observe(context.Background(), OperationFetch, key)
+	if item := c.lookupWith(key, promote); c.fresh(item) {
+		done(true, nil)
 		return item, nil
 	}
-	value, err := fetch()
+	item, err := c.flights.do(flightKey{secondary: key}, func() (*Item, error) {
+		return c.fetch(key, fixedTTL(duration, fetch))
+	})
+	done(false, err)
+	return item, err
+}
+
+// Like Fetch, but fetch returns the TTL of the value along with it, so that it
+// can be decided per value (e.g. from the caching headers of a response).
+func (c *Cache) FetchWithTTL(key string, fetch func() (interface{}, time.Duration, error)) (*Item, error) {
+	done := c.observe(context.Background(), OperationFetch, key)
+	if item := c.lookup(key); c.fresh(item) {
+		done(true, nil)
+		return item, nil
+	}
+	item, err := c.flights.do(flightKey{secondary: key}, func() (*Item, error) {
+		return c.fetch(key, fetch)
+	})
+	done(false, err)
+	return item, err
+}
+
+// Like Fetch, but for many keys at once: the missing (or stale) keys are loaded
+// with a single call to fetch, e.g. to resolve them with one batched query.
+// Returns the cached and loaded items by key. Keys which fetch doesn't return,
+// or whose value OnFetch rejects, are left out, as are the keys fetch returns
+// but which weren't missing: those aren't cached either. If fetch returns an error,
+// nothing is cached and the error is returned along with the cached items.
+// Unlike Fetch, concurrent misses aren't coalesced.
+func (c *Cache) MultiFetch(keys []string, duration time.Duration, fetch func(missing []string) (map[string]interface{}, error)) (map[string]*Item, error) {
+	items := make(map[string]*Item, len(keys))
+	var missing []string
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if _, exists := seen[key]; exists {
+			continue
+		}
+		seen[key] = struct{}{}
+		if item := c.lookup(key); c.fresh(item) {
+			items[key] = item
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return items, nil
+	}
+
+	start := time.Now().UnixNano()
+	loaded, _, err := doFetch(c.fetchSlots, c.fetchWait, func() (interface{}, time.Duration, error) {
+		values, err := fetch(missing)
+		return values, duration, err
+	})
+	if err != nil {
+		return items, err
+	}
+	values := loaded.(map[string]interface{})
+	for _, key := range missing {
+		value, exists := values[key]
+		if exists == false {
+			continue
+		}
+		if item, err := c.setFetched(key, value, duration, start); err == nil {
+			items[key] = item
+		}
+	}
+	return items, nil
+}
+
+// Like Fetch, but fetch receives a context and the caller stops waiting when ctx
+// is done, returning ctx.Err(). When the fetch is shared by concurrent misses,
+// its context is only cancelled once all of the callers waiting for it gave up;
+// it carries the values of the ctx of the caller which started it.
+func (c *Cache) FetchContext(ctx context.Context, key string, duration time.Duration, fetch func(ctx context.Context) (interface{}, error)) (*Item, error) {
+	done := c.observe(ctx, OperationFetch, key)
+	if item := c.lookup(key); c.fresh(item) {
+		done(true, nil)
+		return item, nil
+	}
+	item, err := c.flights.doContext(ctx, flightKey{secondary: key}, func(ctx context.Context) (*Item, error) {
+		return c.fetch(key, fixedTTL(duration, func() (interface{}, error) {
+			return fetch(ctx)
+		}))
+	})
+	done(false, err)
+	return item, err
+}
+
+// Like Fetch, but an item which expired less than stale ago is returned right
+// away, and refreshed in the background by calling fetch (stale-while-revalidate).
+// Errors from the background refresh are ignored, the stale item is kept. A
+// stale of 0 uses the Configuration.StaleWhileRevalidate window.
+func (c *Cache) FetchStale(key string, duration time.Duration, stale time.Duration, fetch func() (interface{}, error)) (*Item, error) {
+	item := c.lookup(key)
+	if c.fresh(item) {
+		return item, nil
+	}
+	if stale == 0 {
+		stale = c.staleWindow
+	}
+	load := func() (*Item, error) {
+		return c.fetch(key, fixedTTL(duration, fetch))
+	}
+	// an item which is refreshed early (see EarlyExpiration) isn't expired yet
+	if item != nil && (!item.Expired() || (stale > 0 && !item.expiredFor(stale))) {
+		c.flights.background(flightKey{secondary: key}, &c.refreshes, load, func(v interface{}) {
+			c.logRefreshPanic(key, v)
+		})
+		return item, nil
+	}
+	return c.flights.do(flightKey{secondary: key}, load)
+}
+
+func (c *Cache) fetch(key string, fetch func() (interface{}, time.Duration, error)) (*Item, error) {
+	start := time.Now().UnixNano()
+	value, duration, err := doFetch(c.fetchSlots, c.fetchWait, fetch)
 	if err != nil {
 		return nil, err
 	}
-	return c.set(key, value, duration, false), nil
+	return c.setFetched(key, value, duration, start)
+}
+
+// Caches a value loaded by a fetch which started at start
+func (c *Cache) setFetched(key string, value interface{}, duration time.Duration, start int64) (*Item, error) {
+	var err error
+	if c.onFetch != nil {
+		if value, err = c.onFetch(key, value, duration); err != nil {
+			return nil, err
+		}
+	}
+	if c.admitFetched != nil && c.admitFetched(key, sizeOf(value, c.sizer)) == false {
+		return newItem(key, value, time.Now().Add(duration).UnixNano(), false), nil
+	}
+	var item *Item
+	if c.tombstoneTTL > 0 {
+		item = c.setIfNotDeletedSince(key, value, duration, start)
+	} else {
+		item = c.countedSet(key, value, duration, false)
+	}
+	if c.earlyBeta > 0 {
+		atomic.StoreInt64(&item.delta, time.Now().UnixNano()-start)
+	}
+	return item, nil
+}
+
+// Whether Fetch should refresh the (unexpired) item early, see
+// Configuration.EarlyExpiration
+func (c *Cache) refreshEarly(item *Item) bool {
+	return c.earlyBeta > 0 && item.expiresEarly(c.earlyBeta)
+}
+
+// Calls fetch, first waiting for a free slot when the number of concurrent
+// fetches is limited (slots is nil otherwise).
+func doFetch(slots chan struct{}, wait time.Duration, fetch func() (interface{}, time.Duration, error)) (interface{}, time.Duration, error) {
+	if slots != nil {
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case slots <- struct{}{}:
+				timer.Stop()
+			case <-timer.C:
+				return nil, 0, ErrFetchTimeout
+			}
+		} else {
+			slots <- struct{}{}
+		}
+		defer func() { <-slots }()
+	}
+	return fetch()
+}
+
+// Adapts a fetch func with a fixed TTL to the form taken by FetchWithTTL
+func fixedTTL(duration time.Duration, fetch func() (interface{}, error)) func() (interface{}, time.Duration, error) {
+	return func() (interface{}, time.Duration, error) {
+		value, err := fetch()
+		return value, duration, err
+	}
 }
 
 // Remove the item from the cache, return true if the item was present, false otherwise.
 func (c *Cache) Delete(key string) bool {
-	item := c.bucket(key).delete(key)
+	done := c.observe(context.Background(), OperationDelete, key)
+	deleted := c.delete(key)
+	done(deleted, nil)
+	return deleted
+}
+
+func (c *Cache) delete(key string) bool {
+	key, ok := c.checkKey(key)
+	if ok == false {
+		return false
+	}
+	if c.shadow != nil {
+		c.shadow.delete(key)
+	}
+	if c.ghosts != nil {
+		c.ghosts.delete(key)
+	}
+	item := c.bucket(key).remove(key)
 	if item != nil {
-		c.deletables <- item
+		atomic.AddInt64(&c.stats.deletes, 1)
+		if c.front != nil {
+			c.front.remove(item)
+		}
+		c.queueDelete(item)
 		return true
 	}
 	return false
@@ -188,19 +979,74 @@ func (c *Cache) Delete(key string) bool {
 // Clears the cache
 // This is a control command.
 func (c *Cache) Clear() {
+	observed := c.observe(context.Background(), OperationClear, "")
 	done := make(chan struct{})
 	c.control <- clear{done: done}
 	<-done
+	observed(false, nil)
 }
 
 // Stops the background worker. Operations performed on the cache after Stop
 // is called are likely to panic
 // This is a control command.
 func (c *Cache) Stop() {
+	if c.revalidator != nil {
+		c.revalidator.stop()
+	}
+	c.refreshes.stop()
+	if c.snapshots != nil {
+		c.stopSnapshots()
+	}
+	if c.wal != nil {
+		c.wal.close()
+	}
+	if c.expvarName != "" {
+		unpublishExpvar(c.expvarName, c)
+	}
+	atomic.StoreInt32(&c.stopped, 1)
 	close(c.promotables)
 	<-c.control
 }
 
+// Gets the histogram of the age of the items returned by Get since the cache
+// was created. Returns zeroed stats unless TrackServedAge was configured.
+func (c *Cache) ServedAges() ServedAges {
+	if c.ages == nil {
+		return newServedAges().get()
+	}
+	return c.ages.get()
+}
+
+// Gets the hit/miss counters of the cache along with what they would have been
+// with the configured Shadow max size. Returns zeroed stats if no Shadow was
+// configured.
+func (c *Cache) ShadowStats() ShadowStats {
+	if c.shadow == nil {
+		return ShadowStats{}
+	}
+	return c.shadow.getStats()
+}
+
+// Gets the number of Sets which were dropped because the promote buffer was
+// full (see SetBackpressure) since the last time DroppedSets was called.
+func (c *Cache) DroppedSets() int64 {
+	return atomic.SwapInt64(&c.droppedSets, 0)
+}
+
+// Gets the bucket lock counters, summed across all buckets. Returns zeroed
+// stats unless TrackContention was configured.
+func (c *Cache) LockStats() LockStats {
+	var total LockStats
+	for _, b := range c.buckets {
+		stats := b.lockStats()
+		total.ReadLocks += stats.ReadLocks
+		total.ReadWait += stats.ReadWait
+		total.WriteLocks += stats.WriteLocks
+		total.WriteWait += stats.WriteWait
+	}
+	return total
+}
+
 // Gets the number of items removed from the cache due to memory pressure since
 // the last time GetDropped was called
 // This is a control command.
@@ -239,7 +1085,8 @@ func doSyncUpdates(controlCh chan<- interface{}) {
 }
 
 // Sets a new max size. That can result in a GC being run if the new maxium size
-// is smaller than the cached size
+// is smaller than the cached size. During a Warmup, this sets the max size
+// which applies once the warmup is over.
 // This is a control command.
 func (c *Cache) SetMaxSize(size int64) {
 	done := make(chan struct{})
@@ -256,6 +1103,35 @@ func (c *Cache) GC() {
 	<-done
 }
 
+// Removes every expired item and returns the number of items removed. Unlike
+// GC, which evicts the least recently used items, only expired items are
+// removed, making this safe to call on demand to reclaim memory.
+// This is a control command.
+func (c *Cache) PurgeExpired() int {
+	res := make(chan int)
+	c.control <- purgeExpired{res: res}
+	return <-res
+}
+
+// Recalculates the size of the item, for Sized values (or values sized by
+// Configuration.Sizer) which grew or shrank in place, and GCs if the cache is
+// now too large. Returns false if the key doesn't exist.
+// This is a control command.
+func (c *Cache) Resize(key string) bool {
+	key, ok := c.checkKey(key)
+	if ok == false {
+		return false
+	}
+	item := c.bucket(key).get(key)
+	if item == nil {
+		return false
+	}
+	done := make(chan struct{})
+	c.control <- resize{item: item, done: done}
+	<-done
+	return true
+}
+
 // Gets the size of the cache. This is an O(1) call to make, but it is handled
 // by the worker goroutine. It's meant to be called periodically for metrics, or
 // from tests.
@@ -275,73 +1151,429 @@ func (c *Cache) restart() {
 
 func (c *Cache) deleteItem(bucket *bucket, item *Item) {
 	bucket.delete(item.key) //stop other GETs from getting it
-	c.deletables <- item
+	c.queueDelete(item)
 }
 
 func (c *Cache) set(key string, value interface{}, duration time.Duration, track bool) *Item {
+	item, stored := c.store(key, value, duration, track)
+	if stored {
+		c.promoteNew(item)
+	}
+	return item
+}
+
+// set, for Set and Fetch: the value is counted in Stats.Sets if it was stored
+func (c *Cache) countedSet(key string, value interface{}, duration time.Duration, track bool) *Item {
+	item, stored := c.store(key, value, duration, track)
+	if stored {
+		atomic.AddInt64(&c.stats.sets, 1)
+		c.promoteNew(item)
+	}
+	return item
+}
+
+// Like set, but leaves the promotion of the item to the caller. Returns false,
+// with an item which isn't cached, if the value must not be cached, or with
+// the existing item if the set only refreshed its TTL (see
+// Configuration.ValueEqual).
+func (c *Cache) store(key string, value interface{}, duration time.Duration, track bool) (*Item, bool) {
+	original := key
+	key, ok := c.checkKey(key)
+	if ok == false {
+		return newItem(key, value, time.Now().Add(duration).UnixNano(), false), false
+	}
+	if duration, ok = c.checkTTL(key, duration); ok == false {
+		return newItem(key, value, time.Now().Add(duration).UnixNano(), false), false
+	}
+	if c.bypass(key) || c.rejectsSize(original, value, true) {
+		return newItem(key, value, time.Now().Add(duration).UnixNano(), false), false
+	}
 	item, existing := c.bucket(key).set(key, value, duration, track)
+	if c.shadow != nil {
+		c.shadow.set(key, item.size, item.expires)
+	}
+	if existing == item {
+		// refreshed, see Configuration.ValueEqual
+		return item, false
+	}
 	if existing != nil {
-		c.deletables <- existing
+		if c.front != nil {
+			c.front.remove(existing)
+		}
+		existing.setReason(DeleteReasonReplaced)
+		c.queueDelete(existing)
 	}
-	c.promotables <- item
+	return item, true
+}
+
+func (c *Cache) setIf(key string, value interface{}, duration time.Duration, accept func(existing *Item) bool, init func(item *Item)) bool {
+	original := key
+	key, ok := c.checkKey(key)
+	if ok == false {
+		return false
+	}
+	if duration, ok = c.checkTTL(key, duration); ok == false {
+		return false
+	}
+	if c.bypass(key) || c.rejectsSize(original, value, false) {
+		return false
+	}
+	return c.put(c.bucket(key).newItem(key, value, duration, false), accept, init)
+}
+
+// The second half of setIf, for a new item which passed the checks
+func (c *Cache) put(item *Item, accept func(existing *Item) bool, init func(item *Item)) bool {
+	if init != nil {
+		init(item)
+	}
+	key := item.key
+	item, existing := c.bucket(key).setIf(item, accept)
+	if item == nil {
+		return false
+	}
+	atomic.AddInt64(&c.stats.sets, 1)
+	if c.shadow != nil {
+		c.shadow.set(key, item.size, item.expires)
+	}
+	if existing != nil {
+		if c.front != nil {
+			c.front.remove(existing)
+		}
+		existing.setReason(DeleteReasonReplaced)
+		c.queueDelete(existing)
+	}
+	c.promoteNew(item)
+	return true
+}
+
+// Used by Fetch when tombstones are enabled. If the key was deleted since the
+// fetch started, the item is returned to the caller but not cached.
+func (c *Cache) setIfNotDeletedSince(key string, value interface{}, duration time.Duration, since int64) *Item {
+	original := key
+	key, ok := c.checkKey(key)
+	if ok == false {
+		return newItem(key, value, time.Now().Add(duration).UnixNano(), false)
+	}
+	if duration, ok = c.checkTTL(key, duration); ok == false {
+		return newItem(key, value, time.Now().Add(duration).UnixNano(), false)
+	}
+	if c.bypass(key) || c.rejectsSize(original, value, true) {
+		return newItem(key, value, time.Now().Add(duration).UnixNano(), false)
+	}
+	item, existing := c.bucket(key).setIfNotDeletedSince(key, value, duration, since)
+	if item == nil {
+		return newItem(key, value, time.Now().Add(duration).UnixNano(), false)
+	}
+	atomic.AddInt64(&c.stats.sets, 1)
+	if c.shadow != nil {
+		c.shadow.set(key, item.size, item.expires)
+	}
+	if existing != nil {
+		if c.front != nil {
+			c.front.remove(existing)
+		}
+		existing.setReason(DeleteReasonReplaced)
+		c.queueDelete(existing)
+	}
+	c.promoteNew(item)
 	return item
 }
 
+// Queues a newly set item for promotion, applying the configured
+// SetBackpressure strategy when the promote buffer is full.
+func (c *Cache) promoteNew(item *Item) {
+	if c.strict && atomic.LoadInt32(&c.stopped) == 1 {
+		panic("ccache: Set called after Stop")
+	}
+	if c.breaker != nil {
+		c.breaker.observe(len(c.promotables) == cap(c.promotables))
+	}
+	if c.backpressure == DropOnFullBuffer {
+		full := false
+		if chaos := c.loadChaos(); chaos != nil {
+			full = chaos.roll(chaos.FullBufferRate)
+		}
+		if full == false {
+			select {
+			case c.promotables <- item:
+				return
+			default:
+			}
+		}
+		c.bucket(item.key).evict(item)
+		if c.front != nil {
+			c.front.remove(item)
+		}
+		// a Get may have queued its promotion meanwhile, which would list it
+		c.tryQueueDelete(item)
+		atomic.AddInt64(&c.droppedSets, 1)
+		return
+	}
+	if c.inline != nil {
+		select {
+		case c.promotables <- item:
+		default:
+			c.inline.Lock()
+			c.inlineDropped += c.promoteItem(item)
+			c.inline.Unlock()
+		}
+		return
+	}
+	c.promotables <- item
+}
+
+// Whether the value mustn't be stored because of its size, see
+// RejectNonPositiveSize and Configuration.MaxItemSize. With replace, an
+// oversized value also deletes the key's item, which it was meant to replace.
+// key is the caller's, not its digest (see HashLongKeys): it's reported to
+// OnOversized.
+func (c *Cache) rejectsSize(key string, value interface{}, replace bool) bool {
+	if c.sizeBehavior != RejectNonPositiveSize && c.maxItemSize <= 0 {
+		return false
+	}
+	return c.rejectsSizeOf(key, sizeOf(value, c.sizer), replace)
+}
+
+func (c *Cache) rejectsSizeOf(key string, size int64, replace bool) bool {
+	if c.sizeBehavior == RejectNonPositiveSize && size <= 0 {
+		return true
+	}
+	if c.maxItemSize > 0 && size > c.maxItemSize {
+		if c.onOversized != nil {
+			c.onOversized(key, size)
+		}
+		if replace {
+			c.delete(key)
+		}
+		return true
+	}
+	return false
+}
+
+// Applies the NonPositiveTTL behavior. Returns the duration to use, or false if
+// the value must not be stored.
+func (c *Cache) checkTTL(key string, duration time.Duration) (time.Duration, bool) {
+	if duration > 0 {
+		return c.jitter(duration), true
+	}
+	switch c.ttlBehavior {
+	case RejectNonPositiveTTL:
+		return duration, false
+	case FallbackNonPositiveTTL:
+		return c.jitter(c.ttlFallback), true
+	case DeleteNonPositiveTTL:
+		c.delete(key)
+		return duration, false
+	}
+	return duration, true
+}
+
+// Randomly lengthens or shortens duration by up to its TTLJitter share
+func (c *Cache) jitter(duration time.Duration) time.Duration {
+	if c.ttlJitter <= 0 {
+		return duration
+	}
+	return duration + time.Duration(float64(duration)*c.ttlJitter*(2*rand.Float64()-1))
+}
+
 func (c *Cache) bucket(key string) *bucket {
-	h := fnv.New32a()
-	h.Write([]byte(key))
-	return c.buckets[h.Sum32()&c.bucketMask]
+	return c.buckets[hash(key)&c.bucketMask]
+}
+
+// 32-bit FNV-1a. Same as hash/fnv's New32a, but without allocating, which keeps
+// Get allocation-free.
+func hash(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
 }
 
 func (c *Cache) worker() {
 	defer close(c.control)
 	dropped := 0
+	// nil, which is never ready, unless deletes can spill
+	var spilled chan struct{}
+	if c.spill != nil {
+		spilled = c.spill.wake
+	}
+	var expiring <-chan time.Time
+	if c.expiry != nil {
+		ticker := time.NewTicker(c.expireEvery)
+		defer ticker.Stop()
+		expiring = ticker.C
+	}
+	// the ClearFunc jobs which aren't done, each checks a batch of keys per
+	// turn. turn is always ready, it's only selected while there are jobs.
+	var clearing []*clearJob
+	turn := make(chan struct{})
+	close(turn)
 	promoteItem := func(item *Item) {
-		if c.doPromote(item) && c.size > c.maxSize {
-			dropped += c.gc()
-		}
+		dropped += c.promoteItem(item)
 	}
 	for {
+		// deletes free memory, so they're favored when both queues are backed up
+		select {
+		case item := <-c.deletables:
+			c.lockWorker()
+			c.doDelete(item)
+			c.unlockWorker()
+			continue
+		default:
+		}
+		var clearTurn chan struct{}
+		if len(clearing) > 0 {
+			clearTurn = turn
+		}
 		select {
 		case item, ok := <-c.promotables:
 			if ok == false {
 				goto drain
 			}
+			c.lockWorker()
 			promoteItem(item)
+			c.unlockWorker()
 		case item := <-c.deletables:
+			c.lockWorker()
 			c.doDelete(item)
+			c.unlockWorker()
+		case <-spilled:
+			c.lockWorker()
+			c.drainSpill()
+			c.unlockWorker()
+		case <-expiring:
+			c.lockWorker()
+			c.expireDue()
+			c.unlockWorker()
+		case <-clearTurn:
+			job := clearing[0]
+			clearing = clearing[1:]
+			c.lockWorker()
+			more := c.clearStep(job)
+			c.unlockWorker()
+			if more {
+				// the rest waits for its turn, behind the other jobs
+				clearing = append(clearing, job)
+			} else {
+				c.clearDone(job)
+			}
 		case control := <-c.control:
+			c.lockWorker()
 			switch msg := control.(type) {
 			case getDropped:
+				dropped += c.inlineDropped
+				c.inlineDropped = 0
 				msg.res <- dropped
 				dropped = 0
+			case diagnoseWorker:
+				maxSize := c.maxSize
+				if c.warmup != nil {
+					maxSize = c.warmup.maxSize
+				}
+				msg.res <- [2]int64{c.size, maxSize}
 			case setMaxSize:
-				c.maxSize = msg.size
-				if c.size > c.maxSize {
-					dropped += c.gc()
+				if c.warmup != nil {
+					c.warmup.maxSize = msg.size
+				} else {
+					c.maxSize = msg.size
+					if c.size > c.maxSize {
+						dropped += c.gc()
+					}
 				}
 				msg.done <- struct{}{}
 			case clear:
-				for _, bucket := range c.buckets {
-					bucket.clear()
-				}
+				c.stats.clear(time.Now())
+				c.clearBuckets()
 				c.size = 0
 				c.list = list.New()
+				c.gcCursor = nil
+				if c.order != nil {
+					c.order.reset()
+				}
+				if c.expiry != nil {
+					c.expiry.reset()
+				}
+				if c.shadow != nil {
+					c.shadow.clear()
+				}
+				if c.front != nil {
+					c.front.invalidate()
+				}
+				if c.ghosts != nil {
+					c.ghosts.clear()
+				}
+				msg.done <- struct{}{}
+			case clearFunc:
+				clearing = append(clearing, msg.job)
+			case listItems:
+				c.drainSpill()
+				doAllPendingPromotesAndDeletes(c.promotables, promoteItem,
+					c.deletables, c.doDelete)
+				msg.res <- c.listItems()
+			case warmItems:
+				for _, item := range msg.items {
+					promoteItem(item)
+				}
+				msg.done <- struct{}{}
+			case swapAll:
+				dropped += c.swapAll(msg.lookups)
 				msg.done <- struct{}{}
 			case getSize:
 				msg.res <- c.size
+			case purgeExpired:
+				msg.res <- c.purgeExpired()
+			case compact:
+				msg.res <- c.compact(msg.ratio, true)
+			case resize:
+				if delta := msg.item.resize(c.sizer, c.sizeBehavior, c.logSize); delta != 0 && msg.item.element != nil {
+					c.size += delta
+					if c.order != nil {
+						c.order.resized(msg.item, delta)
+					}
+					if c.size > c.maxSize {
+						dropped += c.gc()
+					}
+				}
+				msg.done <- struct{}{}
 			case gc:
 				dropped += c.gc()
 				msg.done <- struct{}{}
 			case syncWorker:
+				c.drainSpill()
+				doAllPendingPromotesAndDeletes(c.promotables, promoteItem,
+					c.deletables, c.doDelete)
+				msg.done <- struct{}{}
+			case verify:
+				c.drainSpill()
 				doAllPendingPromotesAndDeletes(c.promotables, promoteItem,
 					c.deletables, c.doDelete)
+				msg.res <- c.verify()
+			case pauseWorker:
+				<-msg.resume
+			case endWarmup:
+				dropped += c.endWarmup()
+				msg.done <- struct{}{}
+			case isWarming:
+				msg.res <- c.warmup != nil
+			case unfreeze:
+				atomic.StoreInt32(&c.frozen, 0)
+				if c.size > c.maxSize {
+					dropped += c.gc()
+				}
 				msg.done <- struct{}{}
 			}
+			c.unlockWorker()
 		}
 	}
 
 drain:
+	// the jobs which are cut short report what they deleted so far
+	for _, job := range clearing {
+		c.clearDone(job)
+	}
+	c.drainSpill()
 	for {
 		select {
 		case item := <-c.deletables:
@@ -353,6 +1585,44 @@ drain:
 	}
 }
 
+// Adds the item to the list if it's new, else moves it according to the
+// eviction policy, GCing if the cache outgrew its max size. Returns the number
+// of items GC'd. Called by the worker, or by a Set which holds inline.
+func (c *Cache) promoteItem(item *Item) int {
+	chaos := c.loadChaos()
+	if chaos != nil {
+		chaos.delay()
+	}
+	isNew := c.doPromote(item)
+	dropped := 0
+	if isNew && c.warmup != nil {
+		dropped += c.checkWarmup()
+	}
+	if isNew && chaos != nil && chaos.roll(chaos.EvictionRate) && !c.Frozen() && c.evictNew(item) {
+		return dropped + 1
+	}
+	if isNew && c.size > c.maxSize {
+		if c.sketch != nil && !c.Frozen() && c.rejects(item) && c.evictNew(item) {
+			return dropped + 1
+		}
+		dropped += c.gc()
+	}
+	return dropped
+}
+
+// Takes the worker's state, see InlineOnFullBuffer
+func (c *Cache) lockWorker() {
+	if c.inline != nil {
+		c.inline.Lock()
+	}
+}
+
+func (c *Cache) unlockWorker() {
+	if c.inline != nil {
+		c.inline.Unlock()
+	}
+}
+
 // This method is used to implement SyncUpdates. It simply receives and processes as many
 // items as it can receive from the promotables and deletables channels immediately without
 // blocking. If some other goroutine sends an item on either channel after this method has
@@ -364,6 +1634,15 @@ func doAllPendingPromotesAndDeletes(
 	deletables <-chan *Item,
 	deleteFn func(*Item),
 ) {
+doAllDeletes:
+	for {
+		select {
+		case item := <-deletables:
+			deleteFn(item)
+		default:
+			break doAllDeletes
+		}
+	}
 doAllPromotes:
 	for {
 		select {
@@ -375,18 +1654,10 @@ doAllPromotes:
 			break doAllPromotes
 		}
 	}
-doAllDeletes:
-	for {
-		select {
-		case item := <-deletables:
-			deleteFn(item)
-		default:
-			break doAllDeletes
-		}
-	}
 }
 
 func (c *Cache) doDelete(item *Item) {
+	c.verifyValue(item)
 	if item.element == nil {
 		item.promotions = -2
 	} else {
@@ -394,54 +1665,184 @@ func (c *Cache) doDelete(item *Item) {
 		if c.onDelete != nil {
 			c.onDelete(item)
 		}
-		c.list.Remove(item.element)
+		c.unlink(item.element)
+		item.element = nil
+		item.promotions = -2
 	}
 }
 
 func (c *Cache) doPromote(item *Item) bool {
+	if c.sketch != nil {
+		c.sketch.add(item.key)
+	}
 	//already deleted
 	if item.promotions == -2 {
 		return false
 	}
 	if item.element != nil { //not a new item
 		if item.shouldPromote(c.getsPerPromote) {
-			c.list.MoveToFront(item.element)
+			c.moved(item.element)
+			if c.order != nil {
+				c.order.promote(c.list, item.element)
+			} else {
+				c.list.MoveToFront(item.element)
+			}
 			item.promotions = 0
 		}
 		return false
 	}
 
 	c.size += item.size
-	item.element = c.list.PushFront(item)
+	c.link(item)
 	return true
 }
 
+// Whether the TinyLFU filter keeps the new item out of the full cache: it's
+// only admitted if its key was used more often than the GC's next victim's
+func (c *Cache) rejects(item *Item) bool {
+	victim := c.list.Back()
+	if victim == nil || victim == item.element {
+		return false
+	}
+	return c.sketch.estimate(item.key) <= c.sketch.estimate(victim.Value.(*Item).key)
+}
+
 func (c *Cache) gc() int {
+	if c.Frozen() {
+		return 0
+	}
 	dropped := 0
 	element := c.list.Back()
+	resumed := false
+	if cursor := c.gcCursor; cursor != nil {
+		c.gcCursor = nil
+		// the cursor's item may have been removed since
+		if cursor.Value.(*Item).element == cursor {
+			element, resumed = cursor, true
+		}
+	}
 
 	itemsToPrune := int64(c.itemsToPrune)
 	if min := c.size - c.maxSize; min > itemsToPrune {
 		itemsToPrune = min
 	}
 
+	var now int64
+	if c.ghosts != nil {
+		now = time.Now().UnixNano()
+		c.ghosts.sweep(now)
+	}
+
+	skipped := false
 	for i := int64(0); i < itemsToPrune; i++ {
 		if element == nil {
 			return dropped
 		}
 		prev := element.Prev()
 		item := element.Value.(*Item)
-		if c.tracking == false || atomic.LoadInt32(&item.refCount) == 0 {
-			c.bucket(item.key).delete(item.key)
+		if c.eviction == EvictClock && atomic.CompareAndSwapInt32(&item.referenced, 1, 0) {
+			// read since it was last considered, it gets a second chance
+			c.list.MoveToFront(element)
+			element = prev
+			i--
+			continue
+		}
+		if item.Pinned() {
+			// pinned items don't count towards the items to prune, else a few of
+			// them at the back would stop the GC for good
+			element = prev
+			i--
+			continue
+		}
+		if c.tracking && atomic.LoadInt32(&item.refCount) > 0 {
+			skipped = true
+		} else {
+			// the key may have been set again since, the new item stays
+			c.bucket(item.key).evict(item)
+			if c.front != nil {
+				c.front.remove(item)
+			}
+			if c.ghosts != nil {
+				c.ghosts.add(item, now)
+			}
+			item.setReason(DeleteReasonEvicted)
 			c.size -= item.size
-			c.list.Remove(element)
+			c.verifyValue(item)
+			c.unlink(element)
+			if c.order != nil {
+				c.order.evicted(c.list, item)
+			}
+			item.element = nil
 			if c.onDelete != nil {
 				c.onDelete(item)
 			}
 			dropped += 1
+			atomic.AddInt64(&c.stats.evictions, 1)
 			item.promotions = -2
 		}
 		element = prev
 	}
+	if c.resumeGC && (skipped || resumed) {
+		c.gcCursor = element
+	}
 	return dropped
 }
+
+// Removes a just promoted item, as if the GC had picked it, see Chaos and
+// Configuration.TinyLFU
+func (c *Cache) evictNew(item *Item) bool {
+	if item.evictable(c.tracking) == false {
+		return false
+	}
+	c.bucket(item.key).evict(item)
+	if c.front != nil {
+		c.front.remove(item)
+	}
+	item.setReason(DeleteReasonEvicted)
+	c.size -= item.size
+	c.verifyValue(item)
+	c.unlink(item.element)
+	item.element = nil
+	if c.onDelete != nil {
+		c.onDelete(item)
+	}
+	item.promotions = -2
+	atomic.AddInt64(&c.stats.evictions, 1)
+	return true
+}
+
+func (c *Cache) purgeExpired() int {
+	if c.Frozen() {
+		return 0
+	}
+	purged := 0
+	now := time.Now().UnixNano()
+	for element := c.list.Back(); element != nil; {
+		prev := element.Prev()
+		item := element.Value.(*Item)
+		if atomic.LoadInt64(&item.expires) < now && (c.tracking == false || atomic.LoadInt32(&item.refCount) == 0) {
+			c.expire(item)
+			purged += 1
+		}
+		element = prev
+	}
+	atomic.AddInt64(&c.stats.expirations, int64(purged))
+	return purged
+}
+
+// Removes the listed, expired, item
+func (c *Cache) expire(item *Item) {
+	c.bucket(item.key).evict(item)
+	if c.front != nil {
+		c.front.remove(item)
+	}
+	item.setReason(DeleteReasonExpired)
+	c.size -= item.size
+	c.verifyValue(item)
+	c.unlink(item.element)
+	item.element = nil
+	if c.onDelete != nil {
+		c.onDelete(item)
+	}
+	item.promotions = -2
+}
@@ -1,8 +1,24 @@
 package ccache
 
 import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -55,6 +71,73 @@ func (_ CacheTests) DeletesAPrefix() {
 	Expect(cache.ItemCount()).To.Equal(2)
 }
 
+func (_ CacheTests) ClearFuncDeletesInBatches() {
+	deleted := 0
+	cache := New(Configure().OnDelete(func(item *Item) {
+		deleted++
+	}))
+	defer cache.Stop()
+	for i := 0; i < 1000; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	cache.SyncUpdates()
+	Expect(cache.ClearFunc(func(key string, item *Item) bool {
+		return item.Value().(int)%2 == 0
+	})).To.Equal(500)
+	Expect(cache.ItemCount()).To.Equal(500)
+	Expect(cache.Get("2")).To.Equal(nil)
+	Expect(cache.Get("3").Value()).To.Equal(3)
+	Expect(cache.GetSize()).To.Eql(500)
+	Expect(deleted).To.Equal(500)
+	Expect(cache.Stats().Deletes).To.Equal(int64(500))
+	Expect(cache.Verify()).To.Equal(nil)
+}
+
+func (_ CacheTests) ClearFuncEndsWhenTheCacheStops() {
+	cache := New(Configure())
+	for i := 0; i < 5000; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	cache.SyncUpdates()
+	started := make(chan struct{})
+	var once sync.Once
+	res := make(chan int)
+	go func() {
+		res <- cache.ClearFunc(func(key string, item *Item) bool {
+			once.Do(func() { close(started) })
+			return true
+		})
+	}()
+	<-started
+	cache.Stop()
+	Expect(<-res <= 5000).To.Equal(true)
+}
+
+func (_ CacheTests) SpillsDeletesWhenTheBufferIsFull() {
+	cache := New(Configure().DeleteBuffer(1).SpillDeletes())
+	defer cache.Stop()
+	for i := 0; i < 5; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	cache.SyncUpdates()
+
+	resume := make(chan struct{})
+	cache.control <- pauseWorker{resume: resume}
+	for i := 0; i < 4; i++ {
+		Expect(cache.Delete(strconv.Itoa(i))).To.Equal(true)
+	}
+	Expect(cache.DeleteFunc(func(key string, item *Item) bool {
+		return key == "4"
+	})).To.Equal(1)
+	Expect(cache.SpilledDeletes()).To.Equal(4)
+	close(resume)
+
+	cache.SyncUpdates()
+	Expect(cache.SpilledDeletes()).To.Equal(0)
+	Expect(cache.GetSize()).To.Equal(int64(0))
+	Expect(cache.Verify()).To.Equal(nil)
+}
+
 func (_ CacheTests) DeletesAFunc() {
 	cache := New(Configure())
 	defer cache.Stop()
@@ -73,162 +156,2765 @@ func (_ CacheTests) DeletesAFunc() {
 	})).To.Equal(0)
 	Expect(cache.ItemCount()).To.Equal(6)
 
-	Expect(cache.DeleteFunc(func(key string, item *Item) bool {
-		return item.Value().(int) < 4
-	})).To.Equal(3)
-	Expect(cache.ItemCount()).To.Equal(3)
+	Expect(cache.DeleteFunc(func(key string, item *Item) bool {
+		return item.Value().(int) < 4
+	})).To.Equal(3)
+	Expect(cache.ItemCount()).To.Equal(3)
+
+	Expect(cache.DeleteFunc(func(key string, item *Item) bool {
+		return key == "d"
+	})).To.Equal(1)
+	Expect(cache.ItemCount()).To.Equal(2)
+
+}
+
+func (_ CacheTests) OnDeleteCallbackCalled() {
+	onDeleteFnCalled := int32(0)
+	onDeleteFn := func(item *Item) {
+		if item.key == "spice" {
+			atomic.AddInt32(&onDeleteFnCalled, 1)
+		}
+	}
+
+	cache := New(Configure().OnDelete(onDeleteFn))
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("worm", "sand", time.Minute)
+
+	cache.SyncUpdates() // wait for worker to pick up preceding updates
+
+	cache.Delete("spice")
+	cache.SyncUpdates()
+
+	Expect(cache.Get("spice")).To.Equal(nil)
+	Expect(cache.Get("worm").Value()).To.Equal("sand")
+	Expect(atomic.LoadInt32(&onDeleteFnCalled)).To.Eql(1)
+}
+
+func (_ CacheTests) OnDeleteSeesTheReason() {
+	var lock sync.Mutex
+	reasons := make(map[string]DeleteReason)
+	cache := New(Configure().MaxSize(3).ItemsToPrune(1).OnDelete(func(item *Item) {
+		lock.Lock()
+		reasons[item.key+":"+item.Value().(string)] = item.DeleteReason()
+		lock.Unlock()
+	}))
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Minute)
+	cache.SyncUpdates()
+	cache.Set("spice", "must", time.Minute)
+	cache.Set("worm", "sand", -time.Minute)
+	cache.SyncUpdates()
+	cache.PurgeExpired()
+	cache.Delete("spice")
+	cache.SyncUpdates()
+	cache.Set("a", "1", time.Minute)
+	cache.Set("b", "2", time.Minute)
+	cache.Set("c", "3", time.Minute)
+	cache.Set("d", "4", time.Minute)
+	cache.SyncUpdates()
+
+	lock.Lock()
+	defer lock.Unlock()
+	Expect(reasons["spice:flow"]).To.Equal(DeleteReasonReplaced)
+	Expect(reasons["worm:sand"]).To.Equal(DeleteReasonExpired)
+	Expect(reasons["spice:must"]).To.Equal(DeleteReasonDeleted)
+	Expect(reasons["a:1"]).To.Equal(DeleteReasonEvicted)
+}
+
+func (_ CacheTests) FetchesExpiredItems() {
+	cache := New(Configure())
+	fn := func() (interface{}, error) { return "moo-moo", nil }
+
+	cache.Set("beef", "moo", time.Second*-1)
+	Expect(cache.Get("beef").Value()).To.Equal("moo")
+
+	out, _ := cache.Fetch("beef", time.Second, fn)
+	Expect(out.Value()).To.Equal("moo-moo")
+}
+
+func (_ CacheTests) OnFetchTransformsLoadedValue() {
+	var seen string
+	cache := New(Configure().OnFetch(func(key string, value interface{}, duration time.Duration) (interface{}, error) {
+		seen = key
+		return value.(string) + "!", nil
+	}))
+	defer cache.Stop()
+
+	item, err := cache.Fetch("spice", time.Minute, func() (interface{}, error) { return "flow", nil })
+	Expect(err).To.Equal(nil)
+	Expect(seen).To.Equal("spice")
+	Expect(item.Value()).To.Equal("flow!")
+	Expect(cache.Get("spice").Value()).To.Equal("flow!")
+}
+
+func (_ CacheTests) OnFetchErrorPreventsCaching() {
+	cache := New(Configure().OnFetch(func(key string, value interface{}, duration time.Duration) (interface{}, error) {
+		return nil, errors.New("invalid")
+	}))
+	defer cache.Stop()
+
+	item, err := cache.Fetch("spice", time.Minute, func() (interface{}, error) { return "flow", nil })
+	Expect(item).To.Equal(nil)
+	Expect(err.Error()).To.Equal("invalid")
+	Expect(cache.Get("spice")).To.Equal(nil)
+}
+
+func (_ CacheTests) MaxConcurrentFetchesTimesOut() {
+	cache := New(Configure().MaxConcurrentFetches(1, time.Millisecond*10))
+	defer cache.Stop()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		cache.Fetch("slow", time.Minute, func() (interface{}, error) {
+			close(started)
+			<-release
+			return "done", nil
+		})
+		close(finished)
+	}()
+	<-started
+
+	_, err := cache.Fetch("fast", time.Minute, func() (interface{}, error) { return "nope", nil })
+	Expect(err).To.Equal(ErrFetchTimeout)
+	Expect(cache.Get("fast")).To.Equal(nil)
+
+	close(release)
+	<-finished
+	item, err := cache.Fetch("fast", time.Minute, func() (interface{}, error) { return "yes", nil })
+	Expect(err).To.Equal(nil)
+	Expect(item.Value()).To.Equal("yes")
+}
+
+func (_ CacheTests) ShadowRecordsWhatASmallerCacheWouldHit() {
+	cache := New(Configure().MaxSize(10).Shadow(2))
+	defer cache.Stop()
+	for i := 0; i < 4; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	cache.Get("0")
+	cache.Get("3")
+	cache.Get("9")
+	cache.Delete("3")
+	cache.Get("3")
+
+	Expect(cache.ShadowStats()).To.Equal(ShadowStats{
+		Hits:         2,
+		Misses:       2,
+		ShadowHits:   1,
+		ShadowMisses: 3,
+	})
+}
+
+func (_ CacheTests) ShardsLargeShadows() {
+	Expect(len(newShadow(2047).shards)).To.Equal(1)
+	Expect(len(newShadow(4096).shards)).To.Equal(4)
+
+	cache := New(Configure().MaxSize(100000).Shadow(1 << 20))
+	defer cache.Stop()
+	Expect(len(cache.shadow.shards)).To.Equal(16)
+	for i := 0; i < 1000; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	for i := 0; i < 2000; i++ {
+		cache.Get(strconv.Itoa(i))
+	}
+	Expect(cache.ShadowStats()).To.Equal(ShadowStats{
+		Hits:         1000,
+		Misses:       1000,
+		ShadowHits:   1000,
+		ShadowMisses: 1000,
+	})
+}
+
+func (_ CacheTests) TombstoneStopsRacingFetchFromResurrecting() {
+	cache := New(Configure().Tombstones(time.Minute))
+	defer cache.Stop()
+
+	item, err := cache.Fetch("worm", time.Minute, func() (interface{}, error) {
+		cache.Delete("worm")
+		return "stale", nil
+	})
+	Expect(err).To.Equal(nil)
+	Expect(item.Value()).To.Equal("stale")
+	Expect(cache.Get("worm")).To.Equal(nil)
+
+	item, _ = cache.Fetch("worm", time.Minute, func() (interface{}, error) {
+		return "fresh", nil
+	})
+	Expect(item.Value()).To.Equal("fresh")
+	Expect(cache.Get("worm").Value()).To.Equal("fresh")
+}
+
+func (_ CacheTests) SetIfVersionAtLeastRejectsStaleWrites() {
+	cache := New(Configure())
+	defer cache.Stop()
+
+	Expect(cache.SetIfVersionAtLeast("spice", "v2", time.Minute, 2)).To.Equal(true)
+	Expect(cache.SetIfVersionAtLeast("spice", "v1", time.Minute, 1)).To.Equal(false)
+	Expect(cache.Get("spice").Value()).To.Equal("v2")
+
+	Expect(cache.SetIfVersionAtLeast("spice", "v2b", time.Minute, 2)).To.Equal(true)
+	Expect(cache.SetIfVersionAtLeast("spice", "v3", time.Minute, 3)).To.Equal(true)
+	Expect(cache.Get("spice").Value()).To.Equal("v3")
+	Expect(cache.Get("spice").Fence()).To.Equal(uint64(3))
+
+	// a set without a fence keeps the highest one
+	cache.Set("spice", "v4", time.Minute)
+	Expect(cache.Get("spice").Fence()).To.Equal(uint64(3))
+	Expect(cache.SetIfVersionAtLeast("spice", "v2c", time.Minute, 2)).To.Equal(false)
+	Expect(cache.Get("spice").Value()).To.Equal("v4")
+}
+
+func (_ CacheTests) SetIfNewerOnlyAppliesNewerWrites() {
+	cache := New(Configure())
+	defer cache.Stop()
+	now := time.Now()
+
+	cache.SetWithTimestamp("spice", "v1", time.Minute, now)
+	Expect(cache.Get("spice").Modified().Equal(now)).To.Equal(true)
+
+	Expect(cache.SetIfNewer("spice", "v0", time.Minute, now.Add(-time.Second))).To.Equal(false)
+	Expect(cache.SetIfNewer("spice", "v1b", time.Minute, now)).To.Equal(false)
+	Expect(cache.Get("spice").Value()).To.Equal("v1")
+
+	Expect(cache.SetIfNewer("spice", "v2", time.Minute, now.Add(time.Second))).To.Equal(true)
+	Expect(cache.Get("spice").Value()).To.Equal("v2")
+	Expect(cache.SetIfNewer("worm", "v1", time.Minute, now)).To.Equal(true)
+}
+
+func (_ CacheTests) ServesStaleItemsForGracePeriod() {
+	cache := New(Configure().ServeStaleFor(time.Minute))
+	defer cache.Stop()
+	cache.Set("fresh", 1, time.Minute)
+	cache.Set("stale", 2, -time.Second)
+	cache.Set("gone", 3, -time.Minute*2)
+
+	Expect(cache.Get("fresh").Stale()).To.Equal(false)
+	Expect(cache.Get("stale").Stale()).To.Equal(true)
+	Expect(cache.Get("stale").Value()).To.Equal(2)
+	Expect(cache.Get("gone")).To.Equal(nil)
+}
+
+func (_ CacheTests) RevalidatesStaleItemsInTheBackground() {
+	loads := int32(0)
+	release := make(chan struct{})
+	cache := New(Configure().Revalidate(func(key string) (interface{}, time.Duration, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return key + "!", time.Minute, nil
+	}, 2, time.Minute))
+
+	cache.Set("spice", "flow", -time.Second)
+	Expect(cache.Get("spice").Value()).To.Equal("flow")
+	Expect(cache.Get("spice").Value()).To.Equal("flow")
+	close(release)
+	cache.Stop()
+
+	Expect(atomic.LoadInt32(&loads)).To.Equal(int32(1))
+	Expect(cache.GetWithoutPromote("spice").Value()).To.Equal("spice!")
+}
+
+func (_ CacheTests) RevalidatesSoftStaleItems() {
+	loads := int32(0)
+	cache := New(Configure().Revalidate(func(key string) (interface{}, time.Duration, error) {
+		atomic.AddInt32(&loads, 1)
+		return "melange", time.Minute, nil
+	}, 1, time.Minute))
+	defer cache.Stop()
+
+	cache.SetWithSoftTTL("spice", "flow", -time.Second, time.Hour)
+	item := cache.Get("spice")
+	Expect(item.Value()).To.Equal("flow")
+	Expect(item.Stale()).To.Equal(true)
+	cache.revalidator.wg.Wait()
+	Expect(atomic.LoadInt32(&loads)).To.Equal(int32(1))
+	Expect(cache.Get("spice").Value()).To.Equal("melange")
+	Expect(cache.Get("spice").Stale()).To.Equal(false)
+}
+
+func (_ CacheTests) RevalidationSurvivesAPanickingLoader() {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	loads := int32(0)
+	cache := New(Configure().Revalidate(func(key string) (interface{}, time.Duration, error) {
+		if atomic.AddInt32(&loads, 1) == 1 {
+			panic("down")
+		}
+		return "melange", time.Minute, nil
+	}, 1, 0))
+	defer cache.Stop()
+
+	cache.Set("spice", "flow", -time.Second)
+	Expect(cache.Get("spice").Value()).To.Equal("flow")
+	cache.revalidator.wg.Wait()
+	Expect(strings.Contains(logged.String(), `the background refresh of "spice" panicked: down`)).To.Equal(true)
+
+	// the panicking refresh gave its worker back
+	Expect(cache.Get("spice").Value()).To.Equal("flow")
+	cache.revalidator.wg.Wait()
+	Expect(atomic.LoadInt32(&loads)).To.Equal(int32(2))
+	Expect(cache.GetWithoutPromote("spice").Value()).To.Equal("melange")
+}
+
+func (_ CacheTests) RejectsLongKeys() {
+	cache := New(Configure().MaxKeyLength(5))
+	defer cache.Stop()
+	cache.Set("spice", 1, time.Minute)
+	cache.Set("spices", 2, time.Minute)
+	Expect(cache.Get("spice").Value()).To.Equal(1)
+	Expect(cache.Get("spices")).To.Equal(nil)
+
+	item, _ := cache.Fetch("spices", time.Minute, func() (interface{}, error) { return 3, nil })
+	Expect(item.Value()).To.Equal(3)
+	Expect(cache.ItemCount()).To.Equal(1)
+}
+
+func (_ CacheTests) HashesLongKeys() {
+	cache := New(Configure().MaxKeyLength(30).HashLongKeys())
+	defer cache.Stop()
+	key := strings.Repeat("spice", 100)
+	cache.Set(key, 1, time.Minute)
+	Expect(cache.Get(key).Value()).To.Equal(1)
+	Expect(len(cache.Get(key).key)).To.Equal(30)
+	Expect(cache.Delete(key)).To.Equal(true)
+	Expect(cache.Get(key)).To.Equal(nil)
+}
+
+func (_ CacheTests) HashedKeysCallBackWithTheOriginalKey() {
+	var revalidated, oversized string
+	cache := New(Configure().MaxKeyLength(30).HashLongKeys().Revalidate(func(key string) (interface{}, time.Duration, error) {
+		revalidated = key
+		return 2, time.Minute, nil
+	}, 1, time.Minute).MaxItemSize(5, func(key string, size int64) {
+		oversized = key
+	}))
+	defer cache.Stop()
+	key := strings.Repeat("spice", 100)
+	cache.Set(key, 1, -time.Second)
+	cache.Get(key)
+	cache.revalidator.wg.Wait()
+	Expect(revalidated).To.Equal(key)
+	Expect(cache.Get(key).Value()).To.Equal(2)
+
+	cache.SetWithSize(key, 3, 10, time.Minute)
+	Expect(oversized).To.Equal(key)
+}
+
+func (_ CacheTests) NonPositiveTTLBehaviors() {
+	cache := New(Configure().NonPositiveTTL(RejectNonPositiveTTL, 0))
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("spice", "must", 0)
+	Expect(cache.Get("spice").Value()).To.Equal("flow")
+	cache.Stop()
+
+	cache = New(Configure().NonPositiveTTL(FallbackNonPositiveTTL, time.Minute))
+	cache.Set("spice", "flow", -time.Second)
+	Expect(cache.Get("spice").Expired()).To.Equal(false)
+	cache.Stop()
+
+	cache = New(Configure().NonPositiveTTL(DeleteNonPositiveTTL, 0))
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("spice", "must", 0)
+	Expect(cache.Get("spice")).To.Equal(nil)
+	cache.Stop()
+}
+
+func (_ CacheTests) NonPositiveSizeBehaviors() {
+	cache := New(Configure())
+	cache.Set("spice", &SizedItem{0, 0}, time.Minute)
+	cache.Set("worm", &SizedItem{1, -3}, time.Minute)
+	cache.SyncUpdates()
+	Expect(cache.GetSize()).To.Equal(int64(-3))
+	cache.Stop()
+
+	cache = New(Configure().NonPositiveSize(OneForNonPositiveSize))
+	cache.Set("spice", &SizedItem{0, 0}, time.Minute)
+	cache.Set("worm", &SizedItem{1, -3}, time.Minute)
+	cache.SyncUpdates()
+	Expect(cache.GetSize()).To.Equal(int64(2))
+	cache.Get("worm").Value().(*SizedItem).s = -1
+	cache.Resize("worm")
+	Expect(cache.GetSize()).To.Equal(int64(2))
+	cache.Stop()
+
+	cache = New(Configure().NonPositiveSize(RejectNonPositiveSize))
+	cache.Set("spice", &SizedItem{0, 2}, time.Minute)
+	cache.Set("spice", &SizedItem{1, 0}, time.Minute)
+	cache.SyncUpdates()
+	Expect(cache.Get("spice").Value().(*SizedItem).id).To.Equal(0)
+	Expect(cache.GetSize()).To.Equal(int64(2))
+	cache.Stop()
+}
+
+func (_ CacheTests) PurgeExpiredRemovesOnlyExpiredItems() {
+	cache := New(Configure())
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("worm", "sand", -time.Second)
+	cache.Set("leto", "ghanima", -time.Minute)
+	cache.SyncUpdates()
+
+	Expect(cache.PurgeExpired()).To.Equal(2)
+	Expect(cache.ItemCount()).To.Equal(1)
+	Expect(cache.GetSize()).To.Eql(1)
+	Expect(cache.Get("spice").Value()).To.Equal("flow")
+	Expect(cache.PurgeExpired()).To.Equal(0)
+}
+
+func (_ CacheTests) GCKeepsTheNewItemOfAReSetKey() {
+	cache := New(Configure().ItemsToPrune(1))
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Minute)
+	cache.SyncUpdates()
+	resume := make(chan struct{})
+	cache.control <- pauseWorker{resume: resume}
+	// the old item is still listed, and the oldest, when the GC runs
+	cache.Set("spice", "melange", time.Minute)
+	cache.gc()
+	close(resume)
+	cache.SyncUpdates()
+	Expect(cache.Get("spice").Value()).To.Equal("melange")
+	Expect(cache.ItemCount()).To.Equal(1)
+}
+
+func (_ CacheTests) ExpiresItemsEveryInterval() {
+	cache := New(Configure().ExpireEvery(time.Millisecond * 5))
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("worm", "sand", time.Millisecond*10)
+	cache.Set("leto", "ghanima", time.Millisecond*10)
+	cache.SyncUpdates()
+	cache.Get("leto").Extend(time.Minute)
+
+	time.Sleep(time.Millisecond * 60)
+	cache.SyncUpdates()
+	Expect(cache.ItemCount()).To.Equal(2)
+	Expect(cache.GetSize()).To.Eql(2)
+	Expect(cache.Get("worm")).To.Equal(nil)
+	Expect(cache.Get("leto").Value()).To.Equal("ghanima")
+	Expect(cache.Stats().Expirations).To.Eql(1)
+	Expect(cache.PurgeExpired()).To.Equal(0)
+}
+
+func (_ CacheTests) SetOfAnEqualValueRefreshesTheTTL() {
+	deleted := int32(0)
+	cache := New(Configure().ValueEqual(func(a, b interface{}) bool {
+		return a.(string) == b.(string)
+	}).OnDelete(func(item *Item) {
+		atomic.AddInt32(&deleted, 1)
+	}))
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Second)
+	cache.SyncUpdates()
+	item := cache.Get("spice")
+
+	cache.Set("spice", "flow", time.Minute)
+	cache.SyncUpdates()
+	Expect(cache.Get("spice")).To.Equal(item)
+	Expect(item.TTL() > time.Second).To.Equal(true)
+	Expect(atomic.LoadInt32(&deleted)).To.Equal(int32(0))
+
+	cache.Set("spice", "melange", time.Minute)
+	cache.SyncUpdates()
+	Expect(cache.Get("spice").Value()).To.Equal("melange")
+	Expect(atomic.LoadInt32(&deleted)).To.Equal(int32(1))
+	Expect(cache.ItemCount()).To.Equal(1)
+	Expect(cache.GetSize()).To.Eql(1)
+}
+
+func (_ CacheTests) SlidingTTLExtendsUsedItems() {
+	cache := New(Configure().SlidingTTL())
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Millisecond*50)
+	cache.Set("worm", "sand", time.Millisecond*50)
+	cache.Set("leto", "ghanima", -time.Second)
+	for i := 0; i < 4; i++ {
+		time.Sleep(time.Millisecond * 20)
+		Expect(cache.Get("spice").Expired()).To.Equal(false)
+	}
+	Expect(cache.GetWithoutPromote("worm").Expired()).To.Equal(true)
+	Expect(cache.Get("leto").Expired()).To.Equal(true)
+	Expect(cache.Get("spice").TTL() <= time.Millisecond*50).To.Equal(true)
+}
+
+func (_ CacheTests) CompactRebuildsShrunkMaps() {
+	cache := New(Configure().Buckets(1).DeleteBuffer(5000).CompactBelow(0.5))
+	defer cache.Stop()
+	for i := 0; i < 5000; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	cache.SyncUpdates()
+	// the keys are all deleted by the time the worker unlinks the items
+	resume := make(chan struct{})
+	cache.control <- pauseWorker{resume: resume}
+	for i := 10; i < 5000; i++ {
+		cache.Delete(strconv.Itoa(i))
+	}
+	close(resume)
+	cache.SyncUpdates()
+	// compacted automatically after 4096 removals
+	Expect(cache.buckets[0].peak).To.Equal(10)
+	Expect(cache.Compact()).To.Equal(0)
+
+	cache.Delete("9")
+	Expect(cache.Compact()).To.Equal(1)
+	Expect(cache.buckets[0].peak).To.Equal(9)
+	Expect(cache.Get("8").Value()).To.Equal(8)
+	Expect(cache.ItemCount()).To.Equal(9)
+}
+
+func (_ CacheTests) CompactedMapsArePublished() {
+	cache := New(Configure().Buckets(1).CopyOnWrite())
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("worm", "sand", time.Minute)
+	cache.Delete("worm")
+	Expect(cache.Compact()).To.Equal(1)
+	cache.Set("leto", "ghanima", time.Minute)
+	Expect(cache.Get("spice").Value()).To.Equal("flow")
+	Expect(cache.Get("leto").Value()).To.Equal("ghanima")
+}
+
+func (_ CacheTests) TTLJitterSpreadsTheExpiries() {
+	cache := New(Configure().TTLJitter(0.1))
+	defer cache.Stop()
+	min, max := time.Hour, time.Duration(0)
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		cache.Set(key, i, time.Minute)
+		ttl, _ := cache.TTL(key)
+		if ttl < min {
+			min = ttl
+		}
+		if ttl > max {
+			max = ttl
+		}
+	}
+	Expect(min > time.Second*53).To.Equal(true)
+	Expect(max <= time.Second*66).To.Equal(true)
+	Expect(max-min > time.Second).To.Equal(true)
+}
+
+func (_ CacheTests) PutUsesTheDefaultTTL() {
+	cache := New(Configure().DefaultTTL(time.Hour))
+	defer cache.Stop()
+	cache.Put("spice", "flow")
+	cache.Set("worm", "sand", time.Minute)
+	Expect(cache.Get("spice").Value()).To.Equal("flow")
+	Expect(cache.Get("spice").TTL() > time.Minute*59).To.Equal(true)
+	Expect(cache.Get("worm").TTL() <= time.Minute).To.Equal(true)
+}
+
+func (_ CacheTests) PutRequiresADefaultTTL() {
+	cache := New(Configure())
+	defer cache.Stop()
+	defer func() {
+		Expect(recover()).To.Equal("ccache: Put called without a DefaultTTL")
+		Expect(cache.Get("spice")).To.Equal(nil)
+	}()
+	cache.Put("spice", "flow")
+}
+
+func (_ CacheTests) ExplicitDurationsOverrideTheDefaultTTL() {
+	cache := New(Configure().DefaultTTL(time.Hour).NonPositiveTTL(RejectNonPositiveTTL, 0))
+	defer cache.Stop()
+	cache.Set("spice", "flow", 0)
+	Expect(cache.Get("spice")).To.Equal(nil)
+}
+
+func (_ CacheTests) GCsTheOldestItems() {
+	cache := New(Configure().ItemsToPrune(10))
+	for i := 0; i < 500; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	cache.SyncUpdates()
+	cache.GC()
+	Expect(cache.Get("9")).To.Equal(nil)
+	Expect(cache.Get("10").Value()).To.Equal(10)
+	Expect(cache.ItemCount()).To.Equal(490)
+}
+
+func (_ CacheTests) PromotedItemsDontGetPruned() {
+	cache := New(Configure().ItemsToPrune(10).GetsPerPromote(1))
+	for i := 0; i < 500; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	cache.SyncUpdates()
+	cache.Get("9")
+	cache.SyncUpdates()
+	cache.GC()
+	Expect(cache.Get("9").Value()).To.Equal(9)
+	Expect(cache.Get("10")).To.Equal(nil)
+	Expect(cache.Get("11").Value()).To.Equal(11)
+}
+
+func (_ CacheTests) ScannedItemsAreNotPromoted() {
+	cache := New(Configure().ItemsToPrune(10).GetsPerPromote(1))
+	for i := 0; i < 500; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	cache.SyncUpdates()
+	cache.WithoutPromotion(func(scan ScanCache) {
+		Expect(scan.Get("9").Value()).To.Equal(9)
+		item, _ := scan.Fetch("8", time.Minute, func() (interface{}, error) {
+			return nil, errors.New("cached")
+		})
+		Expect(item.Value()).To.Equal(8)
+	})
+	cache.SyncUpdates()
+	cache.GC()
+	Expect(cache.Get("8")).To.Equal(nil)
+	Expect(cache.Get("9")).To.Equal(nil)
+	Expect(cache.Get("10").Value()).To.Equal(10)
+	Expect(cache.Stats().Hits).To.Eql(3)
+}
+
+func (_ CacheTests) TTLDoesNotPromote() {
+	cache := New(Configure().ItemsToPrune(10).GetsPerPromote(1))
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("old", "worm", -time.Second)
+	cache.SyncUpdates()
+	ttl, ok := cache.TTL("spice")
+	Expect(ok).To.Equal(true)
+	Expect(ttl > 59*time.Second && ttl <= time.Minute).To.Equal(true)
+	ttl, ok = cache.TTL("old")
+	Expect(ok).To.Equal(true)
+	Expect(ttl < 0).To.Equal(true)
+	_, ok = cache.TTL("melange")
+	Expect(ok).To.Equal(false)
+	Expect(len(cache.promotables)).To.Equal(0)
+}
+
+func (_ CacheTests) GetWithoutPromoteDoesNotPromote() {
+	cache := New(Configure().ItemsToPrune(10).GetsPerPromote(1))
+	for i := 0; i < 500; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	cache.SyncUpdates()
+	cache.GetWithoutPromote("9")
+	cache.SyncUpdates()
+	cache.GC()
+	Expect(cache.Get("9")).To.Equal(nil)
+	Expect(cache.Get("10").Value()).To.Equal(10)
+	Expect(cache.Get("11").Value()).To.Equal(11)
+}
+
+func (_ CacheTests) TrackerDoesNotCleanupHeldInstance() {
+	cache := New(Configure().ItemsToPrune(11).Track())
+	item0 := cache.TrackingSet("0", 0, time.Minute)
+	for i := 1; i < 11; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	item1 := cache.TrackingGet("1")
+	cache.SyncUpdates()
+	cache.GC()
+	Expect(cache.Get("0").Value()).To.Equal(0)
+	Expect(cache.Get("1").Value()).To.Equal(1)
+	item0.Release()
+	item1.Release()
+	cache.GC()
+	Expect(cache.Get("0")).To.Equal(nil)
+	Expect(cache.Get("1")).To.Equal(nil)
+}
+
+func (_ CacheTests) DetectsTrackingLeaks() {
+	leaks := make(chan string, 1)
+	cache := New(Configure().Track().DetectTrackingLeaks(func(key string, site string) {
+		leaks <- key + "@" + site
+	}))
+	defer cache.Stop()
+
+	cache.TrackingSet("leak", "flow", time.Minute)
+	cache.Delete("leak")
+	cache.SyncUpdates()
+
+	for i := 0; i < 100; i++ {
+		runtime.GC()
+		select {
+		case leak := <-leaks:
+			Expect(leak).To.Contain("leak@")
+			Expect(leak).To.Contain("cache_test.go")
+			return
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	Fail("leak was not reported")
+}
+
+func (_ CacheTests) ReportsExceededRefCount() {
+	exceeded := 0
+	cache := New(Configure().Track().MaxRefCount(2, func(item *Item) {
+		exceeded += 1
+	}))
+	defer cache.Stop()
+	cache.TrackingSet("spice", "flow", time.Minute)
+	cache.TrackingGet("spice")
+	Expect(exceeded).To.Equal(0)
+	cache.TrackingGet("spice")
+	cache.TrackingGet("spice")
+	Expect(exceeded).To.Equal(1)
+}
+
+func (_ CacheTests) TrackingGetContextReleasesWhenDone() {
+	cache := New(Configure().Track())
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	item := cache.TrackingGetContext(ctx, "spice").(*Item)
+	Expect(atomic.LoadInt32(&item.refCount)).To.Equal(int32(1))
+	cancel()
+	for i := 0; i < 100 && atomic.LoadInt32(&item.refCount) != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	Expect(atomic.LoadInt32(&item.refCount)).To.Equal(int32(0))
+	Expect(cache.TrackingGetContext(ctx, "worm")).To.Equal(NilTracked)
+
+	// nothing waits on a context which is never done
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		cache.TrackingGetContext(context.Background(), "spice")
+	}
+	Expect(runtime.NumGoroutine() < goroutines+100).To.Equal(true)
+	Expect(atomic.LoadInt32(&item.refCount)).To.Equal(int32(100))
+}
+
+func (_ CacheTests) CopyOnWrite() {
+	cache := New(Configure().CopyOnWrite().MaxSize(5).ItemsToPrune(1))
+	defer cache.Stop()
+	for i := 0; i < 7; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	cache.SyncUpdates()
+	Expect(cache.Get("0")).To.Equal(nil)
+	Expect(cache.Get("6").Value()).To.Equal(6)
+	cache.Delete("6")
+	Expect(cache.Get("6")).To.Equal(nil)
+	Expect(cache.DeletePrefix("5")).To.Equal(1)
+	Expect(cache.Get("5")).To.Equal(nil)
+	cache.Clear()
+	Expect(cache.Get("4")).To.Equal(nil)
+}
+
+func (_ CacheTests) TracksLockContention() {
+	cache := New(Configure().TrackContention())
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Minute)
+	cache.Get("spice")
+	cache.Get("spice")
+
+	stats := cache.LockStats()
+	Expect(stats.ReadLocks).To.Equal(int64(2))
+	Expect(stats.WriteLocks).To.Equal(int64(1))
+	Expect(New(Configure()).LockStats()).To.Equal(LockStats{})
+}
+
+func (_ CacheTests) GetDoesNotAllocate() {
+	if raceEnabled {
+		return
+	}
+	cache := New(Configure())
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Minute)
+	cache.SyncUpdates()
+
+	Expect(testing.AllocsPerRun(100, func() { cache.Get("spice") })).To.Equal(0.0)
+	Expect(testing.AllocsPerRun(100, func() { cache.Get("worm") })).To.Equal(0.0)
+	Expect(testing.AllocsPerRun(100, func() { cache.GetWithoutPromote("spice") })).To.Equal(0.0)
+}
+
+func (_ CacheTests) HashMatchesFnv() {
+	for _, key := range []string{"", "a", "spice", "leto/ghanima"} {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		Expect(hash(key)).To.Equal(h.Sum32())
+	}
+}
+
+func (_ CacheTests) DropsSetsOnFullPromoteBuffer() {
+	entered, block := make(chan struct{}), make(chan struct{})
+	cache := New(Configure().PromoteBuffer(1).SetBackpressure(DropOnFullBuffer).OnDelete(func(item *Item) {
+		close(entered)
+		<-block
+	}))
+	defer cache.Stop()
+	cache.Set("spice", 1, time.Minute)
+	cache.SyncUpdates()
+	// block the worker so that it can't drain the promote buffer
+	cache.Delete("spice")
+	<-entered
+
+	cache.Set("a", 1, time.Minute)
+	cache.Set("b", 2, time.Minute)
+	close(block)
+	Expect(cache.Get("a").Value()).To.Equal(1)
+	Expect(cache.Get("b")).To.Equal(nil)
+	Expect(cache.DroppedSets()).To.Equal(int64(1))
+	Expect(cache.DroppedSets()).To.Equal(int64(0))
+}
+
+func (_ CacheTests) DroppedSetsAreNotListedByTheirGets() {
+	entered, block := make(chan struct{}), make(chan struct{})
+	cache := New(Configure().PromoteBuffer(1).SetBackpressure(DropOnFullBuffer).OnDelete(func(item *Item) {
+		if item.key == "spice" {
+			close(entered)
+			<-block
+		}
+	}))
+	defer cache.Stop()
+	cache.Set("spice", 1, time.Minute)
+	cache.SyncUpdates()
+	cache.Delete("spice")
+	<-entered
+
+	cache.Set("a", 1, time.Minute)
+	cache.Set("b", 2, time.Minute)
+	Expect(cache.DroppedSets()).To.Equal(int64(1))
+	// as if b was read, and its promotion queued, before it was dropped
+	b := <-cache.deletables
+	Expect(b.key).To.Equal("b")
+	close(block)
+	cache.promotables <- b
+	cache.deletables <- b
+	cache.SyncUpdates()
+	Expect(cache.Verify()).To.Equal(nil)
+	Expect(cache.GetSize()).To.Eql(1)
+}
+
+func (_ CacheTests) PromotesInlineOnFullPromoteBuffer() {
+	cache := New(Configure().MaxSize(100).ItemsToPrune(10).PromoteBuffer(1).SetBackpressure(InlineOnFullBuffer))
+	defer cache.Stop()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 2000; j++ {
+				key := strconv.Itoa(j % 300)
+				cache.Set(key, j, time.Minute)
+				cache.Get(key)
+			}
+		}(i)
+	}
+	wg.Wait()
+	cache.SyncUpdates()
+	Expect(cache.Verify()).To.Equal(nil)
+	Expect(cache.GetSize() <= 100).To.Equal(true)
+	Expect(cache.GetDropped() > 0).To.Equal(true)
+}
+
+func (_ CacheTests) InlinesValues() {
+	cache := New(Configure().InlineValues())
+	defer cache.Stop()
+	cache.Set("power", 9001, time.Minute)
+	cache.Set("spice", "flow", time.Minute)
+	Expect(cache.Get("power").Value()).To.Equal(9001)
+	Expect(cache.Get("spice").Value()).To.Equal("flow")
+}
+
+func (_ CacheTests) RemovesOldestItemWhenFull() {
+	onDeleteFnCalled := false
+	onDeleteFn := func(item *Item) {
+		if item.key == "0" {
+			onDeleteFnCalled = true
+		}
+	}
+
+	cache := New(Configure().MaxSize(5).ItemsToPrune(1).OnDelete(onDeleteFn))
+	for i := 0; i < 7; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	cache.SyncUpdates()
+	Expect(cache.Get("0")).To.Equal(nil)
+	Expect(cache.Get("1")).To.Equal(nil)
+	Expect(cache.Get("2").Value()).To.Equal(2)
+	Expect(onDeleteFnCalled).To.Equal(true)
+	Expect(cache.ItemCount()).To.Equal(5)
+}
+
+func (_ CacheTests) RemovesOldestItemWhenFullBySizer() {
+	cache := New(Configure().MaxSize(9).ItemsToPrune(2))
+	for i := 0; i < 7; i++ {
+		cache.Set(strconv.Itoa(i), &SizedItem{i, 2}, time.Minute)
+	}
+	cache.SyncUpdates()
+	Expect(cache.Get("0")).To.Equal(nil)
+	Expect(cache.Get("1")).To.Equal(nil)
+	Expect(cache.Get("2")).To.Equal(nil)
+	Expect(cache.Get("3")).To.Equal(nil)
+	Expect(cache.Get("4").Value().(*SizedItem).id).To.Equal(4)
+	Expect(cache.GetDropped()).To.Equal(4)
+	Expect(cache.GetDropped()).To.Equal(0)
+}
+
+func (_ CacheTests) SizesValuesWithTheSizer() {
+	cache := New(Configure().MaxSize(10).ItemsToPrune(1).Sizer(func(value interface{}) int64 {
+		if data, ok := value.([]byte); ok {
+			return int64(len(data))
+		}
+		return 1
+	}))
+	defer cache.Stop()
+	cache.Set("a", []byte("abcd"), time.Minute)
+	cache.Set("b", []byte("ef"), time.Minute)
+	// Sized values size themselves
+	cache.Set("c", &SizedItem{0, 3}, time.Minute)
+	cache.SyncUpdates()
+	Expect(cache.GetSize()).To.Eql(9)
+
+	cache.Set("d", []byte("ghi"), time.Minute)
+	cache.SyncUpdates()
+	// the GC evicts at least as many items as the cache is over its size
+	Expect(cache.Get("a")).To.Equal(nil)
+	Expect(cache.Get("b")).To.Equal(nil)
+	Expect(cache.GetSize()).To.Eql(6)
+}
+
+func (_ CacheTests) DoesNotCacheOversizedValues() {
+	var rejected []string
+	cache := New(Configure().MaxSize(100).MaxItemSize(5, func(key string, size int64) {
+		rejected = append(rejected, key+":"+strconv.FormatInt(size, 10))
+	}))
+	defer cache.Stop()
+	cache.Set("small", &SizedItem{0, 5}, time.Minute)
+	cache.Set("large", &SizedItem{1, 6}, time.Minute)
+	item, err := cache.Fetch("fetched", time.Minute, func() (interface{}, error) {
+		return &SizedItem{2, 50}, nil
+	})
+	Expect(err).To.Equal(nil)
+	Expect(item.Value().(*SizedItem).id).To.Equal(2)
+	cache.SyncUpdates()
+
+	Expect(cache.Get("small").Value().(*SizedItem).id).To.Equal(0)
+	Expect(cache.Get("large")).To.Equal(nil)
+	Expect(cache.Get("fetched")).To.Equal(nil)
+	Expect(rejected).To.Equal([]string{"large:6", "fetched:50"})
+	Expect(cache.GetSize()).To.Eql(5)
+}
+
+func (_ CacheTests) OversizedValuesDeleteThePreviousValue() {
+	cache := New(Configure().MaxSize(100).MaxItemSize(5, nil))
+	defer cache.Stop()
+	cache.Set("spice", &SizedItem{0, 5}, time.Minute)
+	cache.SetWithSize("worm", "sand", 5, time.Minute)
+	cache.Set("spice", &SizedItem{1, 6}, time.Minute)
+	cache.SetWithSize("worm", "sandworm", 6, time.Minute)
+	cache.SyncUpdates()
+	Expect(cache.Get("spice")).To.Equal(nil)
+	Expect(cache.Get("worm")).To.Equal(nil)
+	Expect(cache.GetSize()).To.Eql(0)
+}
+
+func (_ CacheTests) SetWithSizeOverridesTheValuesSize() {
+	cache := New(Configure().MaxItemSize(100, nil).Sizer(func(value interface{}) int64 {
+		return 1000
+	}))
+	defer cache.Stop()
+	cache.SetWithSize("a", "body", 40, time.Minute)
+	cache.SetWithSize("b", &SizedItem{0, 2}, 10, time.Minute)
+	cache.SetWithSize("c", "huge", 101, time.Minute)
+	cache.SyncUpdates()
+	Expect(cache.Get("a").Value()).To.Equal("body")
+	Expect(cache.Get("c")).To.Equal(nil)
+	Expect(cache.GetSize()).To.Eql(50)
+
+	Expect(cache.Resize("b")).To.Equal(true)
+	Expect(cache.GetSize()).To.Eql(50)
+}
+
+func (_ CacheTests) FetchAdmissionKeepsLargeFetchedValuesOut() {
+	cache := New(Configure().MaxSize(100).FetchAdmission(func(key string, size int64) bool {
+		return size <= 10
+	}))
+	defer cache.Stop()
+	for _, size := range []int64{10, 11} {
+		key := strconv.FormatInt(size, 10)
+		item, err := cache.Fetch(key, time.Minute, func() (interface{}, error) {
+			return &SizedItem{int(size), size}, nil
+		})
+		Expect(err).To.Equal(nil)
+		Expect(item.Value().(*SizedItem).id).To.Equal(int(size))
+	}
+	cache.Set("set", &SizedItem{0, 50}, time.Minute)
+	cache.SyncUpdates()
+	Expect(cache.Get("10")).Not.To.Equal(nil)
+	Expect(cache.Get("11")).To.Equal(nil)
+	Expect(cache.Get("set")).Not.To.Equal(nil)
+	Expect(cache.GetSize()).To.Eql(60)
+}
+
+func (_ CacheTests) GCSkipsPinnedItems() {
+	cache := New(Configure().MaxSize(5).ItemsToPrune(1))
+	defer cache.Stop()
+	cache.SetPinned("flags", 1, time.Minute)
+	cache.Set("config", 2, time.Minute)
+	cache.SyncUpdates()
+	cache.Get("config").Pin()
+	for i := 0; i < 10; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	cache.SyncUpdates()
+	Expect(cache.Get("flags").Pinned()).To.Equal(true)
+	Expect(cache.Get("config").Value()).To.Equal(2)
+	Expect(cache.Get("6")).To.Equal(nil)
+	Expect(cache.GetSize()).To.Eql(5)
+
+	cache.Get("flags").Unpin()
+	cache.Get("config").Unpin()
+	for i := 10; i < 15; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	cache.SyncUpdates()
+	Expect(cache.Get("flags")).To.Equal(nil)
+	Expect(cache.Get("config")).To.Equal(nil)
+}
+
+func (_ CacheTests) SetUpdatesSizeOnDelta() {
+	cache := New(Configure())
+	cache.Set("a", &SizedItem{0, 2}, time.Minute)
+	cache.Set("b", &SizedItem{0, 3}, time.Minute)
+	cache.SyncUpdates()
+	Expect(cache.GetSize()).To.Eql(5)
+	cache.Set("b", &SizedItem{0, 3}, time.Minute)
+	cache.SyncUpdates()
+	Expect(cache.GetSize()).To.Eql(5)
+	cache.Set("b", &SizedItem{0, 4}, time.Minute)
+	cache.SyncUpdates()
+	Expect(cache.GetSize()).To.Eql(6)
+	cache.Set("b", &SizedItem{0, 2}, time.Minute)
+	cache.SyncUpdates()
+	Expect(cache.GetSize()).To.Eql(4)
+	cache.Delete("b")
+	cache.SyncUpdates()
+	Expect(cache.GetSize()).To.Eql(2)
+}
+
+func (_ CacheTests) ResizeAppliesInPlaceGrowth() {
+	cache := New(Configure().MaxSize(10).ItemsToPrune(1))
+	defer cache.Stop()
+	a := &SizedItem{0, 2}
+	cache.Set("a", a, time.Minute)
+	cache.Set("b", &SizedItem{1, 3}, time.Minute)
+	cache.SyncUpdates()
+
+	a.s = 4
+	Expect(cache.Resize("a")).To.Equal(true)
+	Expect(cache.GetSize()).To.Eql(7)
+	a.s = 1
+	Expect(cache.Resize("a")).To.Equal(true)
+	Expect(cache.GetSize()).To.Eql(4)
+	Expect(cache.Resize("z")).To.Equal(false)
+
+	a.s = 8
+	cache.Resize("a")
+	Expect(cache.Get("a")).To.Equal(nil)
+	Expect(cache.GetSize()).To.Eql(3)
+}
+
+func (_ CacheTests) StrictPanicsOnMisuse() {
+	cache := New(Configure().Strict().Track())
+	item := cache.TrackingSet("spice", "flow", time.Minute)
+	item.Release()
+	Expect(panics(item.Release)).To.Equal(true)
+	Expect(panics(func() { cache.Set("worm", &SizedItem{0, -1}, time.Minute) })).To.Equal(true)
+	cache.Stop()
+	Expect(panics(func() { cache.Set("spice", "flow", time.Minute) })).To.Equal(true)
+
+	layered := Layered(Configure().Strict())
+	layered.Stop()
+	Expect(panics(func() { layered.Set("spice", "flow", "value", time.Minute) })).To.Equal(true)
+}
+
+func (_ CacheTests) UnderlayServesMissesFromMappedSnapshot() {
+	f, err := ioutil.TempFile("", "ccache")
+	Expect(err).To.Equal(nil)
+	defer os.Remove(f.Name())
+	values := map[string]interface{}{"spice": "flow", "worm": "sand", "leto": 3}
+	Expect(WriteMappedSnapshot(f, values, GobCodec{})).To.Equal(nil)
+	Expect(f.Close()).To.Equal(nil)
+
+	snapshot, err := OpenMappedSnapshot(f.Name())
+	Expect(err).To.Equal(nil)
+	defer snapshot.Close()
+	Expect(snapshot.Len()).To.Equal(3)
+
+	cache := New(Configure().Underlay(snapshot, time.Minute))
+	defer cache.Stop()
+	cache.Set("worm", "live", time.Minute)
+	Expect(cache.Get("spice").Value()).To.Equal("flow")
+	Expect(cache.Get("leto").Value()).To.Equal(3)
+	Expect(cache.Get("worm").Value()).To.Equal("live")
+	Expect(cache.Get("paul")).To.Equal(nil)
+	Expect(cache.GetWithoutPromote("spice").Value()).To.Equal("flow")
+
+	Expect(snapshot.Close()).To.Equal(nil)
+	Expect(cache.Get("ghanima")).To.Equal(nil)
+}
+
+func (_ CacheTests) OpenMappedSnapshotRejectsOtherFiles() {
+	f, err := ioutil.TempFile("", "ccache")
+	Expect(err).To.Equal(nil)
+	defer os.Remove(f.Name())
+	f.WriteString("not a snapshot, but long enough")
+	f.Close()
+	_, err = OpenMappedSnapshot(f.Name())
+	Expect(err).To.Equal(ErrMalformedSnapshot)
+}
+
+func (_ CacheTests) FrontCacheIsInvalidatedByWrites() {
+	cache := New(Configure().FrontCache(4))
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("worm", "sand", time.Minute)
+	item := cache.Get("spice")
+	Expect(cache.Get("spice")).To.Equal(item)
+	Expect(cache.Get("worm").Value()).To.Equal("sand")
+
+	cache.Set("spice", "must", time.Minute)
+	Expect(cache.Get("spice").Value()).To.Equal("must")
+	Expect(cache.Get("worm").Value()).To.Equal("sand")
+
+	cache.Delete("spice")
+	Expect(cache.Get("spice")).To.Equal(nil)
+	cache.DeletePrefix("wo")
+	Expect(cache.Get("worm")).To.Equal(nil)
+
+	cache.Set("leto", "ghanima", time.Minute)
+	Expect(cache.Get("leto").Value()).To.Equal("ghanima")
+	cache.Clear()
+	Expect(cache.Get("leto")).To.Equal(nil)
+}
+
+func (_ CacheTests) ChaosInjectsFaults() {
+	cache := New(Configure().SetBackpressure(DropOnFullBuffer))
+	defer cache.Stop()
+	cache.SetChaos(&Chaos{EvictionRate: 1})
+	cache.Set("spice", "flow", time.Minute)
+	cache.SyncUpdates()
+	Expect(cache.Get("spice")).To.Equal(nil)
+	Expect(cache.GetDropped()).To.Equal(1)
+
+	cache.SetChaos(&Chaos{FullBufferRate: 1, LatencyRate: 1, Latency: time.Millisecond})
+	cache.Set("worm", "sand", time.Minute)
+	Expect(cache.Get("worm")).To.Equal(nil)
+	Expect(cache.DroppedSets()).To.Equal(int64(1))
+
+	cache.SetChaos(nil)
+	cache.Set("leto", "ghanima", time.Minute)
+	cache.SyncUpdates()
+	Expect(cache.Get("leto").Value()).To.Equal("ghanima")
+	Expect(cache.GetDropped()).To.Equal(0)
+}
+
+func (_ CacheTests) TracksServedAges() {
+	cache := New(Configure().TrackServedAge())
+	defer cache.Stop()
+	Expect(cache.ServedAges().Percentile(0.5)).To.Equal(time.Duration(0))
+	cache.Set("spice", "flow", time.Minute)
+	cache.SetWithTimestamp("worm", "sand", time.Minute, time.Now().Add(-30*time.Second))
+	cache.SetWithTimestamp("leto", "ghanima", time.Minute, time.Now().Add(-48*time.Hour))
+	cache.Get("spice")
+	cache.Get("spice")
+	cache.Get("worm")
+	cache.Get("leto")
+	cache.Get("paul")
+
+	ages := cache.ServedAges()
+	Expect(ages.Counts[0]).To.Equal(int64(2))
+	Expect(ages.Counts[3]).To.Equal(int64(1))
+	Expect(ages.Counts[len(ages.Counts)-1]).To.Equal(int64(1))
+	Expect(ages.Max >= 48*time.Hour).To.Equal(true)
+	Expect(ages.Percentile(0.5)).To.Equal(100 * time.Millisecond)
+	Expect(ages.Percentile(0.75)).To.Equal(time.Minute)
+	Expect(ages.Percentile(1)).To.Equal(ages.Max)
+}
+
+func (_ CacheTests) DrainsHitCounts() {
+	cache := New(Configure().CountHits())
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("worm", "sand", time.Minute)
+	cache.Set("leto", "ghanima", time.Minute)
+	cache.Get("spice")
+	cache.Get("spice")
+	cache.Get("worm")
+	Expect(cache.Get("spice").Hits()).To.Equal(int64(3))
+
+	counts := cache.DrainHitCounts()
+	Expect(len(counts)).To.Equal(2)
+	Expect(counts["spice"]).To.Equal(int64(3))
+	Expect(counts["worm"]).To.Equal(int64(1))
+	Expect(cache.GetWithoutPromote("spice").Hits()).To.Equal(int64(0))
+	Expect(len(cache.DrainHitCounts())).To.Equal(0)
+}
+
+func (_ CacheTests) DecaysHitCounts() {
+	cache := New(Configure().CountHits())
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("worm", "sand", time.Minute)
+	for i := 0; i < 5; i++ {
+		cache.Get("spice")
+	}
+	cache.Get("worm")
+	cache.DecayHitCounts(0.5)
+	Expect(cache.GetWithoutPromote("spice").Hits()).To.Equal(int64(2))
+	Expect(cache.GetWithoutPromote("worm").Hits()).To.Equal(int64(0))
+
+	cache.Get("worm")
+	counts := cache.DrainHitCounts()
+	Expect(counts["spice"]).To.Equal(int64(2))
+	Expect(counts["worm"]).To.Equal(int64(1))
+}
+
+func (_ CacheTests) WorkerFavorsDeletes() {
+	cache := New(Configure().MaxSize(10).PromoteBuffer(20).DeleteBuffer(20))
+	defer cache.Stop()
+	for i := 0; i < 10; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	cache.SyncUpdates()
+
+	// with the worker paused, both queues back up. If the promotions went
+	// first, the cache would go over its max size and GC
+	resume := make(chan struct{})
+	cache.control <- pauseWorker{resume: resume}
+	for i := 0; i < 10; i++ {
+		cache.Delete(strconv.Itoa(i))
+		cache.Set(strconv.Itoa(i+10), i, time.Minute)
+	}
+	close(resume)
+	cache.SyncUpdates()
+	Expect(cache.GetDropped()).To.Equal(0)
+	Expect(cache.ItemCount()).To.Equal(10)
+}
+
+func (_ CacheTests) GCIsNotStarvedByPromotions() {
+	cache := New(Configure().MaxSize(100).ItemsToPrune(10))
+	defer cache.Stop()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				cache.Set(strconv.Itoa(i%1000), i, time.Minute)
+			}
+		}
+	}()
+	gcs := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			cache.GC()
+		}
+		close(gcs)
+	}()
+	starved := false
+	select {
+	case <-gcs:
+	case <-time.After(5 * time.Second):
+		starved = true
+	}
+	close(stop)
+	<-done
+	Expect(starved).To.Equal(false)
+}
+
+func (_ CacheTests) CircuitBreakerBypassesSaturatedCache() {
+	cache := New(Configure().PromoteBuffer(2).DeleteBuffer(1).SetBackpressure(DropOnFullBuffer).CircuitBreaker(time.Nanosecond, time.Minute))
+	defer cache.Stop()
+	cache.Set("leto", "ghanima", time.Minute)
+	cache.SyncUpdates()
+	Expect(cache.Degraded()).To.Equal(false)
+
+	resume := make(chan struct{})
+	cache.control <- pauseWorker{resume: resume}
+	for i := 0; i < 4; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+		time.Sleep(time.Microsecond)
+	}
+	Expect(cache.Degraded()).To.Equal(true)
+	// the dropped Sets filled the delete buffer, which the bypass mustn't wait on
+	Expect(len(cache.deletables)).To.Equal(1)
+	bypassed := make(chan struct{})
+	go func() {
+		cache.Set("leto", "paul", time.Minute)
+		close(bypassed)
+	}()
+	select {
+	case <-bypassed:
+	case <-time.After(time.Second):
+		Fail("the bypassed Set waited on the worker")
+	}
+	Expect(cache.Get("leto")).To.Equal(nil)
+	Expect(cache.BypassedSets()).To.Equal(int64(1))
+	close(resume)
+}
+
+func (_ CacheTests) WarmupProfileSwitchesToSteadyState() {
+	config := Configure().MaxSize(5).ItemsToPrune(1).Warmup(Profile{PauseGC: true}, 0, 8)
+	cache := New(config)
+	defer cache.Stop()
+	for i := 0; i < 7; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	cache.SyncUpdates()
+	Expect(cache.Warming()).To.Equal(true)
+	Expect(cache.GetSize()).To.Eql(7)
+	Expect(config.maxSize).To.Eql(5)
+
+	// reaching the size threshold ends the warmup
+	cache.Set("7", 7, time.Minute)
+	cache.SyncUpdates()
+	Expect(cache.Warming()).To.Equal(false)
+	Expect(cache.GetSize()).To.Eql(5)
+	Expect(cache.GetDropped()).To.Equal(3)
+}
+
+func (_ CacheTests) EndWarmupSwitchesToSteadyState() {
+	cache := New(Configure().MaxSize(5).ItemsToPrune(1).Warmup(Profile{MaxSize: 100}, time.Hour, 0))
+	defer cache.Stop()
+	for i := 0; i < 10; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	cache.SyncUpdates()
+	Expect(cache.GetSize()).To.Eql(10)
+	cache.SetMaxSize(6)
+	cache.EndWarmup()
+	Expect(cache.Warming()).To.Equal(false)
+	Expect(cache.GetSize()).To.Eql(6)
+}
+
+func (_ CacheTests) NamedCachesAreIdentifiedInCallbacks() {
+	var lock sync.Mutex
+	deleted := make(map[string]string)
+	onDelete := func(item *Item) {
+		lock.Lock()
+		deleted[item.Cache().Name+":"+item.Cache().Labels["tier"]] = item.key
+		lock.Unlock()
+	}
+	users := New(Configure().Named("users", map[string]string{"tier": "hot"}).OnDelete(onDelete))
+	defer users.Stop()
+	sessions := Layered(Configure().Named("sessions", nil).OnDelete(onDelete))
+	defer sessions.Stop()
+
+	users.Set("leto", 1, time.Minute)
+	sessions.Set("paul", "a", 2, time.Minute)
+	users.SyncUpdates()
+	sessions.SyncUpdates()
+	users.Delete("leto")
+	sessions.Delete("paul", "a")
+	users.SyncUpdates()
+	sessions.SyncUpdates()
+
+	lock.Lock()
+	defer lock.Unlock()
+	Expect(deleted["users:hot"]).To.Equal("leto")
+	Expect(deleted["sessions:"]).To.Equal("a")
+}
+
+func (_ CacheTests) FetchCoalescesConcurrentMisses() {
+	cache := New(Configure())
+	defer cache.Stop()
+	calls := int32(0)
+	release := make(chan struct{})
+	fetch := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "flow", nil
+	}
+
+	var wg sync.WaitGroup
+	items := make([]*Item, 10)
+	for i := range items {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			items[i], _ = cache.Fetch("spice", time.Minute, fetch)
+		}(i)
+	}
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	Expect(atomic.LoadInt32(&calls)).To.Equal(int32(1))
+	for _, item := range items {
+		Expect(item.Value()).To.Equal("flow")
+	}
+}
+
+func (_ CacheTests) FetchStaleServesExpiredItemsWhileRefreshing() {
+	cache := New(Configure().StaleWhileRevalidate(time.Minute))
+	defer cache.Stop()
+	cache.Set("spice", "old", -time.Second)
+
+	release := make(chan struct{})
+	item, err := cache.FetchStale("spice", time.Minute, 0, func() (interface{}, error) {
+		<-release
+		return "new", nil
+	})
+	Expect(err).To.Equal(nil)
+	Expect(item.Value()).To.Equal("old")
+	close(release)
+	cache.refreshes.wg.Wait()
+	Expect(cache.Get("spice").Value()).To.Equal("new")
+
+	// past the (per call) window, it's a blocking fetch
+	cache.Set("worm", "old", -time.Minute)
+	item, _ = cache.FetchStale("worm", time.Minute, time.Second, func() (interface{}, error) {
+		return "new", nil
+	})
+	Expect(item.Value()).To.Equal("new")
+}
+
+func (_ CacheTests) FetchStaleKeepsTheStaleItemOnError() {
+	cache := New(Configure())
+	defer cache.Stop()
+	cache.Set("spice", "old", -time.Second)
+	item, err := cache.FetchStale("spice", time.Minute, time.Minute, func() (interface{}, error) {
+		return nil, errors.New("down")
+	})
+	Expect(err).To.Equal(nil)
+	Expect(item.Value()).To.Equal("old")
+	cache.refreshes.wg.Wait()
+	Expect(cache.Get("spice").Value()).To.Equal("old")
+}
+
+func (_ CacheTests) FetchStaleSurvivesAPanickingRefresh() {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	cache := New(Configure())
+	defer cache.Stop()
+	cache.Set("spice", "old", -time.Second)
+	item, err := cache.FetchStale("spice", time.Minute, time.Minute, func() (interface{}, error) {
+		panic("down")
+	})
+	Expect(err).To.Equal(nil)
+	Expect(item.Value()).To.Equal("old")
+	cache.refreshes.wg.Wait()
+	Expect(strings.Contains(logged.String(), `the background refresh of "spice" panicked: down`)).To.Equal(true)
+
+	// nothing is refreshed once the cache is stopping
+	cache.refreshes.stop()
+	cache.FetchStale("spice", time.Minute, time.Minute, func() (interface{}, error) {
+		panic("stopped")
+	})
+	cache.refreshes.wg.Wait()
+	Expect(strings.Contains(logged.String(), "stopped")).To.Equal(false)
+}
+
+func (_ CacheTests) SoftTTLServesStaleItemsUntilTheHardTTL() {
+	cache := New(Configure())
+	defer cache.Stop()
+	cache.SetWithSoftTTL("spice", "flow", time.Minute, time.Hour)
+	Expect(cache.Get("spice").Stale()).To.Equal(false)
+
+	cache.SetWithSoftTTL("spice", "old", -time.Second, time.Hour)
+	item := cache.Get("spice")
+	Expect(item.Value()).To.Equal("old")
+	Expect(item.Stale()).To.Equal(true)
+	Expect(item.Expired()).To.Equal(false)
+
+	release := make(chan struct{})
+	item, _ = cache.FetchStale("spice", time.Minute, 0, func() (interface{}, error) {
+		<-release
+		return "new", nil
+	})
+	Expect(item.Value()).To.Equal("old")
+	close(release)
+	cache.refreshes.wg.Wait()
+	Expect(cache.Get("spice").Stale()).To.Equal(false)
+
+	cache.SetWithSoftTTL("spice", "old", -time.Minute, -time.Second)
+	Expect(cache.Get("spice")).To.Equal(nil)
+	item, _ = cache.Fetch("spice", time.Minute, func() (interface{}, error) {
+		return "new", nil
+	})
+	Expect(item.Value()).To.Equal("new")
+}
+
+func (_ CacheTests) EarlyExpirationRefreshesSlowFetchesEarly() {
+	cache := New(Configure().EarlyExpiration(1))
+	defer cache.Stop()
+	fetches := 0
+	fetch := func() (interface{}, error) {
+		fetches++
+		return fetches, nil
+	}
+	item, _ := cache.Fetch("spice", time.Minute, fetch)
+	Expect(item.Value()).To.Equal(1)
+	// a fast fetch, far from its expiry
+	item, _ = cache.Fetch("spice", time.Minute, fetch)
+	Expect(item.Value()).To.Equal(1)
+
+	// a fetch so slow that the refresh is all but certain
+	atomic.StoreInt64(&item.delta, int64(time.Hour*1000000))
+	item, _ = cache.Fetch("spice", time.Minute, fetch)
+	Expect(item.Value()).To.Equal(2)
+}
+
+func (_ CacheTests) FetchContextWaitersGiveUpWithoutCancellingTheLoad() {
+	cache := New(Configure())
+	defer cache.Stop()
+	started, release := make(chan struct{}), make(chan struct{})
+	fetch := func(ctx context.Context) (interface{}, error) {
+		close(started)
+		select {
+		case <-release:
+			return "flow", nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	result := make(chan *Item)
+	go func() {
+		item, _ := cache.FetchContext(context.Background(), "spice", time.Minute, fetch)
+		result <- item
+	}()
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	item, err := cache.FetchContext(ctx, "spice", time.Minute, fetch)
+	Expect(item).To.Equal(nil)
+	Expect(err).To.Equal(context.Canceled)
+
+	close(release)
+	Expect((<-result).Value()).To.Equal("flow")
+}
+
+func (_ CacheTests) FetchContextCancelsTheLoadOnceEveryoneGaveUp() {
+	cache := New(Configure())
+	defer cache.Stop()
+	cancelled := make(chan error)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	_, err := cache.FetchContext(ctx, "spice", time.Minute, func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return nil, ctx.Err()
+	})
+	Expect(err).To.Equal(context.DeadlineExceeded)
+	Expect(<-cancelled).To.Equal(context.Canceled)
+
+	item, err := cache.FetchContext(context.Background(), "spice", time.Minute, func(ctx context.Context) (interface{}, error) {
+		return "flow", nil
+	})
+	Expect(err).To.Equal(nil)
+	Expect(item.Value()).To.Equal("flow")
+}
+
+func (_ CacheTests) FetchWithTTLUsesTheLoadedTTL() {
+	cache := New(Configure())
+	defer cache.Stop()
+	item, err := cache.FetchWithTTL("spice", func() (interface{}, time.Duration, error) {
+		return "flow", time.Hour, nil
+	})
+	Expect(err).To.Equal(nil)
+	Expect(item.Value()).To.Equal("flow")
+	Expect(cache.Get("spice").TTL() > 59*time.Minute).To.Equal(true)
+
+	item, err = cache.FetchWithTTL("worm", func() (interface{}, time.Duration, error) {
+		return nil, 0, errors.New("nope")
+	})
+	Expect(item).To.Equal(nil)
+	Expect(err.Error()).To.Equal("nope")
+	Expect(cache.Get("worm")).To.Equal(nil)
+}
+
+func (_ CacheTests) MultiFetchLoadsTheMissingKeysInOneCall() {
+	cache := New(Configure())
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("worm", "old", -time.Minute)
+
+	var requested []string
+	items, err := cache.MultiFetch([]string{"spice", "worm", "leto", "paul", "leto"}, time.Minute, func(missing []string) (map[string]interface{}, error) {
+		requested = missing
+		return map[string]interface{}{"worm": "sand", "leto": "ghanima", "spice": "melange", "duncan": "idaho"}, nil
+	})
+	Expect(err).To.Equal(nil)
+	Expect(requested).To.Equal([]string{"worm", "leto", "paul"})
+	Expect(len(items)).To.Equal(3)
+	Expect(items["spice"].Value()).To.Equal("flow")
+	Expect(items["worm"].Value()).To.Equal("sand")
+	Expect(items["leto"].Value()).To.Equal("ghanima")
+	Expect(cache.Get("leto").Value()).To.Equal("ghanima")
+	Expect(cache.Get("paul")).To.Equal(nil)
+	// the keys which weren't missing aren't cached
+	Expect(cache.Get("spice").Value()).To.Equal("flow")
+	Expect(cache.Get("duncan")).To.Equal(nil)
+
+	items, err = cache.MultiFetch([]string{"spice", "duncan"}, time.Minute, func(missing []string) (map[string]interface{}, error) {
+		return nil, errors.New("nope")
+	})
+	Expect(err.Error()).To.Equal("nope")
+	Expect(len(items)).To.Equal(1)
+	Expect(items["spice"].Value()).To.Equal("flow")
+}
+
+func (_ CacheTests) FetchSharesPanicsAsErrors() {
+	cache := New(Configure())
+	defer cache.Stop()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	panicked := make(chan interface{})
+	go func() {
+		defer func() { panicked <- recover() }()
+		cache.Fetch("spice", time.Minute, func() (interface{}, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+	errs := make(chan error)
+	go func() {
+		_, err := cache.Fetch("spice", time.Minute, func() (interface{}, error) {
+			return "unused", nil
+		})
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	Expect(<-panicked).To.Equal("boom")
+	Expect(<-errs).To.Equal(ErrFetchPanicked)
+
+	item, err := cache.Fetch("spice", time.Minute, func() (interface{}, error) {
+		return "flow", nil
+	})
+	Expect(err).To.Equal(nil)
+	Expect(item.Value()).To.Equal("flow")
+}
+
+func (_ CacheTests) KeysWithPrefix() {
+	cache := New(Configure())
+	defer cache.Stop()
+	cache.Set("user:2", 2, time.Minute)
+	cache.Set("user:1", 1, time.Minute)
+	cache.Set("users", 0, time.Minute)
+	cache.Set("role:1", 1, time.Minute)
+	Expect(cache.KeysWithPrefix("user:", 0)).To.Equal([]string{"user:1", "user:2"})
+	Expect(cache.KeysWithPrefix("user", 0)).To.Equal([]string{"user:1", "user:2", "users"})
+	Expect(len(cache.KeysWithPrefix("user", 2))).To.Equal(2)
+	Expect(cache.KeysWithPrefix("group", 0)).To.Equal([]string{})
+}
+
+func (_ CacheTests) RangeKeys() {
+	for _, config := range []*Configuration{Configure(), Configure().OrderedIndex()} {
+		cache := New(config.MaxSize(5).ItemsToPrune(1))
+		for i := 1; i <= 6; i++ {
+			cache.Set("event:"+strconv.Itoa(i), i, time.Minute)
+		}
+		cache.Set("event:3", 33, time.Minute)
+		cache.SyncUpdates()
+		// event:1 was GC'd
+		Expect(cache.RangeKeys("event:", "")).To.Equal([]string{"event:2", "event:3", "event:4", "event:5", "event:6"})
+		Expect(cache.RangeKeys("event:3", "event:5")).To.Equal([]string{"event:3", "event:4"})
+
+		cache.Delete("event:4")
+		cache.DeletePrefix("event:6")
+		Expect(cache.RangeKeys("event:3", "")).To.Equal([]string{"event:3", "event:5"})
+		cache.Clear()
+		Expect(cache.RangeKeys("", "")).To.Equal([]string{})
+		cache.Stop()
+	}
+}
+
+func (_ CacheTests) RangeKeysPageContinuesWhereItStopped() {
+	for _, config := range []*Configuration{Configure(), Configure().OrderedIndex()} {
+		cache := New(config.MaxBulkResults(3))
+		for i := 0; i < 10; i++ {
+			cache.Set("event:"+strconv.Itoa(i), i, time.Minute)
+		}
+		cache.SyncUpdates()
+		keys, next := cache.RangeKeysPage("event:", "", 2)
+		Expect(keys).To.Equal([]string{"event:0", "event:1"})
+		Expect(next).To.Equal("event:2")
+		keys, next = cache.RangeKeysPage(next, "event:8", 0)
+		Expect(keys).To.Equal([]string{"event:2", "event:3", "event:4"})
+		keys, next = cache.RangeKeysPage(next, "event:8", 5)
+		Expect(keys).To.Equal([]string{"event:5", "event:6", "event:7"})
+		Expect(next).To.Equal("")
+
+		Expect(cache.RangeKeys("", "")).To.Equal([]string{"event:0", "event:1", "event:2"})
+		Expect(len(cache.KeysWithPrefix("event:", 0))).To.Equal(3)
+		cache.Stop()
+	}
+}
+
+func (_ CacheTests) OrderedIndexStaysSortedUnderChurn() {
+	cache := New(Configure().OrderedIndex().MaxSize(100))
+	defer cache.Stop()
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i * 7919 % 1000)
+		cache.Set(key, i, time.Minute)
+		if i%3 == 0 {
+			cache.Delete(strconv.Itoa(i))
+		}
+	}
+	cache.SyncUpdates()
+	var expected []string
+	cache.ForEachFunc(func(key string, item *Item) bool {
+		expected = append(expected, key)
+		return true
+	})
+	sort.Strings(expected)
+	Expect(cache.RangeKeys("", "")).To.Equal(expected)
+}
+
+func (_ CacheTests) SetTTLWhere() {
+	cache := New(Configure())
+	defer cache.Stop()
+	cache.Set("spice", "flow", -time.Minute)
+	cache.Set("worm", "sand", -time.Minute)
+	cache.Set("leto", "ghanima", time.Minute)
+
+	updated := cache.SetTTLWhere(func(key string, item *Item) bool {
+		return item.Expired()
+	}, time.Hour)
+	Expect(updated).To.Equal(2)
+	Expect(cache.Get("spice").Expired()).To.Equal(false)
+	Expect(cache.Get("worm").TTL() > 59*time.Minute).To.Equal(true)
+	Expect(cache.Get("leto").TTL() <= time.Minute).To.Equal(true)
+}
+
+func (_ CacheTests) FreezeStopsEvictionsAndExpirations() {
+	cache := New(Configure().MaxSize(2).ItemsToPrune(1).ServeStaleFor(time.Millisecond))
+	defer cache.Stop()
+	cache.Freeze()
+	Expect(cache.Frozen()).To.Equal(true)
+	cache.Set("spice", "flow", -time.Minute)
+	cache.Set("worm", "sand", time.Minute)
+	cache.Set("leto", "ghanima", time.Minute)
+	cache.SyncUpdates()
+	cache.GC()
+	Expect(cache.PurgeExpired()).To.Equal(0)
+	Expect(cache.GetDropped()).To.Equal(0)
+	Expect(cache.ItemCount()).To.Equal(3)
+
+	Expect(cache.Get("spice").Value()).To.Equal("flow")
+	item, _ := cache.Fetch("spice", time.Minute, func() (interface{}, error) {
+		return "new", nil
+	})
+	Expect(item.Value()).To.Equal("flow")
+
+	cache.Unfreeze()
+	Expect(cache.Frozen()).To.Equal(false)
+	Expect(cache.GetDropped()).To.Equal(1)
+	Expect(cache.GetSize()).To.Equal(int64(2))
+	Expect(cache.Get("spice")).To.Equal(nil)
+}
+
+func (_ CacheTests) DetectMutationsReportsValuesChangedInPlace() {
+	type user struct{ Name string }
+	gob.Register(&user{})
+	var mutated []string
+	cache := New(Configure().MaxSize(2).ItemsToPrune(1).DetectMutations(func(item *Item) {
+		mutated = append(mutated, item.key)
+	}))
+	defer cache.Stop()
+	cache.Set("leto", &user{"Leto"}, time.Minute)
+	cache.Set("paul", &user{"Paul"}, time.Minute)
+	cache.Get("leto").Value().(*user).Name = "God Emperor"
+	cache.Delete("paul")
+	cache.Delete("leto")
+	cache.SyncUpdates()
+	Expect(mutated).To.Equal([]string{"leto"})
+}
+
+func (_ CacheTests) StatsCountOperations() {
+	cache := New(Configure().MaxSize(3).ItemsToPrune(1))
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("worm", "sand", -time.Minute)
+	cache.Get("spice")
+	cache.Get("worm")
+	cache.Get("leto")
+	cache.Replace("spice", "must")
+	cache.Replace("leto", "ghanima")
+	cache.Fetch("leto", time.Minute, func() (interface{}, error) { return "ghanima", nil })
+	cache.SyncUpdates()
+	cache.Delete("spice")
+	cache.Delete("spice")
+	cache.PurgeExpired()
+	cache.Set("paul", "alia", time.Minute)
+	cache.Set("duncan", "idaho", time.Minute)
+	cache.Set("chani", "kynes", time.Minute)
+	cache.SyncUpdates()
+
+	stats := cache.Stats()
+	Expect(stats).To.Equal(Stats{
+		Gets: 4, Hits: 1, Misses: 3, Sets: 6, Replaces: 1,
+		Deletes: 1, Evictions: 1, Expirations: 1,
+	})
+	Expect(stats.HitRatio()).To.Equal(0.25)
+
+	cache.ResetStats()
+	Expect(cache.Stats()).To.Equal(Stats{})
+	Expect(cache.Stats().HitRatio()).To.Equal(0.0)
+}
+
+func (_ CacheTests) StatsDoNotCountRejectedSets() {
+	cache := New(Configure().NonPositiveTTL(RejectNonPositiveTTL, 0).MaxItemSize(5, nil))
+	defer cache.Stop()
+	cache.Set("spice", "flow", 0)
+	cache.SetWithSize("worm", "sand", 10, time.Minute)
+	cache.TrackingSet("leto", "ghanima", -time.Minute)
+	cache.Fetch("paul", 0, func() (interface{}, error) { return "alia", nil })
+	Expect(cache.Stats().Sets).To.Eql(0)
+
+	cache.Set("spice", "flow", time.Minute)
+	cache.SetWithSize("worm", "sand", 1, time.Minute)
+	Expect(cache.Stats().Sets).To.Eql(2)
+}
+
+func (_ CacheTests) StatsRecordClears() {
+	cache := New(Configure())
+	defer cache.Stop()
+	Expect(cache.Stats().LastClear.IsZero()).To.Equal(true)
+	before := time.Now()
+	cache.Clear()
+	cache.Clear()
+
+	stats := cache.Stats()
+	Expect(stats.Clears).To.Eql(2)
+	Expect(stats.LastClear.Before(before)).To.Equal(false)
+	Expect(stats.LastClear.After(time.Now())).To.Equal(false)
+
+	cache.ResetStats()
+	Expect(cache.Stats().Clears).To.Eql(0)
+	Expect(cache.Stats().LastClear).To.Equal(stats.LastClear)
+}
+
+func (_ CacheTests) PublishesExpvars() {
+	for i := 0; i < 2; i++ {
+		cache := New(Configure().PublishExpvar("ccache-test"))
+		cache.Set("spice", "flow", time.Minute)
+		cache.Get("spice")
+		cache.Get("worm")
+		cache.SyncUpdates()
+		var vars map[string]interface{}
+		Expect(json.Unmarshal([]byte(expvar.Get("ccache-test").String()), &vars)).To.Equal(nil)
+		Expect(vars["items"]).To.Equal(1.0)
+		Expect(vars["size"]).To.Equal(1.0)
+		Expect(vars["hit_ratio"]).To.Equal(0.5)
+		Expect(vars["dropped"]).To.Equal(0.0)
+
+		// reading the vars while the cache stops doesn't reach its worker
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for j := 0; j < 100; j++ {
+				_ = expvar.Get("ccache-test").String()
+			}
+		}()
+		cache.Stop()
+		<-done
+
+		Expect(json.Unmarshal([]byte(expvar.Get("ccache-test").String()), &vars)).To.Equal(nil)
+		Expect(vars["items"]).To.Equal(0.0)
+		Expect(vars["size"]).To.Equal(0.0)
+	}
+}
+
+func (_ CacheTests) ResumeGCSkipsPastTrackedItems() {
+	for _, resume := range []bool{false, true} {
+		config := Configure().Track().MaxSize(6).ItemsToPrune(3)
+		if resume {
+			config.ResumeGC()
+		}
+		cache := New(config)
+		for i := 0; i < 3; i++ {
+			cache.TrackingSet(strconv.Itoa(i), i, time.Minute)
+		}
+		for i := 3; i < 6; i++ {
+			cache.Set(strconv.Itoa(i), i, time.Minute)
+		}
+		cache.SyncUpdates()
+		// the first GC only walks the tracked items
+		cache.GC()
+		Expect(cache.GetDropped()).To.Equal(0)
+		cache.GC()
+		if resume {
+			Expect(cache.GetDropped()).To.Equal(3)
+		} else {
+			Expect(cache.GetDropped()).To.Equal(0)
+		}
+		cache.Stop()
+	}
+}
+
+func (_ CacheTests) ResumeGCForgetsAMovedCursor() {
+	cache := New(Configure().Track().MaxSize(6).ItemsToPrune(3).GetsPerPromote(1).ResumeGC())
+	defer cache.Stop()
+	for i := 0; i < 3; i++ {
+		cache.TrackingSet(strconv.Itoa(i), i, time.Minute)
+	}
+	for i := 3; i < 6; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	cache.SyncUpdates()
+	// resumes from 3 next time, but 3 is then moved to the front
+	cache.GC()
+	cache.Get("3")
+	cache.SyncUpdates()
+	cache.GC()
+	Expect(cache.GetDropped()).To.Equal(0)
+	Expect(cache.Get("3").Value()).To.Equal(3)
+}
+
+type recordedOperation struct {
+	op      Operation
+	key     string
+	hit     bool
+	err     error
+	traceID interface{}
+}
+
+type recordingInstrumentation struct {
+	operations []recordedOperation
+}
+
+func (r *recordingInstrumentation) Start(ctx context.Context, op Operation, key string) func(Outcome) {
+	return func(outcome Outcome) {
+		r.operations = append(r.operations, recordedOperation{op, key, outcome.Hit, outcome.Err, ctx.Value("trace")})
+	}
+}
+
+func (_ CacheTests) InstrumentationObservesOperations() {
+	recorder := new(recordingInstrumentation)
+	cache := New(Configure().Instrument(recorder))
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Minute)
+	cache.Get("spice")
+	cache.Get("worm")
+	cache.Fetch("spice", time.Minute, nil)
+	ctx := context.WithValue(context.Background(), "trace", "t1")
+	cache.FetchContext(ctx, "worm", time.Minute, func(ctx context.Context) (interface{}, error) {
+		return nil, errors.New("nope")
+	})
+	cache.Delete("spice")
+	cache.Delete("spice")
+	cache.Clear()
+	Expect(recorder.operations).To.Equal([]recordedOperation{
+		{OperationSet, "spice", false, nil, nil},
+		{OperationGet, "spice", true, nil, nil},
+		{OperationGet, "worm", false, nil, nil},
+		{OperationFetch, "spice", true, nil, nil},
+		{OperationFetch, "worm", false, errors.New("nope"), "t1"},
+		{OperationDelete, "spice", true, nil, nil},
+		{OperationDelete, "spice", false, nil, nil},
+		{OperationClear, "", false, nil, nil},
+	})
+}
+
+func (_ CacheTests) SwapAllReplacesTheContent() {
+	cache := New(Configure().MaxSize(3).ItemsToPrune(1).OrderedIndex())
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("worm", "sand", time.Minute)
+	cache.SyncUpdates()
+
+	cache.SwapAll(map[string]ValueTTL{
+		"leto": {"ghanima", time.Minute},
+		"paul": {"alia", time.Hour},
+	})
+	Expect(cache.Get("spice")).To.Equal(nil)
+	Expect(cache.Get("leto").Value()).To.Equal("ghanima")
+	Expect(cache.Get("paul").TTL() > 59*time.Minute).To.Equal(true)
+	Expect(cache.ItemCount()).To.Equal(2)
+	Expect(cache.GetSize()).To.Equal(int64(2))
+	Expect(cache.RangeKeys("", "")).To.Equal([]string{"leto", "paul"})
+
+	// the max size still applies
+	cache.SwapAll(map[string]ValueTTL{
+		"a": {1, time.Minute}, "b": {2, time.Minute}, "c": {3, time.Minute}, "d": {4, time.Minute},
+	})
+	Expect(cache.GetSize()).To.Equal(int64(3))
+	Expect(cache.GetDropped()).To.Equal(1)
+}
+
+func (_ CacheTests) SwapAllSpreadsTheExpiries() {
+	cache := New(Configure().TTLJitter(0.1).NonPositiveTTL(FallbackNonPositiveTTL, time.Minute))
+	defer cache.Stop()
+	items := make(map[string]ValueTTL, 100)
+	for i := 0; i < 100; i++ {
+		items[strconv.Itoa(i)] = ValueTTL{i, time.Minute}
+	}
+	items["spice"] = ValueTTL{"flow", 0}
+	cache.SwapAll(items)
+
+	min, max := time.Hour, time.Duration(0)
+	for i := 0; i < 100; i++ {
+		ttl, _ := cache.TTL(strconv.Itoa(i))
+		if ttl < min {
+			min = ttl
+		}
+		if ttl > max {
+			max = ttl
+		}
+	}
+	Expect(min > time.Second*53).To.Equal(true)
+	Expect(max <= time.Second*66).To.Equal(true)
+	Expect(max-min > time.Second).To.Equal(true)
+	ttl, _ := cache.TTL("spice")
+	Expect(ttl > time.Second*53).To.Equal(true)
+}
+
+func (_ CacheTests) SaveAndLoad() {
+	cache := New(Configure())
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("worm", 9001, time.Hour)
+	cache.Set("leto", "ghanima", -time.Minute)
+	cache.SyncUpdates()
+	cache.Get("spice")
+	cache.Get("spice")
+	cache.Get("spice")
+	cache.SyncUpdates()
+
+	var buf bytes.Buffer
+	Expect(cache.Save(&buf)).To.Equal(nil)
+	cache.Stop()
+
+	restored := New(Configure().MaxSize(2).ItemsToPrune(1))
+	defer restored.Stop()
+	Expect(restored.Load(&buf)).To.Equal(nil)
+	restored.SyncUpdates()
+	Expect(restored.Get("leto")).To.Equal(nil)
+	Expect(restored.Get("spice").Value()).To.Equal("flow")
+	Expect(restored.Get("spice").TTL() <= time.Minute).To.Equal(true)
+	Expect(restored.Get("worm").Value()).To.Equal(9001)
+	Expect(restored.Get("worm").TTL() > 59*time.Minute).To.Equal(true)
+
+	// spice was the most recently used
+	restored.Set("paul", "alia", time.Minute)
+	restored.SyncUpdates()
+	Expect(restored.Get("worm")).To.Equal(nil)
+	Expect(restored.Get("spice").Value()).To.Equal("flow")
+}
+
+func (_ CacheTests) LoadRejectsMalformedInput() {
+	cache := New(Configure())
+	defer cache.Stop()
+	Expect(cache.Load(strings.NewReader("nope"))).To.Equal(ErrMalformedSave)
+	Expect(cache.Load(strings.NewReader(savedMagic + "\x01\x00\x00\x00\x00\x00\x00\x00\x05"))).To.Equal(ErrMalformedSave)
+	// a corrupt length, larger than the input, isn't allocated upfront
+	Expect(cache.Load(strings.NewReader(savedMagic + "\x01\x00\x00\x00\x00\x00\x00\x00\xff\xff\xff\xff"))).To.Equal(ErrMalformedSave)
+	Expect(cache.Load(strings.NewReader(savedMagic + "\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01spice"))).To.Equal(ErrMalformedSave)
+}
+
+func (_ CacheTests) SaveIncludesPendingSets() {
+	cache := New(Configure())
+	defer cache.Stop()
+	resume := make(chan struct{})
+	cache.control <- pauseWorker{resume: resume}
+	cache.Set("spice", "flow", time.Minute)
+	close(resume)
+	var buf bytes.Buffer
+	Expect(cache.Save(&buf)).To.Equal(nil)
+
+	restored := New(Configure())
+	defer restored.Stop()
+	Expect(restored.Load(&buf)).To.Equal(nil)
+	Expect(restored.Get("spice").Value()).To.Equal("flow")
+}
+
+func (_ CacheTests) AutoSnapshotRestoresTheCache() {
+	dir, _ := ioutil.TempDir("", "ccache")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.snapshot")
+
+	cache := New(Configure().AutoSnapshot(path, 5*time.Millisecond))
+	cache.Set("spice", "flow", time.Minute)
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	restored := New(Configure())
+	Expect(restored.LoadFile(path)).To.Equal(nil)
+	Expect(restored.Get("spice").Value()).To.Equal("flow")
+	restored.Stop()
+
+	// Stop takes a last snapshot
+	cache.Set("worm", 9001, time.Minute)
+	cache.Stop()
+	cache = New(Configure().AutoSnapshot(path, 0))
+	Expect(cache.Get("spice").Value()).To.Equal("flow")
+	Expect(cache.Get("worm").Value()).To.Equal(9001)
+	cache.Stop()
+
+	entries, _ := ioutil.ReadDir(dir)
+	Expect(len(entries)).To.Equal(1)
+}
+
+func (_ CacheTests) WriteAheadLogIsReplayed() {
+	dir, _ := ioutil.TempDir("", "ccache")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.wal")
+
+	cache := New(Configure().WriteAheadLog(path))
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("worm", 9001, time.Minute)
+	cache.Set("leto", "ghanima", time.Minute)
+	cache.Delete("worm")
+	cache.Set("paul", "alia", -time.Minute)
+	// enough changes to be compacted
+	for i := 0; i < walCompactMin; i++ {
+		cache.Set("count", i, time.Minute)
+	}
+	cache.Stop()
+
+	info, _ := os.Stat(path)
+	Expect(info.Size() < 1024).To.Equal(true)
+
+	// a torn record, left by a crash, is ignored
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	file.Write([]byte{byte(ChangeDelete), 5, 0})
+	file.Close()
+
+	cache = New(Configure().WriteAheadLog(path))
+	Expect(cache.Get("spice").Value()).To.Equal("flow")
+	Expect(cache.Get("leto").Value()).To.Equal("ghanima")
+	Expect(cache.Get("count").Value()).To.Equal(walCompactMin - 1)
+	Expect(cache.Get("worm")).To.Equal(nil)
+	Expect(cache.Get("paul")).To.Equal(nil)
+	cache.Clear()
+	cache.Stop()
+
+	cache = New(Configure().WriteAheadLog(path))
+	defer cache.Stop()
+	Expect(cache.ItemCount()).To.Equal(0)
+}
+
+func (_ CacheTests) ChangeFeedRecordsSetsAndDeletes() {
+	cache := New(Configure().ChangeFeed(3))
+	defer cache.Stop()
+	plain := New(Configure())
+	defer plain.Stop()
+	_, err := plain.ChangesSince(0, 0)
+	Expect(err).To.Equal(ErrNoChangeFeed)
+
+	cache.Set("spice", "flow", time.Minute)
+	cache.Delete("spice")
+	cache.Delete("spice")
+	cache.Set("worm", 9001, time.Minute)
+	Expect(cache.LastChange()).To.Equal(uint64(3))
+
+	changes, err := cache.ChangesSince(0, 0)
+	Expect(err).To.Equal(nil)
+	Expect(len(changes)).To.Equal(3)
+	Expect(changes[0].Seq).To.Equal(uint64(1))
+	Expect(changes[0].Op).To.Equal(ChangeSet)
+	Expect(changes[0].Key).To.Equal("spice")
+	value, _ := unmarshalValue(cache.codec, changes[0].Value)
+	Expect(value).To.Equal("flow")
+	Expect(changes[1].Op).To.Equal(ChangeDelete)
+	Expect(changes[1].Value).To.Equal(nil)
+	Expect(changes[2].Key).To.Equal("worm")
+
+	changes, _ = cache.ChangesSince(1, 1)
+	Expect(len(changes)).To.Equal(1)
+	Expect(changes[0].Seq).To.Equal(uint64(2))
+
+	cache.Clear()
+	changes, _ = cache.ChangesSince(3, 0)
+	Expect(changes[0].Op).To.Equal(ChangeClear)
+
+	_, err = cache.ChangesSince(0, 0)
+	Expect(err).To.Equal(ErrChangesTruncated)
+	_, err = cache.ChangesSince(5, 0)
+	Expect(err).To.Equal(ErrChangesTruncated)
+}
+
+func (_ CacheTests) ApplyChangesReplicatesTheCache() {
+	primary := New(Configure().ChangeFeed(10))
+	defer primary.Stop()
+	replica := New(Configure())
+	defer replica.Stop()
+
+	primary.Set("spice", "flow", time.Minute)
+	primary.Set("worm", 9001, time.Minute)
+	changes, _ := primary.ChangesSince(0, 0)
+	seq, err := replica.ApplyChanges(changes)
+	Expect(err).To.Equal(nil)
+	Expect(seq).To.Equal(uint64(2))
+	Expect(replica.Get("spice").Value()).To.Equal("flow")
+	Expect(replica.Get("worm").Value()).To.Equal(9001)
+	Expect(replica.Get("worm").TTL() > 59*time.Second).To.Equal(true)
+
+	primary.Delete("spice")
+	primary.Set("worm", 9002, time.Minute)
+	changes, _ = primary.ChangesSince(0, 0)
+	// already applied changes are skipped
+	seq, err = replica.ApplyChanges(changes)
+	Expect(err).To.Equal(nil)
+	Expect(seq).To.Equal(uint64(4))
+	Expect(replica.Get("spice")).To.Equal(nil)
+	Expect(replica.Get("worm").Value()).To.Equal(9002)
+
+	primary.Set("leto", "ghanima", time.Minute)
+	primary.Clear()
+	changes, _ = primary.ChangesSince(5, 0)
+	seq, err = replica.ApplyChanges(changes)
+	Expect(err).To.Equal(ErrChangesMissing)
+	Expect(seq).To.Equal(uint64(4))
+	changes, _ = primary.ChangesSince(4, 0)
+	replica.ApplyChanges(changes)
+	Expect(replica.ItemCount()).To.Equal(0)
+}
 
-	Expect(cache.DeleteFunc(func(key string, item *Item) bool {
-		return key == "d"
-	})).To.Equal(1)
-	Expect(cache.ItemCount()).To.Equal(2)
+func (_ CacheTests) ResetAppliedFollowsARestartedPrimary() {
+	replica := New(Configure())
+	defer replica.Stop()
+	primary := New(Configure().ChangeFeed(10))
+	primary.Set("spice", "flow", time.Minute)
+	primary.Set("worm", "sand", time.Minute)
+	changes, _ := primary.ChangesSince(0, 0)
+	replica.ApplyChanges(changes)
+	primary.Stop()
+
+	primary = New(Configure().ChangeFeed(10))
+	defer primary.Stop()
+	primary.Set("leto", "ghanima", time.Minute)
+	changes, _ = primary.ChangesSince(0, 0)
+	// skipped, as if it had been applied already
+	seq, _ := replica.ApplyChanges(changes)
+	Expect(seq).To.Equal(uint64(2))
+	Expect(replica.Get("leto")).To.Equal(nil)
 
+	replica.ResetApplied(0)
+	seq, err := replica.ApplyChanges(changes)
+	Expect(err).To.Equal(nil)
+	Expect(seq).To.Equal(uint64(1))
+	Expect(replica.Get("leto").Value()).To.Equal("ghanima")
 }
 
-func (_ CacheTests) OnDeleteCallbackCalled() {
-	onDeleteFnCalled := int32(0)
-	onDeleteFn := func(item *Item) {
-		if item.key == "spice" {
-			atomic.AddInt32(&onDeleteFnCalled, 1)
+func (_ CacheTests) WarmBulkLoadsItems() {
+	cache := New(Configure().MaxSize(2000).ItemsToPrune(1))
+	defer cache.Stop()
+	err := cache.Warm(context.Background(), func(emit func(key string, value interface{}, ttl time.Duration)) error {
+		for i := 0; i < 2500; i++ {
+			emit(strconv.Itoa(i), i, time.Minute)
 		}
-	}
-
-	cache := New(Configure().OnDelete(onDeleteFn))
-	cache.Set("spice", "flow", time.Minute)
-	cache.Set("worm", "sand", time.Minute)
+		return nil
+	})
+	Expect(err).To.Equal(nil)
+	Expect(cache.GetSize()).To.Equal(int64(2000))
+	Expect(cache.Get("0")).To.Equal(nil)
+	Expect(cache.Get("2499").Value()).To.Equal(2499)
 
-	cache.SyncUpdates() // wait for worker to pick up preceding updates
+	ctx, cancel := context.WithCancel(context.Background())
+	err = cache.Warm(ctx, func(emit func(key string, value interface{}, ttl time.Duration)) error {
+		emit("spice", "flow", time.Minute)
+		cancel()
+		emit("worm", "sand", time.Minute)
+		return nil
+	})
+	Expect(err).To.Equal(context.Canceled)
+	Expect(cache.Get("spice").Value()).To.Equal("flow")
+	Expect(cache.Get("worm")).To.Equal(nil)
+}
 
-	cache.Delete("spice")
+func (_ CacheTests) LFUKeepsFrequentlyUsedItemsThroughAScan() {
+	cache := New(Configure().MaxSize(10).ItemsToPrune(1).GetsPerPromote(1).Eviction(EvictLFU))
+	defer cache.Stop()
+	for i := 0; i < 5; i++ {
+		cache.Set("hot"+strconv.Itoa(i), i, time.Minute)
+	}
+	cache.SyncUpdates()
+	for j := 0; j < 5; j++ {
+		for i := 0; i < 5; i++ {
+			cache.Get("hot" + strconv.Itoa(i))
+		}
+		cache.SyncUpdates()
+	}
+	for i := 0; i < 20; i++ {
+		cache.Set("scan"+strconv.Itoa(i), i, time.Minute)
+	}
 	cache.SyncUpdates()
+	for i := 0; i < 5; i++ {
+		Expect(cache.GetWithoutPromote("hot" + strconv.Itoa(i)).Value()).To.Equal(i)
+	}
+	Expect(cache.GetWithoutPromote("scan19").Value()).To.Equal(19)
+	Expect(cache.GetSize()).To.Equal(int64(10))
+	assertLFUOrder(cache)
 
-	Expect(cache.Get("spice")).To.Equal(nil)
-	Expect(cache.Get("worm").Value()).To.Equal("sand")
-	Expect(atomic.LoadInt32(&onDeleteFnCalled)).To.Eql(1)
+	// the hot items age out once they stop being used
+	for i := 20; i < 200; i++ {
+		cache.Set("scan"+strconv.Itoa(i), i, time.Minute)
+		cache.Get("scan" + strconv.Itoa(i))
+	}
+	cache.SyncUpdates()
+	Expect(cache.GetWithoutPromote("hot0")).To.Equal(nil)
+	assertLFUOrder(cache)
 }
 
-func (_ CacheTests) FetchesExpiredItems() {
-	cache := New(Configure())
-	fn := func() (interface{}, error) { return "moo-moo", nil }
+func (_ CacheTests) LFUKeepsTheListOrdered() {
+	cache := New(Configure().MaxSize(50).ItemsToPrune(5).GetsPerPromote(1).Eviction(EvictLFU))
+	defer cache.Stop()
+	r := rand.New(rand.NewSource(42))
+	for i := 0; i < 20000; i++ {
+		key := strconv.Itoa(r.Intn(100))
+		switch r.Intn(10) {
+		case 0:
+			cache.Delete(key)
+		case 1, 2:
+			cache.Set(key, i, time.Minute)
+		default:
+			cache.Get(key)
+		}
+	}
+	Expect(cache.Verify()).To.Equal(nil)
+	assertLFUOrder(cache)
+}
 
-	cache.Set("beef", "moo", time.Second*-1)
-	Expect(cache.Get("beef").Value()).To.Equal("moo")
+func (_ CacheTests) LFUHalvesTheCountsOnceTheyReachTheCap() {
+	cache := New(Configure().MaxSize(2).ItemsToPrune(1).GetsPerPromote(1).Eviction(EvictLFU))
+	defer cache.Stop()
+	cache.Set("spice", 1, time.Minute)
+	cache.Set("worm", 2, time.Minute)
+	cache.SyncUpdates()
+	for i := 0; i < lfuLevels; i++ {
+		cache.Get("spice")
+		cache.Get("worm")
+		cache.SyncUpdates()
+	}
+	// each new item starts one count higher than the last evicted one
+	for i := 0; i < lfuLevels-1; i++ {
+		cache.Set("new"+strconv.Itoa(i), i, time.Minute)
+		cache.SyncUpdates()
+		Expect(cache.GetWithoutPromote("new" + strconv.Itoa(i))).To.Equal(nil)
+	}
+	cache.Set("leto", 3, time.Minute)
+	cache.SyncUpdates()
+	Expect(cache.GetWithoutPromote("spice")).To.Equal(nil)
+	Expect(cache.GetWithoutPromote("worm").Value()).To.Equal(2)
+	Expect(cache.GetWithoutPromote("leto").Value()).To.Equal(3)
+	assertLFUOrder(cache)
+	Expect(cache.order.(*lfu).floor).To.Equal(uint8(lfuLevels / 2))
+}
 
-	out, _ := cache.Fetch("beef", time.Second, fn)
-	Expect(out.Value()).To.Equal("moo-moo")
+func (_ CacheTests) SLRUKeepsPromotedItemsThroughAScan() {
+	cache := New(Configure().MaxSize(10).ItemsToPrune(1).GetsPerPromote(1).Eviction(EvictSLRU).ProtectedRatio(0.5))
+	defer cache.Stop()
+	for i := 0; i < 6; i++ {
+		cache.Set("hot"+strconv.Itoa(i), i, time.Minute)
+	}
+	cache.SyncUpdates()
+	for i := 0; i < 6; i++ {
+		cache.Get("hot" + strconv.Itoa(i))
+	}
+	cache.SyncUpdates()
+	for i := 0; i < 50; i++ {
+		cache.Set("scan"+strconv.Itoa(i), i, time.Minute)
+	}
+	cache.SyncUpdates()
+	// only 5 fit in protected, hot0 was demoted to probation and evicted
+	Expect(cache.GetWithoutPromote("hot0")).To.Equal(nil)
+	for i := 1; i < 6; i++ {
+		Expect(cache.GetWithoutPromote("hot" + strconv.Itoa(i)).Value()).To.Equal(i)
+	}
+	Expect(cache.GetWithoutPromote("scan49").Value()).To.Equal(49)
+	Expect(cache.GetSize()).To.Equal(int64(10))
+	assertSLRUOrder(cache)
 }
 
-func (_ CacheTests) GCsTheOldestItems() {
-	cache := New(Configure().ItemsToPrune(10))
-	for i := 0; i < 500; i++ {
+func (_ CacheTests) ClockGivesReadItemsASecondChance() {
+	cache := New(Configure().MaxSize(5).ItemsToPrune(1).Eviction(EvictClock))
+	defer cache.Stop()
+	for i := 0; i < 5; i++ {
 		cache.Set(strconv.Itoa(i), i, time.Minute)
 	}
 	cache.SyncUpdates()
-	cache.GC()
-	Expect(cache.Get("9")).To.Equal(nil)
-	Expect(cache.Get("10").Value()).To.Equal(10)
-	Expect(cache.ItemCount()).To.Equal(490)
-}
+	cache.Get("0")
+	cache.Get("1")
+	// no promotion was queued
+	Expect(len(cache.promotables)).To.Equal(0)
 
-func (_ CacheTests) PromotedItemsDontGetPruned() {
-	cache := New(Configure().ItemsToPrune(10).GetsPerPromote(1))
-	for i := 0; i < 500; i++ {
+	cache.Set("5", 5, time.Minute)
+	cache.SyncUpdates()
+	Expect(cache.GetWithoutPromote("0").Value()).To.Equal(0)
+	Expect(cache.GetWithoutPromote("1").Value()).To.Equal(1)
+	Expect(cache.GetWithoutPromote("2")).To.Equal(nil)
+
+	// the second chance cleared the flag
+	for i := 6; i < 11; i++ {
 		cache.Set(strconv.Itoa(i), i, time.Minute)
 	}
 	cache.SyncUpdates()
-	cache.Get("9")
+	Expect(cache.GetWithoutPromote("0")).To.Equal(nil)
+	Expect(cache.GetWithoutPromote("1")).To.Equal(nil)
+	Expect(cache.GetSize()).To.Equal(int64(5))
+}
+
+func (_ CacheTests) DiagnoseRecommendsMoreBuckets() {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(6))
+	cache := New(Configure().Buckets(2))
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Minute)
+	d := cache.Diagnose()
+	Expect(d.BucketGet > 0 && d.BucketSet > 0 && d.WorkerLatency > 0).To.Equal(true)
+	Expect(d.Recommendations).To.Equal([]Recommendation{{
+		Setting:   "Buckets",
+		Current:   2,
+		Suggested: 8,
+		Reason:    "fewer buckets than GOMAXPROCS (6), concurrent writes contend for the same locks",
+	}})
+	Expect(cache.GetWithoutPromote("ccache:diagnose:0")).To.Equal(nil)
+	Expect(cache.Stats().Sets).To.Equal(int64(1))
+}
+
+func (_ CacheTests) EvictsLowPriorityItemsFirst() {
+	cache := New(Configure().MaxSize(5).ItemsToPrune(1).GetsPerPromote(1).Priorities())
+	defer cache.Stop()
+	cache.SetWithPriority("expensive", 1, time.Minute, PriorityHigh)
+	cache.Set("normal", 2, time.Minute)
+	cache.SetWithPriority("cheap1", 3, time.Minute, PriorityLow)
+	cache.SetWithPriority("cheap2", 4, time.Minute, PriorityLow)
 	cache.SyncUpdates()
-	cache.GC()
-	Expect(cache.Get("9").Value()).To.Equal(9)
-	Expect(cache.Get("10")).To.Equal(nil)
-	Expect(cache.Get("11").Value()).To.Equal(11)
+	cache.Get("cheap1")
+	cache.SyncUpdates()
+
+	cache.Set("a", 5, time.Minute)
+	cache.Set("b", 6, time.Minute)
+	cache.Set("c", 7, time.Minute)
+	cache.SyncUpdates()
+	// the low priority items go first, least recently used first, even though
+	// they were used after the others
+	Expect(cache.Get("cheap2")).To.Equal(nil)
+	Expect(cache.Get("cheap1")).To.Equal(nil)
+	Expect(cache.GetWithoutPromote("normal").Value()).To.Equal(2)
+
+	cache.Set("d", 8, time.Minute)
+	cache.Set("e", 9, time.Minute)
+	cache.Set("f", 10, time.Minute)
+	cache.SyncUpdates()
+	Expect(cache.Get("normal")).To.Equal(nil)
+	Expect(cache.Get("expensive").Priority()).To.Equal(PriorityHigh)
+	Expect(cache.GetSize()).To.Eql(5)
+	Expect(cache.Verify()).To.Equal(nil)
 }
 
-func (_ CacheTests) GetWithoutPromoteDoesNotPromote() {
-	cache := New(Configure().ItemsToPrune(10).GetsPerPromote(1))
-	for i := 0; i < 500; i++ {
+func (_ CacheTests) SLRUKeepsTheSegmentsConsistent() {
+	cache := New(Configure().MaxSize(50).ItemsToPrune(5).GetsPerPromote(1).Eviction(EvictSLRU))
+	defer cache.Stop()
+	r := rand.New(rand.NewSource(42))
+	for i := 0; i < 20000; i++ {
+		key := strconv.Itoa(r.Intn(100))
+		switch r.Intn(10) {
+		case 0:
+			cache.Delete(key)
+		case 1, 2:
+			cache.Set(key, i, time.Minute)
+		default:
+			cache.Get(key)
+		}
+	}
+	Expect(cache.Verify()).To.Equal(nil)
+	assertSLRUOrder(cache)
+}
+
+func (_ CacheTests) ARCAdaptsToTheKeysWhichComeBack() {
+	cache := New(Configure().MaxSize(10).ItemsToPrune(1).GetsPerPromote(1).Eviction(EvictARC))
+	defer cache.Stop()
+	a := cache.order.(*arc)
+	for i := 0; i < 11; i++ {
 		cache.Set(strconv.Itoa(i), i, time.Minute)
 	}
 	cache.SyncUpdates()
-	cache.GetWithoutPromote("9")
+	Expect(cache.GetWithoutPromote("0")).To.Equal(nil)
+
+	// 0 was evicted too soon, so more room is kept for the items used once
+	cache.Set("0", 0, time.Minute)
 	cache.SyncUpdates()
-	cache.GC()
-	Expect(cache.Get("9")).To.Equal(nil)
-	Expect(cache.Get("10").Value()).To.Equal(10)
-	Expect(cache.Get("11").Value()).To.Equal(11)
-}
+	Expect(a.p).To.Equal(int64(1))
+	Expect(cache.GetWithoutPromote("0").protected).To.Equal(true)
+	Expect(cache.GetWithoutPromote("1")).To.Equal(nil)
+	assertSLRUOrder(cache)
 
-func (_ CacheTests) TrackerDoesNotCleanupHeldInstance() {
-	cache := New(Configure().ItemsToPrune(11).Track())
-	item0 := cache.TrackingSet("0", 0, time.Minute)
-	for i := 1; i < 11; i++ {
+	// and for those used again when one of them comes back
+	for i := 2; i < 11; i++ {
+		cache.Get(strconv.Itoa(i))
+	}
+	cache.SyncUpdates()
+	for i := 11; i < 20; i++ {
 		cache.Set(strconv.Itoa(i), i, time.Minute)
 	}
-	item1 := cache.TrackingGet("1")
 	cache.SyncUpdates()
-	cache.GC()
-	Expect(cache.Get("0").Value()).To.Equal(0)
-	Expect(cache.Get("1").Value()).To.Equal(1)
-	item0.Release()
-	item1.Release()
-	cache.GC()
-	Expect(cache.Get("0")).To.Equal(nil)
-	Expect(cache.Get("1")).To.Equal(nil)
+	Expect(cache.GetWithoutPromote("0")).To.Equal(nil)
+	cache.Set("0", 0, time.Minute)
+	cache.SyncUpdates()
+	Expect(a.p).To.Equal(int64(0))
+	Expect(cache.GetWithoutPromote("0").protected).To.Equal(true)
+	Expect(cache.GetSize()).To.Equal(int64(10))
+	assertSLRUOrder(cache)
 }
 
-func (_ CacheTests) RemovesOldestItemWhenFull() {
-	onDeleteFnCalled := false
-	onDeleteFn := func(item *Item) {
-		if item.key == "0" {
-			onDeleteFnCalled = true
+func (_ CacheTests) ARCKeepsTheSegmentsConsistent() {
+	cache := New(Configure().MaxSize(50).ItemsToPrune(5).GetsPerPromote(1).Eviction(EvictARC))
+	defer cache.Stop()
+	r := rand.New(rand.NewSource(42))
+	for i := 0; i < 20000; i++ {
+		key := strconv.Itoa(r.Intn(100))
+		switch r.Intn(10) {
+		case 0:
+			cache.Delete(key)
+		case 1, 2:
+			cache.Set(key, i, time.Minute)
+		default:
+			cache.Get(key)
 		}
 	}
+	Expect(cache.Verify()).To.Equal(nil)
+	assertSLRUOrder(cache)
+	a := cache.order.(*arc)
+	Expect(a.recent.len() <= 50).To.Equal(true)
+	Expect(a.frequent.len() <= 50).To.Equal(true)
+}
 
-	cache := New(Configure().MaxSize(5).ItemsToPrune(1).OnDelete(onDeleteFn))
-	for i := 0; i < 7; i++ {
+func (_ CacheTests) ARCBoundsTheGhostsByTheItemCount() {
+	// the max size is twice the number of items
+	cache := New(Configure().MaxSize(20).ItemsToPrune(1).Eviction(EvictARC).Sizer(func(value interface{}) int64 {
+		return 2
+	}))
+	defer cache.Stop()
+	for i := 0; i < 200; i++ {
 		cache.Set(strconv.Itoa(i), i, time.Minute)
 	}
 	cache.SyncUpdates()
-	Expect(cache.Get("0")).To.Equal(nil)
-	Expect(cache.Get("1")).To.Equal(nil)
-	Expect(cache.Get("2").Value()).To.Equal(2)
-	Expect(onDeleteFnCalled).To.Equal(true)
-	Expect(cache.ItemCount()).To.Equal(5)
+	Expect(cache.ItemCount() <= 10).To.Equal(true)
+	a := cache.order.(*arc)
+	Expect(a.recent.len() <= 10).To.Equal(true)
 }
 
-func (_ CacheTests) RemovesOldestItemWhenFullBySizer() {
-	cache := New(Configure().MaxSize(9).ItemsToPrune(2))
-	for i := 0; i < 7; i++ {
-		cache.Set(strconv.Itoa(i), &SizedItem{i, 2}, time.Minute)
+// The protected items are in front of the probation ones, and fit in their
+// share of the cache
+func assertSLRUOrder(cache *Cache) {
+	done := make(chan struct{})
+	cache.control <- pauseWorker{resume: done}
+	defer close(done)
+	var s *slru
+	switch order := cache.order.(type) {
+	case *slru:
+		s = order
+	case *arc:
+		s = order.slru
+	}
+	protected := int64(0)
+	var boundary *list.Element
+	for element := cache.list.Front(); element != nil; element = element.Next() {
+		item := element.Value.(*Item)
+		if item.protected {
+			Expect(boundary).To.Equal(nil)
+			protected += item.size
+		} else if boundary == nil {
+			boundary = element
+		}
+	}
+	Expect(s.boundary).To.Equal(boundary)
+	Expect(s.protectedSize).To.Equal(protected)
+	Expect(protected <= s.limit()).To.Equal(true)
+}
+
+// From the back, the use counts of the items in the worker's list never
+// decrease
+func assertLFUOrder(cache *Cache) {
+	done := make(chan struct{})
+	cache.control <- pauseWorker{resume: done}
+	defer close(done)
+	uses := uint8(0)
+	count := 0
+	for element := cache.list.Back(); element != nil; element = element.Prev() {
+		item := element.Value.(*Item)
+		Expect(item.uses >= uses).To.Equal(true)
+		uses = item.uses
+		Expect(cache.order.(*lfu).heads[uses] != nil).To.Equal(true)
+		count++
 	}
+	Expect(int64(count)).To.Equal(cache.size)
+}
+
+func (_ CacheTests) ValidateOnGetDeletesInvalidItems() {
+	version := 2
+	var reason DeleteReason
+	cache := New(Configure().ValidateOnGet(func(item *Item) bool {
+		return item.Value().(int) == version
+	}).OnDelete(func(item *Item) {
+		reason = item.DeleteReason()
+	}))
+	defer cache.Stop()
+	cache.Set("spice", 1, time.Minute)
+	cache.Set("worm", 2, time.Minute)
 	cache.SyncUpdates()
-	Expect(cache.Get("0")).To.Equal(nil)
-	Expect(cache.Get("1")).To.Equal(nil)
-	Expect(cache.Get("2")).To.Equal(nil)
-	Expect(cache.Get("3")).To.Equal(nil)
-	Expect(cache.Get("4").Value().(*SizedItem).id).To.Equal(4)
-	Expect(cache.GetDropped()).To.Equal(4)
-	Expect(cache.GetDropped()).To.Equal(0)
+	Expect(cache.Get("spice")).To.Equal(nil)
+	Expect(cache.Get("worm").Value()).To.Equal(2)
+	cache.SyncUpdates()
+	Expect(cache.ItemCount()).To.Equal(1)
+	Expect(cache.GetSize()).To.Equal(int64(1))
+	Expect(reason).To.Equal(DeleteReasonInvalid)
+
+	item, _ := cache.Fetch("spice", time.Minute, func() (interface{}, error) {
+		return 2, nil
+	})
+	Expect(item.Value()).To.Equal(2)
 }
 
-func (_ CacheTests) SetUpdatesSizeOnDelta() {
+func (_ CacheTests) RequestCacheReadsTheCacheOnce() {
 	cache := New(Configure())
-	cache.Set("a", &SizedItem{0, 2}, time.Minute)
-	cache.Set("b", &SizedItem{0, 3}, time.Minute)
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Minute)
+
+	request := cache.Request(false)
+	Expect(request.Get("spice").Value()).To.Equal("flow")
+	Expect(request.Get("worm")).To.Equal(nil)
+	cache.Set("spice", "melange", time.Minute)
+	cache.Set("worm", "sand", time.Minute)
+	Expect(request.Get("spice").Value()).To.Equal("flow")
+	Expect(request.Get("worm")).To.Equal(nil)
+	Expect(cache.Stats().Gets).To.Equal(int64(2))
+
+	request.Set("leto", "ghanima", time.Minute)
+	Expect(request.Get("leto").Value()).To.Equal("ghanima")
+	Expect(cache.Get("leto").Value()).To.Equal("ghanima")
+	request.Delete("spice")
+	Expect(request.Get("spice")).To.Equal(nil)
+	Expect(cache.Get("spice")).To.Equal(nil)
+
+	fetches := 0
+	for i := 0; i < 2; i++ {
+		item, _ := request.Fetch("worm", time.Minute, func() (interface{}, error) {
+			fetches++
+			return "shai-hulud", nil
+		})
+		Expect(item.Value()).To.Equal("sand")
+	}
+	Expect(fetches).To.Equal(0)
+}
+
+func (_ CacheTests) RequestCacheWritesBackOnFlush() {
+	cache := New(Configure())
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Minute)
+
+	request := cache.Request(true)
+	request.Set("worm", "sand", time.Minute)
+	request.Set("worm", "shai-hulud", time.Minute)
+	request.Delete("spice")
+	Expect(request.Get("worm").Value()).To.Equal("shai-hulud")
+	Expect(request.Get("spice")).To.Equal(nil)
+	Expect(cache.Get("worm")).To.Equal(nil)
+	Expect(cache.Get("spice").Value()).To.Equal("flow")
+
+	request.Flush()
+	Expect(cache.Get("worm").Value()).To.Equal("shai-hulud")
+	Expect(cache.Get("spice")).To.Equal(nil)
+}
+
+func (_ CacheTests) TinyLFURejectsRarelyUsedKeys() {
+	cache := New(Configure().MaxSize(5).ItemsToPrune(1).GetsPerPromote(1).TinyLFU())
+	defer cache.Stop()
+	for i := 0; i < 5; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
 	cache.SyncUpdates()
-	Expect(cache.GetSize()).To.Eql(5)
-	cache.Set("b", &SizedItem{0, 3}, time.Minute)
+	for j := 0; j < 2; j++ {
+		for i := 0; i < 5; i++ {
+			cache.Get(strconv.Itoa(i))
+		}
+		cache.SyncUpdates()
+	}
+
+	cache.Set("spice", "flow", time.Minute)
 	cache.SyncUpdates()
-	Expect(cache.GetSize()).To.Eql(5)
-	cache.Set("b", &SizedItem{0, 4}, time.Minute)
+	Expect(cache.GetDropped()).To.Equal(1)
+	Expect(cache.GetWithoutPromote("spice")).To.Equal(nil)
+	Expect(cache.GetSize()).To.Equal(int64(5))
+
+	// once it's been used more often than the LRU item, it's admitted
+	for i := 0; i < 3; i++ {
+		cache.Set("spice", "flow", time.Minute)
+		cache.SyncUpdates()
+	}
+	Expect(cache.GetWithoutPromote("spice").Value()).To.Equal("flow")
+	Expect(cache.GetWithoutPromote("0")).To.Equal(nil)
+	Expect(cache.GetSize()).To.Equal(int64(5))
+}
+
+func (_ CacheTests) VerifyReportsAccountingDiscrepancies() {
+	cache := New(Configure().MaxSize(5).ItemsToPrune(1))
+	defer cache.Stop()
+	for i := 0; i < 10; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	cache.Delete("8")
+	Expect(cache.Verify()).To.Equal(nil)
+
+	// corrupt the accounting
 	cache.SyncUpdates()
-	Expect(cache.GetSize()).To.Eql(6)
-	cache.Set("b", &SizedItem{0, 2}, time.Minute)
+	item := cache.bucket("9").get("9")
+	cache.bucket("9").evict(item)
+	cache.bucket("x").set("x", "y", time.Minute, false)
+	err := cache.Verify()
+	Expect(err.Error()).To.Equal(`ccache: "9" is listed but isn't cached; "x" is cached but isn't listed`)
+}
+
+func (_ CacheTests) GhostsReviveEvictedItems() {
+	cache := New(Configure().MaxSize(2).ItemsToPrune(1).Ghosts(time.Minute))
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("worm", "sand", time.Minute)
+	cache.Set("leto", "ghanima", time.Minute)
+	cache.Set("paul", "alia", time.Minute)
 	cache.SyncUpdates()
-	Expect(cache.GetSize()).To.Eql(4)
-	cache.Delete("b")
+	Expect(cache.GetDropped()).To.Equal(2)
+	Expect(cache.GetWithoutPromote("spice")).To.Equal(nil)
+
+	Expect(cache.Get("spice").Value()).To.Equal("flow")
+	Expect(cache.GetWithoutPromote("spice").Value()).To.Equal("flow")
+	Expect(cache.GhostRevivals()).To.Equal(int64(1))
+
+	// deleted items aren't revived
 	cache.SyncUpdates()
-	Expect(cache.GetSize()).To.Eql(2)
+	cache.Delete("worm")
+	Expect(cache.Get("worm")).To.Equal(nil)
+}
+
+func (_ CacheTests) GhostsExpireAfterTheirGracePeriod() {
+	cache := New(Configure().MaxSize(1).ItemsToPrune(1).Ghosts(time.Millisecond))
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("worm", "sand", time.Minute)
+	cache.SyncUpdates()
+	time.Sleep(5 * time.Millisecond)
+	Expect(cache.Get("spice")).To.Equal(nil)
+	Expect(cache.GhostRevivals()).To.Equal(int64(0))
+}
+
+func (_ CacheTests) GhostsDoNotOverwriteANewerSet() {
+	cache := New(Configure().MaxSize(1).ItemsToPrune(1).Ghosts(time.Minute))
+	defer cache.Stop()
+	cache.Set("spice", "flow", time.Minute)
+	cache.Set("worm", "sand", time.Minute)
+	cache.SyncUpdates()
+	Expect(cache.GetDropped()).To.Equal(1)
+	// as if the key was set between a Get's miss and its revival
+	cache.Set("spice", "melange", time.Minute)
+	Expect(cache.revive("spice").Value()).To.Equal("melange")
+	Expect(cache.Get("spice").Value()).To.Equal("melange")
 }
 
 func (_ CacheTests) ReplaceDoesNotchangeSizeIfNotSet() {
@@ -319,6 +3005,42 @@ func (_ CacheTests) ForEachFunc() {
 	Expect(forEachKeys(cache)).Not.To.Contain("stop")
 }
 
+func (_ CacheTests) ForEachFuncInSortedOrder() {
+	cache := New(Configure().SortedIteration())
+	defer cache.Stop()
+	for _, key := range []string{"d", "a", "c", "b", "e"} {
+		cache.Set(key, key, time.Minute)
+	}
+	keys := make([]string, 0, 5)
+	cache.ForEachFunc(func(key string, item *Item) bool {
+		keys = append(keys, key)
+		return key != "d"
+	})
+	Expect(keys).To.Equal([]string{"a", "b", "c", "d"})
+}
+
+func (_ CacheTests) ForEachFuncInBatches() {
+	cache := New(Configure().Buckets(1).IterationBatch(3))
+	defer cache.Stop()
+	for i := 0; i < 10; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	Expect(len(forEachKeys(cache))).To.Equal(10)
+
+	// the function isn't called under the lock, and the deleted items past the
+	// first batch are skipped
+	visited := 0
+	cache.ForEachFunc(func(key string, item *Item) bool {
+		visited++
+		for i := 0; i < 10; i++ {
+			cache.Delete(strconv.Itoa(i))
+		}
+		return true
+	})
+	Expect(visited).To.Equal(3)
+	Expect(cache.ItemCount()).To.Equal(0)
+}
+
 type SizedItem struct {
 	id int
 	s  int64
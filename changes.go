@@ -0,0 +1,208 @@
+package ccache
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type ChangeOp uint8
+
+const (
+	ChangeSet ChangeOp = iota + 1
+	ChangeDelete
+	// every key was removed, by Clear or SwapAll
+	ChangeClear
+)
+
+// A change to the cache, see Configuration.ChangeFeed
+type Change struct {
+	Seq uint64
+	Op  ChangeOp
+	// empty for ChangeClear
+	Key string
+	// the value, serialized with the Codec, and its expiry. ChangeSet only.
+	Value   []byte
+	Expires time.Time
+}
+
+// Returned by ChangesSince when the requested changes are no longer in the
+// feed. The replica has to start over from a snapshot (see Save).
+var ErrChangesTruncated = errors.New("ccache: changes are no longer in the feed")
+
+// Returned by ChangesSince when Configuration.ChangeFeed isn't set
+var ErrNoChangeFeed = errors.New("ccache: the change feed isn't enabled")
+
+// Returned by ApplyChanges when changes are missing between the last applied
+// one and the given ones
+var ErrChangesMissing = errors.New("ccache: changes are missing")
+
+// A ring of the most recent changes. Changes are recorded by the buckets under
+// their write lock, so that the changes to a key are in the same order as the
+// writes. Values are only serialized when the changes are read.
+type changeFeed struct {
+	sync.Mutex
+	seq  uint64
+	ring []change
+}
+
+type change struct {
+	seq  uint64
+	op   ChangeOp
+	key  string
+	item *Item
+}
+
+func newChangeFeed(size int) *changeFeed {
+	return &changeFeed{ring: make([]change, size)}
+}
+
+func (f *changeFeed) record(op ChangeOp, key string, item *Item) {
+	f.Lock()
+	f.seq++
+	f.ring[f.seq%uint64(len(f.ring))] = change{seq: f.seq, op: op, key: key, item: item}
+	f.Unlock()
+}
+
+func (f *changeFeed) last() uint64 {
+	f.Lock()
+	defer f.Unlock()
+	return f.seq
+}
+
+// Up to limit (<= 0 for no limit) of the changes after seq
+func (f *changeFeed) since(seq uint64, limit int) ([]change, error) {
+	f.Lock()
+	defer f.Unlock()
+	if seq > f.seq {
+		// the cache was restarted since the replica last caught up
+		return nil, ErrChangesTruncated
+	}
+	size := uint64(len(f.ring))
+	if f.seq > size && seq < f.seq-size {
+		return nil, ErrChangesTruncated
+	}
+	count := f.seq - seq
+	if limit > 0 && count > uint64(limit) {
+		count = uint64(limit)
+	}
+	changes := make([]change, count)
+	for i := range changes {
+		changes[i] = f.ring[(seq+1+uint64(i))%size]
+	}
+	return changes, nil
+}
+
+// Returns the changes (Sets, Deletes, and Clears) after seq, oldest first, and
+// at most limit of them (<= 0 for no limit), so that a replica can keep up by
+// applying them in order. Start with a seq of LastChange taken before a Save,
+// and continue from the Seq of the last change received. Values which can't be
+// serialized are returned as a ChangeDelete of their key. Evictions and
+// expirations aren't changes: the replica does its own.
+func (c *Cache) ChangesSince(seq uint64, limit int) ([]Change, error) {
+	if c.feed == nil {
+		return nil, ErrNoChangeFeed
+	}
+	recorded, err := c.feed.since(seq, limit)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]Change, len(recorded))
+	for i, r := range recorded {
+		change := Change{Seq: r.seq, Op: r.op, Key: r.key}
+		if r.op == ChangeSet {
+			if data, err := marshalValue(c.codec, r.item.Value()); err == nil {
+				change.Value = data
+				change.Expires = r.item.Expires()
+			} else {
+				change.Op = ChangeDelete
+			}
+		}
+		changes[i] = change
+	}
+	return changes, nil
+}
+
+// Applies the changes read from another cache's ChangesSince, in order,
+// making this cache a replica of it. Changes which were already applied (by
+// sequence number) are skipped, so a batch can safely be applied again. The
+// first change applied can have any sequence number; after that, they must
+// follow each other, or ErrChangesMissing is returned. Applying stops at the
+// first change whose value can't be deserialized. Returns the sequence
+// number of the last applied change, to ask ChangesSince for the next ones.
+func (c *Cache) ApplyChanges(changes []Change) (uint64, error) {
+	c.applyLock.Lock()
+	defer c.applyLock.Unlock()
+	for _, change := range changes {
+		if c.applied != 0 {
+			if change.Seq <= c.applied {
+				continue
+			}
+			if change.Seq != c.applied+1 {
+				return c.applied, ErrChangesMissing
+			}
+		}
+		switch change.Op {
+		case ChangeSet:
+			ttl := time.Until(change.Expires)
+			if ttl <= 0 {
+				c.delete(change.Key)
+				break
+			}
+			value, err := unmarshalValue(c.codec, change.Value)
+			if err != nil {
+				return c.applied, err
+			}
+			c.set(change.Key, value, ttl, false)
+		case ChangeDelete:
+			c.delete(change.Key)
+		case ChangeClear:
+			c.Clear()
+		}
+		c.applied = change.Seq
+	}
+	return c.applied, nil
+}
+
+// Makes ApplyChanges continue from the change after seq, such as when the
+// primary was restarted (and numbers its changes from 1 again) or when this
+// cache was reloaded from a snapshot taken at seq. A seq of 0 accepts any
+// first change, like a new cache.
+func (c *Cache) ResetApplied(seq uint64) {
+	c.applyLock.Lock()
+	c.applied = seq
+	c.applyLock.Unlock()
+}
+
+// Empties the buckets. The clear is recorded while they're all locked, else a
+// set recorded after it could be dropped here but kept by the replicas.
+func (c *Cache) clearBuckets() {
+	for _, b := range c.buckets {
+		b.Lock()
+	}
+	c.changed(ChangeClear, "", nil)
+	for _, b := range c.buckets {
+		b.reset()
+		b.Unlock()
+	}
+}
+
+// Records a change which isn't made by a bucket (the buckets record their
+// own, see bucket.changed)
+func (c *Cache) changed(op ChangeOp, key string, item *Item) {
+	if c.feed != nil {
+		c.feed.record(op, key, item)
+	}
+	if c.wal != nil {
+		c.wal.record(op, key, item)
+	}
+}
+
+// The sequence number of the latest change, 0 if there were none (or the
+// change feed isn't enabled)
+func (c *Cache) LastChange() uint64 {
+	if c.feed == nil {
+		return 0
+	}
+	return c.feed.last()
+}
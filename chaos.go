@@ -0,0 +1,43 @@
+package ccache
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Faults to inject into a Cache, see Cache.SetChaos. Rates are probabilities
+// between 0 and 1.
+type Chaos struct {
+	// How often the worker sleeps (for up to Latency) before handling a
+	// promotion, which backs up the promote buffer
+	LatencyRate float64
+	Latency     time.Duration
+	// How often the promote buffer is treated as full. Promotions from Get are
+	// skipped and, with DropOnFullBuffer, Sets are dropped. With
+	// BlockOnFullBuffer, a full buffer only delays Sets, use Latency instead.
+	FullBufferRate float64
+	// How often a newly set item is evicted as soon as the worker sees it
+	EvictionRate float64
+}
+
+func (c *Chaos) roll(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+func (c *Chaos) delay() {
+	if c.Latency > 0 && c.roll(c.LatencyRate) {
+		time.Sleep(time.Duration(rand.Int63n(int64(c.Latency))))
+	}
+}
+
+// Enables fault injection, or disables it when chaos is nil. Meant to let
+// applications test how they cope with a degraded cache. Can be called at any
+// time, but the Chaos mustn't be modified after being passed in.
+func (c *Cache) SetChaos(chaos *Chaos) {
+	c.chaos.Store(chaos)
+}
+
+func (c *Cache) loadChaos() *Chaos {
+	chaos, _ := c.chaos.Load().(*Chaos)
+	return chaos
+}
@@ -0,0 +1,76 @@
+package ccache
+
+import "sync/atomic"
+
+// The number of keys ClearFunc checks per turn of the worker
+const clearFuncBatch = 256
+
+type clearFunc struct {
+	job *clearJob
+}
+
+// The progress of a ClearFunc, owned by the worker
+type clearJob struct {
+	match func(key string, item *Item) bool
+	res   chan int
+	// the index of the next bucket, and the keys of the current one which are
+	// left to check
+	next  int
+	b     *bucket
+	keys  []string
+	count int
+}
+
+// Deletes the items that match evaluates to true, like DeleteFunc, but the
+// worker does it a batch of keys at a time, and handles the other promotions,
+// deletes and commands in between. Selective mass invalidations thus don't
+// hold up the cache, at the cost of taking longer. Returns the number of
+// items deleted, which are only some of the matching items if the cache is
+// stopped meanwhile. match is called by the worker: it mustn't use the cache.
+// This is a control command.
+func (c *Cache) ClearFunc(match func(key string, item *Item) bool) int {
+	if c.ghosts != nil {
+		c.ghosts.deleteFunc(match)
+	}
+	res := make(chan int, 1)
+	c.control <- clearFunc{job: &clearJob{match: match, res: res}}
+	return <-res
+}
+
+// Reports the job's deletes. Called by the worker.
+func (c *Cache) clearDone(job *clearJob) {
+	atomic.AddInt64(&c.stats.deletes, int64(job.count))
+	job.res <- job.count
+}
+
+// Checks the job's next batch of keys, returns false once the job is done.
+// Called by the worker.
+func (c *Cache) clearStep(job *clearJob) bool {
+	for checked := 0; checked < clearFuncBatch; {
+		if len(job.keys) == 0 {
+			if job.next == len(c.buckets) {
+				return false
+			}
+			job.b = c.buckets[job.next]
+			job.keys = job.b.keys()
+			job.next++
+			continue
+		}
+		key := job.keys[0]
+		job.keys = job.keys[1:]
+		checked++
+		item := job.b.get(key)
+		if item == nil || job.match(key, item) == false || job.b.removeItem(item) == false {
+			continue
+		}
+		if c.shadow != nil {
+			c.shadow.delete(key)
+		}
+		if c.front != nil {
+			c.front.remove(item)
+		}
+		c.doDelete(item)
+		job.count++
+	}
+	return true
+}
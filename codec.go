@@ -0,0 +1,135 @@
+package ccache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// A Codec turns cached values into bytes and back. It's used whenever values
+// have to leave the process (snapshots, persistence, replication).
+// Values which implement ItemMarshaler bypass the codec.
+type Codec interface {
+	Marshal(value interface{}) ([]byte, error)
+	Unmarshal(data []byte) (interface{}, error)
+}
+
+// Values which implement ItemMarshaler control their own serialized
+// representation, which is useful for types with unexported or otherwise
+// non-serializable fields. The type must also be registered, via
+// RegisterItemType, so that it can be re-created.
+type ItemMarshaler interface {
+	MarshalItem() ([]byte, error)
+}
+
+// The counterpart of ItemMarshaler. UnmarshalItem is called on a newly
+// allocated value of the registered type.
+type ItemUnmarshaler interface {
+	UnmarshalItem(data []byte) error
+}
+
+var (
+	itemTypesLock sync.RWMutex
+	itemTypes     = make(map[string]reflect.Type)
+)
+
+// Registers a type which implements both ItemMarshaler and ItemUnmarshaler.
+// Much like gob.Register, the value is only used to learn its type. Values are
+// re-created with that exact type, so pointer types should be registered (and
+// stored) as pointers.
+func RegisterItemType(value ItemUnmarshaler) {
+	t := reflect.TypeOf(value)
+	itemTypesLock.Lock()
+	itemTypes[t.String()] = t
+	itemTypesLock.Unlock()
+}
+
+// GobCodec is the default codec. Like with encoding/gob, concrete types stored
+// behind an interface{} need to be registered with gob.Register.
+type GobCodec struct{}
+
+type gobValue struct {
+	Value interface{}
+}
+
+func (GobCodec) Marshal(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(gobValue{value}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte) (interface{}, error) {
+	var v gobValue
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v); err != nil {
+		return nil, err
+	}
+	return v.Value, nil
+}
+
+// Serialized values are prefixed with a marker so that we know whether to
+// decode them with the codec or with the registered ItemUnmarshaler type.
+const (
+	codecValue     byte = 0
+	marshalerValue byte = 1
+)
+
+func marshalValue(codec Codec, value interface{}) ([]byte, error) {
+	if m, ok := value.(ItemMarshaler); ok {
+		name := reflect.TypeOf(value).String()
+		if len(name) > 255 {
+			return nil, fmt.Errorf("ccache: type name too long: %s", name)
+		}
+		data, err := m.MarshalItem()
+		if err != nil {
+			return nil, err
+		}
+		out := make([]byte, 0, 2+len(name)+len(data))
+		out = append(out, marshalerValue, byte(len(name)))
+		out = append(out, name...)
+		return append(out, data...), nil
+	}
+
+	data, err := codec.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{codecValue}, data...), nil
+}
+
+func unmarshalValue(codec Codec, data []byte) (interface{}, error) {
+	if len(data) == 0 {
+		return nil, errors.New("ccache: empty serialized value")
+	}
+	if data[0] == codecValue {
+		return codec.Unmarshal(data[1:])
+	}
+	if len(data) < 2 || len(data) < 2+int(data[1]) {
+		return nil, errors.New("ccache: malformed serialized value")
+	}
+	name := string(data[2 : 2+int(data[1])])
+	itemTypesLock.RLock()
+	t, ok := itemTypes[name]
+	itemTypesLock.RUnlock()
+	if ok == false {
+		return nil, fmt.Errorf("ccache: unregistered item type %s", name)
+	}
+
+	var value reflect.Value
+	if t.Kind() == reflect.Ptr {
+		value = reflect.New(t.Elem())
+	} else {
+		value = reflect.New(t)
+	}
+	if err := value.Interface().(ItemUnmarshaler).UnmarshalItem(data[2+int(data[1]):]); err != nil {
+		return nil, err
+	}
+	if t.Kind() == reflect.Ptr {
+		return value.Interface(), nil
+	}
+	return value.Elem().Interface(), nil
+}
@@ -0,0 +1,58 @@
+package ccache
+
+import (
+	"encoding/gob"
+	"strconv"
+	"testing"
+
+	. "github.com/karlseguin/expect"
+)
+
+type CodecTests struct{}
+
+func Test_Codec(t *testing.T) {
+	gob.Register(&gobUser{})
+	RegisterItemType(&opaqueUser{})
+	Expectify(new(CodecTests), t)
+}
+
+func (_ CodecTests) RoundTripsThroughTheCodec() {
+	data, err := marshalValue(GobCodec{}, &gobUser{Name: "leto"})
+	Expect(err).To.Equal(nil)
+	value, err := unmarshalValue(GobCodec{}, data)
+	Expect(err).To.Equal(nil)
+	Expect(value.(*gobUser).Name).To.Equal("leto")
+}
+
+func (_ CodecTests) RoundTripsThroughItemMarshaler() {
+	data, err := marshalValue(GobCodec{}, &opaqueUser{id: 9001})
+	Expect(err).To.Equal(nil)
+	value, err := unmarshalValue(GobCodec{}, data)
+	Expect(err).To.Equal(nil)
+	Expect(value.(*opaqueUser).id).To.Equal(9001)
+}
+
+func (_ CodecTests) FailsOnUnregisteredItemType() {
+	data, _ := marshalValue(GobCodec{}, &opaqueUser{id: 1})
+	data[2] = 'X'
+	_, err := unmarshalValue(GobCodec{}, data)
+	Expect(err).Not.To.Equal(nil)
+}
+
+type gobUser struct {
+	Name string
+}
+
+type opaqueUser struct {
+	id int
+}
+
+func (u *opaqueUser) MarshalItem() ([]byte, error) {
+	return []byte(strconv.Itoa(u.id)), nil
+}
+
+func (u *opaqueUser) UnmarshalItem(data []byte) error {
+	id, err := strconv.Atoi(string(data))
+	u.id = id
+	return err
+}
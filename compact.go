@@ -0,0 +1,117 @@
+package ccache
+
+import "container/list"
+
+// The number of items the worker removes between two checks of
+// Configuration.CompactBelow
+const compactCheck = 4096
+
+type compact struct {
+	ratio float64
+	res   chan int
+}
+
+// Go maps never shrink: after large deletes or purges, a bucket's map keeps the
+// memory it needed at its peak. Rebuilds the maps which hold fewer keys than
+// they once did, and returns the number of maps rebuilt. Each bucket is locked
+// while its map is copied.
+// This is a control command.
+func (c *Cache) Compact() int {
+	res := make(chan int)
+	c.control <- compact{ratio: 1, res: res}
+	return <-res
+}
+
+// Rebuilds the maps of the secondary keys which hold fewer keys than they once
+// did, see Cache.Compact. Primary keys whose items were all deleted keep their
+// (emptied) map, as a concurrent Set may be adding to it.
+// This is a control command.
+func (c *LayeredCache) Compact() int {
+	res := make(chan int)
+	c.control <- compact{ratio: 1, res: res}
+	return <-res
+}
+
+// Rebuilds the maps which hold fewer than ratio of the most keys they held.
+// Unless wait, the buckets which are locked are skipped: the worker mustn't
+// wait for a DeleteFunc which is waiting for it to make room in the delete
+// buffer.
+func (c *Cache) compact(ratio float64, wait bool) int {
+	compacted := 0
+	for _, b := range c.buckets {
+		if b.compact(ratio, wait) {
+			compacted += 1
+		}
+	}
+	return compacted
+}
+
+func (c *LayeredCache) compact(ratio float64, wait bool) int {
+	compacted := 0
+	for _, b := range c.buckets {
+		compacted += b.compact(ratio, wait)
+	}
+	return compacted
+}
+
+// Called by the worker for every item it removes from its list. With
+// Configuration.CompactBelow, compacts the maps every compactCheck removals.
+func (c *Cache) removed() {
+	if c.compactBelow == 0 {
+		return
+	}
+	if c.unlinked += 1; c.unlinked >= compactCheck {
+		c.unlinked = 0
+		c.compact(c.compactBelow, false)
+	}
+}
+
+// Removes the element from the worker's list
+func (c *LayeredCache) unlink(element *list.Element) {
+	c.list.Remove(element)
+	if c.compactBelow == 0 {
+		return
+	}
+	if c.unlinked += 1; c.unlinked >= compactCheck {
+		c.unlinked = 0
+		c.compact(c.compactBelow, false)
+	}
+}
+
+// Rebuilds lookup if it holds fewer than ratio of the most keys it held since
+// it was allocated. Returns whether it was rebuilt.
+func (b *bucket) compact(ratio float64, wait bool) bool {
+	if wait {
+		b.Lock()
+	} else if b.RWMutex.TryLock() == false {
+		return false
+	}
+	defer b.Unlock()
+	if float64(len(b.lookup)) >= float64(b.peak)*ratio {
+		return false
+	}
+	lookup := make(map[string]*Item, len(b.lookup))
+	for key, item := range b.lookup {
+		lookup[key] = item
+	}
+	b.lookup = lookup
+	b.peak = len(lookup)
+	b.publish()
+	return true
+}
+
+func (b *layeredBucket) compact(ratio float64, wait bool) int {
+	b.RLock()
+	buckets := make([]*bucket, 0, len(b.buckets))
+	for _, bucket := range b.buckets {
+		buckets = append(buckets, bucket)
+	}
+	b.RUnlock()
+	compacted := 0
+	for _, bucket := range buckets {
+		if bucket.compact(ratio, wait) {
+			compacted += 1
+		}
+	}
+	return compacted
+}
@@ -1,14 +1,164 @@
 package ccache
 
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// What Set does with a zero or negative duration, see
+// Configuration.NonPositiveTTL
+type TTLBehavior int
+
+const (
+	// Store the item, already expired (the default)
+	StoreNonPositiveTTL TTLBehavior = iota
+	// Don't store the item, leaving any existing value in place
+	RejectNonPositiveTTL
+	// Store the item using the fallback duration instead
+	FallbackNonPositiveTTL
+	// Delete the key
+	DeleteNonPositiveTTL
+)
+
+// What Set does with a Sized value whose Size is zero or negative, which would
+// otherwise take no room in the cache (or make room for other items), see
+// Configuration.NonPositiveSize
+type SizeBehavior int
+
+const (
+	// Account for the size as reported (the default)
+	StoreNonPositiveSize SizeBehavior = iota
+	// Count the item as a size of 1
+	OneForNonPositiveSize
+	// Don't store the item, leaving any existing value in place
+	RejectNonPositiveSize
+	// Count the item as a size of 1, and write it to the standard logger
+	LogNonPositiveSize
+)
+
+// What Set does when the promote buffer is full, see
+// Configuration.SetBackpressure
+type Backpressure int
+
+const (
+	// Wait for the worker to make room in the buffer (the default)
+	BlockOnFullBuffer Backpressure = iota
+	// Don't cache the value, counting it in DroppedSets
+	DropOnFullBuffer
+	// Promote the item from the calling goroutine, once the worker is done with
+	// the message it's handling
+	InlineOnFullBuffer
+)
+
+// Which items the GC evicts first, see Configuration.Eviction
+type EvictionPolicy int
+
+const (
+	// The least recently used (the default)
+	EvictLRU EvictionPolicy = iota
+	// The least frequently used, and the least recently used among those used
+	// as often
+	EvictLFU
+	// Segmented LRU: the least recently used of the items which were only
+	// used once, then of the others
+	EvictSLRU
+	// CLOCK, an approximation of LRU: Get only flags the item as referenced,
+	// rather than queueing a promotion for the worker, and the GC moves the
+	// flagged items to the front (clearing the flag) instead of evicting them
+	EvictClock
+	// Adaptive Replacement Cache: like EvictSLRU, but the share of the
+	// protected segment adapts to the workload
+	EvictARC
+)
+
 type Configuration struct {
 	maxSize        int64
 	buckets        int
 	itemsToPrune   int
 	deleteBuffer   int
+	spillDeletes   bool
 	promoteBuffer  int
 	getsPerPromote int32
 	tracking       bool
 	onDelete       func(item *Item)
+	onFetch        func(key string, value interface{}, duration time.Duration) (interface{}, error)
+	maxFetches     int
+	fetchWait      time.Duration
+	codec          Codec
+	shadowSize     int64
+	tombstoneTTL   time.Duration
+	staleFor       time.Duration
+	maxKeyLength   int
+	hashLongKeys   bool
+	ttlBehavior    TTLBehavior
+	ttlFallback    time.Duration
+	sorted         bool
+	iterationBatch int
+	leakReport     func(key string, site string)
+	maxRefCount    int32
+	onMaxRefCount  func(item *Item)
+	copyOnWrite    bool
+	contention     bool
+	backpressure   Backpressure
+	inlineValues   bool
+	maxPrimaries   int
+	maxSecondaries int
+	strict         bool
+	underlay       *MappedSnapshot
+	underlayTTL    time.Duration
+	frontSize      int
+	// secondary => the ways it can be derived, see DeriveVariant
+	derivers  map[string][]deriver
+	servedAge bool
+	countHits bool
+	// see CircuitBreaker
+	saturatedFor time.Duration
+	openFor      time.Duration
+	// see Warmup
+	warming         bool
+	warmupProfile   Profile
+	warmupFor       time.Duration
+	warmupSize      int64
+	info            *CacheInfo
+	ghostGrace      time.Duration
+	staleWindow     time.Duration
+	earlyBeta       float64
+	ordered         bool
+	onMutation      func(item *Item)
+	expvarName      string
+	resumeGC        bool
+	instrumentation Instrumentation
+	feedSize        int
+	snapshotPath    string
+	walPath         string
+	eviction        EvictionPolicy
+	protectedRatio  float64
+	validator       func(item *Item) bool
+	tinyLFU         bool
+	priorities      bool
+	expireEvery     time.Duration
+	sizeBehavior    SizeBehavior
+	sizer           func(value interface{}) int64
+	valueEqual      func(a, b interface{}) bool
+	slidingTTL      bool
+	compactBelow    float64
+	ttlJitter       float64
+	defaultTTL      time.Duration
+	maxBulkResults  int
+	maxItemSize     int64
+	onOversized     func(key string, size int64)
+	admitFetched    func(key string, size int64) bool
+	snapshotEvery   time.Duration
+	// a bucket count which was ignored because it isn't a power of 2
+	invalidBuckets uint32
+
+	revalidator        func(key string) (interface{}, time.Duration, error)
+	revalidateWorkers  int
+	revalidateCooldown time.Duration
 }
 
 // Creates a configuration object with sensible defaults
@@ -20,9 +170,11 @@ func Configure() *Configuration {
 		itemsToPrune:   500,
 		deleteBuffer:   1024,
 		getsPerPromote: 3,
+		protectedRatio: 0.8,
 		promoteBuffer:  1024,
 		maxSize:        5000,
 		tracking:       false,
+		codec:          GobCodec{},
 	}
 }
 
@@ -33,12 +185,65 @@ func (c *Configuration) MaxSize(max int64) *Configuration {
 	return c
 }
 
+// Makes Get lock-free: rather than being modified under a lock, the buckets'
+// maps are copied, modified and swapped on every write. Writes become O(n) in
+// the number of items per bucket (see Buckets), so this is only worthwhile for
+// read-mostly caches (e.g. more than 100 reads per write).
+// Only used by Cache.
+func (c *Configuration) CopyOnWrite() *Configuration {
+	c.copyOnWrite = true
+	return c
+}
+
+// Records how many times the buckets' locks were acquired and how long callers
+// waited for them, exposed via Cache.LockStats. A high average wait suggests
+// increasing Buckets. Adds the cost of reading the clock to every lock.
+// Only used by Cache.
+func (c *Configuration) TrackContention() *Configuration {
+	c.contention = true
+	return c
+}
+
+// Stores scalar values (int, int64, uint64, float64 and bool) inside the item
+// rather than behind an interface{}, saving an allocation per Set and reducing
+// the number of pointers the garbage collector has to chase. The trade-off is
+// that Item.Value() has to box the value on every call; use Item.Int64() to
+// read integers without allocating.
+// Only used by Cache.
+func (c *Configuration) InlineValues() *Configuration {
+	c.inlineValues = true
+	return c
+}
+
+// Bounds the number of primary keys of a LayeredCache. The primary keys are
+// kept in their own LRU and, when there are more than max, all the items of the
+// least recently used primary key are evicted.
+// Only used by LayeredCache.
+// [0 - unlimited]
+func (c *Configuration) MaxPrimaries(max uint32) *Configuration {
+	c.maxPrimaries = int(max)
+	return c
+}
+
+// Bounds the number of secondary keys per primary key of a LayeredCache. Each
+// primary key gets its own LRU and, when it has more than max items, its least
+// recently used items are evicted.
+// Only used by LayeredCache.
+// [0 - unlimited]
+func (c *Configuration) MaxSecondaries(max uint32) *Configuration {
+	c.maxSecondaries = int(max)
+	return c
+}
+
 // Keys are hashed into % bucket count to provide greater concurrency (every set
 // requires a write lock on the bucket). Must be a power of 2 (1, 2, 4, 8, 16, ...)
 // [16]
 func (c *Configuration) Buckets(count uint32) *Configuration {
 	if count == 0 || ((count&(^count+1)) == count) == false {
+		c.invalidBuckets = count
 		count = 16
+	} else {
+		c.invalidBuckets = 0
 	}
 	c.buckets = int(count)
 	return c
@@ -59,6 +264,21 @@ func (c *Configuration) PromoteBuffer(size uint32) *Configuration {
 	return c
 }
 
+// What to do when a Set finds the promote buffer full. Unlike Gets, which
+// simply skip the promotion, a newly set item must be queued, else it would
+// never be accounted for or evicted. By default, Set blocks until the worker
+// catches up. With DropOnFullBuffer, Set doesn't block but the value isn't
+// cached (see Cache.DroppedSets), which favors latency over hit ratio. With
+// InlineOnFullBuffer, Set promotes the item itself, GCing if needed, which
+// bounds its wait to one message of the worker rather than to a whole buffer,
+// at the cost of the worker taking a lock for each message.
+// Only used by Cache.
+// [BlockOnFullBuffer]
+func (c *Configuration) SetBackpressure(strategy Backpressure) *Configuration {
+	c.backpressure = strategy
+	return c
+}
+
 // The size of the queue for items which should be deleted. If the queue fills
 // up, calls to Delete() will block
 func (c *Configuration) DeleteBuffer(size uint32) *Configuration {
@@ -66,6 +286,17 @@ func (c *Configuration) DeleteBuffer(size uint32) *Configuration {
 	return c
 }
 
+// Makes the deletes which don't fit in the DeleteBuffer spill into an
+// unbounded backlog, which the worker drains, rather than blocking Delete (and
+// the Sets which replace an item) until the worker catches up. Trades memory
+// for never blocking the write path under delete storms, see
+// Cache.SpilledDeletes.
+// Only used by Cache.
+func (c *Configuration) SpillDeletes() *Configuration {
+	c.spillDeletes = true
+	return c
+}
+
 // Give a large cache with a high read / write ratio, it's usually unnecessary
 // to promote an item on every Get. GetsPerPromote specifies the number of Gets
 // a key must have before being promoted
@@ -75,6 +306,455 @@ func (c *Configuration) GetsPerPromote(count int32) *Configuration {
 	return c
 }
 
+// Limits the number of fetch callbacks (see Fetch) that can execute concurrently.
+// This protects the backend when many distinct keys miss at once (e.g. on a cold
+// start). Fetches beyond the limit wait for a slot; if wait is greater than 0 and
+// no slot frees up within it, Fetch returns ErrFetchTimeout.
+// [0 - unlimited]
+func (c *Configuration) MaxConcurrentFetches(max uint32, wait time.Duration) *Configuration {
+	c.maxFetches = int(max)
+	c.fetchWait = wait
+	return c
+}
+
+// Simulates, next to the real cache, a key-only cache with the given max size
+// and records what its hit ratio would have been (see Cache.ShadowStats). This
+// makes it possible to evaluate a different MaxSize against production traffic.
+// Past a few thousand, the shadow is split into up to 16 LRUs, by key, which
+// approximates a single LRU without serializing every Get.
+// Only used by Cache.
+// [0 - disabled]
+func (c *Configuration) Shadow(maxSize int64) *Configuration {
+	c.shadowSize = maxSize
+	return c
+}
+
+// When set, Delete, DeletePrefix and DeleteFunc leave a tombstone for the
+// deleted keys which lives for the given duration. A Fetch which started loading
+// before the key was deleted will return its value without caching it, so that
+// a slow load can't resurrect data which was just invalidated.
+// Only used by Cache.
+// [0 - disabled]
+func (c *Configuration) Tombstones(ttl time.Duration) *Configuration {
+	c.tombstoneTTL = ttl
+	return c
+}
+
+// By default, Get returns expired items, no matter how long ago they expired.
+// With ServeStaleFor, Get only returns an expired item for up to the given
+// duration past its expiry (and acts as a miss after that). Such items are
+// flagged by Item.Stale().
+// [0 - serve expired items indefinitely]
+func (c *Configuration) ServeStaleFor(grace time.Duration) *Configuration {
+	c.staleFor = grace
+	return c
+}
+
+// The default window of Cache.FetchStale: how long after its expiry an item is
+// still returned while it's being refreshed in the background.
+// Only used by Cache.
+// [0 - FetchStale behaves like Fetch unless given a window]
+func (c *Configuration) StaleWhileRevalidate(window time.Duration) *Configuration {
+	c.staleWindow = window
+	return c
+}
+
+// Enables probabilistic early expiration (XFetch) to avoid stampedes when a
+// popular item expires: Fetch sometimes treats an item which is about to expire
+// as a miss and refreshes it ahead of time. The closer the item is to its
+// expiry, and the longer its fetch took, the more likely this is. beta tunes
+// how eager this is: above 1 favors earlier refreshes, below 1 later ones.
+// Only used by Cache.
+// [0 - disabled]
+func (c *Configuration) EarlyExpiration(beta float64) *Configuration {
+	c.earlyBeta = beta
+	return c
+}
+
+// Registers a loader used to refresh stale items in the background. When Get
+// serves a stale item (expired, or past its soft TTL), a refresh of the key is
+// scheduled, unless one is already running or was scheduled less than cooldown
+// ago. At most workers refreshes run at once; when they are all busy, the
+// refresh is skipped (Get never blocks).
+// The loader returns the new value and its duration. Errors are ignored, and
+// panics are recovered and logged.
+// Only used by Cache.
+func (c *Configuration) Revalidate(loader func(key string) (interface{}, time.Duration, error), workers uint32, cooldown time.Duration) *Configuration {
+	if workers == 0 {
+		workers = 1
+	}
+	c.revalidator = loader
+	c.revalidateWorkers = int(workers)
+	c.revalidateCooldown = cooldown
+	return c
+}
+
+// Keys longer than length are rejected: they are never cached, Get treats them
+// as a miss and Fetch returns the loaded value without caching it. See
+// HashLongKeys for an alternative.
+// Only used by Cache.
+// [0 - unlimited]
+func (c *Configuration) MaxKeyLength(length uint32) *Configuration {
+	c.maxKeyLength = int(length)
+	return c
+}
+
+// Rather than rejecting keys longer than MaxKeyLength, replaces them with their
+// SHA-256 digest: a NUL byte followed by up to 43 base64 characters, cut down
+// to MaxKeyLength. Keys starting with a NUL byte are reserved for the digests,
+// the others are rejected. A MaxKeyLength below 23 leaves too few bits to tell
+// the digests apart, long keys are then rejected (and Strict panics). Functions
+// which expose keys, such as ForEachFunc, see the digest.
+func (c *Configuration) HashLongKeys() *Configuration {
+	c.hashLongKeys = true
+	return c
+}
+
+// Starts the keys which HashLongKeys replaced with their digest
+const hashedKeyPrefix = "\x00"
+
+// The shortest MaxKeyLength which HashLongKeys works with: the prefix and 22
+// base64 characters, i.e. 132 bits of the digest
+const minHashedKeyLength = len(hashedKeyPrefix) + 22
+
+// Applies MaxKeyLength to key. Returns false if the key must be rejected.
+// Idempotent, so it's safe to apply to a key which was already checked.
+func (c *Configuration) checkKey(key string) (string, bool) {
+	if c.maxKeyLength == 0 {
+		return key, true
+	}
+	if c.hashLongKeys && strings.HasPrefix(key, hashedKeyPrefix) {
+		// a digest, such as one exposed by ForEachFunc, or a key which would
+		// collide with them
+		return key, len(key) == c.hashedKeyLength()
+	}
+	if len(key) <= c.maxKeyLength {
+		return key, true
+	}
+	if c.hashLongKeys == false || c.maxKeyLength < minHashedKeyLength {
+		return key, false
+	}
+	digest := sha256.Sum256([]byte(key))
+	encoded := base64.RawURLEncoding.EncodeToString(digest[:])
+	return hashedKeyPrefix + encoded[:c.hashedKeyLength()-len(hashedKeyPrefix)], true
+}
+
+func (c *Configuration) hashedKeyLength() int {
+	length := len(hashedKeyPrefix) + base64.RawURLEncoding.EncodedLen(sha256.Size)
+	if c.maxKeyLength < length {
+		return c.maxKeyLength
+	}
+	return length
+}
+
+// Sizes the values which don't implement Sized, rather than counting each as
+// 1, so that MaxSize can be a cost such as a number of bytes, e.g. the length
+// of []byte values plus an estimate for the rest. It's called on every Set,
+// and by Resize. Sizes of zero or less are handled as per NonPositiveSize.
+// Only used by Cache.
+// [nil - 1 per value]
+func (c *Configuration) Sizer(sizer func(value interface{}) int64) *Configuration {
+	c.sizer = sizer
+	return c
+}
+
+// Makes the worker compact the buckets' maps (see Cache.Compact) whose number of
+// keys dropped below ratio (e.g. 0.25) of the most they held, as Go maps never
+// shrink. It's checked every few thousand removed items.
+// [0 - disabled]
+func (c *Configuration) CompactBelow(ratio float64) *Configuration {
+	c.compactBelow = ratio
+	return c
+}
+
+// Makes every Get of an unexpired item push its expiry back to now plus the TTL
+// it was set with, so that items stay cached for as long as they're used, as
+// sessions do. Expired items aren't revived, and the reads which don't promote
+// (GetWithoutPromote, WithoutPromotion) don't slide the expiry.
+// Only used by Cache.
+func (c *Configuration) SlidingTTL() *Configuration {
+	c.slidingTTL = true
+	return c
+}
+
+// Makes a Set of a value equal to the cached one, as per equal, refresh the
+// cached item's TTL rather than replacing the item, so that unchanged
+// upstream data doesn't go through the delete buffer and OnDelete.
+// The cached item keeps its value, size and settings (e.g. its priority or
+// pinning), and isn't promoted. Items with a soft TTL, and expired items, are
+// always replaced. equal is called with the cached value first, under the
+// bucket's lock, so it must be fast.
+// Only used by Cache.
+// [nil - always replace]
+func (c *Configuration) ValueEqual(equal func(a, b interface{}) bool) *Configuration {
+	c.valueEqual = equal
+	return c
+}
+
+// Values larger than max (as sized for MaxSize) aren't cached by Set, Fetch and
+// the other functions which set a value, so that a single giant value can't
+// evict thousands of useful ones. Fetch still returns the fetched value. The
+// key's previous value is deleted, rather than served in place of the new one.
+// onOversized, when not nil, is called with the key and the size of each
+// value which isn't cached. Resize doesn't apply it to items already cached.
+// Only used by Cache.
+// [0 - no limit]
+func (c *Configuration) MaxItemSize(max int64, onOversized func(key string, size int64)) *Configuration {
+	c.maxItemSize = max
+	c.onOversized = onOversized
+	return c
+}
+
+// Decides whether a value loaded by Fetch (or its variants) is cached, given
+// its size (as sized for MaxSize). A value which isn't admitted is still
+// returned to the caller, so that one-off huge responses, which would evict
+// many items as soon as they're cached, don't churn the cache. For example,
+// to only admit values up to a tenth of the cache:
+//
+//	FetchAdmission(func(key string, size int64) bool { return size <= max/10 })
+//
+// Unlike MaxItemSize, Set is unaffected.
+// Only used by Cache.
+func (c *Configuration) FetchAdmission(admit func(key string, size int64) bool) *Configuration {
+	c.admitFetched = admit
+	return c
+}
+
+// By default, the size of a Sized value is accounted for as is, even if it's
+// zero or negative, which lets such items defeat MaxSize. This changes that
+// behavior. Applies to every function which sets a value, including Fetch.
+// Resize, which can't reject an item that's already cached, counts it as a
+// size of 1 with RejectNonPositiveSize. In Strict mode, negative sizes panic
+// regardless.
+// Only used by Cache.
+// [StoreNonPositiveSize]
+func (c *Configuration) NonPositiveSize(behavior SizeBehavior) *Configuration {
+	c.sizeBehavior = behavior
+	return c
+}
+
+// Caps the number of keys returned by KeysWithPrefix, RangeKeys and
+// RangeKeysPage, whatever limit they're given, so that an accidental unbounded
+// call on a large cache can't allocate a huge result. RangeKeysPage returns
+// where to continue from.
+// Only used by Cache.
+// [0 - unlimited]
+func (c *Configuration) MaxBulkResults(max int) *Configuration {
+	c.maxBulkResults = max
+	return c
+}
+
+// The TTL of the items set with Put, which doesn't take one. The functions
+// which do take a TTL aren't affected: an explicit duration, even 0, is used
+// as given.
+// [0 - Put panics]
+func (c *Configuration) DefaultTTL(ttl time.Duration) *Configuration {
+	c.defaultTTL = ttl
+	return c
+}
+
+// The TTL for Put. Without a DefaultTTL, Put would silently store items which
+// are already expired.
+func (c *Configuration) putTTL() time.Duration {
+	if c.defaultTTL <= 0 {
+		panic("ccache: Put called without a DefaultTTL")
+	}
+	return c.defaultTTL
+}
+
+// Randomly lengthens or shortens every positive TTL by up to ratio of it (e.g.
+// 0.1 for ±10%), so that items set together, as when warming the cache, don't
+// all expire, and get fetched again, at the same instant. Applies to every
+// function which sets a value, including Fetch. ratio must be less than 1.
+// Only used by Cache.
+// [0 - disabled]
+func (c *Configuration) TTLJitter(ratio float64) *Configuration {
+	c.ttlJitter = ratio
+	return c
+}
+
+// By default, setting an item with a zero or negative duration stores an
+// already expired item, which still occupies space until it's evicted. This
+// changes that behavior. fallback is only used with FallbackNonPositiveTTL.
+// Applies to every function which sets a value, including Fetch.
+// Only used by Cache.
+// [StoreNonPositiveTTL]
+func (c *Configuration) NonPositiveTTL(behavior TTLBehavior, fallback time.Duration) *Configuration {
+	c.ttlBehavior = behavior
+	c.ttlFallback = fallback
+	return c
+}
+
+// Makes ForEachFunc visit keys in sorted order rather than in random (map)
+// order. Meant for tests and for diffing exports, as it requires copying and
+// sorting the keys before iterating. Has no cost when disabled.
+func (c *Configuration) SortedIteration() *Configuration {
+	c.sorted = true
+	return c
+}
+
+// Makes ForEachFunc (and the other functions which iterate over the items,
+// like SetTTLWhere and KeysWithPrefix) copy the items out of each bucket size
+// at a time, and call the function without holding the bucket's lock. Writes
+// to a bucket then only wait for a batch to be copied, rather than for the
+// function to be called on all of the bucket's items, which matters with huge
+// buckets or slow functions. The keys of a bucket are still copied under a
+// single read lock; an item deleted (or replaced) after that is skipped (or
+// visited as its replacement).
+// [0 - the function is called under the bucket's read lock]
+func (c *Configuration) IterationBatch(size int) *Configuration {
+	c.iterationBatch = size
+	return c
+}
+
+// With Track, items which are in use can't be evicted, and every GC walks past
+// them again when they pile up at the tail of the LRU. ResumeGC makes each GC
+// resume where the previous one stopped, so that eviction stays proportional to
+// the number of evicted items even with thousands of tracked items. The
+// trade-off is that items released behind that point are only evicted once a
+// GC reaches the head of the LRU and starts over from its tail.
+// Only used by Cache.
+func (c *Configuration) ResumeGC() *Configuration {
+	c.resumeGC = true
+	return c
+}
+
+// Reports Get, Set, Fetch and Delete (and their Tracking and Fetch variants)
+// to instrumentation, along with their outcome and latency, e.g. to trace them.
+// Only used by Cache.
+func (c *Configuration) Instrument(instrumentation Instrumentation) *Configuration {
+	c.instrumentation = instrumentation
+	return c
+}
+
+// Makes the worker remove the expired items every interval, rather than only
+// when the GC gets to them (or PurgeExpired is called), so that their memory
+// is reclaimed promptly. The worker keeps the items ordered by expiry, so each
+// run only touches the expired items. With ServeStaleFor or
+// StaleWhileRevalidate, items are kept for the longest of the grace periods.
+// An item whose TTL is shortened (e.g. by Extend) is removed at its original
+// expiry at the earliest.
+// A LayeredCache doesn't order its items by expiry: it runs PurgeExpired every
+// interval instead, which walks all of them, so use a longer interval.
+// [0 - disabled]
+func (c *Configuration) ExpireEvery(interval time.Duration) *Configuration {
+	c.expireEvery = interval
+	return c
+}
+
+// Makes the GC evict items by priority (see Cache.SetWithPriority) and only
+// then by recency: the least recently used item of the lowest priority goes
+// first. Only applies to EvictLRU.
+// Only used by Cache.
+func (c *Configuration) Priorities() *Configuration {
+	c.priorities = true
+	return c
+}
+
+// Adds a TinyLFU admission filter: the worker keeps an estimate (a count-min
+// sketch) of how often keys are set and read, including keys which are no
+// longer cached. When a new item would make the cache evict, it's only
+// admitted if its key was used more often than the item the GC would evict,
+// else it's dropped (and counted by GetDropped). This keeps keys which are
+// only used once from churning the cache.
+// Only used by Cache.
+func (c *Configuration) TinyLFU() *Configuration {
+	c.tinyLFU = true
+	return c
+}
+
+// The share of MaxSize which the protected segment of EvictSLRU can take.
+// Items which were promoted since they were set are protected, and are only
+// evicted once the other items are.
+// Only used by Cache.
+// [0.8]
+func (c *Configuration) ProtectedRatio(ratio float64) *Configuration {
+	c.protectedRatio = ratio
+	return c
+}
+
+// Calls valid with the item found by every Get (and Fetch). When it returns
+// false, the item is deleted and the Get is a miss. Meant for values which
+// become invalid for reasons other than time, such as a schema version bump,
+// so valid must be cheap.
+// Only used by Cache.
+func (c *Configuration) ValidateOnGet(valid func(item *Item) bool) *Configuration {
+	c.validator = valid
+	return c
+}
+
+// Which items are evicted first when the cache is full. EvictLFU counts the
+// promotions (see GetsPerPromote) of each item and evicts the items with the
+// lowest count first, so that a scan of many items which are only read once
+// doesn't flush the frequently used ones out of the cache. The counts age, so
+// that items which stopped being used eventually make room for new ones. A
+// replaced item's count starts over. EvictSLRU is similar, with less
+// bookkeeping, but only tells apart items which were promoted from those which
+// weren't. EvictClock doesn't promote items at all, which takes the load of
+// Gets off the worker for read heavy workloads, at the cost of a less precise
+// recency (and GetsPerPromote is ignored).
+// Only used by Cache.
+// [EvictLRU]
+func (c *Configuration) Eviction(policy EvictionPolicy) *Configuration {
+	c.eviction = policy
+	return c
+}
+
+// Logs every Set, Delete and Clear (with the TTL) to the file at path, which is
+// replayed when the cache is created. Lighter than snapshots for large caches,
+// as only the changes are written. The log is compacted in the background, by
+// rewriting it with the cache's items, once it holds more than twice as many
+// changes as there were items. Changes are written shortly after they're made
+// (and all of them by Stop), errors are written to the standard logger.
+// Only used by Cache.
+func (c *Configuration) WriteAheadLog(path string) *Configuration {
+	c.walPath = path
+	return c
+}
+
+// Restores the cache from the snapshot at path when it's created, and then
+// saves a new snapshot there every interval (0 to only save on Stop), so that a
+// restarted process, including after a crash, starts mostly warm. Snapshots
+// are written with Cache.SaveFile and errors are written to the standard
+// logger.
+// Only used by Cache.
+func (c *Configuration) AutoSnapshot(path string, every time.Duration) *Configuration {
+	c.snapshotPath = path
+	c.snapshotEvery = every
+	return c
+}
+
+// Keeps the last size Sets and Deletes (and Clears) in a sequence-numbered
+// change feed, which a standby process can follow with Cache.ChangesSince to
+// keep a replica of the cache. A replica which falls more than size changes
+// behind has to start over from a snapshot. The feed holds on to the values
+// of the recorded Sets.
+// [0 - disabled]
+// Only used by Cache.
+func (c *Configuration) ChangeFeed(size int) *Configuration {
+	c.feedSize = size
+	return c
+}
+
+// Publishes the cache's size, item count, dropped count (the items evicted by
+// the GC, Stats.Evictions) and hit ratio (see Cache.Stats) under name with
+// expvar, so that /debug/vars picks them up. A cache created later with the
+// same name replaces this one.
+// Only used by Cache.
+func (c *Configuration) PublishExpvar(name string) *Configuration {
+	c.expvarName = name
+	return c
+}
+
+// Maintains a sorted index of the keys, which makes Cache.RangeKeys cheap. Meant
+// for caches whose keys encode a time or sequence. Every new or removed key
+// updates the index, at a cost of O(log n).
+// Only used by Cache.
+func (c *Configuration) OrderedIndex() *Configuration {
+	c.ordered = true
+	return c
+}
+
 // Typically, a cache is agnostic about how cached values are use. This is fine
 // for a typical cache usage, where you fetch an item from the cache, do something
 // (write it out) and nothing else.
@@ -94,6 +774,83 @@ func (c *Configuration) Track() *Configuration {
 	return c
 }
 
+// A debug facility which reports tracked items (see Track) that were garbage
+// collected without Release having been called, along with the file:line of
+// the TrackingGet or TrackingSet which first tracked them. Relies on runtime
+// finalizers, so reports happen some time after the leak, if ever. If report
+// is nil, leaks are written to the standard logger.
+func (c *Configuration) DetectTrackingLeaks(report func(key string, site string)) *Configuration {
+	if report == nil {
+		report = c.logLeak
+	}
+	c.leakReport = report
+	return c
+}
+
+func (c *Configuration) logLeak(key string, site string) {
+	if c.info != nil {
+		log.Printf("ccache: %s: item %q tracked at %s was never released", c.info.Name, key, site)
+	} else {
+		log.Printf("ccache: item %q tracked at %s was never released", key, site)
+	}
+}
+
+// A debug facility which detects values that were mutated in place while
+// cached: the value is checksummed (through the Codec) when it's set, and
+// verified when the item leaves the cache. Items whose value changed are passed
+// to report, or written to the standard logger if report is nil. The Codec's
+// output must be deterministic for a given value (gob's isn't for maps), and
+// values it can't marshal aren't checked.
+// Only used by Cache.
+func (c *Configuration) DetectMutations(report func(item *Item)) *Configuration {
+	if report == nil {
+		report = c.logMutation
+	}
+	c.onMutation = report
+	return c
+}
+
+func (c *Configuration) logSize(key string, size int64) {
+	if c.info != nil {
+		log.Printf("ccache: %s: the value of %q has a size of %d", c.info.Name, key, size)
+	} else {
+		log.Printf("ccache: the value of %q has a size of %d", key, size)
+	}
+}
+
+func (c *Configuration) logRefreshPanic(key string, v interface{}) {
+	if c.info != nil {
+		log.Printf("ccache: %s: the background refresh of %q panicked: %v", c.info.Name, key, v)
+	} else {
+		log.Printf("ccache: the background refresh of %q panicked: %v", key, v)
+	}
+}
+
+func (c *Configuration) logMutation(item *Item) {
+	if c.info != nil {
+		log.Printf("ccache: %s: the value of %q was modified while cached", c.info.Name, item.key)
+	} else {
+		log.Printf("ccache: the value of %q was modified while cached", item.key)
+	}
+}
+
+// Calls onExceeded when an item's reference count (see Track) goes above max,
+// which usually means that Release isn't being called (or is called in the
+// wrong place) and that the item can never be evicted. onExceeded is called
+// once, when the reference count first exceeds max.
+// [0 - unlimited]
+func (c *Configuration) MaxRefCount(max int32, onExceeded func(item *Item)) *Configuration {
+	c.maxRefCount = max
+	c.onMaxRefCount = onExceeded
+	return c
+}
+
+func (c *Configuration) checkRefCount(item *Item, count int32) {
+	if c.maxRefCount > 0 && count == c.maxRefCount+1 && c.onMaxRefCount != nil {
+		c.onMaxRefCount(item)
+	}
+}
+
 // OnDelete allows setting a callback function to react to ideam deletion.
 // This typically allows to do a cleanup of resources, such as calling a Close() on
 // cached object that require some kind of tear-down.
@@ -101,3 +858,152 @@ func (c *Configuration) OnDelete(callback func(item *Item)) *Configuration {
 	c.onDelete = callback
 	return c
 }
+
+// OnFetch allows setting a callback which is invoked with every value loaded by
+// Fetch, before it is cached. The value it returns is what gets cached (and
+// returned to the caller). Returning an error aborts the Fetch: nothing is cached
+// and the error is returned to the caller. This is a single place to validate,
+// normalize or compress loaded values.
+// For a LayeredCache, key is the primary key.
+func (c *Configuration) OnFetch(callback func(key string, value interface{}, duration time.Duration) (interface{}, error)) *Configuration {
+	c.onFetch = callback
+	return c
+}
+
+// The codec used to serialize values whenever they leave the process (snapshots,
+// persistence, replication). Values implementing ItemMarshaler are serialized
+// by themselves.
+// [GobCodec]
+func (c *Configuration) Codec(codec Codec) *Configuration {
+	c.codec = codec
+	return c
+}
+
+// Serves misses from a read-only snapshot (see WriteMappedSnapshot), so that a
+// large, mostly static, dataset can be kept off the Go heap. Values found in the
+// snapshot are decoded with the configured Codec and cached for duration.
+// Deleting a key only removes it from the cache: the next Get loads it from the
+// snapshot again.
+// Only used by Cache.
+func (c *Configuration) Underlay(snapshot *MappedSnapshot, duration time.Duration) *Configuration {
+	c.underlay = snapshot
+	c.underlayTTL = duration
+	return c
+}
+
+// Keeps the last size hits of each P in a small front cache which Get checks
+// before taking the bucket's lock. Worthwhile for a handful of extremely hot
+// keys. Removing or replacing an item which is in a front cache empties all of
+// them, so this hurts write-heavy caches.
+// Only used by Cache.
+func (c *Configuration) FrontCache(size uint32) *Configuration {
+	c.frontSize = int(size)
+	return c
+}
+
+// Records a histogram of the age of the items returned by Get, see
+// Cache.ServedAges. This measures how stale the served data is, which the TTL
+// only bounds.
+func (c *Configuration) TrackServedAge() *Configuration {
+	c.servedAge = true
+	return c
+}
+
+// Counts the number of times Get returns each item, see Item.Hits,
+// Cache.DrainHitCounts and Cache.DecayHitCounts.
+// Only used by Cache.
+func (c *Configuration) CountHits() *Configuration {
+	c.countHits = true
+	return c
+}
+
+// When the promote buffer stays full for saturatedFor, because the worker can't
+// keep up, Sets bypass the cache for openFor rather than each waiting on the
+// worker: the value isn't cached and any existing value for the key is deleted.
+// See Cache.Degraded and Cache.BypassedSets.
+// Only used by Cache.
+func (c *Configuration) CircuitBreaker(saturatedFor, openFor time.Duration) *Configuration {
+	c.saturatedFor = saturatedFor
+	c.openFor = openFor
+	return c
+}
+
+// Starts the cache with the settings of profile (e.g. a larger max size, or no
+// GC at all, while the cache fills up) rather than the configured ones. The
+// configured settings take over once the cache is older than duration or
+// larger than size (when either is > 0), or when Cache.EndWarmup is called.
+// Buffers are allocated once, so PromoteBuffer and DeleteBuffer can't vary
+// between profiles.
+// Only used by Cache.
+func (c *Configuration) Warmup(profile Profile, duration time.Duration, size int64) *Configuration {
+	c.warming = true
+	c.warmupProfile = profile
+	c.warmupFor = duration
+	c.warmupSize = size
+	return c
+}
+
+// Keeps the items evicted by the GC around for grace, during which a Get of
+// their key revives them (if they haven't expired) rather than missing. This
+// smooths out a max size which is slightly too small, at the cost of holding
+// on to evicted values for a little longer. Explicitly deleted items are never
+// revived.
+// Only used by Cache.
+func (c *Configuration) Ghosts(grace time.Duration) *Configuration {
+	c.ghostGrace = grace
+	return c
+}
+
+// Identifies a cache, see Configuration.Named
+type CacheInfo struct {
+	Name   string
+	Labels map[string]string
+}
+
+// Names the cache, so that callbacks shared by several caches can tell them
+// apart: the items passed to OnDelete, MaxRefCount's onExceeded, and so on,
+// expose the name and labels through Item.Cache. The default leak report (see
+// DetectTrackingLeaks) includes the name.
+func (c *Configuration) Named(name string, labels map[string]string) *Configuration {
+	c.info = &CacheInfo{Name: name, Labels: labels}
+	return c
+}
+
+// Builds a variant from another cached secondary key of the same primary key
+type deriver struct {
+	from   string
+	derive func(primary string, source *Item) (interface{}, error)
+}
+
+// On a Fetch miss for secondary, derive its value from the from secondary of
+// the same primary key, if that one is cached and not expired, rather than
+// calling fetch (e.g. render "json" from a cached "struct"). The derived item
+// expires along with its source. If derive returns an error, the next deriver
+// registered for secondary is tried, and then fetch.
+// Only used by LayeredCache.
+func (c *Configuration) DeriveVariant(secondary, from string, derive func(primary string, source *Item) (interface{}, error)) *Configuration {
+	if c.derivers == nil {
+		c.derivers = make(map[string][]deriver)
+	}
+	c.derivers[secondary] = append(c.derivers[secondary], deriver{from: from, derive: derive})
+	return c
+}
+
+// Panics on API misuse which is otherwise silent or obscure: a bucket count
+// which isn't a power of 2, Set after Stop, Release called more often than the
+// item was tracked and Sized values reporting a negative size. Meant for
+// development and tests.
+func (c *Configuration) Strict() *Configuration {
+	c.strict = true
+	return c
+}
+
+// Panics, in strict mode, if the configuration was given invalid values
+func (c *Configuration) validate() {
+	if c.strict && c.invalidBuckets != 0 {
+		panic(fmt.Sprintf("ccache: bucket count %d is not a power of 2", c.invalidBuckets))
+	}
+	if c.strict && c.hashLongKeys && c.maxKeyLength != 0 && c.maxKeyLength < minHashedKeyLength {
+		panic(fmt.Sprintf("ccache: a MaxKeyLength of %d is too short for HashLongKeys", c.maxKeyLength))
+	}
+}
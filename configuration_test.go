@@ -1,6 +1,7 @@
 package ccache
 
 import (
+	"strings"
 	"testing"
 
 	. "github.com/karlseguin/expect"
@@ -22,3 +23,57 @@ func (_ *ConfigurationTests) BucketsPowerOf2() {
 		}
 	}
 }
+
+func (_ *ConfigurationTests) ChecksKeyLength() {
+	c := Configure().MaxKeyLength(4)
+	key, ok := c.checkKey("abcd")
+	Expect(key, ok).To.Equal("abcd", true)
+	_, ok = c.checkKey("abcde")
+	Expect(ok).To.Equal(false)
+
+	// too short to hash
+	c.HashLongKeys()
+	_, ok = c.checkKey("abcde")
+	Expect(ok).To.Equal(false)
+
+	c.MaxKeyLength(30)
+	key, ok = c.checkKey(strings.Repeat("a", 30))
+	Expect(key, ok).To.Equal(strings.Repeat("a", 30), true)
+	key, ok = c.checkKey(strings.Repeat("a", 31))
+	Expect(ok).To.Equal(true)
+	Expect(len(key)).To.Equal(30)
+	Expect(key[0]).To.Equal(byte(0))
+	again, ok := c.checkKey(key)
+	Expect(again, ok).To.Equal(key, true)
+	other, _ := c.checkKey(strings.Repeat("a", 32))
+	Expect(other == key).To.Equal(false)
+
+	// the digests' namespace is reserved
+	_, ok = c.checkKey("\x00spice")
+	Expect(ok).To.Equal(false)
+
+	c.MaxKeyLength(100)
+	key, _ = c.checkKey(strings.Repeat("a", 101))
+	Expect(len(key)).To.Equal(44)
+}
+
+func (_ *ConfigurationTests) StrictRejectsInvalidBuckets() {
+	Expect(panics(func() { New(Configure().Strict().Buckets(3)) })).To.Equal(true)
+	Expect(panics(func() { Layered(Configure().Buckets(3).Strict()) })).To.Equal(true)
+	New(Configure().Buckets(3)).Stop()
+	New(Configure().Strict().Buckets(3).Buckets(4)).Stop()
+}
+
+func (_ *ConfigurationTests) StrictRejectsShortHashedKeys() {
+	Expect(panics(func() { New(Configure().Strict().MaxKeyLength(22).HashLongKeys()) })).To.Equal(true)
+	New(Configure().Strict().MaxKeyLength(23).HashLongKeys()).Stop()
+}
+
+// Whether fn panicked
+func panics(fn func()) (panicked bool) {
+	defer func() {
+		panicked = recover() != nil
+	}()
+	fn()
+	return false
+}
@@ -0,0 +1,154 @@
+package ccache
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// How long Diagnose observes the cache for
+const diagnoseWindow = 100 * time.Millisecond
+
+// The number of keys of Diagnose's micro-benchmark
+const diagnoseKeys = 1000
+
+// The result of Diagnose, meant to be logged
+type Diagnosis struct {
+	// The time a Get and a Set take on a bucket configured like the cache's,
+	// without any contention
+	BucketGet time.Duration
+	BucketSet time.Duration
+	// The time the worker took to answer a control command (such as GetSize)
+	WorkerLatency time.Duration
+	// The Gets and Sets per second while the cache was observed
+	GetRate float64
+	SetRate float64
+	// The fullest the promote and delete buffers were seen, from 0 to 1
+	PromoteBufferUse float64
+	DeleteBufferUse  float64
+	// Empty when nothing looks amiss
+	Recommendations []Recommendation
+}
+
+// A suggested change to the configuration
+type Recommendation struct {
+	// The Configuration setting, e.g. "Buckets"
+	Setting   string
+	Current   int64
+	Suggested int64
+	Reason    string
+}
+
+type diagnoseWorker struct {
+	res chan [2]int64
+}
+
+// Runs a brief micro-benchmark and checks the configuration against the
+// machine (GOMAXPROCS) and against the load the cache sees, which it observes
+// for about 100ms. Best called once the cache is warmed up and under its usual
+// load. The benchmark runs on a scratch bucket, so the cache's items and Stats
+// are unaffected.
+// This is a control command.
+func (c *Cache) Diagnose() Diagnosis {
+	var d Diagnosis
+	before := c.Stats()
+	start := time.Now()
+	d.BucketGet, d.BucketSet = c.benchmarkBucket()
+
+	res := make(chan [2]int64)
+	sent := time.Now()
+	c.control <- diagnoseWorker{res: res}
+	state := <-res
+	d.WorkerLatency = time.Since(sent)
+	size, maxSize := state[0], state[1]
+
+	for {
+		d.PromoteBufferUse = maxUse(d.PromoteBufferUse, len(c.promotables), cap(c.promotables))
+		d.DeleteBufferUse = maxUse(d.DeleteBufferUse, len(c.deletables), cap(c.deletables))
+		if time.Since(start) >= diagnoseWindow {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	after := c.Stats()
+	seconds := time.Since(start).Seconds()
+	d.GetRate = float64(after.Gets-before.Gets) / seconds
+	d.SetRate = float64(after.Sets-before.Sets) / seconds
+
+	recommend := func(setting string, current, suggested int64, reason string, args ...interface{}) {
+		d.Recommendations = append(d.Recommendations, Recommendation{
+			Setting:   setting,
+			Current:   current,
+			Suggested: suggested,
+			Reason:    fmt.Sprintf(reason, args...),
+		})
+	}
+	if procs := runtime.GOMAXPROCS(0); len(c.buckets) < procs {
+		recommend("Buckets", int64(len(c.buckets)), nextPowerOf2(int64(procs)),
+			"fewer buckets than GOMAXPROCS (%d), concurrent writes contend for the same locks", procs)
+	}
+	// the buffers should absorb 10ms of Sets, and not be seen close to full
+	if need := nextPowerOf2(int64(d.SetRate / 100)); need > int64(cap(c.promotables)) {
+		recommend("PromoteBuffer", int64(cap(c.promotables)), need,
+			"the buffer holds less than 10ms of Sets (%.0f/s)", d.SetRate)
+	} else if d.PromoteBufferUse >= 0.75 {
+		recommend("PromoteBuffer", int64(cap(c.promotables)), int64(2*cap(c.promotables)),
+			"the buffer was seen %.0f%% full, Sets block when it's full", 100*d.PromoteBufferUse)
+	}
+	if d.DeleteBufferUse >= 0.75 && c.spill == nil {
+		recommend("DeleteBuffer", int64(cap(c.deletables)), int64(2*cap(c.deletables)),
+			"the buffer was seen %.0f%% full, Deletes block when it's full (see SpillDeletes)", 100*d.DeleteBufferUse)
+	}
+	evictions := after.Evictions - before.Evictions
+	if sets := after.Sets - before.Sets; sets > 0 && evictions > sets/2 && size >= maxSize && after.HitRatio() < 0.5 {
+		recommend("MaxSize", maxSize, 2*maxSize,
+			"most Sets evict an item and fewer than half of the Gets hit, the cache looks too small")
+	}
+	return d
+}
+
+// Times Gets and Sets on a scratch bucket configured like the cache's
+func (c *Cache) benchmarkBucket() (get time.Duration, set time.Duration) {
+	model := c.buckets[0]
+	b := &bucket{
+		lookup: make(map[string]*Item),
+		cow:    model.cow,
+		inline: model.inline,
+		sizer:  model.sizer,
+	}
+	b.publish()
+	keys := make([]string, diagnoseKeys)
+	for i := range keys {
+		keys[i] = "ccache:diagnose:" + strconv.Itoa(i)
+	}
+	start := time.Now()
+	for i, key := range keys {
+		b.set(key, i, time.Minute, false)
+	}
+	set = time.Since(start) / diagnoseKeys
+	start = time.Now()
+	for _, key := range keys {
+		b.get(key)
+	}
+	get = time.Since(start) / diagnoseKeys
+	return get, set
+}
+
+func maxUse(use float64, length int, capacity int) float64 {
+	if capacity == 0 {
+		return use
+	}
+	if current := float64(length) / float64(capacity); current > use {
+		return current
+	}
+	return use
+}
+
+func nextPowerOf2(n int64) int64 {
+	power := int64(1)
+	for power < n {
+		power <<= 1
+	}
+	return power
+}
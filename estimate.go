@@ -0,0 +1,122 @@
+package ccache
+
+import "reflect"
+
+// Estimates how much memory the value takes, in bytes, by walking it with
+// reflection: the value itself, plus what its strings, slices, maps, pointers
+// and interfaces refer to, recursively. Memory which is reachable more than
+// once (through a shared pointer, slice or map) is counted once. Meant as a
+// Sizer (see Configuration.Sizer), for MaxSize in bytes without writing size
+// math for every type:
+//
+//	Configure().MaxSize(64 << 20).Sizer(ccache.EstimateSize)
+//
+// It's an estimate: allocator overhead and the internals of maps aren't
+// accounted for, and walking large values on every Set has a cost. Functions
+// and channels only count as a pointer.
+func EstimateSize(value interface{}) int64 {
+	if value == nil {
+		return 0
+	}
+	v := reflect.ValueOf(value)
+	e := sizeEstimator{seen: make(map[uintptr]struct{})}
+	return int64(v.Type().Size()) + e.indirect(v)
+}
+
+type sizeEstimator struct {
+	seen map[uintptr]struct{}
+}
+
+// Whether the memory at p wasn't counted yet
+func (e sizeEstimator) visit(p uintptr) bool {
+	if _, seen := e.seen[p]; seen {
+		return false
+	}
+	e.seen[p] = struct{}{}
+	return true
+}
+
+// The size of what v refers to, excluding v itself
+func (e sizeEstimator) indirect(v reflect.Value) int64 {
+	switch v.Kind() {
+	case reflect.String:
+		return int64(v.Len())
+	case reflect.Ptr:
+		if v.IsNil() || e.visit(v.Pointer()) == false {
+			return 0
+		}
+		elem := v.Elem()
+		return int64(elem.Type().Size()) + e.indirect(elem)
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		elem := v.Elem()
+		if elem.Kind() == reflect.Ptr {
+			// stored in the interface itself
+			return e.indirect(elem)
+		}
+		return int64(elem.Type().Size()) + e.indirect(elem)
+	case reflect.Slice:
+		if v.IsNil() || e.visit(v.Pointer()) == false {
+			return 0
+		}
+		size := int64(v.Cap()) * int64(v.Type().Elem().Size())
+		if direct(v.Type().Elem()) == false {
+			for i := 0; i < v.Len(); i++ {
+				size += e.indirect(v.Index(i))
+			}
+		}
+		return size
+	case reflect.Array:
+		size := int64(0)
+		if direct(v.Type().Elem()) == false {
+			for i := 0; i < v.Len(); i++ {
+				size += e.indirect(v.Index(i))
+			}
+		}
+		return size
+	case reflect.Struct:
+		size := int64(0)
+		for i := 0; i < v.NumField(); i++ {
+			size += e.indirect(v.Field(i))
+		}
+		return size
+	case reflect.Map:
+		if v.IsNil() || e.visit(v.Pointer()) == false {
+			return 0
+		}
+		t := v.Type()
+		size := int64(v.Len()) * int64(t.Key().Size()+t.Elem().Size())
+		if direct(t.Key()) && direct(t.Elem()) {
+			return size
+		}
+		entries := v.MapRange()
+		for entries.Next() {
+			size += e.indirect(entries.Key()) + e.indirect(entries.Value())
+		}
+		return size
+	}
+	return 0
+}
+
+// Whether values of type t don't refer to other memory
+func direct(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr, reflect.Float32, reflect.Float64,
+		reflect.Complex64, reflect.Complex128:
+		return true
+	case reflect.Array:
+		return direct(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if direct(t.Field(i).Type) == false {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
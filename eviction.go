@@ -0,0 +1,55 @@
+package ccache
+
+import "container/list"
+
+// Orders the worker's list for an EvictionPolicy other than EvictLRU, which
+// is the list's natural order, or for EvictLRU with Configuration.Priorities,
+// which keeps the items grouped by priority (see prioritized). The GC evicts
+// from the back of the list either way. Owned by the worker.
+type evictionOrder interface {
+	// Adds the new item to l, returning its element
+	insert(l *list.List, item *Item) *list.Element
+	// Moves the element of an item which was used
+	promote(l *list.List, element *list.Element)
+	// Called before the element is removed from l
+	remove(element *list.Element)
+	// Called when the GC evicted the item, after remove
+	evicted(l *list.List, item *Item)
+	// Called when the size of a listed item changed by delta
+	resized(item *Item, delta int64)
+	// Called when l is replaced by an empty list
+	reset()
+}
+
+// Adds the new item to the worker's list
+func (c *Cache) link(item *Item) {
+	if c.order != nil {
+		item.element = c.order.insert(c.list, item)
+	} else {
+		item.element = c.list.PushFront(item)
+	}
+	if c.expiry != nil {
+		c.expiry.add(item)
+	}
+}
+
+// Removes the element from the worker's list
+func (c *Cache) unlink(element *list.Element) {
+	if c.order != nil {
+		c.order.remove(element)
+	}
+	if c.expiry != nil {
+		c.expiry.remove(element.Value.(*Item))
+	}
+	c.moved(element)
+	c.list.Remove(element)
+	c.removed()
+}
+
+// Forgets the GC's cursor if it's the element being moved or removed, else
+// the next GC would resume from wherever the element went
+func (c *Cache) moved(element *list.Element) {
+	if c.gcCursor == element {
+		c.gcCursor = nil
+	}
+}
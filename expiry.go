@@ -0,0 +1,91 @@
+package ccache
+
+import (
+	"container/heap"
+	"sync/atomic"
+	"time"
+)
+
+// The worker's items ordered by expiry, so that ExpireEvery can remove the
+// expired ones without walking the whole list. Items are ordered by the expiry
+// they had when they were added: one which was extended since is put back
+// when it comes up. Owned by the worker.
+type expiryHeap []*Item
+
+func (h expiryHeap) Len() int { return len(h) }
+
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiryAt < h[j].expiryAt }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].expiryIndex = i
+	h[j].expiryIndex = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	item := x.(*Item)
+	item.expiryIndex = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+func (h *expiryHeap) add(item *Item) {
+	item.expiryAt = atomic.LoadInt64(&item.expires)
+	heap.Push(h, item)
+}
+
+func (h *expiryHeap) remove(item *Item) {
+	// items of a list replaced by Clear or SwapAll aren't in the heap anymore
+	if i := item.expiryIndex; i < len(*h) && (*h)[i] == item {
+		heap.Remove(h, i)
+	}
+}
+
+func (h *expiryHeap) reset() {
+	*h = nil
+}
+
+// Removes the items which expired (longer ago than the grace periods of
+// ServeStaleFor and StaleWhileRevalidate), see Configuration.ExpireEvery.
+// Called by the worker.
+func (c *Cache) expireDue() int {
+	if c.Frozen() {
+		return 0
+	}
+	grace := c.staleFor
+	if c.staleWindow > grace {
+		grace = c.staleWindow
+	}
+	deadline := time.Now().UnixNano() - int64(grace)
+	expired := 0
+	var held []*Item
+	for h := c.expiry; len(*h) > 0 && (*h)[0].expiryAt < deadline; {
+		item := (*h)[0]
+		if expires := atomic.LoadInt64(&item.expires); expires >= deadline {
+			// extended since it was added
+			item.expiryAt = expires
+			heap.Fix(h, 0)
+			continue
+		}
+		if c.tracking && atomic.LoadInt32(&item.refCount) > 0 {
+			// tried again on the next tick
+			heap.Pop(h)
+			held = append(held, item)
+			continue
+		}
+		c.expire(item)
+		expired++
+	}
+	for _, item := range held {
+		heap.Push(c.expiry, item)
+	}
+	atomic.AddInt64(&c.stats.expirations, int64(expired))
+	return expired
+}
@@ -0,0 +1,61 @@
+package ccache
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+// name => the cache currently published under it, see
+// Configuration.PublishExpvar. expvar can't unpublish, so each name is
+// published once and a newer cache with the same name replaces the older one.
+// Once the cache is stopped, the name shows zeroed stats.
+var (
+	publishedLock sync.Mutex
+	published     = make(map[string]*Cache)
+)
+
+func publishExpvar(name string, c *Cache) {
+	publishedLock.Lock()
+	defer publishedLock.Unlock()
+	if _, exists := published[name]; exists == false {
+		expvar.Publish(name, expvar.Func(func() interface{} {
+			// held while the stats are read, so that Stop, which unpublishes
+			// first, doesn't stop the worker meanwhile
+			publishedLock.Lock()
+			defer publishedLock.Unlock()
+			return published[name].expvar()
+		}))
+	}
+	published[name] = c
+}
+
+// Called by Stop. Leaves the name alone if a newer cache took it over.
+func unpublishExpvar(name string, c *Cache) {
+	publishedLock.Lock()
+	if published[name] == c {
+		// kept, as a name can only be published once
+		published[name] = nil
+	}
+	publishedLock.Unlock()
+}
+
+// Called under publishedLock. dropped is the number of items evicted by the GC
+// (Stats.Evictions): unlike GetDropped, reading it doesn't reset it.
+func (c *Cache) expvar() interface{} {
+	if c == nil || atomic.LoadInt32(&c.stopped) == 1 {
+		return map[string]interface{}{
+			"items":     0,
+			"size":      0,
+			"dropped":   0,
+			"hit_ratio": 0.0,
+		}
+	}
+	stats := c.Stats()
+	return map[string]interface{}{
+		"items":     c.ItemCount(),
+		"size":      c.GetSize(),
+		"dropped":   stats.Evictions,
+		"hit_ratio": stats.HitRatio(),
+	}
+}
@@ -0,0 +1,203 @@
+package ccache
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// An in-memory Interface for the tests of code which uses a cache. Items are
+// kept in a map, without a worker, and are never evicted. Its behavior can be
+// scripted, at any time, with Miss and Latency. It's safe for concurrent use.
+type Fake struct {
+	lock       sync.Mutex
+	items      map[string]*Item
+	misses     map[string]bool
+	missAll    bool
+	latency    time.Duration
+	defaultTTL time.Duration
+}
+
+// Creates an empty Fake. Put uses defaultTTL, and panics if it isn't positive,
+// as Cache.Put does without a DefaultTTL.
+func NewFake(defaultTTL time.Duration) *Fake {
+	return &Fake{
+		items:      make(map[string]*Item),
+		misses:     make(map[string]bool),
+		defaultTTL: defaultTTL,
+	}
+}
+
+// Makes the reads (Get, GetWithoutPromote, TTL and the Fetch family) of keys
+// miss, even when they're cached, so that Fetch calls its fetch function.
+// Without keys, every read misses. Miss can be called again to add keys.
+func (f *Fake) Miss(keys ...string) *Fake {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(keys) == 0 {
+		f.missAll = true
+	}
+	for _, key := range keys {
+		f.misses[key] = true
+	}
+	return f
+}
+
+// Stops forcing misses, see Miss
+func (f *Fake) Hit() *Fake {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.missAll = false
+	f.misses = make(map[string]bool)
+	return f
+}
+
+// Makes every operation sleep for latency first, e.g. to test timeouts
+func (f *Fake) Latency(latency time.Duration) *Fake {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.latency = latency
+	return f
+}
+
+// Sleeps for the configured latency and locks the fake
+func (f *Fake) enter() {
+	f.lock.Lock()
+	latency := f.latency
+	f.lock.Unlock()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	f.lock.Lock()
+}
+
+// Must be called under the lock
+func (f *Fake) lookup(key string) *Item {
+	if f.missAll || f.misses[key] {
+		return nil
+	}
+	return f.items[key]
+}
+
+func (f *Fake) Get(key string) *Item {
+	f.enter()
+	defer f.lock.Unlock()
+	return f.lookup(key)
+}
+
+func (f *Fake) GetWithoutPromote(key string) *Item {
+	return f.Get(key)
+}
+
+func (f *Fake) TTL(key string) (time.Duration, bool) {
+	item := f.Get(key)
+	if item == nil {
+		return 0, false
+	}
+	return item.TTL(), true
+}
+
+func (f *Fake) Set(key string, value interface{}, duration time.Duration) {
+	f.enter()
+	defer f.lock.Unlock()
+	f.items[key] = newItem(key, value, time.Now().Add(duration).UnixNano(), false)
+}
+
+func (f *Fake) Put(key string, value interface{}) {
+	if f.defaultTTL <= 0 {
+		panic("ccache: Put called without a DefaultTTL")
+	}
+	f.Set(key, value, f.defaultTTL)
+}
+
+// Replaces the value of a cached key, keeping its TTL. Forced misses don't
+// apply.
+func (f *Fake) Replace(key string, value interface{}) bool {
+	f.enter()
+	defer f.lock.Unlock()
+	item, exists := f.items[key]
+	if exists == false {
+		return false
+	}
+	f.items[key] = newItem(key, value, item.expires, false)
+	return true
+}
+
+func (f *Fake) Fetch(key string, duration time.Duration, fetch func() (interface{}, error)) (*Item, error) {
+	return f.FetchWithTTL(key, fixedTTL(duration, fetch))
+}
+
+// Like Cache.FetchWithTTL, but concurrent misses aren't coalesced, and fetch
+// is called without the fake's lock
+func (f *Fake) FetchWithTTL(key string, fetch func() (interface{}, time.Duration, error)) (*Item, error) {
+	if item := f.Get(key); item != nil && !item.Expired() {
+		return item, nil
+	}
+	value, duration, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	item := newItem(key, value, time.Now().Add(duration).UnixNano(), false)
+	f.lock.Lock()
+	f.items[key] = item
+	f.lock.Unlock()
+	return item, nil
+}
+
+func (f *Fake) Delete(key string) bool {
+	f.enter()
+	defer f.lock.Unlock()
+	_, exists := f.items[key]
+	delete(f.items, key)
+	return exists
+}
+
+func (f *Fake) DeletePrefix(prefix string) int {
+	return f.DeleteFunc(func(key string, item *Item) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+func (f *Fake) DeleteFunc(matches func(key string, item *Item) bool) int {
+	f.enter()
+	defer f.lock.Unlock()
+	count := 0
+	for key, item := range f.items {
+		if matches(key, item) {
+			delete(f.items, key)
+			count++
+		}
+	}
+	return count
+}
+
+// Calls matches with the items (in no particular order) until it returns
+// false. matches is called without the fake's lock.
+func (f *Fake) ForEachFunc(matches func(key string, item *Item) bool) {
+	f.enter()
+	items := make([]*Item, 0, len(f.items))
+	for _, item := range f.items {
+		items = append(items, item)
+	}
+	f.lock.Unlock()
+	for _, item := range items {
+		if matches(item.key, item) == false {
+			return
+		}
+	}
+}
+
+func (f *Fake) ItemCount() int {
+	f.enter()
+	defer f.lock.Unlock()
+	return len(f.items)
+}
+
+func (f *Fake) Clear() {
+	f.enter()
+	defer f.lock.Unlock()
+	f.items = make(map[string]*Item)
+}
+
+// Does nothing, the fake has no worker to stop
+func (f *Fake) Stop() {}
@@ -0,0 +1,61 @@
+package ccache
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/karlseguin/expect"
+)
+
+type FakeTests struct{}
+
+func Test_Fake(t *testing.T) {
+	Expectify(new(FakeTests), t)
+}
+
+func (_ FakeTests) BehavesLikeACache() {
+	var cache Interface = NewFake(time.Minute)
+	cache.Set("spice", "flow", time.Hour)
+	cache.Put("worm", "sand")
+	Expect(cache.Get("spice").Value()).To.Equal("flow")
+	Expect(cache.Get("worm").TTL() <= time.Minute).To.Equal(true)
+	Expect(cache.Get("leto")).To.Equal(nil)
+	Expect(cache.Replace("spice", "melange")).To.Equal(true)
+	Expect(cache.Get("spice").Value()).To.Equal("melange")
+	Expect(cache.DeletePrefix("sp")).To.Equal(1)
+	Expect(cache.Delete("worm")).To.Equal(true)
+	Expect(cache.ItemCount()).To.Equal(0)
+}
+
+func (_ FakeTests) ForcesMisses() {
+	fake := NewFake(time.Minute)
+	fake.Set("spice", "flow", time.Hour)
+	fake.Set("worm", "sand", time.Hour)
+	fake.Miss("spice")
+
+	fetches := 0
+	fetch := func() (interface{}, error) {
+		fetches++
+		return "fetched", nil
+	}
+	Expect(fake.Get("spice")).To.Equal(nil)
+	Expect(fake.Get("worm").Value()).To.Equal("sand")
+	item, _ := fake.Fetch("spice", time.Minute, fetch)
+	Expect(item.Value()).To.Equal("fetched")
+	Expect(fetches).To.Equal(1)
+
+	fake.Hit()
+	item, _ = fake.Fetch("spice", time.Minute, fetch)
+	Expect(item.Value()).To.Equal("fetched")
+	Expect(fetches).To.Equal(1)
+
+	fake.Miss()
+	Expect(fake.Get("worm")).To.Equal(nil)
+}
+
+func (_ FakeTests) AddsLatency() {
+	fake := NewFake(time.Minute).Latency(time.Millisecond * 20)
+	start := time.Now()
+	fake.Get("spice")
+	Expect(time.Since(start) >= time.Millisecond*20).To.Equal(true)
+}
@@ -0,0 +1,85 @@
+package ccache
+
+import (
+	"strings"
+	"time"
+)
+
+// The flat (single key) API of Cache. A LayeredCache implements it through
+// Flat, so that code written against it can share storage with layered users.
+type KeyValue interface {
+	Get(key string) *Item
+	GetWithoutPromote(key string) *Item
+	TTL(key string) (time.Duration, bool)
+	Set(key string, value interface{}, duration time.Duration)
+	Replace(key string, value interface{}) bool
+	Fetch(key string, duration time.Duration, fetch func() (interface{}, error)) (*Item, error)
+	Delete(key string) bool
+}
+
+var _ KeyValue = (*Cache)(nil)
+var _ KeyValue = (*FlatCache)(nil)
+
+// A flat view of a LayeredCache, see LayeredCache.Flat
+type FlatCache struct {
+	cache     *LayeredCache
+	separator string
+}
+
+// Returns a view of the cache with the flat API of Cache, where the key
+// primary+separator+secondary is the item of primary and secondary. Keys are
+// split at the first separator, so primary keys mustn't contain it. A key
+// without the separator is the item of that primary key and an empty
+// secondary key.
+func (c *LayeredCache) Flat(separator string) *FlatCache {
+	return &FlatCache{cache: c, separator: separator}
+}
+
+func (f *FlatCache) split(key string) (string, string) {
+	if i := strings.Index(key, f.separator); i != -1 {
+		return key[:i], key[i+len(f.separator):]
+	}
+	return key, ""
+}
+
+// See LayeredCache.Get
+func (f *FlatCache) Get(key string) *Item {
+	primary, secondary := f.split(key)
+	return f.cache.Get(primary, secondary)
+}
+
+// See LayeredCache.GetWithoutPromote
+func (f *FlatCache) GetWithoutPromote(key string) *Item {
+	primary, secondary := f.split(key)
+	return f.cache.GetWithoutPromote(primary, secondary)
+}
+
+// See LayeredCache.TTL
+func (f *FlatCache) TTL(key string) (time.Duration, bool) {
+	primary, secondary := f.split(key)
+	return f.cache.TTL(primary, secondary)
+}
+
+// See LayeredCache.Set
+func (f *FlatCache) Set(key string, value interface{}, duration time.Duration) {
+	primary, secondary := f.split(key)
+	f.cache.Set(primary, secondary, value, duration)
+}
+
+// See LayeredCache.Replace
+func (f *FlatCache) Replace(key string, value interface{}) bool {
+	primary, secondary := f.split(key)
+	return f.cache.Replace(primary, secondary, value)
+}
+
+// See LayeredCache.Fetch
+func (f *FlatCache) Fetch(key string, duration time.Duration, fetch func() (interface{}, error)) (*Item, error) {
+	primary, secondary := f.split(key)
+	return f.cache.Fetch(primary, secondary, duration, fetch)
+}
+
+// See LayeredCache.Delete
+func (f *FlatCache) Delete(key string) bool {
+	primary, secondary := f.split(key)
+	return f.cache.Delete(primary, secondary)
+}
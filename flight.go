@@ -0,0 +1,169 @@
+package ccache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Returned by Fetch to the callers which were waiting on a fetch that panicked
+// (the caller which ran the fetch gets the panic).
+var ErrFetchPanicked = errors.New("ccache: the shared fetch panicked")
+
+// Coalesces concurrent fetches of the same key, so that only one of the callers
+// runs the fetch and the others wait for, and share, its result.
+type flights struct {
+	sync.Mutex
+	calls map[flightKey]*flight
+}
+
+// Cache only uses the secondary
+type flightKey struct {
+	primary   string
+	secondary string
+}
+
+type flight struct {
+	done chan struct{}
+	item *Item
+	err  error
+	// with doContext, the load's context is cancelled once all the callers
+	// waiting for it gave up
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func (f *flights) do(key flightKey, load func() (*Item, error)) (*Item, error) {
+	f.Lock()
+	if call, exists := f.calls[key]; exists {
+		call.waiters++
+		f.Unlock()
+		<-call.done
+		return call.item, call.err
+	}
+	call := f.start(key, nil)
+	f.Unlock()
+	f.run(key, call, load)
+	return call.item, call.err
+}
+
+// Like do, but the load runs in its own goroutine and receives a context which
+// is cancelled once every caller waiting for it gave up. Each caller stops
+// waiting when its own ctx is done, without cancelling the load for the others.
+func (f *flights) doContext(ctx context.Context, key flightKey, load func(ctx context.Context) (*Item, error)) (*Item, error) {
+	f.Lock()
+	call, exists := f.calls[key]
+	if exists == false {
+		loadCtx, cancel := context.WithCancel(detached{ctx})
+		call = f.start(key, cancel)
+		go func() {
+			defer cancel()
+			// nobody can be handed the panic, the waiters get ErrFetchPanicked
+			defer func() { recover() }()
+			f.run(key, call, func() (*Item, error) {
+				return load(loadCtx)
+			})
+		}()
+	}
+	call.waiters++
+	f.Unlock()
+
+	select {
+	case <-call.done:
+		return call.item, call.err
+	case <-ctx.Done():
+		f.Lock()
+		call.waiters--
+		if call.waiters == 0 && call.cancel != nil {
+			call.cancel()
+			// later callers start a new load rather than joining a cancelled one
+			if f.calls[key] == call {
+				delete(f.calls, key)
+			}
+		}
+		f.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// The loads which flights run in the background, see FetchStale
+type backgroundLoads struct {
+	sync.Mutex
+	wg      sync.WaitGroup
+	stopped bool
+}
+
+// Stops starting loads and waits for the running ones to finish
+func (b *backgroundLoads) stop() {
+	b.Lock()
+	b.stopped = true
+	b.Unlock()
+	b.wg.Wait()
+}
+
+// Runs load in the background, tracked by loads, unless a load of key is
+// already in flight or loads is stopped. A panic is passed to onPanic, as the
+// caller has moved on.
+func (f *flights) background(key flightKey, loads *backgroundLoads, load func() (*Item, error), onPanic func(v interface{})) {
+	f.Lock()
+	_, exists := f.calls[key]
+	f.Unlock()
+	if exists {
+		return
+	}
+	loads.Lock()
+	defer loads.Unlock()
+	if loads.stopped {
+		return
+	}
+	loads.wg.Add(1)
+	go func() {
+		defer loads.wg.Done()
+		defer func() {
+			if v := recover(); v != nil {
+				onPanic(v)
+			}
+		}()
+		f.do(key, load)
+	}()
+}
+
+// Registers a new flight for key. Must be called under the lock.
+func (f *flights) start(key flightKey, cancel context.CancelFunc) *flight {
+	if f.calls == nil {
+		f.calls = make(map[flightKey]*flight)
+	}
+	call := &flight{done: make(chan struct{}), cancel: cancel}
+	f.calls[key] = call
+	return call
+}
+
+// Runs the flight's load and then releases its waiters. If load panics, the
+// waiters get ErrFetchPanicked while the panic carries on.
+func (f *flights) run(key flightKey, call *flight, load func() (*Item, error)) {
+	finished := false
+	defer func() {
+		if finished == false {
+			call.err = ErrFetchPanicked
+		}
+		f.Lock()
+		if f.calls[key] == call {
+			delete(f.calls, key)
+		}
+		f.Unlock()
+		close(call.done)
+	}()
+	call.item, call.err = load()
+	finished = true
+}
+
+// A context with the values, but not the deadline or cancellation, of its
+// parent
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
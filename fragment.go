@@ -0,0 +1,32 @@
+package ccache
+
+import (
+	"bytes"
+	"io"
+	"time"
+)
+
+// Writes a rendered (e.g. HTML) fragment to w. The fragment is served from the
+// cache, as the variant (secondary key) of the page (primary key), or rendered
+// and cached for ttl if it's missing or expired. Fragments can then be purged
+// by page with DeleteAll, or individually with Delete.
+// render writes to a buffer, so nothing is written to w if it fails, and its
+// error is returned. Concurrent misses for the same fragment share one render.
+func Fragment(w io.Writer, cache *LayeredCache, page, variant string, ttl time.Duration, render func(w io.Writer) error) error {
+	item := cache.Get(page, variant)
+	if item == nil || item.Expired() {
+		var err error
+		item, err = cache.flights.do(flightKey{primary: page, secondary: variant}, func() (*Item, error) {
+			var buf bytes.Buffer
+			if err := render(&buf); err != nil {
+				return nil, err
+			}
+			return cache.set(page, variant, buf.Bytes(), ttl, false), nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(item.Value().([]byte))
+	return err
+}
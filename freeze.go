@@ -0,0 +1,29 @@
+package ccache
+
+import "sync/atomic"
+
+type unfreeze struct {
+	done chan struct{}
+}
+
+// Stops expirations and evictions, for example during a declared backend
+// maintenance: the GC and PurgeExpired don't remove anything, Get and Fetch
+// serve expired items (ignoring ServeStaleFor) and stale items aren't
+// revalidated. Reads, writes and deletes still work, and the cache can grow
+// past its max size.
+func (c *Cache) Freeze() {
+	atomic.StoreInt32(&c.frozen, 1)
+}
+
+// Undoes Freeze, GCing if the cache grew past its max size while frozen.
+// This is a control command.
+func (c *Cache) Unfreeze() {
+	done := make(chan struct{})
+	c.control <- unfreeze{done: done}
+	<-done
+}
+
+// Whether the cache is frozen, see Freeze
+func (c *Cache) Frozen() bool {
+	return atomic.LoadInt32(&c.frozen) == 1
+}
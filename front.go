@@ -0,0 +1,93 @@
+package ccache
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// A tiny front cache of recent hits, which Get checks before the buckets so
+// that the hottest keys don't even take a bucket's read lock. Each P gets its
+// own (via a sync.Pool), so there's nothing to synchronize. Rather than
+// invalidating each of them individually, removing an item which made it into
+// a front cache bumps the epoch, which empties them all. See
+// Configuration.FrontCache.
+type front struct {
+	// first, to be 64-bit aligned
+	epoch uint64
+	size  int
+	pool  sync.Pool
+}
+
+type frontCache struct {
+	epoch uint64
+	next  int
+	keys  []string
+	items []*Item
+}
+
+func newFront(size int) *front {
+	f := &front{size: size}
+	f.pool.New = func() interface{} {
+		return &frontCache{
+			keys:  make([]string, size),
+			items: make([]*Item, size),
+		}
+	}
+	return f
+}
+
+// Gets key from the calling P's front cache, or from bucket on a miss (adding
+// the item to the front cache if it's live)
+func (f *front) get(key string, bucket *bucket) *Item {
+	epoch := atomic.LoadUint64(&f.epoch)
+	fc := f.pool.Get().(*frontCache)
+	defer f.pool.Put(fc)
+	if fc.epoch != epoch {
+		fc.reset(epoch)
+	}
+	for i, k := range fc.keys {
+		if k == key && fc.items[i] != nil {
+			if item := fc.items[i]; item.Expired() == false {
+				return item
+			}
+			fc.items[i] = nil
+			break
+		}
+	}
+
+	item := bucket.get(key)
+	if item == nil || item.Expired() {
+		return item
+	}
+	// Once marked, removing the item bumps the epoch. Making sure the item is
+	// still current after marking it means that it can't have been removed
+	// without the epoch being bumped.
+	atomic.StoreInt32(&item.fronted, 1)
+	if bucket.get(key) != item {
+		return item
+	}
+	fc.keys[fc.next] = key
+	fc.items[fc.next] = item
+	fc.next = (fc.next + 1) % f.size
+	return item
+}
+
+func (fc *frontCache) reset(epoch uint64) {
+	for i := range fc.items {
+		fc.keys[i] = ""
+		fc.items[i] = nil
+	}
+	fc.epoch = epoch
+	fc.next = 0
+}
+
+// Called after item was removed from its bucket
+func (f *front) remove(item *Item) {
+	if atomic.LoadInt32(&item.fronted) == 1 {
+		f.invalidate()
+	}
+}
+
+func (f *front) invalidate() {
+	atomic.AddUint64(&f.epoch, 1)
+}
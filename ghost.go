@@ -0,0 +1,121 @@
+package ccache
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Items recently evicted by the GC, which Get can revive for a grace period,
+// see Configuration.Ghosts.
+type ghosts struct {
+	// first, so that it's 64-bit aligned for atomic access on 32-bit platforms
+	revivals int64
+	sync.Mutex
+	grace int64
+	items map[string]ghost
+}
+
+type ghost struct {
+	item    *Item
+	evicted int64
+}
+
+func newGhosts(grace time.Duration) *ghosts {
+	return &ghosts{
+		grace: int64(grace),
+		items: make(map[string]ghost),
+	}
+}
+
+// Called by the worker for each item the GC evicts
+func (g *ghosts) add(item *Item, now int64) {
+	g.Lock()
+	g.items[item.key] = ghost{item: item, evicted: now}
+	g.Unlock()
+}
+
+// Removes and returns the ghost of key, nil if there's none or if it's past
+// its grace period or expired
+func (g *ghosts) take(key string) *Item {
+	g.Lock()
+	ghost, exists := g.items[key]
+	if exists {
+		delete(g.items, key)
+	}
+	g.Unlock()
+	if exists == false || time.Now().UnixNano()-ghost.evicted > g.grace || ghost.item.Expired() {
+		return nil
+	}
+	atomic.AddInt64(&g.revivals, 1)
+	return ghost.item
+}
+
+func (g *ghosts) delete(key string) {
+	g.Lock()
+	delete(g.items, key)
+	g.Unlock()
+}
+
+func (g *ghosts) deleteFunc(matches func(key string, item *Item) bool) {
+	g.Lock()
+	defer g.Unlock()
+	for key, ghost := range g.items {
+		if matches(key, ghost.item) {
+			delete(g.items, key)
+		}
+	}
+}
+
+func (g *ghosts) deletePrefix(prefix string) {
+	g.deleteFunc(func(key string, item *Item) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+// Drops the ghosts which are past their grace period
+func (g *ghosts) sweep(now int64) {
+	g.Lock()
+	defer g.Unlock()
+	for key, ghost := range g.items {
+		if now-ghost.evicted > g.grace {
+			delete(g.items, key)
+		}
+	}
+}
+
+func (g *ghosts) clear() {
+	g.Lock()
+	g.items = make(map[string]ghost)
+	g.Unlock()
+}
+
+// Revives key from the ghosts, if it was evicted within the grace period. The
+// key may have been set since the caller's miss, that newer item then wins.
+func (c *Cache) revive(key string) *Item {
+	ghost := c.ghosts.take(key)
+	if ghost == nil {
+		return nil
+	}
+	bucket := c.bucket(key)
+	item, _ := bucket.setIf(bucket.newItem(key, ghost.Value(), ghost.TTL(), false), func(existing *Item) bool {
+		return existing == nil
+	})
+	if item == nil {
+		return bucket.get(key)
+	}
+	if c.shadow != nil {
+		c.shadow.set(key, item.size, item.expires)
+	}
+	c.promoteNew(item)
+	return item
+}
+
+// The number of evicted items which Get revived, see Configuration.Ghosts
+func (c *Cache) GhostRevivals() int64 {
+	if c.ghosts == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&c.ghosts.revivals)
+}
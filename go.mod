@@ -1,5 +1,7 @@
 module github.com/karlseguin/ccache/v2
 
-go 1.13
+go 1.18
 
 require github.com/karlseguin/expect v1.0.7
+
+require github.com/wsxiaoys/terminal v0.0.0-20160513160801-0940f3fc43a0 // indirect
@@ -0,0 +1,98 @@
+package ccache
+
+import (
+	"math/rand"
+	"sync"
+)
+
+const indexMaxLevel = 24
+
+// A sorted index of the cache's keys, see Configuration.OrderedIndex. It's a
+// skiplist, kept up to date by the buckets (under their write lock) whenever a
+// key is added or removed.
+type keyIndex struct {
+	sync.Mutex
+	head  indexNode
+	level int
+	rand  *rand.Rand
+}
+
+type indexNode struct {
+	key  string
+	next []*indexNode
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		level: 1,
+		head:  indexNode{next: make([]*indexNode, indexMaxLevel)},
+		rand:  rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+// Fills path with the last node before key at each level. Must be called
+// under the lock.
+func (x *keyIndex) find(key string, path []*indexNode) *indexNode {
+	node := &x.head
+	for level := x.level - 1; level >= 0; level-- {
+		for next := node.next[level]; next != nil && next.key < key; next = node.next[level] {
+			node = next
+		}
+		if path != nil {
+			path[level] = node
+		}
+	}
+	return node.next[0]
+}
+
+func (x *keyIndex) add(key string) {
+	var path [indexMaxLevel]*indexNode
+	x.Lock()
+	defer x.Unlock()
+	if next := x.find(key, path[:]); next != nil && next.key == key {
+		return
+	}
+	level := 1
+	for level < indexMaxLevel && x.rand.Intn(4) == 0 {
+		level++
+	}
+	for ; x.level < level; x.level++ {
+		path[x.level] = &x.head
+	}
+	node := &indexNode{key: key, next: make([]*indexNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = path[i].next[i]
+		path[i].next[i] = node
+	}
+}
+
+func (x *keyIndex) remove(key string) {
+	var path [indexMaxLevel]*indexNode
+	x.Lock()
+	defer x.Unlock()
+	node := x.find(key, path[:])
+	if node == nil || node.key != key {
+		return
+	}
+	for i := range node.next {
+		path[i].next[i] = node.next[i]
+	}
+	for x.level > 1 && x.head.next[x.level-1] == nil {
+		x.level--
+	}
+}
+
+// The keys from from (inclusive) to to (exclusive, "" for no upper bound),
+// in order, up to limit of them (0 being unlimited)
+func (x *keyIndex) rangeKeys(from, to string, limit int) []string {
+	keys := make([]string, 0)
+	x.Lock()
+	defer x.Unlock()
+	for node := x.find(from, nil); node != nil && (to == "" || node.key < to); node = node.next[0] {
+		if limit > 0 && len(keys) == limit {
+			break
+		}
+		keys = append(keys, node.key)
+	}
+	return keys
+}
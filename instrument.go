@@ -0,0 +1,52 @@
+package ccache
+
+import (
+	"context"
+	"time"
+)
+
+// An operation reported to the Instrumentation
+type Operation string
+
+const (
+	OperationGet    Operation = "get"
+	OperationSet    Operation = "set"
+	OperationFetch  Operation = "fetch"
+	OperationDelete Operation = "delete"
+	OperationClear  Operation = "clear"
+)
+
+// The outcome of an operation reported to the Instrumentation
+type Outcome struct {
+	// Get: an unexpired item was found. Fetch: the item was served from the
+	// cache, without fetching. Delete: the key existed. Always false for Set and Clear.
+	Hit bool
+	// Fetch's error
+	Err      error
+	Duration time.Duration
+}
+
+// Observes the cache's operations, e.g. to trace them, see
+// Configuration.Instrument
+type Instrumentation interface {
+	// Called when an operation on key starts, the returned func is called once
+	// it completes. ctx is the context given to FetchContext, or
+	// context.Background() for the operations which don't take one. key is
+	// empty for Clear.
+	Start(ctx context.Context, op Operation, key string) func(Outcome)
+}
+
+func noopObserved(hit bool, err error) {}
+
+// Reports op to the instrumentation, the returned func must be called once op
+// completes
+func (c *Cache) observe(ctx context.Context, op Operation, key string) func(hit bool, err error) {
+	if c.instrumentation == nil {
+		return noopObserved
+	}
+	finish := c.instrumentation.Start(ctx, op, key)
+	start := time.Now()
+	return func(hit bool, err error) {
+		finish(Outcome{Hit: hit, Err: err, Duration: time.Since(start)})
+	}
+}
@@ -0,0 +1,41 @@
+package ccache
+
+import "time"
+
+// The common operations of Cache, so that code which uses a cache can be
+// tested against a Fake, without the worker goroutine.
+type Interface interface {
+	KeyValue
+	Put(key string, value interface{})
+	FetchWithTTL(key string, fetch func() (interface{}, time.Duration, error)) (*Item, error)
+	DeletePrefix(prefix string) int
+	DeleteFunc(matches func(key string, item *Item) bool) int
+	ForEachFunc(matches func(key string, item *Item) bool)
+	ItemCount() int
+	Clear()
+	Stop()
+}
+
+// The common operations of LayeredCache, see Interface
+type LayeredInterface interface {
+	Get(primary, secondary string) *Item
+	GetWithoutPromote(primary, secondary string) *Item
+	TTL(primary, secondary string) (time.Duration, bool)
+	Set(primary, secondary string, value interface{}, duration time.Duration)
+	Put(primary, secondary string, value interface{})
+	Replace(primary, secondary string, value interface{}) bool
+	Fetch(primary, secondary string, duration time.Duration, fetch func() (interface{}, error)) (*Item, error)
+	FetchWithTTL(primary, secondary string, fetch func() (interface{}, time.Duration, error)) (*Item, error)
+	Delete(primary, secondary string) bool
+	DeleteAll(primary string) bool
+	DeletePrefix(primary, prefix string) int
+	DeleteFunc(primary string, matches func(key string, item *Item) bool) int
+	ForEachFunc(primary string, matches func(key string, item *Item) bool)
+	ItemCount() int
+	Clear()
+	Stop()
+}
+
+var _ Interface = (*Cache)(nil)
+var _ Interface = (*Fake)(nil)
+var _ LayeredInterface = (*LayeredCache)(nil)
@@ -3,6 +3,9 @@ package ccache
 import (
 	"container/list"
 	"fmt"
+	"math"
+	"math/rand"
+	"runtime"
 	"sync/atomic"
 	"time"
 )
@@ -43,26 +46,79 @@ func (i *nilItem) Extend(duration time.Duration) {
 var NilTracked = new(nilItem)
 
 type Item struct {
+	// the int64s which are accessed atomically come first, so that they're
+	// 64-bit aligned on 32-bit platforms
+	expires int64
+	// Gets since the last DrainHitCounts, see Configuration.CountHits
+	hits int64
+	// how long the fetch which loaded the item took, see
+	// Configuration.EarlyExpiration
+	delta      int64
 	key        string
 	group      string
 	promotions int32
 	refCount   int32
-	expires    int64
 	size       int64
+	fence      uint64
+	modified   int64
 	value      interface{}
 	element    *list.Element
+	// the item's position within its primary key, see layeredGroups
+	groupElement *list.Element
+	// where the item was first tracked, see Configuration.DetectTrackingLeaks
+	site    string
+	watched int32
+	// with Configuration.InlineValues, scalar values are stored here rather
+	// than in value
+	scalar uint64
+	kind   scalarKind
+	// see Configuration.Strict
+	strict bool
+	// whether the item was added to a front cache, see front
+	fronted int32
+	// when the item was set
+	created int64
+	// the cache's name, see Configuration.Named
+	info *CacheInfo
+	// why the item was removed, see DeleteReason
+	reason int32
+	// the value's checksum when it was set, see Configuration.DetectMutations
+	checksum    uint64
+	checksummed bool
+	// the number of promotions, see EvictLFU. Owned by the worker.
+	uses uint8
+	// whether the item is in the protected segment, see EvictSLRU. Owned by
+	// the worker.
+	protected bool
+	// whether the item was ever protected, see EvictARC. Owned by the worker.
+	reused bool
+	// whether the size was given rather than the value's, see
+	// Cache.SetWithSize
+	fixedSize bool
+	// 1 when the item was read since the GC last considered it, see EvictClock
+	referenced int32
+	// when the item goes stale, 0 unless it was set with a soft TTL, see
+	// Cache.SetWithSoftTTL
+	soft int64
+	// 1 when the item is pinned, see Pin
+	pinned int32
+	// see Cache.SetWithPriority
+	priority Priority
+	// the item's position in the worker's expiryHeap, and the expiry it's
+	// ordered by. Owned by the worker.
+	expiryIndex int
+	expiryAt    int64
+	// the TTL which Gets push the expiry back by, 0 unless
+	// Configuration.SlidingTTL is set
+	sliding int64
 }
 
 func newItem(key string, value interface{}, expires int64, track bool) *Item {
-	size := int64(1)
-	if sized, ok := value.(Sized); ok {
-		size = sized.Size()
-	}
 	item := &Item{
 		key:        key,
 		value:      value,
 		promotions: 0,
-		size:       size,
+		size:       sizeOf(value, nil),
 		expires:    expires,
 	}
 	if track {
@@ -71,21 +127,240 @@ func newItem(key string, value interface{}, expires int64, track bool) *Item {
 	return item
 }
 
+// The size of a Sized value, else what sizer (see Configuration.Sizer) says
+// if it isn't nil, else 1
+func sizeOf(value interface{}, sizer func(value interface{}) int64) int64 {
+	if sized, ok := value.(Sized); ok {
+		return sized.Size()
+	}
+	if sizer != nil {
+		return sizer(value)
+	}
+	return 1
+}
+
+// Recalculates the size of a Sized value (or of any value with a sizer),
+// returning the difference
+func (i *Item) resize(sizer func(value interface{}) int64, behavior SizeBehavior, log func(key string, size int64)) int64 {
+	if i.fixedSize {
+		return 0
+	}
+	value := i.Value()
+	if _, ok := value.(Sized); ok == false && sizer == nil {
+		return 0
+	}
+	previous := i.size
+	i.size = sizeOf(value, sizer)
+	if i.strict {
+		i.checkSize()
+	}
+	i.fixSize(behavior, log)
+	return i.size - previous
+}
+
+// Applies the SizeBehavior to a zero or negative size, see
+// Configuration.NonPositiveSize. The item was already rejected if it had to be.
+func (i *Item) fixSize(behavior SizeBehavior, log func(key string, size int64)) {
+	if i.size > 0 || behavior == StoreNonPositiveSize {
+		return
+	}
+	if behavior == LogNonPositiveSize {
+		log(i.key, i.size)
+	}
+	i.size = 1
+}
+
+func (i *Item) checkSize() {
+	if i.size < 0 {
+		panic(fmt.Sprintf("ccache: negative size %d for key %q", i.size, i.key))
+	}
+}
+
 func (i *Item) shouldPromote(getsPerPromote int32) bool {
 	i.promotions += 1
 	return i.promotions == getsPerPromote
 }
 
+// Why an item was removed from the cache, available to the OnDelete callback
+// via Item.DeleteReason.
+type DeleteReason int32
+
+const (
+	// Removed by Delete, DeletePrefix or DeleteFunc
+	DeleteReasonDeleted DeleteReason = iota
+	// Overwritten by a Set (or Replace) of the same key
+	DeleteReasonReplaced
+	// Dropped by the garbage collector to stay within the max size
+	DeleteReasonEvicted
+	// Removed by PurgeExpired
+	DeleteReasonExpired
+	// Removed by LayeredCache.DeleteAll or LayeredCache.PurgeAll
+	DeleteReasonPurged
+	// Failed the Configuration.ValidateOnGet check
+	DeleteReasonInvalid
+)
+
+func (i *Item) setReason(reason DeleteReason) {
+	atomic.StoreInt32(&i.reason, int32(reason))
+}
+
+// Why the item was removed from the cache. Only meaningful once the item has
+// been removed, for example within the OnDelete callback.
+func (i *Item) DeleteReason() DeleteReason {
+	return DeleteReason(atomic.LoadInt32(&i.reason))
+}
+
+type scalarKind uint8
+
+const (
+	notScalar scalarKind = iota
+	intScalar
+	int64Scalar
+	uint64Scalar
+	float64Scalar
+	boolScalar
+)
+
+// Moves scalar values out of the interface and into the item itself
+func (i *Item) inlineValue() {
+	switch v := i.value.(type) {
+	case int:
+		i.scalar, i.kind = uint64(v), intScalar
+	case int64:
+		i.scalar, i.kind = uint64(v), int64Scalar
+	case uint64:
+		i.scalar, i.kind = v, uint64Scalar
+	case float64:
+		i.scalar, i.kind = math.Float64bits(v), float64Scalar
+	case bool:
+		i.kind = boolScalar
+		if v {
+			i.scalar = 1
+		}
+	default:
+		return
+	}
+	i.value = nil
+}
+
 func (i *Item) Value() interface{} {
+	switch i.kind {
+	case intScalar:
+		return int(i.scalar)
+	case int64Scalar:
+		return int64(i.scalar)
+	case uint64Scalar:
+		return i.scalar
+	case float64Scalar:
+		return math.Float64frombits(i.scalar)
+	case boolScalar:
+		return i.scalar == 1
+	}
 	return i.value
 }
 
-func (i *Item) track() {
-	atomic.AddInt32(&i.refCount, 1)
+// Returns the value as an int64 without boxing it in an interface{}, which
+// avoids an allocation for inlined values (see Configuration.InlineValues).
+// Returns false if the value isn't an int or an int64.
+func (i *Item) Int64() (int64, bool) {
+	switch i.kind {
+	case intScalar, int64Scalar:
+		return int64(i.scalar), true
+	}
+	switch v := i.value.(type) {
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	return 0, false
+}
+
+// The fencing token the item was set with (see Cache.SetIfVersionAtLeast), 0
+// for items set without one.
+func (i *Item) Fence() uint64 {
+	return i.fence
+}
+
+// The external modification time the item was set with (see
+// Cache.SetWithTimestamp), the zero time for items set without one.
+func (i *Item) Modified() time.Time {
+	if i.modified == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, i.modified)
+}
+
+// The number of times Get returned the item since it was set or since the last
+// Cache.DrainHitCounts, as scaled by Cache.DecayHitCounts. Always 0 unless
+// Configuration.CountHits was set.
+func (i *Item) Hits() int64 {
+	return atomic.LoadInt64(&i.hits)
+}
+
+// The name and labels of the cache the item belongs to, nil unless the cache
+// was configured with Named
+func (i *Item) Cache() *CacheInfo {
+	return i.info
+}
+
+func (i *Item) track() int32 {
+	return atomic.AddInt32(&i.refCount, 1)
+}
+
+// Sets a finalizer which reports the item if it's garbage collected while still
+// being tracked (i.e. Release wasn't called). skip is the number of stack frames
+// between the public Tracking* function and this call.
+func (i *Item) watchLeaks(report func(key string, site string), skip int) {
+	if atomic.CompareAndSwapInt32(&i.watched, 0, 1) == false {
+		return
+	}
+	if _, file, line, ok := runtime.Caller(skip + 1); ok {
+		i.site = fmt.Sprintf("%s:%d", file, line)
+	}
+	runtime.SetFinalizer(i, func(i *Item) {
+		if atomic.LoadInt32(&i.refCount) > 0 {
+			report(i.key, i.site)
+		}
+	})
+}
+
+// Exempts the item from eviction by the GC, for items which must stay cached,
+// such as feature flags or configuration. A pinned item is only removed when
+// it's deleted, replaced, or purged once expired. Pinned items still count
+// towards MaxSize, so pinning too many keeps the cache over its size, and every
+// GC walks past the pinned items it finds: pin a few items, not a large share
+// of the cache.
+func (i *Item) Pin() {
+	atomic.StoreInt32(&i.pinned, 1)
+}
+
+// Makes the item evictable again, see Pin
+func (i *Item) Unpin() {
+	atomic.StoreInt32(&i.pinned, 0)
+}
+
+func (i *Item) Priority() Priority {
+	return i.priority
+}
+
+func (i *Item) Pinned() bool {
+	return atomic.LoadInt32(&i.pinned) == 1
+}
+
+// Whether the GC can evict the item: it isn't pinned nor, with tracking,
+// referenced
+func (i *Item) evictable(tracking bool) bool {
+	if atomic.LoadInt32(&i.pinned) == 1 {
+		return false
+	}
+	return tracking == false || atomic.LoadInt32(&i.refCount) == 0
 }
 
 func (i *Item) Release() {
-	atomic.AddInt32(&i.refCount, -1)
+	if atomic.AddInt32(&i.refCount, -1) < 0 && i.strict {
+		panic(fmt.Sprintf("ccache: Release called more often than %q was tracked", i.key))
+	}
 }
 
 func (i *Item) Expired() bool {
@@ -93,6 +368,33 @@ func (i *Item) Expired() bool {
 	return expires < time.Now().UnixNano()
 }
 
+// Whether the item is being served past its expiry, or its soft TTL (see
+// Cache.SetWithSoftTTL). With ServeStaleFor, Get only returns expired items
+// during the configured grace period.
+func (i *Item) Stale() bool {
+	if i.soft != 0 && i.soft < time.Now().UnixNano() {
+		return true
+	}
+	return i.Expired()
+}
+
+// Whether the item expired more than grace ago
+func (i *Item) expiredFor(grace time.Duration) bool {
+	expires := atomic.LoadInt64(&i.expires)
+	return expires+int64(grace) < time.Now().UnixNano()
+}
+
+// Whether the item should be refreshed ahead of its expiry (XFetch). This gets
+// more likely as the item nears its expiry, and the longer it took to fetch.
+func (i *Item) expiresEarly(beta float64) bool {
+	delta := atomic.LoadInt64(&i.delta)
+	if delta == 0 {
+		return false
+	}
+	early := float64(delta) * beta * -math.Log(1-rand.Float64())
+	return float64(time.Now().UnixNano())+early >= float64(atomic.LoadInt64(&i.expires))
+}
+
 func (i *Item) TTL() time.Duration {
 	expires := atomic.LoadInt64(&i.expires)
 	return time.Nanosecond * time.Duration(expires-time.Now().UnixNano())
@@ -107,6 +409,15 @@ func (i *Item) Extend(duration time.Duration) {
 	atomic.StoreInt64(&i.expires, time.Now().Add(duration).UnixNano())
 }
 
+// Pushes the expiry of an unexpired item back to now plus the TTL it was set
+// with, see Configuration.SlidingTTL
+func (i *Item) slide() {
+	now := time.Now().UnixNano()
+	if atomic.LoadInt64(&i.expires) > now {
+		atomic.StoreInt64(&i.expires, now+i.sliding)
+	}
+}
+
 // String returns a string representation of the Item. This includes the default string
 // representation of its Value(), as implemented by fmt.Sprintf with "%v", but the exact
 // format of the string should not be relied on; it is provided only for debugging
@@ -114,5 +425,5 @@ func (i *Item) Extend(duration time.Duration) {
 // fmt.Sprintf expression could cause fields of the Item to be read in a non-thread-safe
 // way.
 func (i *Item) String() string {
-	return fmt.Sprintf("Item(%v)", i.value)
+	return fmt.Sprintf("Item(%v)", i.Value())
 }
@@ -4,6 +4,7 @@ import (
 	"math"
 	"testing"
 	"time"
+	"unsafe"
 
 	. "github.com/karlseguin/expect"
 )
@@ -20,6 +21,31 @@ func (_ *ItemTests) Promotability() {
 	Expect(item.shouldPromote(5)).To.Equal(false)
 }
 
+func (_ *ItemTests) EstimatesSizes() {
+	type node struct {
+		name string
+		next *node
+	}
+	looped := &node{name: "a"}
+	looped.next = looped
+	// the headers' sizes depend on the platform
+	ptr := int64(unsafe.Sizeof(uintptr(0)))
+	str := int64(unsafe.Sizeof(""))
+	slice := int64(unsafe.Sizeof([]byte(nil)))
+	iface := int64(unsafe.Sizeof(interface{}(nil)))
+	nodeSize := int64(unsafe.Sizeof(node{}))
+
+	Expect(EstimateSize(nil)).To.Equal(int64(0))
+	Expect(EstimateSize(int64(1))).To.Equal(int64(8))
+	Expect(EstimateSize("abc")).To.Equal(str + 3)
+	Expect(EstimateSize(make([]byte, 2, 10))).To.Equal(slice + 10)
+	Expect(EstimateSize([]string{"a", "bc"})).To.Equal(slice + 2*str + 3)
+	Expect(EstimateSize(map[string]int64{"ab": 1})).To.Equal(ptr + str + 8 + 2)
+	// the loop is only counted once
+	Expect(EstimateSize(looped)).To.Equal(ptr + nodeSize + 1)
+	Expect(EstimateSize([]interface{}{int64(1), looped})).To.Equal(slice + 2*iface + 8 + nodeSize + 1)
+}
+
 func (_ *ItemTests) Expired() {
 	now := time.Now().UnixNano()
 	item1 := &Item{expires: now + (10 * int64(time.Millisecond))}
@@ -47,3 +73,17 @@ func (_ *ItemTests) Extend() {
 	item.Extend(time.Minute * 2)
 	Expect(item.Expires().Unix()).To.Equal(time.Now().Unix() + 120)
 }
+
+func (_ *ItemTests) InlinesScalars() {
+	for _, value := range []interface{}{9001, int64(-3), uint64(4), 1.5, true, false, "flow"} {
+		item := &Item{value: value}
+		item.inlineValue()
+		Expect(item.Value()).To.Equal(value)
+	}
+
+	item := &Item{value: 9001}
+	item.inlineValue()
+	Expect(item.value).To.Equal(nil)
+	Expect(item.Int64()).To.Equal(int64(9001), true)
+	Expect((&Item{value: "flow"}).Int64()).To.Equal(int64(0), false)
+}
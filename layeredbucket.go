@@ -8,6 +8,11 @@ import (
 type layeredBucket struct {
 	sync.RWMutex
 	buckets map[string]*bucket
+	// see Configuration.Strict
+	strict bool
+	info   *CacheInfo
+	// see Configuration.IterationBatch
+	batch int
 }
 
 func (b *layeredBucket) itemCount() int {
@@ -28,6 +33,14 @@ func (b *layeredBucket) get(primary, secondary string) *Item {
 	return bucket.get(secondary)
 }
 
+func (b *layeredBucket) getFirst(primary string, secondaries []string, usable func(item *Item) bool) *Item {
+	bucket := b.getSecondaryBucket(primary)
+	if bucket == nil {
+		return nil
+	}
+	return bucket.getFirst(secondaries, usable)
+}
+
 func (b *layeredBucket) getSecondaryBucket(primary string) *bucket {
 	b.RLock()
 	bucket, exists := b.buckets[primary]
@@ -42,7 +55,7 @@ func (b *layeredBucket) set(primary, secondary string, value interface{}, durati
 	b.Lock()
 	bkt, exists := b.buckets[primary]
 	if exists == false {
-		bkt = &bucket{lookup: make(map[string]*Item)}
+		bkt = &bucket{lookup: make(map[string]*Item), strict: b.strict, info: b.info, batch: b.batch}
 		b.buckets[primary] = bkt
 	}
 	b.Unlock()
@@ -61,6 +74,15 @@ func (b *layeredBucket) delete(primary, secondary string) *Item {
 	return bucket.delete(secondary)
 }
 
+func (b *layeredBucket) evict(item *Item) {
+	b.RLock()
+	bucket, exists := b.buckets[item.group]
+	b.RUnlock()
+	if exists {
+		bucket.evict(item)
+	}
+}
+
 func (b *layeredBucket) deletePrefix(primary, prefix string, deletables chan *Item) int {
 	b.RLock()
 	bucket, exists := b.buckets[primary]
@@ -68,7 +90,7 @@ func (b *layeredBucket) deletePrefix(primary, prefix string, deletables chan *It
 	if exists == false {
 		return 0
 	}
-	return bucket.deletePrefix(prefix, deletables)
+	return bucket.deletePrefix(prefix, func(item *Item) { deletables <- item })
 }
 
 func (b *layeredBucket) deleteFunc(primary string, matches func(key string, item *Item) bool, deletables chan *Item) int {
@@ -78,35 +100,42 @@ func (b *layeredBucket) deleteFunc(primary string, matches func(key string, item
 	if exists == false {
 		return 0
 	}
-	return bucket.deleteFunc(matches, deletables)
+	return bucket.deleteFunc(matches, func(item *Item) { deletables <- item })
 }
 
-func (b *layeredBucket) deleteAll(primary string, deletables chan *Item) bool {
+func (b *layeredBucket) deleteAll(primary string, deletables chan *Item) int {
 	b.RLock()
 	bucket, exists := b.buckets[primary]
 	b.RUnlock()
 	if exists == false {
-		return false
+		return 0
 	}
 
 	bucket.Lock()
 	defer bucket.Unlock()
 
-	if l := len(bucket.lookup); l == 0 {
-		return false
-	}
+	count := len(bucket.lookup)
 	for key, item := range bucket.lookup {
 		delete(bucket.lookup, key)
+		item.setReason(DeleteReasonPurged)
 		deletables <- item
 	}
-	return true
+	if count > 0 {
+		bucket.publish()
+	}
+	return count
 }
 
-func (b *layeredBucket) forEachFunc(primary string, matches func(key string, item *Item) bool) {
+func (b *layeredBucket) forEachFunc(primary string, sorted bool, matches func(key string, item *Item) bool) {
 	b.RLock()
 	bucket, exists := b.buckets[primary]
 	b.RUnlock()
-	if exists {
+	if exists == false {
+		return
+	}
+	if sorted {
+		forEachSorted(bucket.collect(nil), matches)
+	} else {
 		bucket.forEachFunc(matches)
 	}
 }
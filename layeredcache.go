@@ -3,7 +3,7 @@ package ccache
 
 import (
 	"container/list"
-	"hash/fnv"
+	"context"
 	"sync/atomic"
 	"time"
 )
@@ -17,6 +17,13 @@ type LayeredCache struct {
 	deletables  chan *Item
 	promotables chan *Item
 	control     chan interface{}
+	fetchSlots  chan struct{}
+	groups      *layeredGroups
+	stopped     int32
+	ages        *servedAges
+	flights     flights
+	// see Cache.unlinked
+	unlinked int
 }
 
 // Create a new layered cache with the specified configuration.
@@ -33,6 +40,7 @@ type LayeredCache struct {
 
 // See ccache.Configure() for creating a configuration
 func Layered(config *Configuration) *LayeredCache {
+	config.validate()
 	c := &LayeredCache{
 		list:          list.New(),
 		Configuration: config,
@@ -44,8 +52,20 @@ func Layered(config *Configuration) *LayeredCache {
 	for i := 0; i < int(config.buckets); i++ {
 		c.buckets[i] = &layeredBucket{
 			buckets: make(map[string]*bucket),
+			strict:  config.strict,
+			info:    config.info,
+			batch:   config.iterationBatch,
 		}
 	}
+	if config.maxFetches > 0 {
+		c.fetchSlots = make(chan struct{}, config.maxFetches)
+	}
+	if config.maxPrimaries > 0 || config.maxSecondaries > 0 {
+		c.groups = newLayeredGroups()
+	}
+	if config.servedAge {
+		c.ages = newServedAges()
+	}
 	c.restart()
 	return c
 }
@@ -61,12 +81,39 @@ func (c *LayeredCache) ItemCount() int {
 // Get an item from the cache. Returns nil if the item wasn't found.
 // This can return an expired item. Use item.Expired() to see if the item
 // is expired and item.TTL() to see how long until the item expires (which
-// will be negative for an already expired item).
+// will be negative for an already expired item). With ServeStaleFor, items
+// which expired longer ago than the grace period are not returned.
 func (c *LayeredCache) Get(primary, secondary string) *Item {
 	item := c.bucket(primary).get(primary, secondary)
+	if item == nil || c.tooStale(item) {
+		return nil
+	}
+	return c.served(item)
+}
+
+// Returns the item of the first of secondaries which is present, in order of
+// preference, or nil if none are. Behaves like Get otherwise, but looks all of
+// the secondaries up under a single lock.
+func (c *LayeredCache) GetEither(primary string, secondaries ...string) *Item {
+	item := c.bucket(primary).getFirst(primary, secondaries, func(item *Item) bool {
+		return !c.tooStale(item)
+	})
 	if item == nil {
 		return nil
 	}
+	return c.served(item)
+}
+
+// Whether the item expired longer ago than ServeStaleFor allows
+func (c *LayeredCache) tooStale(item *Item) bool {
+	return c.staleFor > 0 && item.expiredFor(c.staleFor)
+}
+
+// Records and promotes an item returned by Get
+func (c *LayeredCache) served(item *Item) *Item {
+	if c.ages != nil {
+		c.ages.record(item)
+	}
 	if item.expires > time.Now().UnixNano() {
 		select {
 		case c.promotables <- item:
@@ -83,8 +130,31 @@ func (c *LayeredCache) GetWithoutPromote(primary, secondary string) *Item {
 	return c.bucket(primary).get(primary, secondary)
 }
 
+// Returns how long until the item expires (negative if it already has), and
+// false if it isn't cached. Like GetWithoutPromote, the item isn't promoted.
+func (c *LayeredCache) TTL(primary, secondary string) (time.Duration, bool) {
+	item := c.GetWithoutPromote(primary, secondary)
+	if item == nil {
+		return 0, false
+	}
+	return item.TTL(), true
+}
+
 func (c *LayeredCache) ForEachFunc(primary string, matches func(key string, item *Item) bool) {
-	c.bucket(primary).forEachFunc(primary, matches)
+	c.bucket(primary).forEachFunc(primary, c.sorted, matches)
+}
+
+// Returns the items of primary for which match returns true. Like
+// GetWithoutPromote, the items aren't promoted and may be expired.
+func (c *LayeredCache) FindFunc(primary string, match func(secondary string, item *Item) bool) []*Item {
+	var items []*Item
+	c.bucket(primary).forEachFunc(primary, c.sorted, func(key string, item *Item) bool {
+		if match(key, item) {
+			items = append(items, item)
+		}
+		return true
+	})
+	return items
 }
 
 // Get the secondary cache for a given primary key. This operation will
@@ -95,13 +165,14 @@ func (c *LayeredCache) GetOrCreateSecondaryCache(primary string) *SecondaryCache
 	bkt := primaryBkt.getSecondaryBucket(primary)
 	primaryBkt.Lock()
 	if bkt == nil {
-		bkt = &bucket{lookup: make(map[string]*Item)}
+		bkt = &bucket{lookup: make(map[string]*Item), strict: primaryBkt.strict, info: primaryBkt.info, batch: primaryBkt.batch}
 		primaryBkt.buckets[primary] = bkt
 	}
 	primaryBkt.Unlock()
 	return &SecondaryCache{
-		bucket: bkt,
-		pCache: c,
+		bucket:  bkt,
+		pCache:  c,
+		primary: primary,
 	}
 }
 
@@ -112,20 +183,44 @@ func (c *LayeredCache) TrackingGet(primary, secondary string) TrackedItem {
 	if item == nil {
 		return NilTracked
 	}
-	item.track()
+	c.checkRefCount(item, item.track())
+	if c.leakReport != nil {
+		item.watchLeaks(c.leakReport, 1)
+	}
+	return item
+}
+
+// Same as TrackingGet, but the item is automatically released once ctx is done.
+// See Cache.TrackingGetContext for details.
+func (c *LayeredCache) TrackingGetContext(ctx context.Context, primary, secondary string) TrackedItem {
+	item := c.TrackingGet(primary, secondary)
+	if item != NilTracked {
+		releaseWhenDone(ctx, item)
+	}
 	return item
 }
 
 // Set the value in the cache for the specified duration
 func (c *LayeredCache) TrackingSet(primary, secondary string, value interface{}, duration time.Duration) TrackedItem {
-	return c.set(primary, secondary, value, duration, true)
+	item := c.set(primary, secondary, value, duration, true)
+	if c.leakReport != nil {
+		item.watchLeaks(c.leakReport, 1)
+	}
+	return item
 }
 
-// Set the value in the cache for the specified duration
+// Set the value in the cache for the specified duration. The duration is used
+// as given, even when it's 0 and a DefaultTTL is configured.
 func (c *LayeredCache) Set(primary, secondary string, value interface{}, duration time.Duration) {
 	c.set(primary, secondary, value, duration, false)
 }
 
+// Set the value in the cache for the configured DefaultTTL. Panics if no
+// DefaultTTL is configured.
+func (c *LayeredCache) Put(primary, secondary string, value interface{}) {
+	c.set(primary, secondary, value, c.putTTL(), false)
+}
+
 // Replace the value if it exists, does not set if it doesn't.
 // Returns true if the item existed an was replaced, false otherwise.
 // Replace does not reset item's TTL nor does it alter its position in the LRU
@@ -141,21 +236,75 @@ func (c *LayeredCache) Replace(primary, secondary string, value interface{}) boo
 // Attempts to get the value from the cache and calles fetch on a miss.
 // If fetch returns an error, no value is cached and the error is returned back
 // to the caller.
-// Note that Fetch merely calls the public Get and Set functions. If you want
-// a different Fetch behavior, such as thundering herd protection or returning
-// expired items, implement it in your application.
+// Concurrent misses for the same key are coalesced: only one of the callers
+// runs its fetch, and they all get its item or error.
 func (c *LayeredCache) Fetch(primary, secondary string, duration time.Duration, fetch func() (interface{}, error)) (*Item, error) {
 	item := c.Get(primary, secondary)
 	if item != nil {
 		return item, nil
 	}
-	value, err := fetch()
+	return c.flights.do(flightKey{primary: primary, secondary: secondary}, func() (*Item, error) {
+		return c.fetch(primary, secondary, fixedTTL(duration, fetch))
+	})
+}
+
+// See Cache.FetchWithTTL
+func (c *LayeredCache) FetchWithTTL(primary, secondary string, fetch func() (interface{}, time.Duration, error)) (*Item, error) {
+	item := c.Get(primary, secondary)
+	if item != nil {
+		return item, nil
+	}
+	return c.flights.do(flightKey{primary: primary, secondary: secondary}, func() (*Item, error) {
+		return c.fetch(primary, secondary, fetch)
+	})
+}
+
+// See Cache.FetchContext
+func (c *LayeredCache) FetchContext(ctx context.Context, primary, secondary string, duration time.Duration, fetch func(ctx context.Context) (interface{}, error)) (*Item, error) {
+	item := c.Get(primary, secondary)
+	if item != nil {
+		return item, nil
+	}
+	return c.flights.doContext(ctx, flightKey{primary: primary, secondary: secondary}, func(ctx context.Context) (*Item, error) {
+		return c.fetch(primary, secondary, fixedTTL(duration, func() (interface{}, error) {
+			return fetch(ctx)
+		}))
+	})
+}
+
+func (c *LayeredCache) fetch(primary, secondary string, fetch func() (interface{}, time.Duration, error)) (*Item, error) {
+	if item := c.derive(primary, secondary); item != nil {
+		return item, nil
+	}
+	value, duration, err := doFetch(c.fetchSlots, c.fetchWait, fetch)
 	if err != nil {
 		return nil, err
 	}
+	if c.onFetch != nil {
+		if value, err = c.onFetch(primary, value, duration); err != nil {
+			return nil, err
+		}
+	}
 	return c.set(primary, secondary, value, duration, false), nil
 }
 
+// Builds and caches secondary from one of its registered sources, see
+// Configuration.DeriveVariant. Returns nil if it can't be derived.
+func (c *LayeredCache) derive(primary, secondary string) *Item {
+	for _, d := range c.derivers[secondary] {
+		source := c.Get(primary, d.from)
+		if source == nil || source.Expired() {
+			continue
+		}
+		value, err := d.derive(primary, source)
+		if err != nil {
+			continue
+		}
+		return c.set(primary, secondary, value, source.TTL(), false)
+	}
+	return nil
+}
+
 // Remove the item from the cache, return true if the item was present, false otherwise.
 func (c *LayeredCache) Delete(primary, secondary string) bool {
 	item := c.bucket(primary).delete(primary, secondary)
@@ -168,6 +317,12 @@ func (c *LayeredCache) Delete(primary, secondary string) bool {
 
 // Deletes all items that share the same primary key
 func (c *LayeredCache) DeleteAll(primary string) bool {
+	return c.PurgeAll(primary) > 0
+}
+
+// Like DeleteAll, but returns the number of items removed. The OnDelete
+// callback sees these items with a DeleteReasonPurged reason.
+func (c *LayeredCache) PurgeAll(primary string) int {
 	return c.bucket(primary).deleteAll(primary, c.deletables)
 }
 
@@ -189,6 +344,7 @@ func (c *LayeredCache) Clear() {
 }
 
 func (c *LayeredCache) Stop() {
+	atomic.StoreInt32(&c.stopped, 1)
 	close(c.promotables)
 	<-c.control
 }
@@ -222,6 +378,39 @@ func (c *LayeredCache) GC() {
 	<-done
 }
 
+// Removes every expired item and returns the number of items removed.
+// See Cache.PurgeExpired for details.
+// This is a control command.
+func (c *LayeredCache) PurgeExpired() int {
+	res := make(chan int)
+	c.control <- purgeExpired{res: res}
+	return <-res
+}
+
+// Recalculates the size of the item, for Sized values which grew or shrank
+// in place, and GCs if the cache is now too large. Returns false if the item
+// doesn't exist.
+// This is a control command.
+func (c *LayeredCache) Resize(primary, secondary string) bool {
+	item := c.bucket(primary).get(primary, secondary)
+	if item == nil {
+		return false
+	}
+	done := make(chan struct{})
+	c.control <- resize{item: item, done: done}
+	<-done
+	return true
+}
+
+// Gets the histogram of the age of the items returned by Get since the cache
+// was created. Returns zeroed stats unless TrackServedAge was configured.
+func (c *LayeredCache) ServedAges() ServedAges {
+	if c.ages == nil {
+		return newServedAges().get()
+	}
+	return c.ages.get()
+}
+
 // Gets the size of the cache. This is an O(1) call to make, but it is handled
 // by the worker goroutine. It's meant to be called periodically for metrics, or
 // from tests.
@@ -241,6 +430,7 @@ func (c *LayeredCache) restart() {
 func (c *LayeredCache) set(primary, secondary string, value interface{}, duration time.Duration, track bool) *Item {
 	item, existing := c.bucket(primary).set(primary, secondary, value, duration, track)
 	if existing != nil {
+		existing.setReason(DeleteReasonReplaced)
 		c.deletables <- existing
 	}
 	c.promote(item)
@@ -248,12 +438,13 @@ func (c *LayeredCache) set(primary, secondary string, value interface{}, duratio
 }
 
 func (c *LayeredCache) bucket(key string) *layeredBucket {
-	h := fnv.New32a()
-	h.Write([]byte(key))
-	return c.buckets[h.Sum32()&c.bucketMask]
+	return c.buckets[hash(key)&c.bucketMask]
 }
 
 func (c *LayeredCache) promote(item *Item) {
+	if c.strict && atomic.LoadInt32(&c.stopped) == 1 {
+		panic("ccache: Set called after Stop")
+	}
 	c.promotables <- item
 }
 
@@ -261,7 +452,11 @@ func (c *LayeredCache) worker() {
 	defer close(c.control)
 	dropped := 0
 	promoteItem := func(item *Item) {
-		if c.doPromote(item) && c.size > c.maxSize {
+		isNew := c.doPromote(item)
+		if isNew && c.groups != nil {
+			dropped += c.enforceGroupLimits(item.group)
+		}
+		if isNew && c.size > c.maxSize {
 			dropped += c.gc()
 		}
 	}
@@ -273,10 +468,29 @@ func (c *LayeredCache) worker() {
 			if c.onDelete != nil {
 				c.onDelete(item)
 			}
-			c.list.Remove(item.element)
+			c.unlink(item.element)
+			item.element = nil
+			atomic.StoreInt32(&item.promotions, -2)
+			if c.groups != nil {
+				c.groups.remove(item)
+			}
 		}
 	}
+	// nil, which is never ready, unless Configuration.ExpireEvery is set
+	var expiring <-chan time.Time
+	if c.expireEvery > 0 {
+		ticker := time.NewTicker(c.expireEvery)
+		defer ticker.Stop()
+		expiring = ticker.C
+	}
 	for {
+		// deletes free memory, so they're favored when both queues are backed up
+		select {
+		case item := <-c.deletables:
+			deleteItem(item)
+			continue
+		default:
+		}
 		select {
 		case item, ok := <-c.promotables:
 			if ok == false {
@@ -285,6 +499,8 @@ func (c *LayeredCache) worker() {
 			promoteItem(item)
 		case item := <-c.deletables:
 			deleteItem(item)
+		case <-expiring:
+			c.purgeExpired()
 		case control := <-c.control:
 			switch msg := control.(type) {
 			case getDropped:
@@ -302,9 +518,24 @@ func (c *LayeredCache) worker() {
 				}
 				c.size = 0
 				c.list = list.New()
+				if c.groups != nil {
+					c.groups = newLayeredGroups()
+				}
 				msg.done <- struct{}{}
 			case getSize:
 				msg.res <- c.size
+			case purgeExpired:
+				msg.res <- c.purgeExpired()
+			case compact:
+				msg.res <- c.compact(msg.ratio, true)
+			case resize:
+				if delta := msg.item.resize(nil, StoreNonPositiveSize, nil); delta != 0 && msg.item.element != nil {
+					c.size += delta
+					if c.size > c.maxSize {
+						dropped += c.gc()
+					}
+				}
+				msg.done <- struct{}{}
 			case gc:
 				dropped += c.gc()
 				msg.done <- struct{}{}
@@ -312,6 +543,8 @@ func (c *LayeredCache) worker() {
 				doAllPendingPromotesAndDeletes(c.promotables, promoteItem,
 					c.deletables, deleteItem)
 				msg.done <- struct{}{}
+			case pauseWorker:
+				<-msg.resume
 			}
 		}
 	}
@@ -326,11 +559,17 @@ func (c *LayeredCache) doPromote(item *Item) bool {
 		if item.shouldPromote(c.getsPerPromote) {
 			c.list.MoveToFront(item.element)
 			atomic.StoreInt32(&item.promotions, 0)
+			if c.groups != nil {
+				c.groups.promote(item, false)
+			}
 		}
 		return false
 	}
 	c.size += item.size
 	item.element = c.list.PushFront(item)
+	if c.groups != nil {
+		c.groups.promote(item, true)
+	}
 	return true
 }
 
@@ -349,10 +588,21 @@ func (c *LayeredCache) gc() int {
 		}
 		prev := element.Prev()
 		item := element.Value.(*Item)
+		if item.Pinned() {
+			// see Cache.gc
+			element = prev
+			i--
+			continue
+		}
 		if c.tracking == false || atomic.LoadInt32(&item.refCount) == 0 {
 			c.bucket(item.group).delete(item.group, item.key)
+			item.setReason(DeleteReasonEvicted)
 			c.size -= item.size
-			c.list.Remove(element)
+			c.unlink(element)
+			item.element = nil
+			if c.groups != nil {
+				c.groups.remove(item)
+			}
 			if c.onDelete != nil {
 				c.onDelete(item)
 			}
@@ -363,3 +613,29 @@ func (c *LayeredCache) gc() int {
 	}
 	return dropped
 }
+
+func (c *LayeredCache) purgeExpired() int {
+	purged := 0
+	now := time.Now().UnixNano()
+	for element := c.list.Back(); element != nil; {
+		prev := element.Prev()
+		item := element.Value.(*Item)
+		if atomic.LoadInt64(&item.expires) < now && (c.tracking == false || atomic.LoadInt32(&item.refCount) == 0) {
+			c.bucket(item.group).evict(item)
+			item.setReason(DeleteReasonExpired)
+			c.size -= item.size
+			c.unlink(element)
+			item.element = nil
+			if c.groups != nil {
+				c.groups.remove(item)
+			}
+			if c.onDelete != nil {
+				c.onDelete(item)
+			}
+			item.promotions = -2
+			purged += 1
+		}
+		element = prev
+	}
+	return purged
+}
@@ -1,8 +1,11 @@
 package ccache
 
 import (
+	"errors"
+	"io"
 	"sort"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -151,6 +154,128 @@ func (_ *LayeredCacheTests) OnDeleteCallbackCalled() {
 	Expect(atomic.LoadInt32(&onDeleteFnCalled)).To.Eql(1)
 }
 
+func (_ *LayeredCacheTests) OnFetchTransformsLoadedValue() {
+	var seen string
+	cache := Layered(Configure().OnFetch(func(key string, value interface{}, duration time.Duration) (interface{}, error) {
+		seen = key
+		return value.(string) + "!", nil
+	}))
+	defer cache.Stop()
+
+	item, err := cache.Fetch("spice", "flow", time.Minute, func() (interface{}, error) { return "must", nil })
+	Expect(err).To.Equal(nil)
+	Expect(seen).To.Equal("spice")
+	Expect(item.Value()).To.Equal("must!")
+	Expect(cache.Get("spice", "flow").Value()).To.Equal("must!")
+}
+
+func (_ *LayeredCacheTests) ServesStaleItemsForGracePeriod() {
+	cache := Layered(Configure().ServeStaleFor(time.Minute))
+	defer cache.Stop()
+	cache.Set("spice", "stale", 2, -time.Second)
+	cache.Set("spice", "gone", 3, -time.Minute*2)
+
+	Expect(cache.Get("spice", "stale").Stale()).To.Equal(true)
+	Expect(cache.Get("spice", "gone")).To.Equal(nil)
+}
+
+func (_ *LayeredCacheTests) PurgeExpiredRemovesOnlyExpiredItems() {
+	cache := newLayered()
+	defer cache.Stop()
+	cache.Set("spice", "flow", "a", time.Minute)
+	cache.Set("spice", "worm", "b", -time.Second)
+	cache.Set("leto", "sister", "c", -time.Minute)
+	cache.SyncUpdates()
+
+	Expect(cache.PurgeExpired()).To.Equal(2)
+	Expect(cache.ItemCount()).To.Equal(1)
+	Expect(cache.GetSize()).To.Eql(1)
+}
+
+func (_ *LayeredCacheTests) ExpiresItemsEveryInterval() {
+	cache := Layered(Configure().ExpireEvery(time.Millisecond * 5))
+	defer cache.Stop()
+	cache.Set("spice", "flow", "a", time.Minute)
+	cache.Set("spice", "worm", "b", time.Millisecond*10)
+	cache.Set("leto", "sister", "c", time.Millisecond*10)
+	cache.SyncUpdates()
+
+	time.Sleep(time.Millisecond * 60)
+	cache.SyncUpdates()
+	Expect(cache.ItemCount()).To.Equal(1)
+	Expect(cache.GetSize()).To.Eql(1)
+	Expect(cache.Get("spice", "flow").Value()).To.Equal("a")
+}
+
+func (_ *LayeredCacheTests) CompactRebuildsShrunkMaps() {
+	cache := newLayered()
+	defer cache.Stop()
+	cache.Set("spice", "flow", "a", time.Minute)
+	cache.Set("spice", "worm", "b", time.Minute)
+	cache.Set("leto", "sister", "c", time.Minute)
+	cache.Delete("spice", "worm")
+	cache.SyncUpdates()
+
+	Expect(cache.Compact()).To.Equal(1)
+	Expect(cache.Compact()).To.Equal(0)
+	Expect(cache.Get("spice", "flow").Value()).To.Equal("a")
+	Expect(cache.ItemCount()).To.Equal(2)
+}
+
+func (_ *LayeredCacheTests) PutUsesTheDefaultTTL() {
+	cache := Layered(Configure().DefaultTTL(time.Hour))
+	defer cache.Stop()
+	cache.Put("spice", "flow", "a")
+	Expect(cache.Get("spice", "flow").Value()).To.Equal("a")
+	Expect(cache.Get("spice", "flow").TTL() > time.Minute*59).To.Equal(true)
+}
+
+func (_ *LayeredCacheTests) BoundsSecondariesPerPrimary() {
+	cache := Layered(Configure().MaxSecondaries(2).GetsPerPromote(1))
+	defer cache.Stop()
+	cache.Set("spice", "a", 1, time.Minute)
+	cache.Set("spice", "b", 2, time.Minute)
+	cache.Set("leto", "a", 3, time.Minute)
+	cache.SyncUpdates()
+	cache.Get("spice", "a")
+	cache.SyncUpdates()
+	cache.Set("spice", "c", 4, time.Minute)
+	cache.SyncUpdates()
+
+	Expect(cache.Get("spice", "a").Value()).To.Equal(1)
+	Expect(cache.Get("spice", "b")).To.Equal(nil)
+	Expect(cache.Get("spice", "c").Value()).To.Equal(4)
+	Expect(cache.Get("leto", "a").Value()).To.Equal(3)
+	Expect(cache.GetSize()).To.Eql(3)
+	Expect(cache.GetDropped()).To.Equal(1)
+}
+
+func (_ *LayeredCacheTests) BoundsPrimaries() {
+	cache := Layered(Configure().MaxPrimaries(2).GetsPerPromote(1))
+	defer cache.Stop()
+	cache.Set("spice", "a", 1, time.Minute)
+	cache.Set("spice", "b", 2, time.Minute)
+	cache.Set("leto", "a", 3, time.Minute)
+	cache.SyncUpdates()
+	cache.Get("spice", "a")
+	cache.SyncUpdates()
+	cache.Set("paul", "a", 4, time.Minute)
+	cache.SyncUpdates()
+
+	Expect(cache.Get("spice", "a").Value()).To.Equal(1)
+	Expect(cache.Get("spice", "b").Value()).To.Equal(2)
+	Expect(cache.Get("leto", "a")).To.Equal(nil)
+	Expect(cache.Get("paul", "a").Value()).To.Equal(4)
+	Expect(cache.GetSize()).To.Eql(3)
+
+	cache.Delete("paul", "a")
+	cache.SyncUpdates()
+	cache.Set("leto", "a", 3, time.Minute)
+	cache.SyncUpdates()
+	Expect(cache.Get("spice", "a").Value()).To.Equal(1)
+	Expect(cache.Get("leto", "a").Value()).To.Equal(3)
+}
+
 func (_ *LayeredCacheTests) DeletesALayer() {
 	cache := newLayered()
 	cache.Set("spice", "flow", "value-a", time.Minute)
@@ -163,6 +288,181 @@ func (_ *LayeredCacheTests) DeletesALayer() {
 	Expect(cache.Get("leto", "sister").Value()).To.Equal("ghanima")
 }
 
+func (_ *LayeredCacheTests) PurgeAllReturnsTheCount() {
+	purged := int32(0)
+	cache := Layered(Configure().OnDelete(func(item *Item) {
+		if item.DeleteReason() == DeleteReasonPurged {
+			atomic.AddInt32(&purged, 1)
+		}
+	}))
+	defer cache.Stop()
+	cache.Set("spice", "flow", "value-a", time.Minute)
+	cache.Set("spice", "must", "value-b", time.Minute)
+	cache.Set("leto", "sister", "ghanima", time.Minute)
+	cache.SyncUpdates()
+
+	Expect(cache.PurgeAll("spice")).To.Equal(2)
+	Expect(cache.PurgeAll("spice")).To.Equal(0)
+	Expect(cache.PurgeAll("paul")).To.Equal(0)
+	cache.SyncUpdates()
+	Expect(atomic.LoadInt32(&purged)).To.Equal(int32(2))
+	Expect(cache.Get("leto", "sister").Value()).To.Equal("ghanima")
+}
+
+func (_ *LayeredCacheTests) FindFuncCollectsMatches() {
+	cache := Layered(Configure().SortedIteration())
+	defer cache.Stop()
+	cache.Set("spice", "flow", 1, time.Minute)
+	cache.Set("spice", "must", 2, time.Minute)
+	cache.Set("spice", "worm", 3, time.Minute)
+	cache.Set("leto", "sister", 4, time.Minute)
+
+	items := cache.FindFunc("spice", func(secondary string, item *Item) bool {
+		return item.Value().(int) > 1
+	})
+	Expect(len(items)).To.Equal(2)
+	Expect(items[0].Value()).To.Equal(2)
+	Expect(items[1].Value()).To.Equal(3)
+	Expect(len(cache.FindFunc("paul", func(string, *Item) bool { return true }))).To.Equal(0)
+}
+
+func (_ *LayeredCacheTests) GetVariantNegotiates() {
+	cache := newLayered()
+	defer cache.Stop()
+	cache.Set("/", VariantKey(map[string]string{"encoding": "gzip", "lang": "en"}), "gzip-en", time.Minute)
+	cache.Set("/", VariantKey(map[string]string{"encoding": "br", "lang": "en"}), "br-en", time.Minute)
+	cache.Set("/", VariantKey(map[string]string{"encoding": "gzip", "lang": AnyVariant}), "gzip-any", time.Minute)
+	cache.Set("/", VariantKey(map[string]string{"encoding": "identity"}), "identity", time.Minute)
+
+	Expect(cache.GetVariant("/", map[string][]string{"encoding": {"br", "gzip"}, "lang": {"en"}}).Value()).To.Equal("br-en")
+	Expect(cache.GetVariant("/", map[string][]string{"encoding": {"gzip", "br"}, "lang": {"en"}}).Value()).To.Equal("gzip-en")
+	Expect(cache.GetVariant("/", map[string][]string{"encoding": {"gzip"}, "lang": {"fr"}}).Value()).To.Equal("gzip-any")
+	Expect(cache.GetVariant("/", map[string][]string{"encoding": {"identity"}}).Value()).To.Equal("identity")
+	Expect(cache.GetVariant("/", map[string][]string{"encoding": {"deflate"}})).To.Equal(nil)
+	Expect(cache.GetVariant("/other", map[string][]string{"encoding": {"gzip"}})).To.Equal(nil)
+}
+
+func (_ *LayeredCacheTests) FetchDerivesVariants() {
+	fetches := 0
+	fetch := func() (interface{}, error) {
+		fetches += 1
+		return "fetched", nil
+	}
+	cache := Layered(Configure().
+		DeriveVariant("json", "broken", func(primary string, source *Item) (interface{}, error) {
+			return nil, errors.New("nope")
+		}).
+		DeriveVariant("json", "struct", func(primary string, source *Item) (interface{}, error) {
+			return primary + ":" + strconv.Itoa(source.Value().(int)), nil
+		}))
+	defer cache.Stop()
+	cache.Set("leto", "broken", 1, time.Minute)
+	cache.Set("leto", "struct", 2, time.Minute)
+
+	item, err := cache.Fetch("leto", "json", time.Hour, fetch)
+	Expect(err).To.Equal(nil)
+	Expect(item.Value()).To.Equal("leto:2")
+	Expect(item.TTL() <= time.Minute).To.Equal(true)
+	Expect(cache.Get("leto", "json").Value()).To.Equal("leto:2")
+
+	item, _ = cache.GetOrCreateSecondaryCache("paul").Fetch("json", time.Hour, fetch)
+	Expect(item.Value()).To.Equal("fetched")
+	Expect(fetches).To.Equal(1)
+}
+
+func (_ *LayeredCacheTests) FetchCoalescesConcurrentMisses() {
+	cache := newLayered()
+	defer cache.Stop()
+	calls := int32(0)
+	release := make(chan struct{})
+	fetch := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return nil, errors.New("nope")
+	}
+	errs := make(chan error, 4)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := cache.Fetch("spice", "flow", time.Minute, fetch)
+			errs <- err
+		}()
+		go func() {
+			_, err := cache.GetOrCreateSecondaryCache("spice").Fetch("flow", time.Minute, fetch)
+			errs <- err
+		}()
+	}
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	for i := 0; i < 4; i++ {
+		Expect((<-errs).Error()).To.Equal("nope")
+	}
+	Expect(atomic.LoadInt32(&calls)).To.Equal(int32(1))
+}
+
+func (_ LayeredCacheTests) FetchWithTTLUsesTheLoadedTTL() {
+	cache := newLayered()
+	defer cache.Stop()
+	item, err := cache.FetchWithTTL("leto", "spice", func() (interface{}, time.Duration, error) {
+		return "flow", time.Hour, nil
+	})
+	Expect(err).To.Equal(nil)
+	Expect(item.Value()).To.Equal("flow")
+	Expect(cache.Get("leto", "spice").TTL() > 59*time.Minute).To.Equal(true)
+}
+
+func (_ LayeredCacheTests) FragmentRendersOnceAndServesFromCache() {
+	cache := newLayered()
+	defer cache.Stop()
+	renders := 0
+	render := func(w io.Writer) error {
+		renders++
+		_, err := io.WriteString(w, "<p>spice</p>")
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		var out strings.Builder
+		Expect(Fragment(&out, cache, "/home", "en", time.Minute, render)).To.Equal(nil)
+		Expect(out.String()).To.Equal("<p>spice</p>")
+	}
+	Expect(renders).To.Equal(1)
+
+	cache.DeleteAll("/home")
+	Fragment(io.Discard, cache, "/home", "en", time.Minute, render)
+	Expect(renders).To.Equal(2)
+
+	var out strings.Builder
+	err := Fragment(&out, cache, "/home", "fr", time.Minute, func(w io.Writer) error {
+		io.WriteString(w, "<p>partial")
+		return errors.New("nope")
+	})
+	Expect(err.Error()).To.Equal("nope")
+	Expect(out.String()).To.Equal("")
+	Expect(cache.Get("/home", "fr")).To.Equal(nil)
+}
+
+func (_ LayeredCacheTests) GetEitherReturnsTheFirstPresentSecondary() {
+	cache := newLayered()
+	defer cache.Stop()
+	cache.Set("leto", "gzip", "zipped", time.Minute)
+	cache.Set("leto", "identity", "raw", time.Minute)
+	Expect(cache.GetEither("leto", "br", "gzip", "identity").Value()).To.Equal("zipped")
+	Expect(cache.GetEither("leto", "identity", "gzip").Value()).To.Equal("raw")
+	Expect(cache.GetEither("leto", "br")).To.Equal(nil)
+	Expect(cache.GetEither("paul", "gzip")).To.Equal(nil)
+	Expect(cache.GetEither("leto")).To.Equal(nil)
+}
+
+func (_ LayeredCacheTests) GetEitherSkipsTooStaleSecondaries() {
+	cache := Layered(Configure().ServeStaleFor(time.Second))
+	defer cache.Stop()
+	cache.Set("leto", "gzip", "zipped", -time.Minute)
+	cache.Set("leto", "identity", "raw", time.Minute)
+	Expect(cache.GetEither("leto", "gzip", "identity").Value()).To.Equal("raw")
+}
+
 func (_ LayeredCacheTests) GCsTheOldestItems() {
 	cache := Layered(Configure().ItemsToPrune(10))
 	cache.Set("xx", "a", 23, time.Minute)
@@ -208,6 +508,43 @@ func (_ LayeredCacheTests) GetWithoutPromoteDoesNotPromote() {
 	Expect(cache.Get("11", "a").Value()).To.Equal(11)
 }
 
+func (_ LayeredCacheTests) TTLOfAnItem() {
+	cache := Layered(Configure())
+	defer cache.Stop()
+	cache.Set("spice", "flow", 1, time.Minute)
+	ttl, ok := cache.TTL("spice", "flow")
+	Expect(ok).To.Equal(true)
+	Expect(ttl > 59*time.Second && ttl <= time.Minute).To.Equal(true)
+	_, ok = cache.TTL("spice", "worm")
+	Expect(ok).To.Equal(false)
+}
+
+func (_ LayeredCacheTests) FlatViewSharesTheItems() {
+	cache := Layered(Configure())
+	defer cache.Stop()
+	var flat KeyValue = cache.Flat("/")
+	cache.Set("user:1", "profile", "leto", time.Minute)
+	flat.Set("user:2/profile", "paul", time.Minute)
+	flat.Set("user:3", "jessica", time.Minute)
+
+	Expect(flat.Get("user:1/profile").Value()).To.Equal("leto")
+	Expect(cache.Get("user:2", "profile").Value()).To.Equal("paul")
+	Expect(cache.Get("user:3", "").Value()).To.Equal("jessica")
+	Expect(flat.Get("user:1")).To.Equal(nil)
+
+	item, err := flat.Fetch("user:4/profile", time.Minute, func() (interface{}, error) {
+		return "alia", nil
+	})
+	Expect(err).To.Equal(nil)
+	Expect(item.Value()).To.Equal("alia")
+	Expect(cache.Get("user:4", "profile").Value()).To.Equal("alia")
+
+	Expect(flat.Replace("user:1/profile", "duncan")).To.Equal(true)
+	Expect(cache.Get("user:1", "profile").Value()).To.Equal("duncan")
+	Expect(flat.Delete("user:1/profile")).To.Equal(true)
+	Expect(cache.Get("user:1", "profile")).To.Equal(nil)
+}
+
 func (_ LayeredCacheTests) TrackerDoesNotCleanupHeldInstance() {
 	cache := Layered(Configure().ItemsToPrune(10).Track())
 	item0 := cache.TrackingSet("0", "a", 0, time.Minute)
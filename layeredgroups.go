@@ -0,0 +1,112 @@
+package ccache
+
+import "container/list"
+
+// Worker-owned bookkeeping which bounds a LayeredCache in both dimensions (see
+// Configuration.MaxPrimaries and Configuration.MaxSecondaries): each primary
+// key has its own LRU of secondary items, and the primary keys themselves are
+// kept in an LRU.
+type layeredGroups struct {
+	// *layeredGroup, most recently used first
+	primaries *list.List
+	lookup    map[string]*layeredGroup
+}
+
+type layeredGroup struct {
+	primary string
+	// *Item, most recently used first
+	items   *list.List
+	element *list.Element
+}
+
+func newLayeredGroups() *layeredGroups {
+	return &layeredGroups{
+		primaries: list.New(),
+		lookup:    make(map[string]*layeredGroup),
+	}
+}
+
+// Called by the worker when item is promoted, isNew being true the first time
+func (g *layeredGroups) promote(item *Item, isNew bool) {
+	group, exists := g.lookup[item.group]
+	if exists == false {
+		group = &layeredGroup{primary: item.group, items: list.New()}
+		group.element = g.primaries.PushFront(group)
+		g.lookup[item.group] = group
+	} else {
+		g.primaries.MoveToFront(group.element)
+	}
+	if isNew {
+		item.groupElement = group.items.PushFront(item)
+	} else if item.groupElement != nil {
+		group.items.MoveToFront(item.groupElement)
+	}
+}
+
+// Called by the worker when item leaves the cache
+func (g *layeredGroups) remove(item *Item) {
+	if item.groupElement == nil {
+		return
+	}
+	group := g.lookup[item.group]
+	group.items.Remove(item.groupElement)
+	item.groupElement = nil
+	if group.items.Len() == 0 {
+		g.primaries.Remove(group.element)
+		delete(g.lookup, group.primary)
+	}
+}
+
+// Evicts the least recently used secondaries of primary and the least recently
+// used primaries until both are within bounds. Tracked items which are still
+// referenced are skipped. Returns the number of evicted items.
+func (c *LayeredCache) enforceGroupLimits(primary string) int {
+	g := c.groups
+	dropped := 0
+	if group, exists := g.lookup[primary]; exists && c.maxSecondaries > 0 {
+		element := group.items.Back()
+		for group.items.Len() > c.maxSecondaries && element != nil {
+			prev := element.Prev()
+			if c.evictItem(element.Value.(*Item)) {
+				dropped += 1
+			}
+			element = prev
+		}
+	}
+
+	if c.maxPrimaries == 0 {
+		return dropped
+	}
+	element := g.primaries.Back()
+	for len(g.lookup) > c.maxPrimaries && element != nil {
+		prev := element.Prev()
+		group := element.Value.(*layeredGroup)
+		for e := group.items.Back(); e != nil; {
+			p := e.Prev()
+			if c.evictItem(e.Value.(*Item)) {
+				dropped += 1
+			}
+			e = p
+		}
+		element = prev
+	}
+	return dropped
+}
+
+// Removes the item from the cache, unless it's tracked and still referenced
+func (c *LayeredCache) evictItem(item *Item) bool {
+	if item.evictable(c.tracking) == false {
+		return false
+	}
+	c.bucket(item.group).evict(item)
+	item.setReason(DeleteReasonEvicted)
+	c.size -= item.size
+	c.unlink(item.element)
+	item.element = nil
+	c.groups.remove(item)
+	if c.onDelete != nil {
+		c.onDelete(item)
+	}
+	item.promotions = -2
+	return true
+}
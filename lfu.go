@@ -0,0 +1,95 @@
+package ccache
+
+import "container/list"
+
+// The number of use counts EvictLFU tells apart
+const lfuLevels = 16
+
+// Keeps the worker's list ordered for EvictLFU: from the back, by use count
+// and then by recency within the same count, so that the GC evicts the least
+// frequently used items first. Owned by the worker.
+//
+// New items don't start at 0 but at one more than the count of the last
+// evicted item (dynamic aging, as in LFU-DA). Else, once every cached item was
+// used a few times, new items would be the first to go, and could never get
+// in. The counts are halved when they reach lfuLevels, so that items which used
+// to be popular eventually make room.
+type lfu struct {
+	// the front-most (most recently used) element of each count, nil when no
+	// item has that count
+	heads [lfuLevels]*list.Element
+	// the count new items start at
+	floor uint8
+}
+
+// Adds the new item to l, with the floor's count
+func (f *lfu) insert(l *list.List, item *Item) *list.Element {
+	item.uses = f.floor
+	var element *list.Element
+	if mark := f.below(item.uses); mark != nil {
+		element = l.InsertBefore(item, mark)
+	} else {
+		element = l.PushBack(item)
+	}
+	f.heads[item.uses] = element
+	return element
+}
+
+// Counts a use of the element's item and moves it accordingly
+func (f *lfu) promote(l *list.List, element *list.Element) {
+	item := element.Value.(*Item)
+	f.remove(element)
+	if item.uses < lfuLevels-1 {
+		item.uses++
+	}
+	if mark := f.below(item.uses); mark == nil {
+		l.MoveToBack(element)
+	} else {
+		l.MoveBefore(element, mark)
+	}
+	f.heads[item.uses] = element
+}
+
+// The element which the most recently used item with the given count goes in
+// front of: the head of the closest count at or below it, nil for the back
+func (f *lfu) below(uses uint8) *list.Element {
+	for level := int(uses); level >= 0; level-- {
+		if head := f.heads[level]; head != nil {
+			return head
+		}
+	}
+	return nil
+}
+
+func (f *lfu) remove(element *list.Element) {
+	uses := element.Value.(*Item).uses
+	if f.heads[uses] != element {
+		return
+	}
+	f.heads[uses] = nil
+	if next := element.Next(); next != nil && next.Value.(*Item).uses == uses {
+		f.heads[uses] = next
+	}
+}
+
+func (f *lfu) evicted(l *list.List, item *Item) {
+	if item.uses < lfuLevels-1 {
+		f.floor = item.uses + 1
+		return
+	}
+	// halving keeps the order
+	f.heads = [lfuLevels]*list.Element{}
+	for element := l.Back(); element != nil; element = element.Prev() {
+		item := element.Value.(*Item)
+		item.uses /= 2
+		f.heads[item.uses] = element
+	}
+	f.floor = lfuLevels / 2
+}
+
+func (f *lfu) reset() {
+	f.heads = [lfuLevels]*list.Element{}
+	f.floor = 0
+}
+
+func (f *lfu) resized(item *Item, delta int64) {}
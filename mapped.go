@@ -0,0 +1,165 @@
+package ccache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// A mapped snapshot starts with mappedMagic and the number of records, followed
+// by the offset of each record (in key order) and then the records themselves:
+// the length of the key, the key, the length of the value and the value. All
+// integers are little endian; counts and offsets are 8 bytes, lengths 4.
+const mappedMagic = "ccsnap01"
+
+const mappedHeader = len(mappedMagic) + 8
+
+var ErrMalformedSnapshot = errors.New("ccache: malformed mapped snapshot")
+
+// A read-only snapshot of keys and serialized values which is memory mapped
+// rather than loaded on the Go heap (on platforms without mmap, the file is
+// read into memory instead). See Configuration.Underlay.
+type MappedSnapshot struct {
+	sync.RWMutex
+	data  []byte
+	count int
+}
+
+// Writes values as a snapshot which can be opened with OpenMappedSnapshot.
+// Values are serialized with codec (or their ItemMarshaler implementation).
+// The cache which the snapshot underlays must be configured with the same
+// Codec.
+func WriteMappedSnapshot(w io.Writer, values map[string]interface{}, codec Codec) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	serialized := make([][]byte, len(keys))
+	offset := uint64(mappedHeader + 8*len(keys))
+	offsets := make([]byte, 8*len(keys))
+	for i, key := range keys {
+		data, err := marshalValue(codec, values[key])
+		if err != nil {
+			return err
+		}
+		serialized[i] = data
+		binary.LittleEndian.PutUint64(offsets[8*i:], offset)
+		offset += uint64(8 + len(key) + len(data))
+	}
+
+	out := bufio.NewWriter(w)
+	var scratch [8]byte
+	out.WriteString(mappedMagic)
+	binary.LittleEndian.PutUint64(scratch[:], uint64(len(keys)))
+	out.Write(scratch[:])
+	out.Write(offsets)
+	for i, key := range keys {
+		binary.LittleEndian.PutUint32(scratch[:4], uint32(len(key)))
+		out.Write(scratch[:4])
+		out.WriteString(key)
+		binary.LittleEndian.PutUint32(scratch[:4], uint32(len(serialized[i])))
+		out.Write(scratch[:4])
+		out.Write(serialized[i])
+	}
+	return out.Flush()
+}
+
+// Maps the snapshot at path into memory. Close it once the cache using it has
+// been stopped.
+func OpenMappedSnapshot(path string) (*MappedSnapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < int64(mappedHeader) {
+		return nil, ErrMalformedSnapshot
+	}
+	data, err := mapFile(f, int(size))
+	if err != nil {
+		return nil, err
+	}
+	count := binary.LittleEndian.Uint64(data[len(mappedMagic):])
+	if string(data[:len(mappedMagic)]) != mappedMagic || count > uint64(size-int64(mappedHeader))/8 {
+		unmapFile(data)
+		return nil, ErrMalformedSnapshot
+	}
+	return &MappedSnapshot{data: data, count: int(count)}, nil
+}
+
+// The number of keys in the snapshot
+func (s *MappedSnapshot) Len() int {
+	return s.count
+}
+
+// Unmaps the snapshot. Subsequent lookups miss.
+func (s *MappedSnapshot) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.data == nil {
+		return nil
+	}
+	data := s.data
+	s.data = nil
+	return unmapFile(data)
+}
+
+// Returns a copy of the serialized value of key
+func (s *MappedSnapshot) get(key string) ([]byte, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	if s.data == nil {
+		return nil, false
+	}
+	lo, hi := 0, s.count
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		k, value, ok := s.record(mid)
+		if ok == false {
+			return nil, false
+		}
+		if string(k) == key {
+			return append([]byte(nil), value...), true
+		}
+		if string(k) < key {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return nil, false
+}
+
+// Returns the key and value of the i'th record, false if the record is
+// out of bounds
+func (s *MappedSnapshot) record(i int) ([]byte, []byte, bool) {
+	data := s.data
+	offset := binary.LittleEndian.Uint64(data[mappedHeader+8*i:])
+	if offset > uint64(len(data)-4) {
+		return nil, nil, false
+	}
+	keyLength := uint64(binary.LittleEndian.Uint32(data[offset:]))
+	offset += 4
+	if keyLength+4 > uint64(len(data))-offset {
+		return nil, nil, false
+	}
+	key := data[offset : offset+keyLength]
+	offset += keyLength
+	valueLength := uint64(binary.LittleEndian.Uint32(data[offset:]))
+	offset += 4
+	if valueLength > uint64(len(data))-offset {
+		return nil, nil, false
+	}
+	return key, data[offset : offset+valueLength], true
+}
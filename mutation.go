@@ -0,0 +1,26 @@
+package ccache
+
+import "hash/fnv"
+
+// Checksums the value through the codec, see Configuration.DetectMutations.
+// Returns false if the value can't be marshaled.
+func checksumValue(codec Codec, value interface{}) (uint64, bool) {
+	data, err := marshalValue(codec, value)
+	if err != nil {
+		return 0, false
+	}
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64(), true
+}
+
+// Reports the item if its value was changed in place since it was set. Called
+// by the worker as items leave the cache.
+func (c *Cache) verifyValue(item *Item) {
+	if c.onMutation == nil || item.checksummed == false {
+		return
+	}
+	if checksum, ok := checksumValue(c.codec, item.Value()); ok && checksum != item.checksum {
+		c.onMutation(item)
+	}
+}
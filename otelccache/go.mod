@@ -0,0 +1,20 @@
+module github.com/karlseguin/ccache/v2/otelccache
+
+go 1.18
+
+require (
+	github.com/karlseguin/ccache/v2 v2.0.0
+	github.com/karlseguin/expect v1.0.7
+	go.opentelemetry.io/otel v1.11.1
+	go.opentelemetry.io/otel/sdk v1.11.1
+	go.opentelemetry.io/otel/trace v1.11.1
+)
+
+require (
+	github.com/go-logr/logr v1.2.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/wsxiaoys/terminal v0.0.0-20160513160801-0940f3fc43a0 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+)
+
+replace github.com/karlseguin/ccache/v2 => ../
@@ -0,0 +1,43 @@
+// An OpenTelemetry adapter for ccache's Instrumentation, which traces the
+// cache's operations as spans. It's its own module so that ccache itself
+// doesn't depend on OpenTelemetry.
+//
+//	cache := ccache.New(ccache.Configure().Instrument(otelccache.New(tracer, "users")))
+package otelccache
+
+import (
+	"context"
+
+	"github.com/karlseguin/ccache/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type Instrumentation struct {
+	tracer trace.Tracer
+	name   string
+}
+
+// Traces the operations of the cache called name with tracer
+func New(tracer trace.Tracer, name string) *Instrumentation {
+	return &Instrumentation{tracer: tracer, name: name}
+}
+
+func (i *Instrumentation) Start(ctx context.Context, op ccache.Operation, key string) func(ccache.Outcome) {
+	_, span := i.tracer.Start(ctx, "ccache."+string(op),
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(
+			attribute.String("cache.name", i.name),
+			attribute.String("cache.key", key),
+		),
+	)
+	return func(outcome ccache.Outcome) {
+		span.SetAttributes(attribute.Bool("cache.hit", outcome.Hit))
+		if outcome.Err != nil {
+			span.RecordError(outcome.Err)
+			span.SetStatus(codes.Error, outcome.Err.Error())
+		}
+		span.End()
+	}
+}
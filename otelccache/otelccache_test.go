@@ -0,0 +1,67 @@
+package otelccache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/karlseguin/ccache/v2"
+	. "github.com/karlseguin/expect"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type OtelTests struct{}
+
+func Test_Otel(t *testing.T) {
+	Expectify(new(OtelTests), t)
+}
+
+func (_ OtelTests) TracesOperations() {
+	spans, tracer := record()
+	cache := ccache.New(ccache.Configure().Instrument(New(tracer, "users")))
+	defer cache.Stop()
+	cache.Set("leto", "ghanima", time.Minute)
+	cache.Get("leto")
+	cache.Get("paul")
+
+	ended := spans.GetSpans()
+	Expect(len(ended)).To.Equal(3)
+	Expect(ended[0].Name).To.Equal("ccache.set")
+	Expect(ended[1].Name).To.Equal("ccache.get")
+	Expect(attributes(ended[1])).To.Eql(map[string]attribute.Value{
+		"cache.name": attribute.StringValue("users"),
+		"cache.key":  attribute.StringValue("leto"),
+		"cache.hit":  attribute.BoolValue(true),
+	})
+	Expect(attributes(ended[2])["cache.hit"]).To.Eql(attribute.BoolValue(false))
+}
+
+func (_ OtelTests) RecordsErrors() {
+	spans, tracer := record()
+	New(tracer, "users").Start(context.Background(), ccache.OperationFetch, "leto")(ccache.Outcome{Err: errors.New("nope")})
+
+	ended := spans.GetSpans()
+	Expect(len(ended)).To.Equal(1)
+	Expect(ended[0].Status.Code).To.Equal(codes.Error)
+	Expect(ended[0].Status.Description).To.Equal("nope")
+	Expect(len(ended[0].Events)).To.Equal(1)
+}
+
+// Returns a tracer, and the spans it ended
+func record() (*tracetest.InMemoryExporter, trace.Tracer) {
+	spans := tracetest.NewInMemoryExporter()
+	return spans, sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans)).Tracer("test")
+}
+
+func attributes(span tracetest.SpanStub) map[string]attribute.Value {
+	m := make(map[string]attribute.Value, len(span.Attributes))
+	for _, kv := range span.Attributes {
+		m[string(kv.Key)] = kv.Value
+	}
+	return m
+}
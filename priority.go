@@ -0,0 +1,93 @@
+package ccache
+
+import "container/list"
+
+// How readily an item is evicted, see Cache.SetWithPriority
+type Priority uint8
+
+const (
+	PriorityNormal Priority = iota
+	// evicted before any item of a higher priority, e.g. for values which are
+	// cheap to recompute
+	PriorityLow
+	// only evicted once there are no items of a lower priority left, e.g. for
+	// values which are expensive to recompute
+	PriorityHigh
+)
+
+// The position of each priority in the worker's list, from the back
+func (p Priority) rank() int {
+	switch p {
+	case PriorityLow:
+		return 0
+	case PriorityHigh:
+		return 2
+	}
+	return 1
+}
+
+// Keeps the worker's list ordered by priority, see Configuration.Priorities:
+// from the back, the low priority items, then the normal and then the high
+// ones, each in LRU order, so that the GC evicts the least recently used item
+// of the lowest priority first. Owned by the worker.
+type prioritized struct {
+	// the front-most (most recently used) element of each rank, nil when no
+	// item has that rank
+	heads [3]*list.Element
+}
+
+func (p *prioritized) insert(l *list.List, item *Item) *list.Element {
+	rank := item.priority.rank()
+	var element *list.Element
+	if mark := p.below(rank); mark != nil {
+		element = l.InsertBefore(item, mark)
+	} else {
+		element = l.PushBack(item)
+	}
+	p.heads[rank] = element
+	return element
+}
+
+func (p *prioritized) promote(l *list.List, element *list.Element) {
+	rank := element.Value.(*Item).priority.rank()
+	if p.heads[rank] == element {
+		return
+	}
+	p.remove(element)
+	if mark := p.below(rank); mark == nil {
+		l.MoveToBack(element)
+	} else {
+		l.MoveBefore(element, mark)
+	}
+	p.heads[rank] = element
+}
+
+// The element which the most recently used item of the given rank goes in
+// front of: the head of the closest rank at or below it, nil for the back
+func (p *prioritized) below(rank int) *list.Element {
+	for ; rank >= 0; rank-- {
+		if head := p.heads[rank]; head != nil {
+			return head
+		}
+	}
+	return nil
+}
+
+func (p *prioritized) remove(element *list.Element) {
+	rank := element.Value.(*Item).priority.rank()
+	if p.heads[rank] != element {
+		return
+	}
+	p.heads[rank] = nil
+	if next := element.Next(); next != nil && next.Value.(*Item).priority.rank() == rank {
+		p.heads[rank] = next
+	}
+}
+
+func (p *prioritized) evicted(l *list.List, item *Item) {}
+
+func (p *prioritized) resized(item *Item, delta int64) {}
+
+func (p *prioritized) reset() {
+	p.heads = [3]*list.Element{}
+}
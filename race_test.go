@@ -0,0 +1,7 @@
+//go:build race
+// +build race
+
+package ccache
+
+// The race detector allocates, so allocation audits are skipped under -race
+const raceEnabled = true
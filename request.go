@@ -0,0 +1,90 @@
+package ccache
+
+import "time"
+
+// A view of a Cache for the duration of a single request. The items read
+// through it are remembered (misses included), so that reading a key many
+// times within the request only hits the shared cache, and promotes the item,
+// once. It isn't safe for concurrent use: create one per request.
+type RequestCache struct {
+	cache *Cache
+	items map[string]*Item
+	// nil unless writes are deferred to Flush
+	writes map[string]requestWrite
+}
+
+type requestWrite struct {
+	value    interface{}
+	duration time.Duration
+	deleted  bool
+}
+
+// Creates a RequestCache over the cache. With writeBack, Set and Delete are
+// only visible within the request until Flush applies them to the cache.
+func (c *Cache) Request(writeBack bool) *RequestCache {
+	r := &RequestCache{cache: c, items: make(map[string]*Item)}
+	if writeBack {
+		r.writes = make(map[string]requestWrite)
+	}
+	return r
+}
+
+// Gets the item from the request's items, or from the cache the first time
+// the key is read
+func (r *RequestCache) Get(key string) *Item {
+	if item, exists := r.items[key]; exists {
+		return item
+	}
+	item := r.cache.Get(key)
+	r.items[key] = item
+	return item
+}
+
+// Like Cache.Fetch, but a cached item (or the fetched one) is remembered for
+// the rest of the request. Fetched values are cached right away, even with
+// writeBack.
+func (r *RequestCache) Fetch(key string, duration time.Duration, fetch func() (interface{}, error)) (*Item, error) {
+	if item, exists := r.items[key]; exists && item != nil && !item.Expired() {
+		return item, nil
+	}
+	item, err := r.cache.Fetch(key, duration, fetch)
+	if err != nil {
+		return nil, err
+	}
+	r.items[key] = item
+	return item, nil
+}
+
+// Sets the value for the rest of the request, and in the cache (see Flush)
+func (r *RequestCache) Set(key string, value interface{}, duration time.Duration) {
+	r.items[key] = newItem(key, value, time.Now().Add(duration).UnixNano(), false)
+	if r.writes != nil {
+		r.writes[key] = requestWrite{value: value, duration: duration}
+		return
+	}
+	r.cache.Set(key, value, duration)
+}
+
+// Deletes the key for the rest of the request, and from the cache (see Flush)
+func (r *RequestCache) Delete(key string) {
+	r.items[key] = nil
+	if r.writes != nil {
+		r.writes[key] = requestWrite{deleted: true}
+		return
+	}
+	r.cache.Delete(key)
+}
+
+// Applies the Sets and Deletes deferred by a write-back RequestCache to the
+// cache, typically at the end of the request. Only the last write of each key
+// is applied.
+func (r *RequestCache) Flush() {
+	for key, write := range r.writes {
+		if write.deleted {
+			r.cache.Delete(key)
+		} else {
+			r.cache.Set(key, write.value, write.duration)
+		}
+		delete(r.writes, key)
+	}
+}
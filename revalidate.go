@@ -0,0 +1,90 @@
+package ccache
+
+import (
+	"sync"
+	"time"
+)
+
+// Refreshes stale items in the background, see Configuration.Revalidate.
+type revalidator struct {
+	sync.Mutex
+	wg        sync.WaitGroup
+	stopped   bool
+	loader    func(key string) (interface{}, time.Duration, error)
+	cooldown  int64
+	slots     chan struct{}
+	lastSweep int64
+	// keys currently being refreshed
+	inflight map[string]struct{}
+	// key => when the key was last scheduled
+	scheduled map[string]int64
+}
+
+func newRevalidator(config *Configuration) *revalidator {
+	return &revalidator{
+		loader:    config.revalidator,
+		cooldown:  int64(config.revalidateCooldown),
+		slots:     make(chan struct{}, config.revalidateWorkers),
+		inflight:  make(map[string]struct{}),
+		scheduled: make(map[string]int64),
+	}
+}
+
+// Schedules a refresh of key, unless one is already running, one was scheduled
+// within the cooldown or all workers are busy. Never blocks. A panic of the
+// loader is recovered and reported to onPanic.
+func (r *revalidator) schedule(key string, set func(key string, value interface{}, duration time.Duration), onPanic func(v interface{})) {
+	now := time.Now().UnixNano()
+	r.Lock()
+	defer r.Unlock()
+	if r.stopped {
+		return
+	}
+	if _, exists := r.inflight[key]; exists {
+		return
+	}
+	if last, exists := r.scheduled[key]; exists && now-last < r.cooldown {
+		return
+	}
+	select {
+	case r.slots <- struct{}{}:
+	default:
+		return
+	}
+	r.inflight[key] = struct{}{}
+	r.scheduled[key] = now
+	if now-r.lastSweep > r.cooldown {
+		for key, last := range r.scheduled {
+			if now-last >= r.cooldown {
+				delete(r.scheduled, key)
+			}
+		}
+		r.lastSweep = now
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer func() {
+			if v := recover(); v != nil {
+				onPanic(v)
+			}
+			r.Lock()
+			delete(r.inflight, key)
+			r.Unlock()
+			<-r.slots
+		}()
+		value, duration, err := r.loader(key)
+		if err == nil {
+			set(key, value, duration)
+		}
+	}()
+}
+
+// Stops scheduling refreshes and waits for the running ones to finish
+func (r *revalidator) stop() {
+	r.Lock()
+	r.stopped = true
+	r.Unlock()
+	r.wg.Wait()
+}
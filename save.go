@@ -0,0 +1,137 @@
+package ccache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// A saved cache starts with savedMagic and the number of items, followed by
+// the items from the least to the most recently used: the length of the key,
+// the key, the remaining TTL in nanoseconds, the length of the value and the
+// value. Integers are little endian; the count and TTL are 8 bytes, lengths 4.
+const savedMagic = "ccsave01"
+
+// The longest key or value Load accepts, so that a corrupt length can't make it
+// allocate more than that
+const maxSavedLength = 64 << 20
+
+var ErrMalformedSave = errors.New("ccache: malformed saved cache")
+
+type listItems struct {
+	res chan []*Item
+}
+
+// Writes the cache's items, in LRU order, to w so that they can be restored
+// with Load, e.g. to start warm after a deploy. Values are serialized with the
+// configured Codec (or their ItemMarshaler implementation); Save fails if one
+// of them can't be. Expired items are skipped. The Sets and Gets made before
+// Save is called are included, even if the worker hadn't applied them yet.
+func (c *Cache) Save(w io.Writer) error {
+	res := make(chan []*Item)
+	c.control <- listItems{res: res}
+	items := <-res
+
+	now := time.Now()
+	type saved struct {
+		key  string
+		ttl  time.Duration
+		data []byte
+	}
+	records := make([]saved, 0, len(items))
+	for _, item := range items {
+		ttl := item.Expires().Sub(now)
+		if ttl <= 0 {
+			continue
+		}
+		data, err := marshalValue(c.codec, item.Value())
+		if err != nil {
+			return err
+		}
+		records = append(records, saved{key: item.key, ttl: ttl, data: data})
+	}
+
+	out := bufio.NewWriter(w)
+	var scratch [8]byte
+	out.WriteString(savedMagic)
+	binary.LittleEndian.PutUint64(scratch[:], uint64(len(records)))
+	out.Write(scratch[:])
+	for _, record := range records {
+		binary.LittleEndian.PutUint32(scratch[:4], uint32(len(record.key)))
+		out.Write(scratch[:4])
+		out.WriteString(record.key)
+		binary.LittleEndian.PutUint64(scratch[:], uint64(record.ttl))
+		out.Write(scratch[:])
+		binary.LittleEndian.PutUint32(scratch[:4], uint32(len(record.data)))
+		out.Write(scratch[:4])
+		out.Write(record.data)
+	}
+	return out.Flush()
+}
+
+// Restores the items written by Save, with their remaining TTL and LRU order.
+// The cache must be configured with the same Codec. Items which are already in
+// the cache are replaced. On error, the items read until then are kept. Keys
+// and values longer than 64MB are rejected as malformed.
+func (c *Cache) Load(r io.Reader) error {
+	in := bufio.NewReader(r)
+	header := make([]byte, len(savedMagic)+8)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return ErrMalformedSave
+	}
+	if string(header[:len(savedMagic)]) != savedMagic {
+		return ErrMalformedSave
+	}
+	count := binary.LittleEndian.Uint64(header[len(savedMagic):])
+
+	var scratch [8]byte
+	for i := uint64(0); i < count; i++ {
+		key, err := readSaved(in, scratch[:4])
+		if err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(in, scratch[:]); err != nil {
+			return ErrMalformedSave
+		}
+		ttl := time.Duration(binary.LittleEndian.Uint64(scratch[:]))
+		data, err := readSaved(in, scratch[:4])
+		if err != nil {
+			return err
+		}
+		value, err := unmarshalValue(c.codec, data)
+		if err != nil {
+			return err
+		}
+		c.set(string(key), value, ttl, false)
+	}
+	return nil
+}
+
+// Reads a length (into scratch) prefixed byte slice
+func readSaved(in io.Reader, scratch []byte) ([]byte, error) {
+	if _, err := io.ReadFull(in, scratch); err != nil {
+		return nil, ErrMalformedSave
+	}
+	length := binary.LittleEndian.Uint32(scratch)
+	if length > maxSavedLength {
+		return nil, ErrMalformedSave
+	}
+	// grows with what's actually read, rather than trusting length upfront
+	data, err := io.ReadAll(io.LimitReader(in, int64(length)))
+	if err != nil || len(data) != int(length) {
+		return nil, ErrMalformedSave
+	}
+	return data, nil
+}
+
+// Called by the worker, once it applied the pending promotes and deletes,
+// returns the items from the least to the most recently used
+func (c *Cache) listItems() []*Item {
+	items := make([]*Item, 0, c.list.Len())
+	for element := c.list.Back(); element != nil; element = element.Prev() {
+		items = append(items, element.Value.(*Item))
+	}
+	return items
+}
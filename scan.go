@@ -0,0 +1,37 @@
+package ccache
+
+import (
+	"context"
+	"time"
+)
+
+// A view of a Cache whose reads don't promote the items, so that reading many
+// keys once, as a backup or an export does, doesn't push the items which are
+// actually in use towards eviction. See Cache.WithoutPromotion.
+type ScanCache struct {
+	cache *Cache
+}
+
+// Calls fn with a view of the cache whose reads don't promote the items (nor,
+// with EvictClock, give them a second chance). Only the reads made through
+// the view are affected: those made through the cache, including concurrent
+// ones, still promote.
+func (c *Cache) WithoutPromotion(fn func(scan ScanCache)) {
+	fn(ScanCache{cache: c})
+}
+
+// Like Cache.Get, but the item isn't promoted. Unlike Cache.GetWithoutPromote,
+// the read is counted in the stats, and the item goes through the same checks
+// (ServeStaleFor, ValidateOnGet, ...) as with Get.
+func (s ScanCache) Get(key string) *Item {
+	done := s.cache.observe(context.Background(), OperationGet, key)
+	item := s.cache.lookupWith(key, false)
+	done(item != nil && !item.Expired(), nil)
+	return item
+}
+
+// Like Cache.Fetch, but a cached item isn't promoted. A fetched value is
+// cached, like any new item.
+func (s ScanCache) Fetch(key string, duration time.Duration, fetch func() (interface{}, error)) (*Item, error) {
+	return s.cache.fetchWith(key, duration, fetch, false)
+}
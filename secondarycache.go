@@ -3,8 +3,9 @@ package ccache
 import "time"
 
 type SecondaryCache struct {
-	bucket *bucket
-	pCache *LayeredCache
+	bucket  *bucket
+	pCache  *LayeredCache
+	primary string
 }
 
 // Get the secondary key.
@@ -17,7 +18,9 @@ func (s *SecondaryCache) Get(secondary string) *Item {
 // The semantics are the same as for LayeredCache.Set
 func (s *SecondaryCache) Set(secondary string, value interface{}, duration time.Duration) *Item {
 	item, existing := s.bucket.set(secondary, value, duration, false)
+	item.group = s.primary
 	if existing != nil {
+		existing.setReason(DeleteReasonReplaced)
 		s.pCache.deletables <- existing
 	}
 	s.pCache.promote(item)
@@ -31,10 +34,24 @@ func (s *SecondaryCache) Fetch(secondary string, duration time.Duration, fetch f
 	if item != nil {
 		return item, nil
 	}
-	value, err := fetch()
+	return s.pCache.flights.do(flightKey{primary: s.primary, secondary: secondary}, func() (*Item, error) {
+		return s.fetch(secondary, fixedTTL(duration, fetch))
+	})
+}
+
+func (s *SecondaryCache) fetch(secondary string, fetch func() (interface{}, time.Duration, error)) (*Item, error) {
+	if item := s.pCache.derive(s.primary, secondary); item != nil {
+		return item, nil
+	}
+	value, duration, err := doFetch(s.pCache.fetchSlots, s.pCache.fetchWait, fetch)
 	if err != nil {
 		return nil, err
 	}
+	if s.pCache.onFetch != nil {
+		if value, err = s.pCache.onFetch(s.primary, value, duration); err != nil {
+			return nil, err
+		}
+	}
 	return s.Set(secondary, value, duration), nil
 }
 
@@ -67,6 +84,6 @@ func (c *SecondaryCache) TrackingGet(secondary string) TrackedItem {
 	if item == nil {
 		return NilTracked
 	}
-	item.track()
+	c.pCache.checkRefCount(item, item.track())
 	return item
 }
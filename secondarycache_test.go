@@ -104,3 +104,16 @@ func (_ SecondaryCacheTests) TrackerDoesNotCleanupHeldInstance() {
 	cache.GC()
 	Expect(cache.Get("0", "a")).To.Equal(nil)
 }
+
+func (_ SecondaryCacheTests) SetsAreBoundedPerPrimary() {
+	cache := Layered(Configure().MaxSecondaries(1))
+	defer cache.Stop()
+	sCache := cache.GetOrCreateSecondaryCache("spice")
+	sCache.Set("a", 1, time.Minute)
+	sCache.Set("b", 2, time.Minute)
+	cache.SyncUpdates()
+	Expect(sCache.Get("a")).To.Equal(nil)
+	Expect(sCache.Get("b").Value()).To.Equal(2)
+	Expect(cache.GetSize()).To.Eql(1)
+	Expect(cache.GetDropped()).To.Equal(1)
+}
@@ -0,0 +1,158 @@
+package ccache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Hit/miss counters of the real cache alongside those of its shadow.
+type ShadowStats struct {
+	Hits         int64
+	Misses       int64
+	ShadowHits   int64
+	ShadowMisses int64
+}
+
+// A key-only LRU simulating how the cache would behave with a different max
+// size. It never holds values, only keys, sizes and expirations, so that it can
+// run next to the real cache in production at a negligible memory cost. Large
+// shadows are split into shards, each an LRU of its share of the max size, so
+// that Gets don't all contend on one lock.
+type shadow struct {
+	mask   uint32
+	shards []*shadowShard
+}
+
+type shadowShard struct {
+	sync.Mutex
+	maxSize int64
+	size    int64
+	list    *list.List
+	lookup  map[string]*list.Element
+	stats   ShadowStats
+}
+
+type shadowEntry struct {
+	key     string
+	size    int64
+	expires int64
+}
+
+// The fewest keys a shard should hold, for each to behave like a slice of the
+// whole LRU
+const minShadowShardSize = 1024
+
+func newShadow(maxSize int64) *shadow {
+	count := 1
+	for count < 16 && maxSize/int64(count*2) >= minShadowShardSize {
+		count *= 2
+	}
+	s := &shadow{mask: uint32(count) - 1, shards: make([]*shadowShard, count)}
+	for i := range s.shards {
+		s.shards[i] = &shadowShard{
+			maxSize: maxSize / int64(count),
+			list:    list.New(),
+			lookup:  make(map[string]*list.Element),
+		}
+	}
+	return s
+}
+
+func (s *shadow) shard(key string) *shadowShard {
+	return s.shards[hash(key)&s.mask]
+}
+
+// Records a Get, hit being whether the real cache returned a live item.
+func (s *shadow) get(key string, hit bool) {
+	s.shard(key).get(key, hit)
+}
+
+func (s *shadow) set(key string, size int64, expires int64) {
+	s.shard(key).set(key, size, expires)
+}
+
+func (s *shadow) delete(key string) {
+	s.shard(key).delete(key)
+}
+
+func (s *shadow) clear() {
+	for _, shard := range s.shards {
+		shard.clear()
+	}
+}
+
+func (s *shadow) getStats() ShadowStats {
+	var stats ShadowStats
+	for _, shard := range s.shards {
+		shard.Lock()
+		stats.Hits += shard.stats.Hits
+		stats.Misses += shard.stats.Misses
+		stats.ShadowHits += shard.stats.ShadowHits
+		stats.ShadowMisses += shard.stats.ShadowMisses
+		shard.Unlock()
+	}
+	return stats
+}
+
+func (s *shadowShard) get(key string, hit bool) {
+	s.Lock()
+	defer s.Unlock()
+	if hit {
+		s.stats.Hits += 1
+	} else {
+		s.stats.Misses += 1
+	}
+	element, exists := s.lookup[key]
+	if exists && element.Value.(*shadowEntry).expires > time.Now().UnixNano() {
+		s.stats.ShadowHits += 1
+		s.list.MoveToFront(element)
+	} else {
+		s.stats.ShadowMisses += 1
+	}
+}
+
+func (s *shadowShard) set(key string, size int64, expires int64) {
+	s.Lock()
+	defer s.Unlock()
+	if element, exists := s.lookup[key]; exists {
+		entry := element.Value.(*shadowEntry)
+		s.size += size - entry.size
+		entry.size = size
+		entry.expires = expires
+		s.list.MoveToFront(element)
+	} else {
+		s.lookup[key] = s.list.PushFront(&shadowEntry{key: key, size: size, expires: expires})
+		s.size += size
+	}
+	for s.size > s.maxSize {
+		element := s.list.Back()
+		if element == nil {
+			break
+		}
+		s.remove(element)
+	}
+}
+
+func (s *shadowShard) delete(key string) {
+	s.Lock()
+	defer s.Unlock()
+	if element, exists := s.lookup[key]; exists {
+		s.remove(element)
+	}
+}
+
+func (s *shadowShard) remove(element *list.Element) {
+	entry := element.Value.(*shadowEntry)
+	delete(s.lookup, entry.key)
+	s.size -= entry.size
+	s.list.Remove(element)
+}
+
+func (s *shadowShard) clear() {
+	s.Lock()
+	defer s.Unlock()
+	s.size = 0
+	s.list = list.New()
+	s.lookup = make(map[string]*list.Element)
+}
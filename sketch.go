@@ -0,0 +1,68 @@
+package ccache
+
+// The number of rows of the sketch, each with its own hash of the key
+const sketchDepth = 4
+
+// A count-min sketch of how often keys were used, for the TinyLFU admission
+// filter (see Configuration.TinyLFU). It only takes a byte per counter and
+// row, but overestimates the counts of keys which collide with more popular
+// ones. The counts are halved once the number of uses recorded reaches ten
+// times the width, so that keys which used to be popular lose their
+// advantage. Owned by the worker.
+type sketch struct {
+	rows      [sketchDepth][]uint8
+	mask      uint32
+	additions int
+	resetAt   int
+}
+
+// width is rounded up to a power of 2
+func newSketch(width int) *sketch {
+	size := 16
+	for size < width && size < 1<<24 {
+		size <<= 1
+	}
+	s := &sketch{mask: uint32(size - 1), resetAt: 10 * size}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, size)
+	}
+	return s
+}
+
+// The index of the key's counter in each row, by double hashing
+func (s *sketch) indexes(key string) [sketchDepth]uint32 {
+	var indexes [sketchDepth]uint32
+	h1 := hash(key)
+	h2 := h1>>17 | h1<<15
+	for i := range indexes {
+		indexes[i] = (h1 + uint32(i)*h2) & s.mask
+	}
+	return indexes
+}
+
+func (s *sketch) add(key string) {
+	for i, index := range s.indexes(key) {
+		if s.rows[i][index] < 255 {
+			s.rows[i][index]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAt {
+		for _, row := range s.rows {
+			for i := range row {
+				row[i] /= 2
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+func (s *sketch) estimate(key string) uint8 {
+	min := uint8(255)
+	for i, index := range s.indexes(key) {
+		if count := s.rows[i][index]; count < min {
+			min = count
+		}
+	}
+	return min
+}
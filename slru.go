@@ -0,0 +1,85 @@
+package ccache
+
+import "container/list"
+
+// Keeps the worker's list ordered for EvictSLRU: the protected segment at the
+// front and the probation segment at the back, each in LRU order. New items
+// go at the front of probation, and are only moved to protected by their
+// first promotion. When protected outgrows its share of the max size, its
+// least recently used items go back to the front of probation. Since the GC
+// evicts from the back, items which were only used once are evicted before
+// any protected one. Owned by the worker.
+type slru struct {
+	// the max size of the protected segment
+	limit func() int64
+	// the front-most probation element, nil when probation is empty
+	boundary *list.Element
+	// the total size of the protected items
+	protectedSize int64
+}
+
+func (s *slru) insert(l *list.List, item *Item) *list.Element {
+	var element *list.Element
+	if s.boundary != nil {
+		element = l.InsertBefore(item, s.boundary)
+	} else {
+		element = l.PushBack(item)
+	}
+	s.boundary = element
+	return element
+}
+
+func (s *slru) promote(l *list.List, element *list.Element) {
+	item := element.Value.(*Item)
+	if item.protected == false {
+		s.remove(element)
+		item.protected = true
+		item.reused = true
+		s.protectedSize += item.size
+	}
+	l.MoveToFront(element)
+	s.demote(l)
+}
+
+// Moves the least recently used protected items to probation, until protected
+// fits in its share of the max size. They're right in front of probation
+// already, so they just need to be relabeled.
+func (s *slru) demote(l *list.List) {
+	limit := s.limit()
+	for s.protectedSize > limit {
+		element := l.Back()
+		if s.boundary != nil {
+			element = s.boundary.Prev()
+		}
+		if element == nil {
+			return
+		}
+		item := element.Value.(*Item)
+		item.protected = false
+		s.protectedSize -= item.size
+		s.boundary = element
+	}
+}
+
+func (s *slru) remove(element *list.Element) {
+	item := element.Value.(*Item)
+	if item.protected {
+		s.protectedSize -= item.size
+		item.protected = false
+	} else if s.boundary == element {
+		s.boundary = element.Next()
+	}
+}
+
+func (s *slru) evicted(l *list.List, item *Item) {}
+
+func (s *slru) resized(item *Item, delta int64) {
+	if item.protected {
+		s.protectedSize += delta
+	}
+}
+
+func (s *slru) reset() {
+	s.boundary = nil
+	s.protectedSize = 0
+}
@@ -0,0 +1,93 @@
+package ccache
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Saves the cache (see Save) to the file at path. The snapshot is written to a
+// temporary file in the same directory which is then renamed, so that path
+// always holds a complete snapshot, even if the process dies while saving.
+func (c *Cache) SaveFile(path string) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if err := c.Save(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// Loads the snapshot which SaveFile wrote to path, see Load
+func (c *Cache) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return c.Load(file)
+}
+
+// Periodically saves the cache, see Configuration.AutoSnapshot
+type snapshotter struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Restores the last snapshot, if there's one, and starts saving new ones
+func (c *Cache) startSnapshots() {
+	if err := c.LoadFile(c.snapshotPath); err != nil && os.IsNotExist(err) == false {
+		c.logSnapshot("restoring", err)
+	}
+	s := &snapshotter{stop: make(chan struct{}), done: make(chan struct{})}
+	c.snapshots = s
+	go func() {
+		defer close(s.done)
+		// without an interval, the only snapshot is taken by Stop
+		var tick <-chan time.Time
+		if c.snapshotEvery > 0 {
+			ticker := time.NewTicker(c.snapshotEvery)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-tick:
+				if err := c.SaveFile(c.snapshotPath); err != nil {
+					c.logSnapshot("saving", err)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops the periodic snapshots and saves a last one
+func (c *Cache) stopSnapshots() {
+	close(c.snapshots.stop)
+	<-c.snapshots.done
+	if err := c.SaveFile(c.snapshotPath); err != nil {
+		c.logSnapshot("saving", err)
+	}
+}
+
+func (c *Cache) logSnapshot(action string, err error) {
+	if c.info != nil {
+		log.Printf("ccache: %s: %s the snapshot %s: %v", c.info.Name, action, c.snapshotPath, err)
+	} else {
+		log.Printf("ccache: %s the snapshot %s: %v", action, c.snapshotPath, err)
+	}
+}
@@ -0,0 +1,74 @@
+package ccache
+
+import "sync"
+
+// The deletes which didn't fit in the deletables channel, see
+// Configuration.SpillDeletes
+type deleteSpill struct {
+	sync.Mutex
+	items []*Item
+	// signals the worker that items were spilled
+	wake chan struct{}
+}
+
+func newDeleteSpill() *deleteSpill {
+	return &deleteSpill{wake: make(chan struct{}, 1)}
+}
+
+// Queues the item for the worker to delete. Only blocks when the deletables
+// channel is full and SpillDeletes isn't set.
+func (c *Cache) queueDelete(item *Item) {
+	if c.spill == nil {
+		c.deletables <- item
+		return
+	}
+	select {
+	case c.deletables <- item:
+	default:
+		c.spill.Lock()
+		c.spill.items = append(c.spill.items, item)
+		c.spill.Unlock()
+		select {
+		case c.spill.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Like queueDelete, but never waits on the worker: an item which can't be
+// queued stays listed until the GC gets to it.
+func (c *Cache) tryQueueDelete(item *Item) {
+	if c.spill != nil {
+		c.queueDelete(item)
+		return
+	}
+	select {
+	case c.deletables <- item:
+	default:
+	}
+}
+
+// Deletes the spilled items. Called by the worker.
+func (c *Cache) drainSpill() {
+	if c.spill == nil {
+		return
+	}
+	c.spill.Lock()
+	items := c.spill.items
+	c.spill.items = nil
+	c.spill.Unlock()
+	for _, item := range items {
+		c.doDelete(item)
+	}
+}
+
+// The number of deletes waiting in the spill, 0 unless
+// Configuration.SpillDeletes is set
+func (c *Cache) SpilledDeletes() int {
+	if c.spill == nil {
+		return 0
+	}
+	c.spill.Lock()
+	defer c.spill.Unlock()
+	return len(c.spill.items)
+}
@@ -0,0 +1,134 @@
+// A read-through cache of database/sql query results, backed by a ccache.Cache.
+// Results are keyed by the normalized query and a hash of its arguments, and
+// are invalidated by table: every query declares the tables it reads, and
+// writing to (or invalidating) a table makes all of the cached queries which
+// read it miss.
+package sqlcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karlseguin/ccache/v2"
+)
+
+// A materialized query result
+type Rows struct {
+	Columns []string
+	Values  [][]interface{}
+}
+
+type DB struct {
+	db    *sql.DB
+	cache *ccache.Cache
+	ttl   time.Duration
+	sync.RWMutex
+	// table => generation, bumped on every invalidation of the table. The
+	// generations of the tables a query reads are part of its key, so that
+	// invalidated results are never hit again and simply age out of the cache.
+	generations map[string]uint64
+}
+
+// Caches the results of queries run against db in cache, for ttl
+func New(db *sql.DB, cache *ccache.Cache, ttl time.Duration) *DB {
+	return &DB{
+		db:          db,
+		cache:       cache,
+		ttl:         ttl,
+		generations: make(map[string]uint64),
+	}
+}
+
+// The underlying database
+func (d *DB) DB() *sql.DB {
+	return d.db
+}
+
+// Returns the (possibly cached) result of query. tables are the tables that
+// the query reads, which Invalidate and Exec use to evict its result.
+// Concurrent misses for the same query and arguments share a single query.
+func (d *DB) Query(ctx context.Context, tables []string, query string, args ...interface{}) (*Rows, error) {
+	item, err := d.cache.FetchContext(ctx, d.key(tables, query, args), d.ttl, func(ctx context.Context) (interface{}, error) {
+		return d.query(ctx, query, args)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item.Value().(*Rows), nil
+}
+
+// Runs a statement which writes to tables, invalidating the cached results of
+// the queries which read them.
+func (d *DB) Exec(ctx context.Context, tables []string, query string, args ...interface{}) (sql.Result, error) {
+	result, err := d.db.ExecContext(ctx, query, args...)
+	// even a failed statement may have written something
+	d.Invalidate(tables...)
+	return result, err
+}
+
+// Invalidates the cached results of the queries which read any of tables
+func (d *DB) Invalidate(tables ...string) {
+	d.Lock()
+	for _, table := range tables {
+		d.generations[table]++
+	}
+	d.Unlock()
+}
+
+func (d *DB) query(ctx context.Context, query string, args []interface{}) (*Rows, error) {
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := &Rows{Columns: columns}
+	for rows.Next() {
+		// scanning into an *interface{} copies []byte values, which the
+		// driver may otherwise reuse
+		values := make([]interface{}, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		result.Values = append(result.Values, values)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (d *DB) key(tables []string, query string, args []interface{}) string {
+	h := sha256.New()
+	h.Write([]byte(normalize(query)))
+	for _, arg := range args {
+		fmt.Fprintf(h, "\x00%T:%v", arg, arg)
+	}
+	d.RLock()
+	for _, table := range tables {
+		fmt.Fprintf(h, "\x00%s@%d", table, d.generations[table])
+	}
+	d.RUnlock()
+	return "sql:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// Collapses whitespace, so that differently formatted copies of the same query
+// share their results. This includes whitespace within literals, which is why
+// values should be passed as arguments.
+func normalize(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
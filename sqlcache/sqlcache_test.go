@@ -0,0 +1,165 @@
+package sqlcache
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/karlseguin/ccache/v2"
+	. "github.com/karlseguin/expect"
+)
+
+type SQLCacheTests struct{}
+
+func Test_SQLCache(t *testing.T) {
+	Expectify(new(SQLCacheTests), t)
+}
+
+func (_ SQLCacheTests) CachesQueryResults() {
+	db, queries, done := open()
+	defer done()
+	rows, err := db.Query(context.Background(), []string{"users"}, "select id, name from users where id = ?", 1)
+	Expect(err).To.Equal(nil)
+	Expect(rows.Columns).To.Equal([]string{"id", "name"})
+	Expect(rows.Values).To.Equal([][]interface{}{{int64(1), []byte("leto")}})
+
+	rows, _ = db.Query(context.Background(), []string{"users"}, "select id,  name\n from users where id = ?", 1)
+	Expect(rows.Values[0][0]).To.Equal(int64(1))
+	Expect(atomic.LoadInt32(queries)).To.Equal(int32(1))
+
+	db.Query(context.Background(), []string{"users"}, "select id, name from users where id = ?", 2)
+	Expect(atomic.LoadInt32(queries)).To.Equal(int32(2))
+}
+
+func (_ SQLCacheTests) InvalidatesByTable() {
+	db, queries, done := open()
+	defer done()
+	query := "select id, name from users join roles where id = ?"
+	db.Query(context.Background(), []string{"users", "roles"}, query, 1)
+	db.Query(context.Background(), []string{"users"}, "select id, name from users")
+
+	db.Invalidate("roles")
+	db.Query(context.Background(), []string{"users", "roles"}, query, 1)
+	db.Query(context.Background(), []string{"users"}, "select id, name from users")
+	Expect(atomic.LoadInt32(queries)).To.Equal(int32(3))
+
+	_, err := db.Exec(context.Background(), []string{"users"}, "update users set name = ?", "paul")
+	Expect(err).To.Equal(nil)
+	db.Query(context.Background(), []string{"users", "roles"}, query, 1)
+	db.Query(context.Background(), []string{"users"}, "select id, name from users")
+	Expect(atomic.LoadInt32(queries)).To.Equal(int32(5))
+}
+
+func (_ SQLCacheTests) DoesNotCacheErrors() {
+	db, queries, done := open()
+	defer done()
+	_, err := db.Query(context.Background(), nil, "fail")
+	Expect(err.Error()).To.Equal("nope")
+	_, err = db.Query(context.Background(), nil, "fail")
+	Expect(err.Error()).To.Equal("nope")
+	Expect(atomic.LoadInt32(queries)).To.Equal(int32(2))
+}
+
+// Returns the DB, its query count, and a func which closes the DB and stops
+// its cache
+func open() (*DB, *int32, func()) {
+	queries := new(int32)
+	db := sql.OpenDB(fakeConnector{queries})
+	cache := ccache.New(ccache.Configure())
+	return New(db, cache, time.Minute), queries, func() {
+		db.Close()
+		cache.Stop()
+	}
+}
+
+// A driver whose queries return the row (id, "leto"), id being the first
+// argument (or 1), and fail if the query is "fail"
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	return fakeConn{new(int32)}, nil
+}
+
+type fakeConnector struct {
+	queries *int32
+}
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	return fakeConn{c.queries}, nil
+}
+
+func (fakeConnector) Driver() driver.Driver {
+	return fakeDriver{}
+}
+
+type fakeConn struct {
+	queries *int32
+}
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{query: query, queries: c.queries}, nil
+}
+
+func (fakeConn) Close() error {
+	return nil
+}
+
+func (fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+type fakeStmt struct {
+	query   string
+	queries *int32
+}
+
+func (fakeStmt) Close() error {
+	return nil
+}
+
+func (fakeStmt) NumInput() int {
+	return -1
+}
+
+func (fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	atomic.AddInt32(s.queries, 1)
+	if s.query == "fail" {
+		return nil, errors.New("nope")
+	}
+	id := int64(1)
+	if len(args) > 0 {
+		id = args[0].(int64)
+	}
+	return &fakeRows{row: []driver.Value{id, []byte("leto")}}, nil
+}
+
+type fakeRows struct {
+	row  []driver.Value
+	done bool
+}
+
+func (fakeRows) Columns() []string {
+	return []string{"id", "name"}
+}
+
+func (fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	copy(dest, r.row)
+	return nil
+}
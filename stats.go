@@ -0,0 +1,107 @@
+package ccache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Counters of the cache's operations, since it was created or since the last
+// ResetStats, see Cache.Stats
+type Stats struct {
+	// Calls to Get (and to the Fetch and TrackingGet family, which use it)
+	Gets int64
+	// Gets which returned an item that wasn't expired
+	Hits int64
+	// Gets which returned nothing, or an expired item
+	Misses int64
+	// Values stored by Set (and its variants) and by Fetch (and its variants).
+	// The values which aren't stored (see NonPositiveTTL, MaxItemSize and
+	// FetchAdmission), or only refresh the TTL of an equal one (see ValueEqual),
+	// aren't counted.
+	Sets int64
+	// Successful calls to Replace, which aren't counted as Sets
+	Replaces int64
+	// Items removed by Delete, DeletePrefix and DeleteFunc
+	Deletes int64
+	// Items evicted by the GC
+	Evictions int64
+	// Expired items removed by PurgeExpired
+	Expirations int64
+	// Calls to Clear
+	Clears int64
+	// When Clear last ran, zero if it never did. Unlike the counters, it isn't
+	// reset by ResetStats, so that it still tells whether (and when) the cache
+	// was flushed.
+	LastClear time.Time
+}
+
+// The ratio of Gets which were hits, 0 if there were no Gets
+func (s Stats) HitRatio() float64 {
+	if s.Gets == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Gets)
+}
+
+type stats struct {
+	gets        int64
+	hits        int64
+	misses      int64
+	sets        int64
+	replaces    int64
+	deletes     int64
+	evictions   int64
+	expirations int64
+	clears      int64
+	// unix nanoseconds, 0 if Clear never ran
+	lastClear int64
+}
+
+func (s *stats) get(item *Item) {
+	atomic.AddInt64(&s.gets, 1)
+	if item != nil && !item.Expired() {
+		atomic.AddInt64(&s.hits, 1)
+	} else {
+		atomic.AddInt64(&s.misses, 1)
+	}
+}
+
+func (s *stats) load(swap bool) Stats {
+	read := atomic.LoadInt64
+	if swap {
+		read = func(counter *int64) int64 {
+			return atomic.SwapInt64(counter, 0)
+		}
+	}
+	stats := Stats{
+		Gets:        read(&s.gets),
+		Hits:        read(&s.hits),
+		Misses:      read(&s.misses),
+		Sets:        read(&s.sets),
+		Replaces:    read(&s.replaces),
+		Deletes:     read(&s.deletes),
+		Evictions:   read(&s.evictions),
+		Expirations: read(&s.expirations),
+		Clears:      read(&s.clears),
+	}
+	if lastClear := atomic.LoadInt64(&s.lastClear); lastClear != 0 {
+		stats.LastClear = time.Unix(0, lastClear)
+	}
+	return stats
+}
+
+// Counts a Clear which ran at now
+func (s *stats) clear(now time.Time) {
+	atomic.AddInt64(&s.clears, 1)
+	atomic.StoreInt64(&s.lastClear, now.UnixNano())
+}
+
+// Returns the cache's counters, see Stats
+func (c *Cache) Stats() Stats {
+	return c.stats.load(false)
+}
+
+// Resets the cache's counters to 0
+func (c *Cache) ResetStats() {
+	c.stats.load(true)
+}
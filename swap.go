@@ -0,0 +1,106 @@
+package ccache
+
+import (
+	"container/list"
+	"time"
+)
+
+// A value and its TTL, see Cache.SwapAll
+type ValueTTL struct {
+	Value interface{}
+	TTL   time.Duration
+}
+
+type swapAll struct {
+	lookups []map[string]*Item
+	done    chan struct{}
+}
+
+// Atomically replaces the whole content of the cache with items: Get sees
+// either the old content or the new one, and never an empty or partially
+// swapped cache. Meant for reference data which is reloaded wholesale. The new
+// items are built aside, and then switched in by the worker, which GCs if they
+// exceed the max size. The old items are dropped, like with Clear. The TTLs
+// follow NonPositiveTTL and TTLJitter, as with Set; a non-positive TTL with
+// DeleteNonPositiveTTL leaves the key out.
+// This is a control command.
+func (c *Cache) SwapAll(items map[string]ValueTTL) {
+	lookups := make([]map[string]*Item, len(c.buckets))
+	for i := range lookups {
+		lookups[i] = make(map[string]*Item)
+	}
+	for original, v := range items {
+		key, ok := c.checkKey(original)
+		if ok == false || c.rejectsSize(original, v.Value, false) {
+			continue
+		}
+		// the swap drops the key's item anyway, deleting it now would expose
+		// a partially swapped cache
+		if v.TTL <= 0 && c.ttlBehavior == DeleteNonPositiveTTL {
+			continue
+		}
+		ttl, ok := c.checkTTL(key, v.TTL)
+		if ok == false {
+			continue
+		}
+		index := hash(key) & c.bucketMask
+		lookups[index][key] = c.buckets[index].newItem(key, v.Value, ttl, false)
+	}
+	done := make(chan struct{})
+	c.control <- swapAll{lookups: lookups, done: done}
+	<-done
+}
+
+// Called by the worker. Returns the number of items GC'd.
+func (c *Cache) swapAll(lookups []map[string]*Item) int {
+	for _, b := range c.buckets {
+		b.Lock()
+	}
+	if c.feed != nil || c.wal != nil {
+		c.changed(ChangeClear, "", nil)
+		for _, lookup := range lookups {
+			for key, item := range lookup {
+				c.changed(ChangeSet, key, item)
+			}
+		}
+	}
+	for i, b := range c.buckets {
+		for _, item := range b.swap(lookups[i]) {
+			// stops pending promotions from adding it back to the list
+			item.promotions = -2
+			item.element = nil
+		}
+	}
+	for _, b := range c.buckets {
+		b.Unlock()
+	}
+
+	c.size = 0
+	c.list = list.New()
+	c.gcCursor = nil
+	if c.order != nil {
+		c.order.reset()
+	}
+	if c.expiry != nil {
+		c.expiry.reset()
+	}
+	for _, lookup := range lookups {
+		for _, item := range lookup {
+			c.size += item.size
+			c.link(item)
+		}
+	}
+	if c.shadow != nil {
+		c.shadow.clear()
+	}
+	if c.front != nil {
+		c.front.invalidate()
+	}
+	if c.ghosts != nil {
+		c.ghosts.clear()
+	}
+	if c.size > c.maxSize {
+		return c.gc()
+	}
+	return 0
+}
@@ -0,0 +1,277 @@
+package ccache
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+	"unsafe"
+)
+
+// An Item whose value is known to be a V
+type TypedItem[V any] struct {
+	*Item
+}
+
+// The item's value, or V's zero value if the value isn't a V (e.g. nil)
+func (i *TypedItem[V]) Value() V {
+	value, _ := i.Item.Value().(V)
+	return value
+}
+
+func typedItem[V any](item *Item) *TypedItem[V] {
+	if item == nil {
+		return nil
+	}
+	return &TypedItem[V]{item}
+}
+
+// A Cache of V values, identified by K keys, which saves callers from type
+// asserting every value. Keys are stored as strings: string keys as-is, other
+// keys formatted with %#v. The methods of the underlying Cache which don't take
+// keys or values (Stop, Clear, GetSize, ...) are available as-is.
+type TypedCache[K comparable, V any] struct {
+	*Cache
+	key func(K) string
+}
+
+// Create a new typed cache with the specified configuration
+func NewTyped[K comparable, V any](config *Configuration) *TypedCache[K, V] {
+	return &TypedCache[K, V]{
+		Cache: New(config),
+		key:   keyFunc[K](),
+	}
+}
+
+// Returns the function which turns K keys into the cache's string keys
+func keyFunc[K comparable]() func(K) string {
+	if reflect.TypeOf((*K)(nil)).Elem().Kind() == reflect.String {
+		// K's underlying type is string, so this is a plain conversion which,
+		// unlike going through an interface, doesn't allocate
+		return func(key K) string {
+			return *(*string)(unsafe.Pointer(&key))
+		}
+	}
+	return func(key K) string {
+		return fmt.Sprintf("%#v", key)
+	}
+}
+
+// See Cache.Get
+func (c *TypedCache[K, V]) Get(key K) *TypedItem[V] {
+	return typedItem[V](c.Cache.Get(c.key(key)))
+}
+
+// See Cache.GetWithoutPromote
+func (c *TypedCache[K, V]) GetWithoutPromote(key K) *TypedItem[V] {
+	return typedItem[V](c.Cache.GetWithoutPromote(c.key(key)))
+}
+
+// See Cache.TrackingGet. Returns nil on a miss, and otherwise an item which
+// must be released.
+func (c *TypedCache[K, V]) TrackingGet(key K) *TypedItem[V] {
+	tracked := c.Cache.TrackingGet(c.key(key))
+	if tracked == NilTracked {
+		return nil
+	}
+	return &TypedItem[V]{tracked.(*Item)}
+}
+
+// See Cache.TrackingSet
+func (c *TypedCache[K, V]) TrackingSet(key K, value V, duration time.Duration) *TypedItem[V] {
+	return &TypedItem[V]{c.Cache.TrackingSet(c.key(key), value, duration).(*Item)}
+}
+
+// See Cache.Set
+func (c *TypedCache[K, V]) Set(key K, value V, duration time.Duration) {
+	c.Cache.Set(c.key(key), value, duration)
+}
+
+// See Cache.Replace
+func (c *TypedCache[K, V]) Replace(key K, value V) bool {
+	return c.Cache.Replace(c.key(key), value)
+}
+
+// See Cache.Fetch
+func (c *TypedCache[K, V]) Fetch(key K, duration time.Duration, fetch func() (V, error)) (*TypedItem[V], error) {
+	item, err := c.Cache.Fetch(c.key(key), duration, func() (interface{}, error) {
+		return fetch()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return typedItem[V](item), nil
+}
+
+// See Cache.FetchWithTTL
+func (c *TypedCache[K, V]) FetchWithTTL(key K, fetch func() (V, time.Duration, error)) (*TypedItem[V], error) {
+	item, err := c.Cache.FetchWithTTL(c.key(key), func() (interface{}, time.Duration, error) {
+		return fetch()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return typedItem[V](item), nil
+}
+
+// See Cache.FetchContext
+func (c *TypedCache[K, V]) FetchContext(ctx context.Context, key K, duration time.Duration, fetch func(ctx context.Context) (V, error)) (*TypedItem[V], error) {
+	item, err := c.Cache.FetchContext(ctx, c.key(key), duration, func(ctx context.Context) (interface{}, error) {
+		return fetch(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return typedItem[V](item), nil
+}
+
+// See Cache.Delete
+func (c *TypedCache[K, V]) Delete(key K) bool {
+	return c.Cache.Delete(c.key(key))
+}
+
+// A LayeredCache of V values, identified by PK primary keys and SK secondary
+// keys. Keys are stored as strings, like TypedCache's. The methods of the
+// underlying LayeredCache which don't take keys or values are available as-is.
+type TypedLayeredCache[PK, SK comparable, V any] struct {
+	*LayeredCache
+	primary   func(PK) string
+	secondary func(SK) string
+}
+
+// Create a new typed layered cache with the specified configuration
+func NewTypedLayered[PK, SK comparable, V any](config *Configuration) *TypedLayeredCache[PK, SK, V] {
+	return &TypedLayeredCache[PK, SK, V]{
+		LayeredCache: Layered(config),
+		primary:      keyFunc[PK](),
+		secondary:    keyFunc[SK](),
+	}
+}
+
+// See LayeredCache.Get
+func (c *TypedLayeredCache[PK, SK, V]) Get(primary PK, secondary SK) *TypedItem[V] {
+	return typedItem[V](c.LayeredCache.Get(c.primary(primary), c.secondary(secondary)))
+}
+
+// See LayeredCache.GetWithoutPromote
+func (c *TypedLayeredCache[PK, SK, V]) GetWithoutPromote(primary PK, secondary SK) *TypedItem[V] {
+	return typedItem[V](c.LayeredCache.GetWithoutPromote(c.primary(primary), c.secondary(secondary)))
+}
+
+// See LayeredCache.TrackingGet. Returns nil on a miss, and otherwise an item
+// which must be released.
+func (c *TypedLayeredCache[PK, SK, V]) TrackingGet(primary PK, secondary SK) *TypedItem[V] {
+	tracked := c.LayeredCache.TrackingGet(c.primary(primary), c.secondary(secondary))
+	if tracked == NilTracked {
+		return nil
+	}
+	return &TypedItem[V]{tracked.(*Item)}
+}
+
+// See LayeredCache.TrackingSet
+func (c *TypedLayeredCache[PK, SK, V]) TrackingSet(primary PK, secondary SK, value V, duration time.Duration) *TypedItem[V] {
+	return &TypedItem[V]{c.LayeredCache.TrackingSet(c.primary(primary), c.secondary(secondary), value, duration).(*Item)}
+}
+
+// See LayeredCache.Set
+func (c *TypedLayeredCache[PK, SK, V]) Set(primary PK, secondary SK, value V, duration time.Duration) {
+	c.LayeredCache.Set(c.primary(primary), c.secondary(secondary), value, duration)
+}
+
+// See LayeredCache.Replace
+func (c *TypedLayeredCache[PK, SK, V]) Replace(primary PK, secondary SK, value V) bool {
+	return c.LayeredCache.Replace(c.primary(primary), c.secondary(secondary), value)
+}
+
+// See LayeredCache.Fetch
+func (c *TypedLayeredCache[PK, SK, V]) Fetch(primary PK, secondary SK, duration time.Duration, fetch func() (V, error)) (*TypedItem[V], error) {
+	item, err := c.LayeredCache.Fetch(c.primary(primary), c.secondary(secondary), duration, func() (interface{}, error) {
+		return fetch()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return typedItem[V](item), nil
+}
+
+// See LayeredCache.FetchWithTTL
+func (c *TypedLayeredCache[PK, SK, V]) FetchWithTTL(primary PK, secondary SK, fetch func() (V, time.Duration, error)) (*TypedItem[V], error) {
+	item, err := c.LayeredCache.FetchWithTTL(c.primary(primary), c.secondary(secondary), func() (interface{}, time.Duration, error) {
+		return fetch()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return typedItem[V](item), nil
+}
+
+// See LayeredCache.FetchContext
+func (c *TypedLayeredCache[PK, SK, V]) FetchContext(ctx context.Context, primary PK, secondary SK, duration time.Duration, fetch func(ctx context.Context) (V, error)) (*TypedItem[V], error) {
+	item, err := c.LayeredCache.FetchContext(ctx, c.primary(primary), c.secondary(secondary), duration, func(ctx context.Context) (interface{}, error) {
+		return fetch(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return typedItem[V](item), nil
+}
+
+// See LayeredCache.Delete
+func (c *TypedLayeredCache[PK, SK, V]) Delete(primary PK, secondary SK) bool {
+	return c.LayeredCache.Delete(c.primary(primary), c.secondary(secondary))
+}
+
+// See LayeredCache.DeleteAll
+func (c *TypedLayeredCache[PK, SK, V]) DeleteAll(primary PK) bool {
+	return c.LayeredCache.DeleteAll(c.primary(primary))
+}
+
+// See LayeredCache.PurgeAll
+func (c *TypedLayeredCache[PK, SK, V]) PurgeAll(primary PK) int {
+	return c.LayeredCache.PurgeAll(c.primary(primary))
+}
+
+// See LayeredCache.GetOrCreateSecondaryCache
+func (c *TypedLayeredCache[PK, SK, V]) GetOrCreateSecondaryCache(primary PK) *TypedSecondaryCache[SK, V] {
+	return &TypedSecondaryCache[SK, V]{
+		cache: c.LayeredCache.GetOrCreateSecondaryCache(c.primary(primary)),
+		key:   c.secondary,
+	}
+}
+
+// The typed counterpart of SecondaryCache
+type TypedSecondaryCache[SK comparable, V any] struct {
+	cache *SecondaryCache
+	key   func(SK) string
+}
+
+// See SecondaryCache.Get
+func (s *TypedSecondaryCache[SK, V]) Get(secondary SK) *TypedItem[V] {
+	return typedItem[V](s.cache.Get(s.key(secondary)))
+}
+
+// See SecondaryCache.Set
+func (s *TypedSecondaryCache[SK, V]) Set(secondary SK, value V, duration time.Duration) *TypedItem[V] {
+	return typedItem[V](s.cache.Set(s.key(secondary), value, duration))
+}
+
+// See SecondaryCache.Fetch
+func (s *TypedSecondaryCache[SK, V]) Fetch(secondary SK, duration time.Duration, fetch func() (V, error)) (*TypedItem[V], error) {
+	item, err := s.cache.Fetch(s.key(secondary), duration, func() (interface{}, error) {
+		return fetch()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return typedItem[V](item), nil
+}
+
+// See SecondaryCache.Delete
+func (s *TypedSecondaryCache[SK, V]) Delete(secondary SK) bool {
+	return s.cache.Delete(s.key(secondary))
+}
+
+// See SecondaryCache.Replace
+func (s *TypedSecondaryCache[SK, V]) Replace(secondary SK, value V) bool {
+	return s.cache.Replace(s.key(secondary), value)
+}
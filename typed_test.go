@@ -0,0 +1,136 @@
+package ccache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/karlseguin/expect"
+)
+
+type TypedCacheTests struct{}
+
+func Test_TypedCache(t *testing.T) {
+	Expectify(new(TypedCacheTests), t)
+}
+
+type typedUser struct {
+	name string
+}
+
+type userID string
+
+func (_ TypedCacheTests) GetsAndSetsTypedValues() {
+	cache := NewTyped[userID, *typedUser](Configure())
+	defer cache.Stop()
+	Expect(cache.Get("leto")).To.Equal(nil)
+
+	cache.Set("leto", &typedUser{name: "Leto"}, time.Minute)
+	Expect(cache.Get("leto").Value().name).To.Equal("Leto")
+	Expect(cache.GetWithoutPromote("leto").Expired()).To.Equal(false)
+	Expect(cache.Cache.Get("leto").Value().(*typedUser).name).To.Equal("Leto")
+
+	Expect(cache.Replace("leto", &typedUser{name: "Paul"})).To.Equal(true)
+	Expect(cache.Get("leto").Value().name).To.Equal("Paul")
+	Expect(cache.Delete("leto")).To.Equal(true)
+	Expect(cache.Get("leto")).To.Equal(nil)
+}
+
+func (_ TypedCacheTests) FormatsNonStringKeys() {
+	type key struct {
+		id   int
+		kind string
+	}
+	cache := NewTyped[key, int](Configure())
+	defer cache.Stop()
+	cache.Set(key{1, "a"}, 1, time.Minute)
+	cache.Set(key{1, "b"}, 2, time.Minute)
+	Expect(cache.Get(key{1, "a"}).Value()).To.Equal(1)
+	Expect(cache.Get(key{1, "b"}).Value()).To.Equal(2)
+	Expect(cache.Get(key{2, "a"})).To.Equal(nil)
+	Expect(cache.ItemCount()).To.Equal(2)
+}
+
+func (_ TypedCacheTests) FetchesTypedValues() {
+	cache := NewTyped[int, string](Configure())
+	defer cache.Stop()
+	item, err := cache.Fetch(4, time.Minute, func() (string, error) {
+		return "four", nil
+	})
+	Expect(err).To.Equal(nil)
+	Expect(item.Value()).To.Equal("four")
+	Expect(cache.Get(4).Value()).To.Equal("four")
+
+	item, err = cache.Fetch(5, time.Minute, func() (string, error) {
+		return "", errors.New("nope")
+	})
+	Expect(item).To.Equal(nil)
+	Expect(err.Error()).To.Equal("nope")
+}
+
+func (_ TypedCacheTests) TracksTypedItems() {
+	cache := NewTyped[string, int](Configure().Track())
+	defer cache.Stop()
+	Expect(cache.TrackingGet("a")).To.Equal(nil)
+	item := cache.TrackingSet("a", 1, time.Minute)
+	Expect(item.Value()).To.Equal(1)
+	item.Release()
+	item = cache.TrackingGet("a")
+	Expect(item.Value()).To.Equal(1)
+	Expect(item.refCount).To.Equal(int32(1))
+	item.Release()
+}
+
+func (_ TypedCacheTests) LayeredGetsAndSetsTypedValues() {
+	cache := NewTypedLayered[int, string, *typedUser](Configure())
+	defer cache.Stop()
+	cache.Set(1, "name", &typedUser{name: "Leto"}, time.Minute)
+	cache.Set(1, "alias", &typedUser{name: "God Emperor"}, time.Minute)
+	cache.Set(2, "name", &typedUser{name: "Paul"}, time.Minute)
+	Expect(cache.Get(1, "name").Value().name).To.Equal("Leto")
+	Expect(cache.Get(2, "alias")).To.Equal(nil)
+
+	item, err := cache.Fetch(2, "alias", time.Minute, func() (*typedUser, error) {
+		return &typedUser{name: "Muad'Dib"}, nil
+	})
+	Expect(err).To.Equal(nil)
+	Expect(item.Value().name).To.Equal("Muad'Dib")
+
+	Expect(cache.Replace(1, "alias", &typedUser{name: "Tyrant"})).To.Equal(true)
+	Expect(cache.GetWithoutPromote(1, "alias").Value().name).To.Equal("Tyrant")
+	Expect(cache.Delete(2, "alias")).To.Equal(true)
+	Expect(cache.PurgeAll(1)).To.Equal(2)
+	Expect(cache.Get(1, "name")).To.Equal(nil)
+	Expect(cache.Get(2, "name").Value().name).To.Equal("Paul")
+}
+
+func (_ TypedCacheTests) LayeredFetchesWithAContext() {
+	cache := NewTypedLayered[int, string, string](Configure())
+	defer cache.Stop()
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "flow")
+	item, err := cache.FetchContext(ctx, 1, "spice", time.Minute, func(ctx context.Context) (string, error) {
+		return ctx.Value(ctxKey{}).(string), nil
+	})
+	Expect(err).To.Equal(nil)
+	Expect(item.Value()).To.Equal("flow")
+	Expect(cache.Get(1, "spice").Value()).To.Equal("flow")
+}
+
+func (_ TypedCacheTests) TypedSecondaryCache() {
+	cache := NewTypedLayered[string, int, string](Configure())
+	defer cache.Stop()
+	sc := cache.GetOrCreateSecondaryCache("spice")
+	Expect(sc.Get(1)).To.Equal(nil)
+	Expect(sc.Set(1, "flow", time.Minute).Value()).To.Equal("flow")
+	Expect(cache.Get("spice", 1).Value()).To.Equal("flow")
+	item, _ := sc.Fetch(2, time.Minute, func() (string, error) {
+		return "must", nil
+	})
+	Expect(item.Value()).To.Equal("must")
+	Expect(sc.Replace(2, "worm")).To.Equal(true)
+	Expect(sc.Get(2).Value()).To.Equal("worm")
+	Expect(sc.Delete(2)).To.Equal(true)
+	Expect(sc.Get(2)).To.Equal(nil)
+}
@@ -0,0 +1,83 @@
+package ccache
+
+import (
+	"net/url"
+)
+
+// The attribute value of a variant which matches any requested value
+const AnyVariant = "*"
+
+// Builds the secondary key of a variant from its attributes, such as
+// {"encoding": "gzip", "lang": "en"}. Attributes are sorted, so the same
+// attributes always produce the same key. Use AnyVariant as the value of an
+// attribute the variant doesn't vary on, or simply leave it out.
+func VariantKey(attributes map[string]string) string {
+	values := make(url.Values, len(attributes))
+	for name, value := range attributes {
+		values[name] = []string{value}
+	}
+	return values.Encode()
+}
+
+// Selects the variant of primary which best matches the requested attributes.
+// The secondary keys of primary are expected to have been built with
+// VariantKey. requested maps each attribute to the acceptable values, in order
+// of preference (much like an http.Header).
+//
+// A variant matches when each of its attributes is either AnyVariant or one of
+// the requested values. Among the matching variants, the one with the fewest
+// AnyVariant attributes wins, then the one whose values rank higher in the
+// requested preferences, then the one with the smallest key.
+//
+// The selected variant is returned as per Get. Returns nil when no variant
+// matches.
+func (c *LayeredCache) GetVariant(primary string, requested map[string][]string) *Item {
+	best := ""
+	found := false
+	var bestWildcards, bestRank int
+	c.bucket(primary).forEachFunc(primary, false, func(key string, item *Item) bool {
+		wildcards, rank, ok := matchVariant(key, requested)
+		if ok == false {
+			return true
+		}
+		if found == false || wildcards < bestWildcards ||
+			(wildcards == bestWildcards && (rank < bestRank || (rank == bestRank && key < best))) {
+			best, bestWildcards, bestRank, found = key, wildcards, rank, true
+		}
+		return true
+	})
+	if found == false {
+		return nil
+	}
+	return c.Get(primary, best)
+}
+
+// Returns how many of the variant's attributes are wildcards and the sum of
+// the preference positions of the others, or false if the variant doesn't
+// match the requested attributes.
+func matchVariant(key string, requested map[string][]string) (int, int, bool) {
+	attributes, err := url.ParseQuery(key)
+	if err != nil {
+		return 0, 0, false
+	}
+	wildcards, rank := 0, 0
+	for name, values := range attributes {
+		value := values[0]
+		if value == AnyVariant {
+			wildcards += 1
+			continue
+		}
+		position := -1
+		for i, accepted := range requested[name] {
+			if accepted == value || accepted == AnyVariant {
+				position = i
+				break
+			}
+		}
+		if position == -1 {
+			return 0, 0, false
+		}
+		rank += position
+	}
+	return wildcards, rank, true
+}
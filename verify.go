@@ -0,0 +1,85 @@
+package ccache
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The number of discrepancies which Verify describes, the others are counted
+const verifyExamples = 5
+
+type verify struct {
+	res chan error
+}
+
+// Checks the worker's accounting against the buckets, once the pending
+// promotions and deletes are applied: every cached item must be listed (and
+// the other way around), and the size must be the sum of the listed items'.
+// Returns an error describing the discrepancies, nil if there are none. Meant
+// for tests and debugging, such as checking custom extensions of the cache.
+// Concurrent Sets and Deletes can show up as discrepancies.
+// This is a control command.
+func (c *Cache) Verify() error {
+	res := make(chan error)
+	c.control <- verify{res: res}
+	return <-res
+}
+
+// Called by the worker
+func (c *Cache) verify() error {
+	for _, b := range c.buckets {
+		b.RLock()
+	}
+	defer func() {
+		for _, b := range c.buckets {
+			b.RUnlock()
+		}
+	}()
+
+	var problems, examples []string
+	discrepancies := 0
+	report := func(format string, args ...interface{}) {
+		discrepancies++
+		if len(examples) < verifyExamples {
+			examples = append(examples, fmt.Sprintf(format, args...))
+		}
+	}
+
+	listed, size := 0, int64(0)
+	for element := c.list.Front(); element != nil; element = element.Next() {
+		item := element.Value.(*Item)
+		listed++
+		size += item.size
+		if item.element != element {
+			report("%q isn't listed at its element", item.key)
+		}
+		if c.bucket(item.key).lookup[item.key] != item {
+			report("%q is listed but isn't cached", item.key)
+		}
+	}
+	cached := 0
+	for _, b := range c.buckets {
+		for key, item := range b.lookup {
+			cached++
+			if item.element == nil {
+				report("%q is cached but isn't listed", key)
+			}
+		}
+	}
+
+	if cached != listed {
+		problems = append(problems, fmt.Sprintf("%d items are cached but %d are listed", cached, listed))
+	}
+	if size != c.size {
+		problems = append(problems, fmt.Sprintf("the size is %d but the listed items add up to %d", c.size, size))
+	}
+	problems = append(problems, examples...)
+	if more := discrepancies - len(examples); more > 0 {
+		problems = append(problems, fmt.Sprintf("and %d more", more))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New("ccache: " + strings.Join(problems, "; "))
+}
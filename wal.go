@@ -0,0 +1,260 @@
+package ccache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A write-ahead log starts with walMagic, followed by one record per change:
+// the ChangeOp, the length of the key, the key, the expiry in unix
+// nanoseconds, the length of the value and the value. The expiry and value
+// are only there for ChangeSet. Integers are little endian; the expiry is 8
+// bytes, lengths 4.
+const walMagic = "ccwal001"
+
+// The log is compacted once it has walCompactMin records and more than twice
+// as many as there were items when it was last compacted
+const walCompactMin = 1024
+
+// Records the cache's Sets, Deletes and Clears to a file, see
+// Configuration.WriteAheadLog. Changes are queued by the buckets, under their
+// write lock, and written by a background goroutine.
+type wal struct {
+	sync.Mutex
+	cache   *Cache
+	path    string
+	pending []change
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	// owned by the writer
+	file    *os.File
+	out     *bufio.Writer
+	records int
+	// the number of items written by the last compaction
+	compacted int
+}
+
+func (w *wal) record(op ChangeOp, key string, item *Item) {
+	w.Lock()
+	w.pending = append(w.pending, change{op: op, key: key, item: item})
+	w.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Replays the log at path into the cache, compacts it and starts logging the
+// cache's changes to it. Runs before New returns, so nothing else is changing
+// the cache.
+func (c *Cache) openWAL(path string) {
+	w := &wal{
+		cache: c,
+		path:  path,
+		wake:  make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	if err := c.replayWAL(path); err != nil && os.IsNotExist(err) == false {
+		w.log("replaying", err)
+	}
+	if err := w.compact(); err != nil {
+		// the cache works without the log
+		w.log("creating", err)
+		return
+	}
+	c.wal = w
+	// the buckets are only told about the log once it's replayed, so that the
+	// replay isn't logged again
+	for _, b := range c.buckets {
+		b.wal = w
+	}
+	go w.run()
+}
+
+func (c *Cache) replayWAL(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	in := bufio.NewReader(file)
+	magic := make([]byte, len(walMagic))
+	if _, err := io.ReadFull(in, magic); err != nil || string(magic) != walMagic {
+		return ErrMalformedSave
+	}
+
+	var scratch [8]byte
+	for {
+		op, err := in.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		// a torn record at the end is what's left of a crash while writing,
+		// everything before it is applied
+		key, err := readSaved(in, scratch[:4])
+		if err != nil {
+			return nil
+		}
+		switch ChangeOp(op) {
+		case ChangeSet:
+			if _, err := io.ReadFull(in, scratch[:]); err != nil {
+				return nil
+			}
+			expires := int64(binary.LittleEndian.Uint64(scratch[:]))
+			data, err := readSaved(in, scratch[:4])
+			if err != nil {
+				return nil
+			}
+			ttl := time.Duration(expires - time.Now().UnixNano())
+			if ttl <= 0 {
+				c.delete(string(key))
+				continue
+			}
+			value, err := unmarshalValue(c.codec, data)
+			if err != nil {
+				c.delete(string(key))
+				continue
+			}
+			c.set(string(key), value, ttl, false)
+		case ChangeDelete:
+			c.delete(string(key))
+		case ChangeClear:
+			c.Clear()
+		default:
+			return ErrMalformedSave
+		}
+	}
+}
+
+func (w *wal) run() {
+	defer close(w.done)
+	for {
+		select {
+		case <-w.wake:
+			w.flush()
+		case <-w.stop:
+			w.flush()
+			if err := w.file.Close(); err != nil {
+				w.log("closing", err)
+			}
+			return
+		}
+	}
+}
+
+// Writes the pending changes, and then compacts the log if it grew too large
+func (w *wal) flush() {
+	w.Lock()
+	pending := w.pending
+	w.pending = nil
+	w.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	for _, change := range pending {
+		w.write(change)
+	}
+	if err := w.out.Flush(); err != nil {
+		w.log("writing", err)
+	}
+	w.records += len(pending)
+	if w.records >= walCompactMin && w.records > 2*w.compacted {
+		if err := w.compact(); err != nil {
+			w.log("compacting", err)
+		}
+	}
+}
+
+func (w *wal) write(change change) {
+	var scratch [8]byte
+	var data []byte
+	if change.op == ChangeSet {
+		var err error
+		if data, err = marshalValue(w.cache.codec, change.item.Value()); err != nil {
+			// the replay mustn't bring back the previous value
+			change.op = ChangeDelete
+		}
+	}
+	w.out.WriteByte(byte(change.op))
+	binary.LittleEndian.PutUint32(scratch[:4], uint32(len(change.key)))
+	w.out.Write(scratch[:4])
+	w.out.WriteString(change.key)
+	if change.op == ChangeSet {
+		binary.LittleEndian.PutUint64(scratch[:], uint64(atomic.LoadInt64(&change.item.expires)))
+		w.out.Write(scratch[:])
+		binary.LittleEndian.PutUint32(scratch[:4], uint32(len(data)))
+		w.out.Write(scratch[:4])
+		w.out.Write(data)
+	}
+}
+
+// Rewrites the log with a Set for each of the cache's items. The items are
+// read from the buckets, so that every change which isn't reflected in them
+// is still pending, and gets appended to the new log.
+func (w *wal) compact() error {
+	file, err := os.CreateTemp(filepath.Dir(w.path), filepath.Base(w.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(file)
+	out.WriteString(walMagic)
+	previous := w.out
+	w.out = out
+
+	now := time.Now().UnixNano()
+	items := make([]*Item, 0)
+	count := 0
+	for _, b := range w.cache.buckets {
+		items = b.collect(items[:0])
+		for _, item := range items {
+			if atomic.LoadInt64(&item.expires) > now {
+				w.write(change{op: ChangeSet, key: item.key, item: item})
+				count++
+			}
+		}
+	}
+
+	err = out.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), w.path)
+	}
+	if err != nil {
+		w.out = previous
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if w.file != nil {
+		w.file.Close()
+	}
+	w.file = file
+	w.records = 0
+	w.compacted = count
+	return nil
+}
+
+// Writes the pending changes and closes the log
+func (w *wal) close() {
+	close(w.stop)
+	<-w.done
+}
+
+func (w *wal) log(action string, err error) {
+	if info := w.cache.info; info != nil {
+		log.Printf("ccache: %s: %s the write-ahead log %s: %v", info.Name, action, w.path, err)
+	} else {
+		log.Printf("ccache: %s the write-ahead log %s: %v", action, w.path, err)
+	}
+}
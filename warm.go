@@ -0,0 +1,48 @@
+package ccache
+
+import (
+	"context"
+	"time"
+)
+
+// The number of items Warm hands to the worker at once
+const warmBatch = 1024
+
+type warmItems struct {
+	items []*Item
+	done  chan struct{}
+}
+
+// Bulk loads the items which load emits, e.g. to preload the cache before it
+// starts serving. Items are stored like with Set, but they're handed to the
+// worker in batches rather than one by one through the promote buffer, which
+// makes loading a large number of them much faster. Items emitted once ctx is
+// done are ignored. Returns load's error, or ctx's.
+func (c *Cache) Warm(ctx context.Context, load func(emit func(key string, value interface{}, ttl time.Duration)) error) error {
+	batch := make([]*Item, 0, warmBatch)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		done := make(chan struct{})
+		c.control <- warmItems{items: batch, done: done}
+		<-done
+		batch = batch[:0]
+	}
+	err := load(func(key string, value interface{}, ttl time.Duration) {
+		if ctx.Err() != nil {
+			return
+		}
+		if item, stored := c.store(key, value, ttl, false); stored {
+			batch = append(batch, item)
+			if len(batch) == warmBatch {
+				flush()
+			}
+		}
+	})
+	flush()
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,102 @@
+package ccache
+
+import (
+	"math"
+	"time"
+)
+
+// Settings which replace the configured ones while the cache warms up, see
+// Configuration.Warmup. Zero values keep the configured setting.
+type Profile struct {
+	MaxSize        int64
+	ItemsToPrune   uint32
+	GetsPerPromote int32
+	// Don't GC at all, letting the cache grow past any max size
+	PauseGC bool
+}
+
+type endWarmup struct {
+	done chan struct{}
+}
+
+type isWarming struct {
+	res chan bool
+}
+
+// The worker's warmup state. The steady state settings are kept here while the
+// warmup profile is applied to the configuration.
+type warmup struct {
+	ends           int64
+	size           int64
+	maxSize        int64
+	itemsToPrune   int
+	getsPerPromote int32
+}
+
+// Applies the warmup profile, remembering the steady state settings
+func (c *Cache) startWarmup() {
+	p := c.warmupProfile
+	c.warmup = &warmup{
+		size:           c.warmupSize,
+		maxSize:        c.maxSize,
+		itemsToPrune:   c.itemsToPrune,
+		getsPerPromote: c.getsPerPromote,
+	}
+	if c.warmupFor > 0 {
+		c.warmup.ends = time.Now().Add(c.warmupFor).UnixNano()
+	}
+	if p.MaxSize > 0 {
+		c.maxSize = p.MaxSize
+	}
+	if p.PauseGC {
+		c.maxSize = math.MaxInt64
+	}
+	if p.ItemsToPrune > 0 {
+		c.itemsToPrune = int(p.ItemsToPrune)
+	}
+	if p.GetsPerPromote > 0 {
+		c.getsPerPromote = p.GetsPerPromote
+	}
+}
+
+// Switches to the steady state settings if the warmup's time or size threshold
+// was reached. Returns the number of items GC'd as a result.
+func (c *Cache) checkWarmup() int {
+	w := c.warmup
+	if (w.size > 0 && c.size >= w.size) || (w.ends > 0 && time.Now().UnixNano() >= w.ends) {
+		return c.endWarmup()
+	}
+	return 0
+}
+
+func (c *Cache) endWarmup() int {
+	w := c.warmup
+	if w == nil {
+		return 0
+	}
+	c.warmup = nil
+	c.maxSize = w.maxSize
+	c.itemsToPrune = w.itemsToPrune
+	c.getsPerPromote = w.getsPerPromote
+	if c.size > c.maxSize {
+		return c.gc()
+	}
+	return 0
+}
+
+// Whether the cache is still using its Warmup profile
+// This is a control command.
+func (c *Cache) Warming() bool {
+	res := make(chan bool)
+	c.control <- isWarming{res: res}
+	return <-res
+}
+
+// Switches from the Warmup profile to the steady state settings, GCing if the
+// cache is over its steady state max size. Does nothing if the warmup is over.
+// This is a control command.
+func (c *Cache) EndWarmup() {
+	done := make(chan struct{})
+	c.control <- endWarmup{done: done}
+	<-done
+}